@@ -21,10 +21,11 @@ func threadIndex() int {
 
 func AddLCProxy(svr *stnet.Server, lc map[string]proxyWeight) error {
 	for k, v := range lc {
-		e := svr.AddTcpProxyService(k, 0, threadIndex(), v.address, v.weight)
+		s, e := svr.AddTcpProxyServiceWithHeader(k, 0, threadIndex(), v.address, v.weight, proxyProtocol)
 		if e != nil {
 			return e
 		}
+		s.SetProxyProtocol(acceptProxyProtocol)
 	}
 	return nil
 }
@@ -39,6 +40,7 @@ func AddLLProxy(svr *stnet.Server, ll map[string]proxyWeight) error {
 		if e != nil {
 			return e
 		}
+		raw.SetProxyProtocol(acceptProxyProtocol)
 
 		llg := &ServiceProxyLLGpb{}
 		gpb, e := svr.AddService("", v.address[0], 60, llg, threadIndex())
@@ -20,6 +20,9 @@ var (
 	listenConnect  = make(map[string]proxyWeight)
 	listenListen   = make(map[string]proxyWeight)
 	connectConnect = make(map[string]proxyWeight)
+
+	proxyProtocol       int //version of PROXY protocol header sent to backends of lc proxy, 0 means no header
+	acceptProxyProtocol int //0 off, 1 optional, 2 required; parse PROXY protocol header from load balancer
 )
 
 func getType(src, dst string) string {
@@ -42,6 +45,8 @@ func LoadCfg() error {
 	if e != nil {
 		return e
 	}
+	proxyProtocol = int(c.IntegerSection("option", "proxy_protocol", 0))
+	acceptProxyProtocol = int(c.IntegerSection("option", "accept_proxy_protocol", 0))
 	listenAddress = c.Section("listen")
 	connectAddress = c.Section("connect")
 	for k, _ := range listenAddress {
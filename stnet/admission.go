@@ -0,0 +1,251 @@
+package stnet
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AdmissionConfig limits connections accepted by a stream listener(tcp or unix).
+// ip limits and allow/deny lists are ignored by connections without ip, such as unix socket.
+type AdmissionConfig struct {
+	MaxSessions      int      //max concurrent sessions of the listener, 0 means no limit
+	MaxSessionsPerIP int      //max concurrent sessions of one ip, 0 means no limit
+	AcceptRatePerIP  float64  //accepted connections per second of one ip, 0 means no limit
+	AcceptBurstPerIP int      //burst of AcceptRatePerIP, default is AcceptRatePerIP
+	Allow            []string //ip or CIDR(192.168.0.0/16); when it is not empty, only ip in the list is accepted
+	Deny             []string //ip or CIDR; deny list is checked before allow list
+}
+
+// AdmissionStats counters of accepted and rejected connections.
+type AdmissionStats struct {
+	Accepted            uint64
+	RejectedMaxSessions uint64
+	RejectedPerIP       uint64
+	RejectedRate        uint64
+	RejectedDenied      uint64
+	RejectedByImp       uint64
+}
+
+// Rejected total number of rejected connections.
+func (as AdmissionStats) Rejected() uint64 {
+	return as.RejectedMaxSessions + as.RejectedPerIP + as.RejectedRate + as.RejectedDenied + as.RejectedByImp
+}
+
+// sessionAdmitter is implemented by Service, it calls SessionAdmitter of ServiceImp.
+type sessionAdmitter interface {
+	admit(remote net.Addr) error
+}
+
+type admission struct {
+	mutex   sync.Mutex
+	enabled bool
+	cfg     AdmissionConfig
+	allow   []*net.IPNet
+	deny    []*net.IPNet
+	ipSess  map[string]int //number of sessions of ip
+	ipRate  map[string]*tokenBucket
+	stats   AdmissionStats
+	lastGC  time.Time
+}
+
+func parseCIDRs(list []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(list))
+	for _, v := range list {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		if !strings.Contains(v, "/") {
+			if ip := net.ParseIP(v); ip != nil {
+				if ip.To4() != nil {
+					v += "/32"
+				} else {
+					v += "/128"
+				}
+			}
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ip or CIDR: %s", v)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	return nil
+}
+
+func (am *admission) set(cfg *AdmissionConfig) error {
+	var (
+		allow []*net.IPNet
+		deny  []*net.IPNet
+		err   error
+	)
+	if cfg != nil {
+		if allow, err = parseCIDRs(cfg.Allow); err != nil {
+			return err
+		}
+		if deny, err = parseCIDRs(cfg.Deny); err != nil {
+			return err
+		}
+	}
+
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+	if cfg == nil {
+		am.cfg = AdmissionConfig{}
+		am.enabled = false
+	} else {
+		am.cfg = *cfg
+		am.enabled = true
+	}
+	am.allow = allow
+	am.deny = deny
+	am.ipRate = make(map[string]*tokenBucket) //rate limit may be changed
+	if am.ipSess == nil {
+		am.ipSess = make(map[string]int)
+	}
+	return nil
+}
+
+// check ip lists and accept rate.
+func (am *admission) checkIP(ip net.IP, now time.Time) error {
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+	if !am.enabled || ip == nil {
+		return nil
+	}
+	if containsIP(am.deny, ip) || (len(am.allow) > 0 && !containsIP(am.allow, ip)) {
+		am.stats.RejectedDenied++
+		return fmt.Errorf("ip is denied")
+	}
+	if am.cfg.AcceptRatePerIP > 0 {
+		key := ip.String()
+		tb, ok := am.ipRate[key]
+		if !ok {
+			am.gcRate(now)
+			tb = newTokenBucket(am.cfg.AcceptRatePerIP, am.cfg.AcceptBurstPerIP, now)
+			am.ipRate[key] = tb
+		}
+		if !tb.take(1, now) {
+			am.stats.RejectedRate++
+			return fmt.Errorf("accept rate of ip is over limit")
+		}
+	}
+	return nil
+}
+
+// gcRate remove buckets of idle ip.
+func (am *admission) gcRate(now time.Time) {
+	if now.Sub(am.lastGC) < time.Minute {
+		return
+	}
+	am.lastGC = now
+	for k, tb := range am.ipRate {
+		if tb.isFull(now) {
+			delete(am.ipRate, k)
+		}
+	}
+}
+
+// checkSessions check limit of sessions without acquiring, it is used before session is created.
+func (am *admission) checkSessions(sessNum int) error {
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+	if am.enabled && am.cfg.MaxSessions > 0 && sessNum >= am.cfg.MaxSessions {
+		am.stats.RejectedMaxSessions++
+		return fmt.Errorf("sessions of listener is over limit %d", am.cfg.MaxSessions)
+	}
+	return nil
+}
+
+// acquire check session limits, the returned release function should be called when session closed.
+func (am *admission) acquire(ip net.IP, sessNum int) (func(), error) {
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+	if am.enabled && am.cfg.MaxSessions > 0 && sessNum >= am.cfg.MaxSessions {
+		am.stats.RejectedMaxSessions++
+		return nil, fmt.Errorf("sessions of listener is over limit %d", am.cfg.MaxSessions)
+	}
+	if ip == nil {
+		am.stats.Accepted++
+		return nil, nil
+	}
+	key := ip.String()
+	if am.enabled && am.cfg.MaxSessionsPerIP > 0 && am.ipSess[key] >= am.cfg.MaxSessionsPerIP {
+		am.stats.RejectedPerIP++
+		return nil, fmt.Errorf("sessions of ip is over limit %d", am.cfg.MaxSessionsPerIP)
+	}
+	am.stats.Accepted++
+	if am.ipSess == nil {
+		am.ipSess = make(map[string]int)
+	}
+	am.ipSess[key]++
+	return func() {
+		am.mutex.Lock()
+		if am.ipSess[key] <= 1 {
+			delete(am.ipSess, key)
+		} else {
+			am.ipSess[key]--
+		}
+		am.mutex.Unlock()
+	}, nil
+}
+
+func (am *admission) rejectedByImp() {
+	am.mutex.Lock()
+	am.stats.RejectedByImp++
+	am.mutex.Unlock()
+}
+
+func (am *admission) getStats() AdmissionStats {
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+	return am.stats
+}
+
+// SetAdmission set limits of accepting connections, it could be called at runtime to reload limits and ip lists.
+// nil means no limit.
+func (ls *Listener) SetAdmission(cfg *AdmissionConfig) error {
+	return ls.admission.set(cfg)
+}
+
+// AdmissionStats returns counters of accepted and rejected connections.
+func (ls *Listener) AdmissionStats() AdmissionStats {
+	return ls.admission.getStats()
+}
+
+// admit check admission before session is created. sessMapMutex should not be locked.
+func (ls *Listener) admit(conn net.Conn, msgparse MsgParse) (ip net.IP, err error) {
+	ip = addrIP(conn.RemoteAddr())
+	if err = ls.admission.checkIP(ip, time.Now()); err != nil {
+		return
+	}
+	if a, ok := msgparse.(sessionAdmitter); ok {
+		if err = a.admit(conn.RemoteAddr()); err != nil {
+			ls.admission.rejectedByImp()
+			return
+		}
+	}
+	return
+}
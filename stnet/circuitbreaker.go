@@ -0,0 +1,215 @@
+package stnet
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	ErrCircuitOpen = errors.New("circuit breaker is open")
+)
+
+type CircuitState int
+
+const (
+	CircuitClosed   CircuitState = iota //requests are allowed
+	CircuitOpen                         //requests fail fast
+	CircuitHalfOpen                     //a few probe requests are allowed
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+type CircuitBreakerConfig struct {
+	FailureThreshold int           //consecutive failures(connect failed, disconnected, rpc timeout) to open, default 5
+	OpenTimeout      time.Duration //time of open state before half-open, default 10s
+	HalfOpenProbes   int           //max probe requests in half-open state, and successes needed to close, default 1
+}
+
+// CircuitBreaker is thread safe.
+type CircuitBreaker struct {
+	mutex     sync.Mutex
+	cfg       CircuitBreakerConfig
+	state     CircuitState
+	failures  int
+	probes    int //probe requests in flight
+	successes int
+	openedAt  time.Time
+	onChange  func(from, to CircuitState)
+}
+
+// NewCircuitBreaker onChange is called without lock when state changed, it could be nil.
+func NewCircuitBreaker(cfg *CircuitBreakerConfig, onChange func(from, to CircuitState)) *CircuitBreaker {
+	cb := &CircuitBreaker{onChange: onChange}
+	if cfg != nil {
+		cb.cfg = *cfg
+	}
+	if cb.cfg.FailureThreshold <= 0 {
+		cb.cfg.FailureThreshold = 5
+	}
+	if cb.cfg.OpenTimeout <= 0 {
+		cb.cfg.OpenTimeout = 10 * time.Second
+	}
+	if cb.cfg.HalfOpenProbes <= 0 {
+		cb.cfg.HalfOpenProbes = 1
+	}
+	return cb
+}
+
+// setState mutex should be locked, returns the function reporting the change.
+func (cb *CircuitBreaker) setState(to CircuitState) func() {
+	from := cb.state
+	if from == to {
+		return nil
+	}
+	cb.state = to
+	cb.failures = 0
+	cb.probes = 0
+	cb.successes = 0
+	if to == CircuitOpen {
+		cb.openedAt = time.Now()
+	}
+	sysLog.System("circuit breaker state changed: %s -> %s", from, to)
+	if cb.onChange == nil {
+		return nil
+	}
+	return func() { cb.onChange(from, to) }
+}
+
+// checkTimeout open to half-open when OpenTimeout elapsed, mutex should be locked.
+func (cb *CircuitBreaker) checkTimeout() func() {
+	if cb.state == CircuitOpen && time.Since(cb.openedAt) >= cb.cfg.OpenTimeout {
+		return cb.setState(CircuitHalfOpen)
+	}
+	return nil
+}
+
+func (cb *CircuitBreaker) State() CircuitState {
+	cb.mutex.Lock()
+	report := cb.checkTimeout()
+	st := cb.state
+	cb.mutex.Unlock()
+	if report != nil {
+		report()
+	}
+	return st
+}
+
+// Allow returns whether a request could be sent; in half-open state, an allowed request must be reported by Success or Failure.
+func (cb *CircuitBreaker) Allow() bool {
+	cb.mutex.Lock()
+	report := cb.checkTimeout()
+	allow := true
+	switch cb.state {
+	case CircuitOpen:
+		allow = false
+	case CircuitHalfOpen:
+		if cb.probes >= cb.cfg.HalfOpenProbes {
+			allow = false
+		} else {
+			cb.probes++
+		}
+	}
+	cb.mutex.Unlock()
+	if report != nil {
+		report()
+	}
+	return allow
+}
+
+func (cb *CircuitBreaker) Success() {
+	cb.mutex.Lock()
+	var report func()
+	switch cb.state {
+	case CircuitClosed:
+		cb.failures = 0
+	case CircuitHalfOpen:
+		if cb.probes > 0 {
+			cb.probes--
+		}
+		cb.successes++
+		if cb.successes >= cb.cfg.HalfOpenProbes {
+			report = cb.setState(CircuitClosed)
+		}
+	}
+	cb.mutex.Unlock()
+	if report != nil {
+		report()
+	}
+}
+
+func (cb *CircuitBreaker) Failure() {
+	cb.mutex.Lock()
+	var report func()
+	switch cb.state {
+	case CircuitClosed:
+		cb.failures++
+		if cb.failures >= cb.cfg.FailureThreshold {
+			report = cb.setState(CircuitOpen)
+		}
+	case CircuitHalfOpen:
+		report = cb.setState(CircuitOpen)
+	}
+	cb.mutex.Unlock()
+	if report != nil {
+		report()
+	}
+}
+
+// SetCircuitBreaker enable circuit breaker of the connect, nil means disable.
+// state changes are reported to CircuitObserver of ServiceImp.
+func (ct *Connect) SetCircuitBreaker(cfg *CircuitBreakerConfig) {
+	if cfg == nil {
+		ct.setBreaker(nil)
+		return
+	}
+	ct.setBreaker(NewCircuitBreaker(cfg, func(from, to CircuitState) {
+		if o, ok := ct.Master.imp.(CircuitObserver); ok {
+			o.CircuitStateChanged(ct, from, to)
+		}
+	}))
+}
+
+// CircuitState state of circuit breaker, CircuitClosed if it is disabled.
+func (c *Connector) CircuitState() CircuitState {
+	if cb := c.getBreaker(); cb != nil {
+		return cb.State()
+	}
+	return CircuitClosed
+}
+
+func (c *Connector) setBreaker(cb *CircuitBreaker) {
+	c.breaker.Store(&cb)
+}
+
+func (c *Connector) getBreaker() *CircuitBreaker {
+	if cb, ok := c.breaker.Load().(**CircuitBreaker); ok {
+		return *cb
+	}
+	return nil
+}
+
+// SetCircuitBreaker enable circuit breaker of all connects of the pool(including connects added later), nil means disable.
+// connects whose circuit is open are not picked.
+func (p *ConnectPool) SetCircuitBreaker(cfg *CircuitBreakerConfig) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if cfg != nil {
+		c := *cfg
+		cfg = &c
+	}
+	p.breakerCfg = cfg
+	for _, c := range p.conns {
+		c.SetCircuitBreaker(cfg)
+	}
+}
@@ -0,0 +1,132 @@
+package stnet_test
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/greedchase/gotools/stnet"
+	"github.com/greedchase/gotools/stnet/stnettest"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	const (
+		fail  = "fail"
+		ok    = "ok"
+		allow = "allow" //Allow returns true
+		deny  = "deny"  //Allow returns false
+		wait  = "wait"  //OpenTimeout elapses
+	)
+	type step struct {
+		op   string
+		want stnet.CircuitState
+	}
+	cases := []struct {
+		name        string
+		cfg         stnet.CircuitBreakerConfig
+		steps       []step
+		transitions []stnet.CircuitState
+	}{
+		{
+			name: "open at threshold",
+			cfg:  stnet.CircuitBreakerConfig{FailureThreshold: 3},
+			steps: []step{
+				{fail, stnet.CircuitClosed}, {fail, stnet.CircuitClosed}, {ok, stnet.CircuitClosed}, //success resets failures
+				{fail, stnet.CircuitClosed}, {fail, stnet.CircuitClosed}, {allow, stnet.CircuitClosed},
+				{fail, stnet.CircuitOpen}, {deny, stnet.CircuitOpen},
+			},
+			transitions: []stnet.CircuitState{stnet.CircuitOpen},
+		},
+		{
+			name: "half-open probes close it",
+			cfg:  stnet.CircuitBreakerConfig{FailureThreshold: 1, HalfOpenProbes: 2},
+			steps: []step{
+				{fail, stnet.CircuitOpen}, {deny, stnet.CircuitOpen}, {wait, stnet.CircuitHalfOpen},
+				{allow, stnet.CircuitHalfOpen}, {allow, stnet.CircuitHalfOpen}, {deny, stnet.CircuitHalfOpen}, //probe limit
+				{ok, stnet.CircuitHalfOpen}, {allow, stnet.CircuitHalfOpen}, {ok, stnet.CircuitClosed},
+				{ok, stnet.CircuitClosed}, {allow, stnet.CircuitClosed},
+			},
+			transitions: []stnet.CircuitState{stnet.CircuitOpen, stnet.CircuitHalfOpen, stnet.CircuitClosed},
+		},
+		{
+			name: "failed probe opens it again",
+			cfg:  stnet.CircuitBreakerConfig{FailureThreshold: 2},
+			steps: []step{
+				{fail, stnet.CircuitClosed}, {fail, stnet.CircuitOpen}, {wait, stnet.CircuitHalfOpen},
+				{allow, stnet.CircuitHalfOpen}, {deny, stnet.CircuitHalfOpen}, {fail, stnet.CircuitOpen}, {deny, stnet.CircuitOpen},
+				{wait, stnet.CircuitHalfOpen}, {allow, stnet.CircuitHalfOpen}, {ok, stnet.CircuitClosed},
+			},
+			transitions: []stnet.CircuitState{stnet.CircuitOpen, stnet.CircuitHalfOpen, stnet.CircuitOpen, stnet.CircuitHalfOpen, stnet.CircuitClosed},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cfg := c.cfg
+			cfg.OpenTimeout = 20 * time.Millisecond
+			var transitions []stnet.CircuitState
+			last := stnet.CircuitClosed
+			cb := stnet.NewCircuitBreaker(&cfg, func(from, to stnet.CircuitState) {
+				if from != last {
+					t.Errorf("transition from %s, last state is %s", from, last)
+				}
+				last = to
+				transitions = append(transitions, to)
+			})
+			for i, s := range c.steps {
+				switch s.op {
+				case fail:
+					cb.Failure()
+				case ok:
+					cb.Success()
+				case allow, deny:
+					if got := cb.Allow(); got != (s.op == allow) {
+						t.Fatalf("step %d: Allow returns %v", i, got)
+					}
+				case wait:
+					time.Sleep(cfg.OpenTimeout + 10*time.Millisecond)
+				}
+				if st := cb.State(); st != s.want {
+					t.Fatalf("step %d(%s): state %s, want %s", i, s.op, st, s.want)
+				}
+			}
+			if !reflect.DeepEqual(transitions, c.transitions) {
+				t.Fatalf("transitions %v, want %v", transitions, c.transitions)
+			}
+		})
+	}
+}
+
+func TestRpcCallCircuitOpen(t *testing.T) {
+	h := stnettest.New(t, 1)
+	client := stnet.NewServiceRpc(&arith{})
+	cs, _ := h.AddClientService("client", client, 0)
+	h.Start()
+	defer h.Stop()
+
+	//nobody listens, failed connecting opens the circuit
+	conn := cs.NewConnectWithPolicy(h.Addr("none"), nil, fastPolicy())
+	conn.SetCircuitBreaker(&stnet.CircuitBreakerConfig{FailureThreshold: 1, OpenTimeout: time.Minute})
+	deadline := time.Now().Add(h.Timeout)
+	for conn.CircuitState() != stnet.CircuitOpen {
+		if time.Now().After(deadline) {
+			t.Fatal("circuit is not open")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	code := int32(0)
+	err := client.RpcCall(conn.Session(), "Add", 1, 2, func(int) { t.Error("callback is called") }, func(c int32) { code = c })
+	if err != stnet.ErrCircuitOpen || code != stnet.RpcErrCircuitOpen {
+		t.Fatalf("call returns %v, exception code %d", err, code)
+	}
+	if err := client.RpcCall(conn.Session(), "Add", 1, 2, nil, nil); err != stnet.ErrCircuitOpen {
+		t.Fatalf("one-way call returns %v", err)
+	}
+	if err := conn.Send([]byte("x\n")); err != stnet.ErrCircuitOpen {
+		t.Fatalf("send returns %v", err)
+	}
+	if conn.Pending() != 0 {
+		t.Fatalf("%d pending requests", conn.Pending())
+	}
+}
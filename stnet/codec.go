@@ -0,0 +1,188 @@
+package stnet
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"sync/atomic"
+)
+
+// control type of codec check, the dialing side sends id of its codec when connection established
+const (
+	ctrlCodecHello = 3 //[codec id(1 byte)]
+)
+
+var (
+	ErrUnknownCodec  = errors.New("unknown codec")
+	ErrCodecMismatch = errors.New("codec of peer is different")
+)
+
+// Codec encodes messages of ServiceSpb and params of ServiceRpc, it must be safe for concurrent use.
+// frames of stnet(JsonProto ReqProto RspProto) are always encoded by spb, only the payload is encoded by codec,
+// so codecs which only accept their own types(such as protobuf) could be used.
+type Codec interface {
+	ID() int      //0-255, EncodeTyepSpb and EncodeTyepJson are built in
+	Name() string //name in Service.SetCodec
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error //v is a pointer
+}
+
+var (
+	codecMutex  sync.RWMutex
+	codecByID   = make(map[int]Codec)
+	codecByName = make(map[string]Codec)
+)
+
+func init() {
+	RegisterCodec(spbCodec{})
+	RegisterCodec(jsonCodec{})
+}
+
+// RegisterCodec add codec into registry, the id and name must be unique.
+// it should be called before sessions start, usually in init.
+func RegisterCodec(c Codec) error {
+	codecMutex.Lock()
+	defer codecMutex.Unlock()
+	if c.ID() < 0 || c.ID() > 255 {
+		return fmt.Errorf("codec id %d is invalid", c.ID())
+	}
+	if _, ok := codecByID[c.ID()]; ok {
+		return fmt.Errorf("codec id %d is registered", c.ID())
+	}
+	if _, ok := codecByName[c.Name()]; ok {
+		return fmt.Errorf("codec %s is registered", c.Name())
+	}
+	codecByID[c.ID()] = c
+	codecByName[c.Name()] = c
+	return nil
+}
+
+// GetCodec return registered codec of name, nil if not found.
+func GetCodec(name string) Codec {
+	codecMutex.RLock()
+	defer codecMutex.RUnlock()
+	return codecByName[name]
+}
+
+func codecOf(id int) Codec {
+	codecMutex.RLock()
+	defer codecMutex.RUnlock()
+	return codecByID[id]
+}
+
+type spbCodec struct{}
+
+func (spbCodec) ID() int                                    { return EncodeTyepSpb }
+func (spbCodec) Name() string                               { return "spb" }
+func (spbCodec) Marshal(v interface{}) ([]byte, error)      { return SpbEncode(v) }
+func (spbCodec) Unmarshal(data []byte, v interface{}) error { return SpbDecode(data, v) }
+
+type jsonCodec struct{}
+
+func (jsonCodec) ID() int                                    { return EncodeTyepJson }
+func (jsonCodec) Name() string                               { return "json" }
+func (jsonCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+// SetCodec set codec of messages of ServiceSpb and params of ServiceRpc, the default is spb.
+// both sides must use the same codec: when it is set, the dialing side sends id of its codec when connection established,
+// and the accepting side closes the session if the codec is different from its own.
+// it is not used by ServiceJson, messages of it are passed to imp as they are.
+// it should be called before the server starts.
+func (service *Service) SetCodec(name string) error {
+	c := GetCodec(name)
+	if c == nil {
+		return fmt.Errorf("%s: %s", ErrUnknownCodec.Error(), name)
+	}
+	atomic.StoreInt32(&service.msgCodec, int32(c.ID())+1)
+	return nil
+}
+
+// codecID id of codec set by SetCodec, -1 if it is not set.
+func (service *Service) codecID() int {
+	return int(atomic.LoadInt32(&service.msgCodec)) - 1
+}
+
+// msgEncoding id of codec of messages of session, EncodeTyepSpb if it is not set.
+func (s *Session) msgEncoding() int {
+	if s != nil {
+		if svc := sessionService(s); svc != nil && svc.codecID() >= 0 {
+			return svc.codecID()
+		}
+	}
+	return EncodeTyepSpb
+}
+
+// startCodec is called when session opened, the dialing side sends id of its codec.
+func (service *Service) startCodec(sess *Session) {
+	if id := service.codecID(); id >= 0 && sess.conn != nil && !sess.isUdp {
+		sess.Send(sess.controlFrame([]byte{ctrlCodecHello, byte(id)}), nil)
+	}
+}
+
+// checkCodec check codec of peer, session is closed if it is different.
+func (s *Session) checkCodec(hello []byte) error {
+	if len(hello) < 1 {
+		return ErrCodecMismatch
+	}
+	if id := int(hello[0]); id != s.msgEncoding() {
+		sysLog.Error("%s: peer %d local %d;sessionid=%d", ErrCodecMismatch.Error(), id, s.msgEncoding(), s.id)
+		return ErrCodecMismatch
+	}
+	return nil
+}
+
+// rpcParams pack params and returns of rpc, they are tagged fields of spb if codec is spb,
+// otherwise every value is [length(uvarint)][encoded by codec].
+type rpcParams struct {
+	enc int
+	c   Codec //nil means spb
+	spb Spb
+}
+
+func newRpcParams(encoding int, data []byte) (*rpcParams, error) {
+	p := &rpcParams{enc: encoding, spb: newSpbReader(data, GetSpbLimits())}
+	if encoding != EncodeTyepSpb {
+		if p.c = codecOf(encoding); p.c == nil {
+			return nil, fmt.Errorf("%s: %d", ErrUnknownCodec.Error(), encoding)
+		}
+	}
+	return p, nil
+}
+
+func (p *rpcParams) marshal(tag uint32, v interface{}) error {
+	if p.c == nil {
+		return rpcMarshal(&p.spb, tag, v)
+	}
+	d, err := p.c.Marshal(v)
+	if err != nil {
+		return err
+	}
+	p.spb.buf = appendUvarint(p.spb.buf, uint64(len(d)))
+	p.spb.buf = append(p.spb.buf, d...)
+	return nil
+}
+
+func (p *rpcParams) unmarshal(tag uint32, v interface{}) error {
+	if p.c == nil {
+		return rpcUnmarshal(&p.spb, tag, v)
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("Unmarshal need is ptr,but this is %s", rv.Kind())
+	}
+	data := p.spb.buf[p.spb.index:]
+	l, n := binary.Uvarint(data)
+	if n <= 0 || l > uint64(len(data)-n) {
+		return fmt.Errorf("rpc param %d is truncated", tag)
+	}
+	p.spb.index += n + int(l)
+	return p.c.Unmarshal(data[n:n+int(l)], v)
+}
+
+func (p *rpcParams) bytes() []byte {
+	return p.spb.buf
+}
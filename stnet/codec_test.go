@@ -0,0 +1,127 @@
+package stnet_test
+
+import (
+	"bytes"
+	"encoding/gob"
+	"testing"
+
+	"github.com/greedchase/gotools/stnet"
+	"github.com/greedchase/gotools/stnet/stnettest"
+)
+
+const gobCodecID = 100
+
+type gobCodec struct{}
+
+func (gobCodec) ID() int      { return gobCodecID }
+func (gobCodec) Name() string { return "gob" }
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	var b bytes.Buffer
+	err := gob.NewEncoder(&b).Encode(v)
+	return b.Bytes(), err
+}
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+func init() {
+	stnet.RegisterCodec(gobCodec{})
+}
+
+func TestCodecRegistry(t *testing.T) {
+	if stnet.RegisterCodec(gobCodec{}) == nil {
+		t.Fatal("duplicate codec is registered")
+	}
+	if stnet.GetCodec("spb") == nil || stnet.GetCodec("json") == nil || stnet.GetCodec("none") != nil {
+		t.Fatal("GetCodec failed")
+	}
+	in := spbInner{"gob", 1.5}
+	d, err := stnet.Marshal(in, gobCodecID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out spbInner
+	if err = stnet.Unmarshal(d, &out, gobCodecID); err != nil || out != in {
+		t.Fatalf("gob round trip failed: %v %v", out, err)
+	}
+	if _, err = stnet.Marshal(in, 99); err == nil {
+		t.Fatal("unknown codec should fail")
+	}
+}
+
+func TestSpbCodec(t *testing.T) {
+	h := stnettest.New(t, 1)
+	imp := stnet.NewServiceSpb(&echoSpbImp{})
+	imp.RegisterMsg(1, spbInner{})
+	s, rec := h.AddService("spb", imp, 0)
+	if err := s.SetCodec("gob"); err != nil {
+		t.Fatal(err)
+	}
+	h.Start()
+	defer h.Stop()
+
+	c := h.Dial(s)
+	defer c.Close()
+	in := spbInner{"payload", 2}
+	d, _ := stnet.Marshal(in, gobCodecID)
+	buf, _ := stnet.EncodeProtocol(stnet.JsonProto{CmdId: 1, CmdData: d}, stnet.EncodeTyepSpb)
+	c.Send(buf)
+
+	var cmd stnet.JsonProto
+	if err := stnet.Unmarshal(c.ReadFrame()[4:], &cmd, stnet.EncodeTyepSpb); err != nil {
+		t.Fatal(err)
+	}
+	var out spbInner
+	if err := stnet.Unmarshal(cmd.CmdData, &out, gobCodecID); err != nil || out != in {
+		t.Fatalf("echo is %v %v", out, err)
+	}
+	if rec.Count(stnettest.EventError) > 0 {
+		t.Fatal("error occurs")
+	}
+}
+
+func TestRpcCodec(t *testing.T) {
+	h := stnettest.New(t, 2)
+	defer h.Stop()
+	ss, srec := h.AddService("server", stnet.NewServiceRpc(&arith{}), 0)
+	cli := stnet.NewServiceRpc(&arith{})
+	cs, crec := h.AddClientService("client", cli, 1)
+	if ss.SetCodec("gob") != nil || cs.SetCodec("gob") != nil {
+		t.Fatal("SetCodec failed")
+	}
+	conn := cs.NewConnectWithPolicy(h.Addr("server"), nil, fastPolicy())
+	h.Start()
+	h.WaitOpen(srec)
+	h.WaitOpen(crec)
+
+	q, r := 0, 0
+	if err := cli.RpcCall_Sync(conn.Session(), "Div", 17, 5, func(a, b int) { q, r = a, b }, nil); err != nil {
+		t.Fatal(err)
+	}
+	if q != 3 || r != 2 {
+		t.Fatalf("Div returns %d %d", q, r)
+	}
+	s := ""
+	cli.RpcCall_Sync(conn.Session(), "Concat", []string{"a", "b"}, "-", func(v string) { s = v }, nil)
+	if s != "a-b" {
+		t.Fatalf("Concat returns %q", s)
+	}
+	if srec.Count(stnettest.EventError) > 0 {
+		t.Fatal("error occurs")
+	}
+}
+
+func TestCodecMismatch(t *testing.T) {
+	h := stnettest.New(t, 2)
+	defer h.Stop()
+	ss, srec := h.AddService("server", stnet.NewServiceRpc(&arith{}), 0)
+	cs, _ := h.AddClientService("client", stnet.NewServiceRpc(&arith{}), 1)
+	ss.SetCodec("spb")
+	cs.SetCodec("gob")
+	cs.NewConnectWithPolicy(h.Addr("server"), nil, fastPolicy())
+	h.Start()
+	h.WaitClose(srec, h.WaitOpen(srec))
+	if ss.SetCodec("none") == nil {
+		t.Fatal("unknown codec is set")
+	}
+}
@@ -0,0 +1,264 @@
+package stnet
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// control types of control frames, body of control frame is [control type(1 byte)][data]
+const (
+	ctrlCompressHello = 1 //[reply(1 byte)][ids of algorithms the sender accepts]
+)
+
+// ids of built-in compressors
+const (
+	CompressDeflate = 1
+	CompressLZ      = 2 //snappy-like LZ77, fast with lower ratio
+	CompressZstd    = 3 //reserved, zstd is not built in, register an implementation with this id to use it
+)
+
+// DefaultCompressThreshold frames whose body is shorter than this are not compressed.
+const DefaultCompressThreshold = 256
+
+var (
+	ErrDecompressTooLarge = errors.New("decompressed message is too large")
+	ErrUnknownCompressor  = errors.New("unknown compressor")
+)
+
+// Compressor compresses the body of frames, it must be safe for concurrent use.
+type Compressor interface {
+	ID() byte     //id in frame, 1-255
+	Name() string //name in CompressOptions
+	Compress(src []byte) ([]byte, error)
+	Decompress(src []byte, maxSize int) ([]byte, error) //returns ErrDecompressTooLarge if result is larger than maxSize
+}
+
+var (
+	compressorMutex  sync.RWMutex
+	compressorByID   = make(map[byte]Compressor)
+	compressorByName = make(map[string]Compressor)
+)
+
+func init() {
+	RegisterCompressor(&deflateCompressor{})
+	RegisterCompressor(lzCompressor{})
+}
+
+// RegisterCompressor add compressor into registry, the id and name must be unique.
+// it should be called before sessions start, usually in init.
+func RegisterCompressor(c Compressor) error {
+	compressorMutex.Lock()
+	defer compressorMutex.Unlock()
+	if c.ID() == 0 {
+		return fmt.Errorf("compressor id 0 is invalid")
+	}
+	if _, ok := compressorByID[c.ID()]; ok {
+		return fmt.Errorf("compressor id %d is registered", c.ID())
+	}
+	if _, ok := compressorByName[c.Name()]; ok {
+		return fmt.Errorf("compressor %s is registered", c.Name())
+	}
+	compressorByID[c.ID()] = c
+	compressorByName[c.Name()] = c
+	return nil
+}
+
+// GetCompressor return registered compressor of name, nil if not found.
+func GetCompressor(name string) Compressor {
+	compressorMutex.RLock()
+	defer compressorMutex.RUnlock()
+	return compressorByName[name]
+}
+
+func compressorOf(id byte) Compressor {
+	compressorMutex.RLock()
+	defer compressorMutex.RUnlock()
+	return compressorByID[id]
+}
+
+type deflateCompressor struct {
+	writers sync.Pool
+}
+
+func (c *deflateCompressor) ID() byte     { return CompressDeflate }
+func (c *deflateCompressor) Name() string { return "deflate" }
+
+func (c *deflateCompressor) Compress(src []byte) ([]byte, error) {
+	var b bytes.Buffer
+	w, _ := c.writers.Get().(*flate.Writer)
+	if w == nil {
+		var err error
+		if w, err = flate.NewWriter(&b, flate.BestSpeed); err != nil {
+			return nil, err
+		}
+	} else {
+		w.Reset(&b)
+	}
+	defer c.writers.Put(w)
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func (c *deflateCompressor) Decompress(src []byte, maxSize int) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(src))
+	defer r.Close()
+	d, err := ioutil.ReadAll(io.LimitReader(r, int64(maxSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(d) > maxSize {
+		return nil, ErrDecompressTooLarge
+	}
+	return d, nil
+}
+
+type lzCompressor struct{}
+
+func (lzCompressor) ID() byte     { return CompressLZ }
+func (lzCompressor) Name() string { return "lz" }
+
+func (lzCompressor) Compress(src []byte) ([]byte, error) {
+	return lzEncode(src), nil
+}
+
+func (lzCompressor) Decompress(src []byte, maxSize int) ([]byte, error) {
+	return lzDecode(src, maxSize)
+}
+
+// CompressOptions compression of frames sent by ServiceSpb ServiceJson and ServiceRpc.
+// compression is used only when both sides of a session enable it, algorithms are negotiated when connection established:
+// the dialing side sends the algorithms it accepts, the accepting side replies with its algorithms,
+// then both sides send with the first algorithm of their own list which is accepted by the peer.
+// received frames are always decompressed if the algorithm is registered.
+// datagram sessions(udp, unixgram) are never compressed.
+type CompressOptions struct {
+	Algorithms []string //names of registered compressors in order of preference, such as "lz", "deflate"
+	Threshold  int      //frames whose body is shorter than Threshold are sent uncompressed, 0 means DefaultCompressThreshold
+}
+
+type compressConfig struct {
+	ids       []byte
+	threshold int
+}
+
+// sessionCompress negotiated compression of sending.
+type sessionCompress struct {
+	c         Compressor
+	threshold int
+}
+
+// SetCompression enable compression of sessions of this service(including connections), nil disables it.
+// the dialing side must enable it only when the peer supports compression(stnet with this option), otherwise the peer closes the session.
+// it takes effect on sessions opened later.
+func (service *Service) SetCompression(opt *CompressOptions) error {
+	if opt == nil {
+		service.compress.Store((*compressConfig)(nil))
+		return nil
+	}
+	cfg := &compressConfig{threshold: opt.Threshold}
+	if cfg.threshold <= 0 {
+		cfg.threshold = DefaultCompressThreshold
+	}
+	for _, name := range opt.Algorithms {
+		c := GetCompressor(name)
+		if c == nil {
+			return fmt.Errorf("%s: %s", ErrUnknownCompressor.Error(), name)
+		}
+		cfg.ids = append(cfg.ids, c.ID())
+	}
+	if len(cfg.ids) == 0 {
+		return fmt.Errorf("no compression algorithm")
+	}
+	service.compress.Store(cfg)
+	return nil
+}
+
+func (service *Service) compressConfig() *compressConfig {
+	cfg, _ := service.compress.Load().(*compressConfig)
+	return cfg
+}
+
+func sessionService(sess *Session) *Service {
+	svc, _ := sess.parser.(*Service)
+	return svc
+}
+
+// startCompress is called when session opened, the dialing side sends hello.
+func (service *Service) startCompress(sess *Session) {
+	sess.compress.Store((*sessionCompress)(nil))
+	cfg := service.compressConfig()
+	if cfg != nil && sess.conn != nil && !sess.isUdp {
+		sess.sendCompressHello(cfg, false)
+	}
+}
+
+func (s *Session) sendCompressHello(cfg *compressConfig, reply bool) error {
+	body := []byte{ctrlCompressHello, 0}
+	if reply {
+		body[1] = 1
+	}
+	return s.Send(s.controlFrame(append(body, cfg.ids...)), nil)
+}
+
+// negotiateCompress choose algorithm of sending by hello of peer.
+func (s *Session) negotiateCompress(hello []byte) {
+	svc := sessionService(s)
+	if s.isUdp || svc == nil || len(hello) < 1 {
+		return
+	}
+	cfg := svc.compressConfig()
+	if cfg == nil {
+		return
+	}
+	if hello[0] == 0 { //reply before compressed frames are sent
+		s.sendCompressHello(cfg, true)
+	}
+	for _, id := range cfg.ids {
+		if bytes.IndexByte(hello[1:], id) >= 0 {
+			s.compress.Store(&sessionCompress{compressorOf(id), cfg.threshold})
+			return
+		}
+	}
+}
+
+// compressBody compress body if compression is negotiated, body is returned as it is if it is not smaller.
+func (s *Session) compressBody(h *FrameHeader, body []byte) []byte {
+	if s == nil {
+		return body
+	}
+	sc, _ := s.compress.Load().(*sessionCompress)
+	if sc == nil || len(body) < sc.threshold || h.Flags&(FrameFlagCompressed|FrameFlagControl) != 0 {
+		return body
+	}
+	d, err := sc.c.Compress(body)
+	if err != nil {
+		sysLog.Error("compress failed: %s;sessionid=%d", err.Error(), s.id)
+		return body
+	}
+	if len(d)+1 >= len(body) {
+		return body
+	}
+	h.Flags |= FrameFlagCompressed
+	return append([]byte{sc.c.ID()}, d...)
+}
+
+func decompressBody(body []byte) ([]byte, error) {
+	if len(body) < 1 {
+		return nil, fmt.Errorf("compressed message is empty")
+	}
+	c := compressorOf(body[0])
+	if c == nil {
+		return nil, fmt.Errorf("%s: %d", ErrUnknownCompressor.Error(), body[0])
+	}
+	return c.Decompress(body[1:], MaxMsgSize)
+}
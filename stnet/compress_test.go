@@ -0,0 +1,127 @@
+package stnet_test
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/greedchase/gotools/stnet"
+	"github.com/greedchase/gotools/stnet/stnettest"
+)
+
+func TestCompressors(t *testing.T) {
+	random := make([]byte, 5000)
+	rand.Read(random)
+	inputs := [][]byte{
+		{},
+		[]byte("a"),
+		[]byte("abcabcabcabcabcabcabcabcabcabc"),
+		[]byte(strings.Repeat("item:sword,count:1;", 500)),
+		random,
+		append(random[:1000:1000], bytes.Repeat([]byte{0}, 70000)...),
+	}
+	for _, name := range []string{"deflate", "lz"} {
+		c := stnet.GetCompressor(name)
+		if c == nil {
+			t.Fatalf("%s is not registered", name)
+		}
+		for _, in := range inputs {
+			d, err := c.Compress(in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out, err := c.Decompress(d, len(in))
+			if err != nil || !bytes.Equal(in, out) {
+				t.Fatalf("%s: round trip of %d bytes failed: %v", name, len(in), err)
+			}
+			if len(in) > 1 {
+				if _, err := c.Decompress(d, len(in)-1); err != stnet.ErrDecompressTooLarge {
+					t.Fatalf("%s: limit is not checked: %v", name, err)
+				}
+			}
+		}
+	}
+}
+
+func TestLZCorrupt(t *testing.T) {
+	c := stnet.GetCompressor("lz")
+	d, _ := c.Compress([]byte(strings.Repeat("hello world ", 100)))
+	for i := 0; i < 1000; i++ {
+		b := append([]byte(nil), d...)
+		b[rand.Intn(len(b))] ^= byte(rand.Intn(255) + 1)
+		c.Decompress(b[:rand.Intn(len(b)+1)], 1<<16) //must not panic
+	}
+}
+
+func TestRegisterCompressor(t *testing.T) {
+	if err := stnet.RegisterCompressor(stnet.GetCompressor("lz")); err == nil {
+		t.Fatal("duplicate compressor is registered")
+	}
+	s := &stnet.Service{}
+	if err := s.SetCompression(&stnet.CompressOptions{Algorithms: []string{"nope"}}); err == nil {
+		t.Fatal("unknown algorithm is accepted")
+	}
+}
+
+// frames received by client are recorded to check whether they are compressed.
+func rpcWithCompression(t *testing.T, server, client *stnet.CompressOptions) (compressed bool) {
+	h := stnettest.New(t, 2)
+	defer h.Stop()
+	ss, srec := h.AddService("server", stnet.NewServiceRpc(&arith{}), 0)
+	if server != nil {
+		ss.SetCompression(server)
+	}
+	cli := stnet.NewServiceRpc(&arith{})
+	cs, crec := h.AddClientService("client", cli, 1)
+	if client != nil {
+		cs.SetCompression(client)
+	}
+	conn := cs.NewConnectWithPolicy(h.Addr("server"), nil, fastPolicy())
+	h.Start()
+	h.WaitOpen(srec)
+	h.WaitOpen(crec)
+
+	var buf bytes.Buffer
+	rec := stnet.NewTrafficRecorder(&buf)
+	conn.Session().SetRecorder(rec)
+
+	words := strings.Split(strings.Repeat("spb ", 1000), " ")
+	s := ""
+	if err := cli.RpcCall_Sync(conn.Session(), "Concat", words, ",", func(r string) { s = r }, nil); err != nil {
+		t.Fatal(err)
+	}
+	if s != strings.Join(words, ",") {
+		t.Fatalf("Concat returns %d bytes", len(s))
+	}
+
+	rec.Flush()
+	r, _ := stnet.NewTrafficReader(&buf)
+	for {
+		f, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if f.Dir == stnet.TrafficIn && f.Data[0]&0x4 != 0 {
+			compressed = true
+		}
+	}
+	return compressed
+}
+
+func TestRpcCompression(t *testing.T) {
+	opt := &stnet.CompressOptions{Algorithms: []string{"lz", "deflate"}, Threshold: 64}
+	if !rpcWithCompression(t, opt, opt) {
+		t.Fatal("response is not compressed")
+	}
+	if !rpcWithCompression(t, &stnet.CompressOptions{Algorithms: []string{"deflate"}}, opt) {
+		t.Fatal("response is not compressed with deflate")
+	}
+	if rpcWithCompression(t, nil, opt) {
+		t.Fatal("server without compression compresses")
+	}
+	if rpcWithCompression(t, opt, nil) {
+		t.Fatal("compressed without negotiation")
+	}
+}
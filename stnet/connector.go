@@ -3,6 +3,7 @@ package stnet
 import (
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -10,20 +11,43 @@ type Connector struct {
 	sess            *Session
 	network         string
 	address         string
-	reconnectMSec   int //Millisecond
+	policy          *ReconnectPolicy
 	reconnCount     int
 	closer          chan int
 	closeLock       sync.Mutex
 	sessCloseSignal chan int
 	reconnSignal    chan int
 	wg              *sync.WaitGroup
+	pending         int64        //number of rpc requests waiting for response
+	breaker         atomic.Value //**CircuitBreaker
+	wrapper         atomic.Value //ConnWrapper
+	onGiveUp        func()       //set by owner of the connector, called when it gives up before policy.OnGiveUp
+	preface         []byte       //set by owner of the connector, written to every connection dialed before any data
 }
 
 // NewConnector reconnect at 0 1 4 9 16...times reconnectMSec(100ms);when call send or changeAddr, it will NotifyReconn and reconnect at once;when call Close, reconnect will stop
 func NewConnector(address string, msgparse MsgParse, userdata interface{}) *Connector {
+	return NewConnectorWithPolicy(address, msgparse, userdata, nil)
+}
+
+// NewConnectorWithPolicy reconnect by policy, nil means DefaultReconnectPolicy.
+func NewConnectorWithPolicy(address string, msgparse MsgParse, userdata interface{}, policy *ReconnectPolicy) *Connector {
+	conn := newConnector(address, msgparse, userdata, policy)
+	conn.start()
+	return conn
+}
+
+// newConnector create connector without connecting, call start after it is set up.
+func newConnector(address string, msgparse MsgParse, userdata interface{}, policy *ReconnectPolicy) *Connector {
 	if msgparse == nil {
 		panic(ErrMsgParseNil)
 	}
+	if policy == nil {
+		policy = DefaultReconnectPolicy()
+	} else {
+		p := *policy
+		policy = &p
+	}
 
 	network, ipport := parseAddress(address)
 
@@ -33,26 +57,30 @@ func NewConnector(address string, msgparse MsgParse, userdata interface{}) *Conn
 		closer:          make(chan int, 1),
 		network:         network,
 		address:         ipport,
-		reconnectMSec:   100,
+		policy:          policy,
 		wg:              &sync.WaitGroup{},
 	}
+	conn.wrapper.Store(policy.WrapConn)
 
 	conn.sess, _ = newConnSession(msgparse, nil, func(*Session) {
 		conn.sessCloseSignal <- 1
-	}, conn, network == "udp")
+	}, conn, isPacketNetwork(network))
 	conn.sess.UserData = userdata
 
-	go conn.connect()
-
 	return conn
 }
 
-func (c *Connector) connect() {
+func (c *Connector) start() {
 	c.wg.Add(1)
+	go c.connect()
+}
+
+func (c *Connector) connect() {
 	defer c.wg.Done()
+	failed := 0 //continuous failed attempts
 	for !c.IsClose() {
 		if c.reconnCount > 0 {
-			to := time.NewTimer(time.Duration(c.reconnCount*c.reconnCount*c.reconnectMSec) * time.Millisecond)
+			to := time.NewTimer(c.policy.interval(c.reconnCount))
 			select {
 			case <-c.closer:
 				to.Stop()
@@ -64,15 +92,24 @@ func (c *Connector) connect() {
 			}
 		}
 		c.reconnCount++
-		if c.reconnCount > 30 { //max 900 times
-			c.reconnCount = 10
-		}
 
-		cn, err := net.Dial(c.network, c.address)
+		cb := c.getBreaker()
+		if cb != nil && !cb.Allow() {
+			continue //circuit is open, wait for half-open
+		}
+		cn, err := c.dial()
 		if err != nil {
+			if cb != nil {
+				cb.Failure()
+			}
 			c.sess.parser.sessionEvent(c.sess, Close)
 			sysLog.Error("connect failed;addr=%s;error=%s", c.address, err.Error())
-			if c.reconnectMSec <= 0 || c.IsClose() {
+			failed++
+			if c.policy.MaxAttempts > 0 && failed >= c.policy.MaxAttempts {
+				c.giveUp()
+				break
+			}
+			if c.IsClose() {
 				break
 			}
 			continue
@@ -93,11 +130,81 @@ func (c *Connector) connect() {
 		c.closeLock.Unlock()
 
 		c.reconnCount = 0
+		failed = 0
+		if cb != nil {
+			cb.Success()
+		}
+		if c.policy.OnConnected != nil {
+			c.policy.OnConnected(c)
+		}
 		<-c.sessCloseSignal
-		if c.reconnectMSec <= 0 || c.IsClose() {
+		if c.policy.OnDisconnected != nil {
+			c.policy.OnDisconnected(c)
+		}
+		if c.IsClose() {
 			break
 		}
+		if cb := c.getBreaker(); cb != nil {
+			cb.Failure() //disconnected by remote
+		}
+	}
+}
+
+// giveUp stop reconnecting and close the connector.
+func (c *Connector) giveUp() {
+	sysLog.Error("give up connecting;addr=%s;attempts=%d", c.address, c.policy.MaxAttempts)
+	c.closeLock.Lock()
+	if !c.IsClose() {
+		close(c.closer)
+	}
+	c.closeLock.Unlock()
+	if c.onGiveUp != nil {
+		c.onGiveUp()
+	}
+	if c.policy.OnGiveUp != nil {
+		c.policy.OnGiveUp(c)
+	}
+}
+
+func (c *Connector) dial() (net.Conn, error) {
+	var (
+		cn  net.Conn
+		err error
+	)
+	if c.network == "unixgram" {
+		cn, err = dialUnixgram(c.address)
+	} else if c.network == "mem" {
+		cn, err = DialMem(c.address)
+	} else {
+		var d *net.Dialer
+		if d, err = c.policy.dialer(c.network); err == nil {
+			cn, err = d.Dial(c.network, c.address)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if w, _ := c.wrapper.Load().(ConnWrapper); w != nil {
+		cn = w(cn)
+	}
+	if len(c.preface) > 0 {
+		if c.policy.DialTimeout > 0 {
+			cn.SetWriteDeadline(time.Now().Add(c.policy.DialTimeout))
+		}
+		_, err = cn.Write(c.preface)
+		cn.SetWriteDeadline(time.Time{})
+		if err != nil {
+			cn.Close()
+			return nil, err
+		}
 	}
+	return cn, nil
+}
+
+// SetConnWrapper wraps connections dialed later, example FaultInjector.Wrap; nil means no wrapper.
+// use ReconnectPolicy.WrapConn to wrap the first connection.
+func (c *Connector) SetConnWrapper(w ConnWrapper) {
+	c.wrapper.Store(w)
 }
 
 func (c *Connector) ChangeAddr(addr string) {
@@ -127,6 +234,10 @@ func (c *Connector) Close() {
 	}
 
 	c.closeLock.Lock()
+	if c.IsClose() {
+		c.closeLock.Unlock()
+		return
+	}
 	close(c.closer)
 	c.sess.Close()
 	c.closeLock.Unlock()
@@ -144,11 +255,20 @@ func (c *Connector) IsClose() bool {
 	}
 }
 
+// Pending number of rpc requests sent by ServiceRpc and waiting for response.
+func (c *Connector) Pending() int64 {
+	return atomic.LoadInt64(&c.pending)
+}
+
 func (c *Connector) GetID() uint64 {
 	return c.sess.GetID()
 }
 
+// Send data is dropped and ErrCircuitOpen is returned when circuit breaker is open.
 func (c *Connector) Send(data []byte) error {
+	if c.CircuitState() == CircuitOpen {
+		return ErrCircuitOpen
+	}
 	c.NotifyReconn()
 	return c.sess.Send(data, nil)
 }
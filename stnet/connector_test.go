@@ -0,0 +1,104 @@
+package stnet_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/greedchase/gotools/stnet"
+	"github.com/greedchase/gotools/stnet/stnettest"
+)
+
+func fastPolicy() *stnet.ReconnectPolicy {
+	return &stnet.ReconnectPolicy{Backoff: stnet.BackoffFixed, Base: 10 * time.Millisecond}
+}
+
+func TestConnectorSend(t *testing.T) {
+	h := stnettest.New(t, 2)
+	_, srec := h.AddService("server", &lineImp{}, 0)
+	cs, crec := h.AddClientService("client", &lineImp{}, 1)
+	conn := cs.NewConnectWithPolicy(h.Addr("server"), "userdata", fastPolicy())
+	h.Start()
+	defer h.Stop()
+
+	ssess := h.WaitOpen(srec)
+	h.WaitOpen(crec)
+	if !conn.IsConnected() {
+		t.Fatal("connector should be connected")
+	}
+	if conn.Session().UserData != "userdata" {
+		t.Fatalf("userdata %v", conn.Session().UserData)
+	}
+
+	if err := conn.Send([]byte("ping\n")); err != nil {
+		t.Fatal(err)
+	}
+	h.WaitMessage(srec, 'p')
+	ssess.Send([]byte("qong\n"), nil)
+	e := h.WaitMessage(crec, 'q')
+	if e.Sess != conn.Session() {
+		t.Fatal("message should be received by connector session")
+	}
+}
+
+func TestConnectorSendBeforeConnected(t *testing.T) {
+	server := stnettest.New(t, 1)
+	h := stnettest.New(t, 1)
+	cs, _ := h.AddClientService("client", &lineImp{}, 0)
+	h.Start()
+	defer h.Stop()
+
+	//data sent before connected is queued and flushed when connected
+	conn := cs.NewConnectWithPolicy(server.Addr("server"), nil, fastPolicy())
+	if err := conn.Send([]byte("early\n")); err != nil {
+		t.Fatal(err)
+	}
+	_, srec := server.AddService("server", &lineImp{}, 0)
+	server.Start()
+	defer server.Stop()
+	h.WaitMessage(srec, 'e')
+}
+
+func TestConnectorReconnect(t *testing.T) {
+	h := stnettest.New(t, 1)
+	_, srec := h.AddService("server", &lineImp{}, 0)
+	cs, crec := h.AddClientService("client", &lineImp{}, 0)
+	conn := cs.NewConnectWithPolicy(h.Addr("server"), nil, fastPolicy())
+	h.Start()
+	defer h.Stop()
+
+	ssess := h.WaitOpen(srec)
+	h.WaitOpen(crec)
+	ssess.Close()
+	h.WaitClose(crec, nil)
+
+	h.WaitOpen(srec)
+	h.WaitOpen(crec)
+	if err := conn.Send([]byte("again\n")); err != nil {
+		t.Fatal(err)
+	}
+	h.WaitMessage(srec, 'a')
+}
+
+func TestConnectorGiveUp(t *testing.T) {
+	h := stnettest.New(t, 1)
+	cs, _ := h.AddClientService("client", &lineImp{}, 0)
+	gaveUp := make(chan struct{})
+	p := fastPolicy()
+	p.MaxAttempts = 3
+	p.OnGiveUp = func(*stnet.Connector) { close(gaveUp) }
+	conn := cs.NewConnectWithPolicy(h.Addr("nobody"), nil, p)
+	h.Start()
+	defer h.Stop()
+
+	select {
+	case <-gaveUp:
+	case <-time.After(stnettest.DefaultTimeout):
+		t.Fatal("connector should give up")
+	}
+	if conn.IsConnected() {
+		t.Fatal("connector should not be connected")
+	}
+	if cs.GetConnect(conn.GetID()) != nil {
+		t.Fatal("connect should be removed from service")
+	}
+}
@@ -0,0 +1,213 @@
+package stnet
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	// PoolRefreshInterval interval of ConnectPool calling Resolver.
+	PoolRefreshInterval = 10 * time.Second
+
+	ErrNoConnect = errors.New("no connect in pool")
+)
+
+// ConnectPool keeps connects to all instances returned by Resolver.
+type ConnectPool struct {
+	service  *Service
+	resolver Resolver
+	picker   Picker
+	userdata interface{}
+
+	mutex   sync.RWMutex
+	conns   map[string]*Connect //address->connect
+	weights map[string]int
+	closer  chan int
+	wg      sync.WaitGroup
+
+	breakerCfg *CircuitBreakerConfig
+	policy     *ReconnectPolicy
+}
+
+// NewConnectPool connects to all endpoints of resolver and keeps them updated; picker default is RoundRobinPicker.
+// userdata is the UserData of every session of connects.
+func (service *Service) NewConnectPool(resolver Resolver, picker Picker, userdata interface{}) (*ConnectPool, error) {
+	if resolver == nil {
+		return nil, errors.New("resolver should not be nil")
+	}
+	if picker == nil {
+		picker = NewRoundRobinPicker()
+	}
+	p := &ConnectPool{
+		service:  service,
+		resolver: resolver,
+		picker:   picker,
+		userdata: userdata,
+		conns:    make(map[string]*Connect),
+		weights:  make(map[string]int),
+		closer:   make(chan int),
+	}
+	if err := p.Refresh(); err != nil {
+		return nil, err
+	}
+
+	p.wg.Add(1)
+	go p.watch()
+	return p, nil
+}
+
+func (p *ConnectPool) watch() {
+	defer p.wg.Done()
+	var changed <-chan struct{}
+	if n, ok := p.resolver.(ResolverNotifier); ok {
+		changed = n.Changed()
+	}
+	tk := time.NewTicker(PoolRefreshInterval)
+	defer tk.Stop()
+	for {
+		select {
+		case <-p.closer:
+			return
+		case <-tk.C:
+		case <-changed:
+		}
+		if err := p.Refresh(); err != nil {
+			sysLog.Error("connect pool refresh failed;service=%s;error=%s", p.service.Name, err.Error())
+		}
+	}
+}
+
+// Refresh resolve endpoints at once, connect to new endpoints and close connects of removed endpoints.
+func (p *ConnectPool) Refresh() error {
+	eps, err := p.resolver.Resolve()
+	if err != nil {
+		return err
+	}
+
+	p.mutex.Lock()
+	if p.isClose() {
+		p.mutex.Unlock()
+		return nil
+	}
+	changed := false
+	newEps := make(map[string]int)
+	for _, ep := range eps {
+		if ep.Addr == "" {
+			continue
+		}
+		newEps[ep.Addr] = ep.Weight
+		if _, ok := p.conns[ep.Addr]; !ok {
+			c := p.service.NewConnectWithPolicy(ep.Addr, p.userdata, p.policy)
+			if p.breakerCfg != nil {
+				c.SetCircuitBreaker(p.breakerCfg)
+			}
+			p.conns[ep.Addr] = c
+			changed = true
+		}
+		if p.weights[ep.Addr] != ep.Weight {
+			p.weights[ep.Addr] = ep.Weight
+			changed = true
+		}
+	}
+	for addr, c := range p.conns {
+		if _, ok := newEps[addr]; !ok {
+			delete(p.conns, addr)
+			delete(p.weights, addr)
+			c.Close()
+			changed = true
+		}
+	}
+	if changed {
+		p.updatePicker()
+	}
+	p.mutex.Unlock()
+	return nil
+}
+
+// updatePicker mutex should be locked.
+func (p *ConnectPool) updatePicker() {
+	addrs := make([]string, 0, len(p.conns))
+	for addr := range p.conns {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	conns := make([]*Connect, len(addrs))
+	weights := make([]int, len(addrs))
+	for i, addr := range addrs {
+		conns[i] = p.conns[addr]
+		weights[i] = p.weights[addr]
+	}
+	p.picker.Update(conns, weights)
+}
+
+// SetReconnectPolicy policy of connects added later, nil means DefaultReconnectPolicy.
+func (p *ConnectPool) SetReconnectPolicy(policy *ReconnectPolicy) {
+	p.mutex.Lock()
+	p.policy = policy
+	p.mutex.Unlock()
+}
+
+// Pick select a connect by picker, key is used by ConsistentHashPicker.
+func (p *ConnectPool) Pick(key string) *Connect {
+	return p.picker.Pick(key)
+}
+
+// Session returns session of the picked connect, nil if there is no connect.
+func (p *ConnectPool) Session(key string) *Session {
+	c := p.Pick(key)
+	if c == nil {
+		return nil
+	}
+	return c.Session()
+}
+
+// Send data to the picked connect.
+func (p *ConnectPool) Send(key string, data []byte) error {
+	c := p.Pick(key)
+	if c == nil {
+		return ErrNoConnect
+	}
+	return c.Send(data)
+}
+
+// IterateConnect iterate all connects of the pool.
+func (p *ConnectPool) IterateConnect(callback func(*Connect) bool) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	for _, c := range p.conns {
+		if !callback(c) {
+			break
+		}
+	}
+}
+
+func (p *ConnectPool) isClose() bool {
+	select {
+	case <-p.closer:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close stop watching resolver and close all connects, resolver is closed if it implements ResolverCloser.
+func (p *ConnectPool) Close() {
+	p.mutex.Lock()
+	if p.isClose() {
+		p.mutex.Unlock()
+		return
+	}
+	close(p.closer)
+	for addr, c := range p.conns {
+		delete(p.conns, addr)
+		c.Close()
+	}
+	p.updatePicker()
+	p.mutex.Unlock()
+	p.wg.Wait()
+	if c, ok := p.resolver.(ResolverCloser); ok {
+		c.Close()
+	}
+}
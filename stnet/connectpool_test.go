@@ -0,0 +1,246 @@
+package stnet_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/greedchase/gotools/stnet"
+	"github.com/greedchase/gotools/stnet/stnettest"
+)
+
+// startPool add services named by weights and connect them by a pool of picker, it returns when all connects are connected.
+func startPool(t *testing.T, picker stnet.Picker, client stnet.ServiceImp, weights map[string]int) (*stnettest.Harness, *stnet.ConnectPool) {
+	t.Helper()
+	h := stnettest.New(t, 2)
+	eps := make([]stnet.Endpoint, 0, len(weights))
+	for name, w := range weights {
+		h.AddService(name, &lineImp{}, 0)
+		eps = append(eps, stnet.Endpoint{Addr: h.Addr(name), Weight: w})
+	}
+	cs, crec := h.AddClientService("client", client, 1)
+	h.Start()
+	pool, err := cs.NewConnectPool(stnet.NewWeightedStaticResolver(eps), picker, nil)
+	if err != nil {
+		h.Stop()
+		t.Fatal(err)
+	}
+	for range weights {
+		h.WaitOpen(crec)
+	}
+	return h, pool
+}
+
+// connAddr is Connect.Addr of service name.
+func connAddr(h *stnettest.Harness, name string) string {
+	return strings.TrimPrefix(h.Addr(name), "mem://")
+}
+
+func poolAddrs(pool *stnet.ConnectPool) map[string]bool {
+	addrs := make(map[string]bool)
+	pool.IterateConnect(func(c *stnet.Connect) bool {
+		addrs[c.Addr()] = true
+		return true
+	})
+	return addrs
+}
+
+func TestConnectPoolRefresh(t *testing.T) {
+	h := stnettest.New(t, 2)
+	recs := make(map[string]*stnettest.Recorder)
+	for _, name := range []string{"a", "b", "c"} {
+		_, recs[name] = h.AddService(name, &lineImp{}, 0)
+	}
+	cs, _ := h.AddClientService("client", &lineImp{}, 1)
+	h.Start()
+	defer h.Stop()
+
+	reg := stnet.NewRegistry()
+	reg.Register("svc", stnet.Endpoint{Addr: h.Addr("a")})
+	reg.Register("svc", stnet.Endpoint{Addr: h.Addr("b")})
+	r := reg.Resolver("svc")
+	pool, err := cs.NewConnectPool(r, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.WaitOpen(recs["a"])
+	h.WaitOpen(recs["b"])
+
+	//pool refreshes when registry changed
+	reg.Register("svc", stnet.Endpoint{Addr: h.Addr("c")})
+	h.WaitOpen(recs["c"])
+	reg.Deregister("svc", h.Addr("a"))
+	h.WaitClose(recs["a"], nil)
+	if err := pool.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]bool{connAddr(h, "b"): true, connAddr(h, "c"): true}
+	if got := poolAddrs(pool); !reflect.DeepEqual(got, want) {
+		t.Fatalf("connects %v, want %v", got, want)
+	}
+
+	//closed pool stops watching registry
+	pool.Close()
+	changed := r.(stnet.ResolverNotifier).Changed()
+	select {
+	case <-changed:
+	default:
+	}
+	reg.Register("svc", stnet.Endpoint{Addr: h.Addr("a")})
+	select {
+	case <-changed:
+		t.Fatal("resolver of closed pool is notified")
+	default:
+	}
+	if len(poolAddrs(pool)) != 0 {
+		t.Fatal("connects of closed pool are not closed")
+	}
+}
+
+func TestRoundRobinPicker(t *testing.T) {
+	h, pool := startPool(t, stnet.NewRoundRobinPicker(), &lineImp{}, map[string]int{"a": 1, "b": 1, "c": 1})
+	defer h.Stop()
+	defer pool.Close()
+
+	counts := make(map[string]int)
+	last := ""
+	for i := 0; i < 6; i++ {
+		addr := pool.Pick("").Addr()
+		if addr == last {
+			t.Fatalf("%s is picked twice in a row", addr)
+		}
+		last = addr
+		counts[addr]++
+	}
+	for addr, n := range counts {
+		if n != 2 {
+			t.Fatalf("%s is picked %d times, want 2", addr, n)
+		}
+	}
+}
+
+func TestWeightedPicker(t *testing.T) {
+	h, pool := startPool(t, stnet.NewWeightedPicker(), &lineImp{}, map[string]int{"a": 5, "b": 1, "c": 1})
+	defer h.Stop()
+	defer pool.Close()
+
+	//smooth weighted round-robin spreads picks of heavy connect
+	want := []string{"a", "a", "b", "a", "c", "a", "a"}
+	for round := 0; round < 2; round++ {
+		for i, name := range want {
+			if got := pool.Pick("").Addr(); got != connAddr(h, name) {
+				t.Fatalf("round %d pick %d: %s, want %s", round, i, got, connAddr(h, name))
+			}
+		}
+	}
+}
+
+func TestLeastPendingPicker(t *testing.T) {
+	//servers never respond, so requests are pending
+	client := stnet.NewServiceRpc(&arith{})
+	h, pool := startPool(t, stnet.NewLeastPendingPicker(), client, map[string]int{"a": 1, "b": 1, "c": 1})
+	defer h.Stop()
+	defer pool.Close()
+
+	for i := 0; i < 3; i++ {
+		if err := client.RpcCallPool(pool, "", "Add", 1, 2, func(int) {}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pool.IterateConnect(func(c *stnet.Connect) bool {
+		if c.Pending() != 1 {
+			t.Fatalf("%s has %d pending requests, want 1", c.Addr(), c.Pending())
+		}
+		return true
+	})
+}
+
+func TestConsistentHashPicker(t *testing.T) {
+	h := stnettest.New(t, 2)
+	for _, name := range []string{"a", "b", "c"} {
+		h.AddService(name, &lineImp{}, 0)
+	}
+	cs, crec := h.AddClientService("client", &lineImp{}, 1)
+	h.Start()
+	defer h.Stop()
+
+	reg := stnet.NewRegistry()
+	for _, name := range []string{"a", "b", "c"} {
+		reg.Register("svc", stnet.Endpoint{Addr: h.Addr(name)})
+	}
+	pool, err := cs.NewConnectPool(reg.Resolver("svc"), stnet.NewConsistentHashPicker(0), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	for i := 0; i < 3; i++ {
+		h.WaitOpen(crec)
+	}
+
+	picked := make(map[string]string)
+	used := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		key := "key" + strconv.Itoa(i)
+		picked[key] = pool.Pick(key).Addr()
+		used[picked[key]] = true
+		if again := pool.Pick(key).Addr(); again != picked[key] {
+			t.Fatalf("key %s is picked %s then %s", key, picked[key], again)
+		}
+	}
+	if len(used) != 3 {
+		t.Fatalf("keys are picked by %d connects, want 3", len(used))
+	}
+
+	//keys of remaining connects are not moved
+	removed := connAddr(h, "a")
+	reg.Deregister("svc", h.Addr("a"))
+	if err := pool.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	for key, addr := range picked {
+		got := pool.Pick(key).Addr()
+		if got == removed || (addr != removed && got != addr) {
+			t.Fatalf("key %s is picked %s, it was %s", key, got, addr)
+		}
+	}
+}
+
+func TestFileResolver(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "endpoints")
+	write := func(s string) {
+		if err := ioutil.WriteFile(path, []byte(s), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := stnet.NewFileResolver(path)
+	if _, err := r.Resolve(); err == nil {
+		t.Fatal("resolve missing file should fail")
+	}
+
+	write("# instances\n\n127.0.0.1:6060\n  udp:127.0.0.1:6061 3  \nunix:///tmp/s.sock 0\n")
+	eps, err := r.Resolve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []stnet.Endpoint{{Addr: "127.0.0.1:6060", Weight: 1}, {Addr: "udp:127.0.0.1:6061", Weight: 3}, {Addr: "unix:///tmp/s.sock", Weight: 0}}
+	if !reflect.DeepEqual(eps, want) {
+		t.Fatalf("endpoints %v, want %v", eps, want)
+	}
+
+	//modified file is read again
+	write("127.0.0.1:6060 x\n")
+	if _, err := r.Resolve(); err == nil {
+		t.Fatal("invalid weight should fail")
+	}
+	write("127.0.0.1:7070\n")
+	eps, err = r.Resolve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []stnet.Endpoint{{Addr: "127.0.0.1:7070", Weight: 1}}; !reflect.DeepEqual(eps, want) {
+		t.Fatalf("endpoints %v, want %v", eps, want)
+	}
+}
@@ -0,0 +1,67 @@
+package stnet
+
+import (
+	"hash/crc32"
+	"sort"
+	"strconv"
+)
+
+// hashRing consistent hash with virtual nodes.
+type hashRing struct {
+	hashes []uint32
+	nodes  map[uint32]int //hash->index of node
+}
+
+func newHashRing(replicas int, nodes []string) *hashRing {
+	if replicas <= 0 {
+		replicas = 160
+	}
+	r := &hashRing{nodes: make(map[uint32]int)}
+	for i, n := range nodes {
+		for j := 0; j < replicas; j++ {
+			h := hashKey(n + "#" + strconv.Itoa(j))
+			if _, ok := r.nodes[h]; ok {
+				continue
+			}
+			r.nodes[h] = i
+			r.hashes = append(r.hashes, h)
+		}
+	}
+	sort.Slice(r.hashes, func(i, j int) bool { return r.hashes[i] < r.hashes[j] })
+	return r
+}
+
+func hashKey(key string) uint32 {
+	return crc32.ChecksumIEEE([]byte(key))
+}
+
+// get returns index of the node which key is mapped to, -1 if ring is empty.
+func (r *hashRing) get(key string) int {
+	if len(r.hashes) == 0 {
+		return -1
+	}
+	h := hashKey(key)
+	i := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	return r.nodes[r.hashes[i%len(r.hashes)]]
+}
+
+// getN returns the nth different node after the node which key is mapped to.
+func (r *hashRing) getN(key string, n int) int {
+	if len(r.hashes) == 0 {
+		return -1
+	}
+	h := hashKey(key)
+	i := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	seen := make(map[int]bool)
+	for k := 0; k < len(r.hashes); k++ {
+		node := r.nodes[r.hashes[(i+k)%len(r.hashes)]]
+		if seen[node] {
+			continue
+		}
+		if len(seen) == n {
+			return node
+		}
+		seen[node] = true
+	}
+	return -1
+}
@@ -0,0 +1,138 @@
+package stnet
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule is parsed from spec of 5 fields: minute hour day-of-month month day-of-week.
+// every field supports * */n a-b a-b/n a,b; and @yearly @monthly @weekly @daily @hourly are supported.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64 //bit set
+	domStar, dowStar              bool
+}
+
+var cronAlias = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+func parseCron(spec string) (*cronSchedule, error) {
+	spec = strings.TrimSpace(spec)
+	if s, ok := cronAlias[spec]; ok {
+		spec = s
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron spec should have 5 fields: %s", spec)
+	}
+	var (
+		cs  cronSchedule
+		err error
+	)
+	if cs.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, err
+	}
+	if cs.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, err
+	}
+	if cs.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, err
+	}
+	if cs.month, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, err
+	}
+	if cs.dow, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, err
+	}
+	if cs.dow&(1<<7) != 0 { //7 is sunday too
+		cs.dow |= 1
+	}
+	cs.domStar = strings.HasPrefix(fields[2], "*")
+	cs.dowStar = strings.HasPrefix(fields[4], "*")
+	return &cs, nil
+}
+
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			s, err := strconv.Atoi(part[i+1:])
+			if err != nil || s <= 0 {
+				return 0, fmt.Errorf("invalid cron step: %s", field)
+			}
+			step = s
+			part = part[:i]
+		}
+		lo, hi := min, max
+		if part != "*" {
+			if i := strings.Index(part, "-"); i >= 0 {
+				var err1, err2 error
+				lo, err1 = strconv.Atoi(part[:i])
+				hi, err2 = strconv.Atoi(part[i+1:])
+				if err1 != nil || err2 != nil {
+					return 0, fmt.Errorf("invalid cron range: %s", field)
+				}
+			} else {
+				v, err := strconv.Atoi(part)
+				if err != nil {
+					return 0, fmt.Errorf("invalid cron value: %s", field)
+				}
+				lo = v
+				if step == 1 {
+					hi = v
+				}
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("cron value out of range[%d-%d]: %s", min, max, field)
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func (cs *cronSchedule) dayMatch(t time.Time) bool {
+	domOk := cs.dom&(1<<uint(t.Day())) != 0
+	dowOk := cs.dow&(1<<uint(t.Weekday())) != 0
+	if cs.domStar || cs.dowStar {
+		return domOk && dowOk
+	}
+	return domOk || dowOk
+}
+
+// next returns the first time matched after t, zero time if not found in 5 years.
+func (cs *cronSchedule) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	end := t.AddDate(5, 0, 0)
+	for t.Before(end) {
+		if cs.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !cs.dayMatch(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if cs.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if cs.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
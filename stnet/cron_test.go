@@ -0,0 +1,99 @@
+package stnet
+
+import (
+	"testing"
+	"time"
+)
+
+func cronBits(vs ...int) uint64 {
+	var bits uint64
+	for _, v := range vs {
+		bits |= 1 << uint(v)
+	}
+	return bits
+}
+
+func TestParseCron(t *testing.T) {
+	cases := []struct {
+		spec string
+		want *cronSchedule //nil means error
+	}{
+		{"5 * * * *", &cronSchedule{cronBits(5), 1<<24 - 1, 1<<32 - 2, 1<<13 - 2, 1<<8 - 1, true, true}},
+		{"*/15 0-6/2 1,15 * 7", &cronSchedule{cronBits(0, 15, 30, 45), cronBits(0, 2, 4, 6), cronBits(1, 15), 1<<13 - 2, cronBits(0, 7), false, false}},
+		{"10-12,30 5/6 * 1-3 1-5", &cronSchedule{cronBits(10, 11, 12, 30), cronBits(5, 11, 17, 23), 1<<32 - 2, cronBits(1, 2, 3), cronBits(1, 2, 3, 4, 5), true, false}},
+		{"@daily", &cronSchedule{cronBits(0), cronBits(0), 1<<32 - 2, 1<<13 - 2, 1<<8 - 1, true, true}},
+		{"@weekly", &cronSchedule{cronBits(0), cronBits(0), 1<<32 - 2, 1<<13 - 2, cronBits(0), true, false}},
+		{"60 * * * *", nil},
+		{"* 24 * * *", nil},
+		{"* * 0 * *", nil},
+		{"* * 32 * *", nil},
+		{"* * * 13 *", nil},
+		{"* * * * 8", nil},
+		{"5-1 * * * *", nil},
+		{"*/0 * * * *", nil},
+		{"1-2/x * * * *", nil},
+		{"a * * * *", nil},
+		{"* * * *", nil},
+		{"* * * * * *", nil},
+	}
+	for _, c := range cases {
+		cs, err := parseCron(c.spec)
+		if c.want == nil {
+			if err == nil {
+				t.Errorf("%q: parse should fail", c.spec)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", c.spec, err)
+		} else if *cs != *c.want {
+			t.Errorf("%q: %+v, want %+v", c.spec, *cs, *c.want)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	at := func(s string) time.Time {
+		v, err := time.Parse("2006-01-02 15:04", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	//2024-01-01 is monday
+	cases := []struct {
+		spec, from string
+		want       []string //next times one after another, "" means never
+	}{
+		{"30 9 * * *", "2024-01-01 10:00", []string{"2024-01-02 09:30", "2024-01-03 09:30"}},
+		{"*/20 * * * *", "2024-01-01 10:05", []string{"2024-01-01 10:20", "2024-01-01 10:40", "2024-01-01 11:00"}},
+		{"0 0 * * 7", "2024-01-01 00:00", []string{"2024-01-07 00:00", "2024-01-14 00:00"}}, //7 is sunday
+		{"0 0 13 * *", "2024-01-01 00:00", []string{"2024-01-13 00:00", "2024-02-13 00:00"}},
+		{"0 0 * * 5", "2024-01-01 00:00", []string{"2024-01-05 00:00", "2024-01-12 00:00"}},
+		//day of month or day of week when both are restricted
+		{"0 0 13 * 5", "2024-01-01 00:00", []string{"2024-01-05 00:00", "2024-01-12 00:00", "2024-01-13 00:00", "2024-01-19 00:00"}},
+		{"0 0 29 2 *", "2024-03-01 00:00", []string{"2028-02-29 00:00"}},
+		{"0 0 31 2 *", "2024-01-01 00:00", []string{""}},
+	}
+	for _, c := range cases {
+		cs, err := parseCron(c.spec)
+		if err != nil {
+			t.Fatalf("%q: %v", c.spec, err)
+		}
+		from := at(c.from)
+		for _, w := range c.want {
+			next := cs.next(from)
+			if w == "" {
+				if !next.IsZero() {
+					t.Errorf("%q: next of %v is %v, want never", c.spec, from, next)
+				}
+				break
+			}
+			if !next.Equal(at(w)) {
+				t.Errorf("%q: next of %v is %v, want %s", c.spec, from, next, w)
+				break
+			}
+			from = next
+		}
+	}
+}
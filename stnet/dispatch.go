@@ -0,0 +1,149 @@
+package stnet
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+var (
+	ErrMsgNotRegistered = errors.New("type of msg is not registered")
+	ErrNilMsg           = errors.New("msg is nil")
+)
+
+var currentContentType = reflect.TypeOf((*CurrentContent)(nil))
+
+// msgDispatcher maps msgID to type of msg and typed handlers of ServiceSpb and ServiceJson.
+// registration is not safe for concurrent use, it should be done before the service starts.
+type msgDispatcher struct {
+	types    map[uint64]reflect.Type
+	ids      map[reflect.Type]uint64
+	handlers map[uint64]reflect.Value
+	unknown  func(current *CurrentContent, msgID uint64, data []byte)
+}
+
+func (d *msgDispatcher) register(msgID uint64, t reflect.Type) error {
+	if t == nil || t.Kind() == reflect.Ptr {
+		return fmt.Errorf("type of msg cannot be ptr or nil")
+	}
+	if d.types == nil {
+		d.types = make(map[uint64]reflect.Type)
+		d.ids = make(map[reflect.Type]uint64)
+	}
+	d.types[msgID] = t
+	if _, ok := d.ids[t]; !ok { //the first id of type is used by SendMsg
+		d.ids[t] = msgID
+	}
+	return nil
+}
+
+// registerHandler handler is func(*CurrentContent, *T), T is registered as type of msgID.
+func (d *msgDispatcher) registerHandler(msgID uint64, handler interface{}) error {
+	if handler == nil {
+		return fmt.Errorf("handler of msg %d is nil", msgID)
+	}
+	hv := reflect.ValueOf(handler)
+	ht := hv.Type()
+	if ht.Kind() != reflect.Func || ht.NumIn() != 2 || ht.NumOut() != 0 || ht.In(0) != currentContentType || ht.In(1).Kind() != reflect.Ptr {
+		return fmt.Errorf("handler of msg %d should be func(*CurrentContent, *T)", msgID)
+	}
+	if err := d.register(msgID, ht.In(1).Elem()); err != nil {
+		return err
+	}
+	if d.handlers == nil {
+		d.handlers = make(map[uint64]reflect.Value)
+	}
+	d.handlers[msgID] = hv
+	return nil
+}
+
+// idOf return msgID registered for type of msg, msg could be T or *T.
+func (d *msgDispatcher) idOf(msg interface{}) (uint64, error) {
+	if msg == nil {
+		return 0, ErrNilMsg
+	}
+	v := reflect.ValueOf(msg)
+	t := v.Type()
+	if t.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return 0, ErrNilMsg
+		}
+		t = t.Elem()
+	}
+	id, ok := d.ids[t]
+	if !ok {
+		return 0, fmt.Errorf("%s: %v", ErrMsgNotRegistered.Error(), t)
+	}
+	return id, nil
+}
+
+// dispatch call handler of msgID with decoded msg m(*T), false if there is no handler.
+func (d *msgDispatcher) dispatch(current *CurrentContent, msgID uint64, m interface{}) bool {
+	h, ok := d.handlers[msgID]
+	if !ok {
+		return false
+	}
+	h.Call([]reflect.Value{reflect.ValueOf(current), reflect.ValueOf(m)})
+	return true
+}
+
+// handleUnknown call hook of unregistered msgID, false if there is no hook.
+func (d *msgDispatcher) handleUnknown(current *CurrentContent, msgID uint64, data []byte) bool {
+	if d.unknown == nil {
+		return false
+	}
+	d.unknown(current, msgID, data)
+	return true
+}
+
+// RegisterHandler register handler of msgID, handler is func(*CurrentContent, *T) and T is registered as RegisterMsg(msgID, T{}).
+// messages of msgID are decoded into *T and passed to handler instead of SpbService.Handle, decoding errors are still passed to Handle.
+func (service *ServiceSpb) RegisterHandler(msgID uint64, handler interface{}) error {
+	return service.disp.registerHandler(msgID, handler)
+}
+
+// SetUnknownHandler set hook of messages whose msgID is not registered, data is the encoded msg.
+// if it is not set, they are passed to SpbService.Handle as []byte.
+func (service *ServiceSpb) SetUnknownHandler(h func(current *CurrentContent, msgID uint64, data []byte)) {
+	service.disp.unknown = h
+}
+
+// SendMsg send msg with msgID registered for its type by RegisterMsg or RegisterHandler, same as SendSpbCmd.
+func (service *ServiceSpb) SendMsg(sess *Session, msg interface{}) error {
+	id, err := service.disp.idOf(msg)
+	if err != nil {
+		return err
+	}
+	return SendSpbCmd(sess, id, reflect.Indirect(reflect.ValueOf(msg)).Interface())
+}
+
+// RegisterMsg register type of msgID for SendMsg, msg is T(not ptr).
+// received messages of it are passed to JsonService.Handle as they are unless a handler is registered.
+func (service *ServiceJson) RegisterMsg(msgID uint64, msg interface{}) error {
+	return service.disp.register(msgID, reflect.TypeOf(msg))
+}
+
+// RegisterHandler register handler of msgID, handler is func(*CurrentContent, *T), CmdData is decoded into *T by json.
+// decoding errors are passed to JsonService.Handle.
+func (service *ServiceJson) RegisterHandler(msgID uint64, handler interface{}) error {
+	return service.disp.registerHandler(msgID, handler)
+}
+
+// SetUnknownHandler set hook of messages whose msgID is not registered, data is CmdData.
+// if it is not set, they are passed to JsonService.Handle.
+func (service *ServiceJson) SetUnknownHandler(h func(current *CurrentContent, msgID uint64, data []byte)) {
+	service.disp.unknown = h
+}
+
+// SendMsg encode msg by json and send it with msgID registered for its type, same as SendJsonCmd.
+func (service *ServiceJson) SendMsg(sess *Session, msg interface{}) error {
+	id, err := service.disp.idOf(msg)
+	if err != nil {
+		return err
+	}
+	d, err := Marshal(msg, EncodeTyepJson)
+	if err != nil {
+		return err
+	}
+	return SendJsonCmd(sess, id, d)
+}
@@ -0,0 +1,123 @@
+package stnet_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/greedchase/gotools/stnet"
+	"github.com/greedchase/gotools/stnet/stnettest"
+)
+
+type loginReq struct {
+	User string
+	Code int
+}
+
+type loginRsp struct {
+	User string
+	OK   bool
+}
+
+func TestSpbTypedHandler(t *testing.T) {
+	h := stnettest.New(t, 1)
+	imp := stnet.NewServiceSpb(nil)
+	unknown := make(chan uint64, 1)
+	if imp.RegisterHandler(1, func(current *stnet.CurrentContent, req loginReq) {}) == nil {
+		t.Fatal("handler with non-ptr msg is registered")
+	}
+	err := imp.RegisterHandler(1, func(current *stnet.CurrentContent, req *loginReq) {
+		imp.SendMsg(current.Sess, &loginRsp{req.User, req.Code == 7})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	imp.RegisterMsg(2, loginRsp{})
+	imp.SetUnknownHandler(func(current *stnet.CurrentContent, msgID uint64, data []byte) { unknown <- msgID })
+	s, rec := h.AddService("spb", imp, 0)
+	h.Start()
+	defer h.Stop()
+
+	c := h.Dial(s)
+	defer c.Close()
+	c.SendSpb(1, loginReq{"tom", 7})
+	var rsp loginRsp
+	if id := c.ReadSpb(&rsp); id != 2 || rsp != (loginRsp{"tom", true}) {
+		t.Fatalf("response is %d %v", id, rsp)
+	}
+	c.SendSpb(9, loginReq{})
+	if id := <-unknown; id != 9 {
+		t.Fatalf("unknown msg %d", id)
+	}
+	if err := imp.SendMsg(nil, spbInner{}); err == nil {
+		t.Fatal("msg of unregistered type is sent")
+	}
+	for _, m := range []interface{}{nil, (*loginRsp)(nil)} {
+		if err := imp.SendMsg(nil, m); err != stnet.ErrNilMsg {
+			t.Fatalf("send nil msg %T returns %v", m, err)
+		}
+	}
+	if rec.Count(stnettest.EventError) > 0 {
+		t.Fatal("error occurs")
+	}
+}
+
+type jsonEchoImp struct {
+	got chan stnet.JsonProto
+}
+
+func (imp *jsonEchoImp) Init() bool { return true }
+func (imp *jsonEchoImp) Loop()      {}
+func (imp *jsonEchoImp) Handle(current *stnet.CurrentContent, cmd stnet.JsonProto, e error) {
+	imp.got <- cmd
+}
+func (imp *jsonEchoImp) HashProcessor(current *stnet.CurrentContent, cmd stnet.JsonProto) int {
+	return 0
+}
+
+func TestJsonTypedHandler(t *testing.T) {
+	h := stnettest.New(t, 1)
+	imp := &jsonEchoImp{make(chan stnet.JsonProto, 1)}
+	svc := stnet.NewServiceJson(imp)
+	svc.RegisterMsg(2, loginRsp{})
+	svc.RegisterHandler(1, func(current *stnet.CurrentContent, req *loginReq) {
+		svc.SendMsg(current.Sess, loginRsp{req.User, true})
+	})
+	s, _ := h.AddService("json", svc, 0)
+	h.Start()
+	defer h.Stop()
+
+	c := h.Dial(s)
+	defer c.Close()
+	c.SendJson(1, []byte(`{"User":"amy"}`))
+	var cmd stnet.JsonProto
+	if err := json.Unmarshal(c.ReadFrame()[4:], &cmd); err != nil {
+		t.Fatal(err)
+	}
+	var rsp loginRsp
+	if err := json.Unmarshal(cmd.CmdData, &rsp); err != nil || cmd.CmdId != 2 || rsp != (loginRsp{"amy", true}) {
+		t.Fatalf("response is %d %s", cmd.CmdId, cmd.CmdData)
+	}
+
+	//frame of version 1 has json flag
+	frame, _ := stnet.EncodeProtocol(stnet.JsonProto{CmdId: 1, CmdData: []byte(`{"User":"bob"}`)}, stnet.EncodeTyepJson)
+	frame[0] = 0x30
+	c.Send(frame)
+	if err := json.Unmarshal(c.ReadFrame()[4:], &cmd); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(cmd.CmdData, &rsp); err != nil || rsp != (loginRsp{"bob", true}) {
+		t.Fatalf("response of version 1 frame is %d %s", cmd.CmdId, cmd.CmdData)
+	}
+
+	c.SendJson(3, []byte(`"raw"`)) //no handler, passed to imp
+	if got := <-imp.got; got.CmdId != 3 || string(got.CmdData) != `"raw"` {
+		t.Fatalf("imp receives %d %s", got.CmdId, got.CmdData)
+	}
+	c.SendJson(1, []byte(`{"User":1}`)) //decoding error is passed to imp
+	if got := <-imp.got; got.CmdId != 1 {
+		t.Fatalf("imp receives %d", got.CmdId)
+	}
+	if err := svc.SendMsg(nil, (*loginRsp)(nil)); err != stnet.ErrNilMsg {
+		t.Fatalf("send nil msg returns %v", err)
+	}
+}
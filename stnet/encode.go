@@ -1,7 +1,6 @@
 package stnet
 
 import (
-	"encoding/json"
 	"fmt"
 	"reflect"
 )
@@ -11,27 +10,27 @@ const (
 	EncodeTyepJson = 1
 )
 
+// Marshal encode m by registered Codec whose id is encodeType.
 func Marshal(m interface{}, encodeType int) ([]byte, error) {
-	if encodeType == EncodeTyepSpb {
-		return SpbEncode(m)
-	} else if encodeType == EncodeTyepJson {
-		return json.Marshal(m)
+	c := codecOf(encodeType)
+	if c == nil {
+		return nil, fmt.Errorf("error encode type %d", encodeType)
 	}
-	return nil, fmt.Errorf("error encode type %d", encodeType)
+	return c.Marshal(m)
 }
 
+// Unmarshal decode data into m by registered Codec whose id is encodeType, m must be a pointer.
 func Unmarshal(data []byte, m interface{}, encodeType int) error {
 	rv := reflect.ValueOf(m)
 	if rv.Kind() != reflect.Ptr || rv.IsNil() {
 		return fmt.Errorf("Unmarshal need is ptr,but this is %s", rv.Kind())
 	}
 
-	if encodeType == EncodeTyepSpb {
-		return SpbDecode(data, m)
-	} else if encodeType == EncodeTyepJson {
-		return json.Unmarshal(data, m)
+	c := codecOf(encodeType)
+	if c == nil {
+		return fmt.Errorf("error encode type %d", encodeType)
 	}
-	return fmt.Errorf("error encode type %d", encodeType)
+	return c.Unmarshal(data, m)
 }
 
 func rpcMarshal(spb *Spb, tag uint32, i interface{}) error {
@@ -46,21 +45,15 @@ func rpcUnmarshal(spb *Spb, tag uint32, i interface{}) error {
 	return spb.unpack(rv, true)
 }
 
-func MsgLen(b []byte) uint32 {
-	return uint32(b[3]) | uint32(b[2])<<8 | uint32(b[1])<<16 | uint32(b[0])<<24
+// EncodeProtocol encode msg into frame with DefaultFrameCodec.
+func EncodeProtocol(msg interface{}, encode int) ([]byte, error) {
+	return encodeFrameMsg(DefaultFrameCodec, msg, encode)
 }
 
-func EncodeProtocol(msg interface{}, encode int) ([]byte, error) {
+func encodeFrameMsg(codec FrameCodec, msg interface{}, encode int) ([]byte, error) {
 	data, e := Marshal(msg, encode)
 	if e != nil {
 		return nil, e
 	}
-	msglen := len(data) + 4
-	buff := make([]byte, msglen)
-	buff[0] = byte(msglen >> 24)
-	buff[1] = byte(msglen >> 18)
-	buff[2] = byte(msglen >> 8)
-	buff[3] = byte(msglen)
-	copy(buff[4:], data)
-	return buff, nil
+	return encodeFrame(codec, FrameHeader{Encoding: encode, Version: FrameVersion}, data)
 }
@@ -0,0 +1,338 @@
+package stnet
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// control type of key exchange, body of encrypted frame is sealed by AES-GCM, nonce is the sequence number of the direction
+const (
+	ctrlKeyExchange = 2 //[mode(1 byte)][nonce(16 bytes)][key data]
+)
+
+// modes of key exchange
+const (
+	EncryptECDH = 1 //X25519 ephemeral keys, it protects against eavesdropping but does not authenticate server
+	EncryptRSA  = 2 //session secret is encrypted with RSA public key of server, only the owner of private key could decrypt it
+)
+
+// DefaultHandshakeTimeout session is closed if key exchange is not finished in time.
+const DefaultHandshakeTimeout = 10 * time.Second
+
+var (
+	ErrNotEncrypted      = errors.New("message is not encrypted")
+	ErrDecryptFailed     = errors.New("message decrypt failed")
+	ErrHandshakeFailed   = errors.New("encryption handshake failed")
+	ErrHandshakeNotReady = errors.New("encrypted message before handshake")
+)
+
+// EncryptOptions encryption of frames of ServiceSpb ServiceJson and ServiceRpc.
+// when it is set, every message of sessions of the service is encrypted, both sides must set it with the same Mode.
+// the dialing side starts key exchange when connection established, messages are sent after key exchange is finished.
+// plaintext messages received are errors(HandleError of imp is called, default action is closing the session).
+// datagram sessions(udp, unixgram) are not supported.
+type EncryptOptions struct {
+	Mode             int           //EncryptECDH or EncryptRSA
+	PublicKey        []byte        //PEM of RSA public key(PKIX, same as stutil.RsaEncrypt), it is used by the dialing side in EncryptRSA
+	PrivateKey       []byte        //PEM of RSA private key(PKCS1, same as stutil.RsaDecrypt), it is used by the accepting side in EncryptRSA
+	HandshakeTimeout time.Duration //0 means DefaultHandshakeTimeout
+}
+
+// SetEncryption enable encryption of sessions of this service(including connections), nil disables it.
+// it takes effect on sessions opened later.
+func (service *Service) SetEncryption(opt *EncryptOptions) error {
+	if opt == nil {
+		service.encrypt.Store((*EncryptOptions)(nil))
+		return nil
+	}
+	if opt.Mode != EncryptECDH && opt.Mode != EncryptRSA {
+		return fmt.Errorf("invalid encryption mode %d", opt.Mode)
+	}
+	if opt.Mode == EncryptRSA && len(opt.PublicKey) == 0 && len(opt.PrivateKey) == 0 {
+		return fmt.Errorf("rsa key is empty")
+	}
+	o := *opt
+	if o.HandshakeTimeout <= 0 {
+		o.HandshakeTimeout = DefaultHandshakeTimeout
+	}
+	service.encrypt.Store(&o)
+	return nil
+}
+
+func (service *Service) encryptOptions() *EncryptOptions {
+	opt, _ := service.encrypt.Load().(*EncryptOptions)
+	return opt
+}
+
+// sessionCrypt keys of a connection, send side is used in dosend only and recv side in dorecv only.
+type sessionCrypt struct {
+	sess   *Session
+	opt    *EncryptOptions
+	client bool
+	ready  chan struct{} //closed when keys are established
+	timer  *time.Timer
+
+	//handshake
+	nonce  [16]byte
+	priv   [32]byte //ECDH private key of client
+	secret []byte   //RSA secret of client
+	hello  []byte   //key exchange sent by client or replied by server
+
+	send, recv       cipher.AEAD
+	sendSeq, recvSeq uint64
+}
+
+// initCrypt is called before goroutines of session start, every connection has new keys.
+func (s *Session) initCrypt() error {
+	s.crypt.Store((*sessionCrypt)(nil))
+	svc := sessionService(s)
+	if svc == nil || s.isUdp {
+		return nil
+	}
+	opt := svc.encryptOptions()
+	if opt == nil {
+		return nil
+	}
+	c := &sessionCrypt{sess: s, opt: opt, client: s.conn != nil, ready: make(chan struct{})}
+	if _, err := io.ReadFull(rand.Reader, c.nonce[:]); err != nil {
+		return err
+	}
+	if c.client {
+		hello := []byte{ctrlKeyExchange, byte(opt.Mode)}
+		hello = append(hello, c.nonce[:]...)
+		switch opt.Mode {
+		case EncryptECDH:
+			pub, err := newX25519(c.priv[:])
+			if err != nil {
+				return err
+			}
+			hello = append(hello, pub...)
+		case EncryptRSA:
+			c.secret = make([]byte, 32)
+			if _, err := io.ReadFull(rand.Reader, c.secret); err != nil {
+				return err
+			}
+			d, err := rsaWrap(c.secret, opt.PublicKey)
+			if err != nil {
+				return err
+			}
+			hello = append(hello, d...)
+		}
+		c.hello = s.controlFrame(hello)
+	}
+	sock := s.socket
+	c.timer = time.AfterFunc(opt.HandshakeTimeout, func() {
+		sysLog.Error("encryption handshake timeout;sessionid=%d", s.id)
+		sock.Close()
+	})
+	s.crypt.Store(c)
+	return nil
+}
+
+func (s *Session) cryptState() *sessionCrypt {
+	c, _ := s.crypt.Load().(*sessionCrypt)
+	return c
+}
+
+// stopHandshakeTimer is called when session closed, the timer is stopped by establish if keys are established.
+func (s *Session) stopHandshakeTimer() {
+	if c := s.cryptState(); c != nil {
+		c.timer.Stop()
+	}
+}
+
+// rsaWrap encrypt secret with RSA-OAEP, keys are in the same format as stutil.RsaEncrypt.
+func rsaWrap(secret, pubKey []byte) ([]byte, error) {
+	block, _ := pem.Decode(pubKey)
+	if block == nil {
+		return nil, errors.New("invalid rsa public key")
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rpub, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("invalid rsa public key")
+	}
+	return rsa.EncryptOAEP(sha256.New(), rand.Reader, rpub, secret, nil)
+}
+
+func rsaUnwrap(d, priKey []byte) ([]byte, error) {
+	block, _ := pem.Decode(priKey)
+	if block == nil {
+		return nil, errors.New("invalid rsa private key")
+	}
+	priv, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	return rsa.DecryptOAEP(sha256.New(), rand.Reader, priv, d, nil)
+}
+
+func newX25519(priv []byte) ([]byte, error) {
+	if _, err := io.ReadFull(rand.Reader, priv); err != nil {
+		return nil, err
+	}
+	return curve25519.X25519(priv, curve25519.Basepoint)
+}
+
+func newGCM(secret, salt []byte, info string) (cipher.AEAD, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, []byte(info)), key); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// establish derive keys of both directions, nonces of client and server are salt.
+func (c *sessionCrypt) establish(secret []byte, clientNonce, serverNonce []byte) error {
+	salt := append(append([]byte{}, clientNonce...), serverNonce...)
+	c2s, err := newGCM(secret, salt, "stnet client to server")
+	if err != nil {
+		return err
+	}
+	s2c, err := newGCM(secret, salt, "stnet server to client")
+	if err != nil {
+		return err
+	}
+	if c.client {
+		c.send, c.recv = c2s, s2c
+	} else {
+		c.send, c.recv = s2c, c2s
+	}
+	c.timer.Stop()
+	close(c.ready)
+	return nil
+}
+
+func (c *sessionCrypt) isReady() bool {
+	select {
+	case <-c.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+// keyExchange handle key exchange frame received, it is called in dorecv.
+func (c *sessionCrypt) keyExchange(body []byte) error {
+	if c.isReady() || len(body) < 1+16 || int(body[0]) != c.opt.Mode {
+		return ErrHandshakeFailed
+	}
+	peerNonce, data := body[1:17], body[17:]
+
+	if c.client {
+		secret := c.secret
+		if c.opt.Mode == EncryptECDH {
+			if len(data) != 32 {
+				return ErrHandshakeFailed
+			}
+			var err error
+			if secret, err = curve25519.X25519(c.priv[:], data); err != nil {
+				return ErrHandshakeFailed
+			}
+		}
+		return c.establish(secret, c.nonce[:], peerNonce)
+	}
+
+	reply := []byte{ctrlKeyExchange, byte(c.opt.Mode)}
+	reply = append(reply, c.nonce[:]...)
+	var secret []byte
+	switch c.opt.Mode {
+	case EncryptECDH:
+		if len(data) != 32 {
+			return ErrHandshakeFailed
+		}
+		var priv [32]byte
+		pub, err := newX25519(priv[:])
+		if err != nil {
+			return err
+		}
+		if secret, err = curve25519.X25519(priv[:], data); err != nil {
+			return ErrHandshakeFailed
+		}
+		reply = append(reply, pub...)
+	case EncryptRSA:
+		var err error
+		if secret, err = rsaUnwrap(data, c.opt.PrivateKey); err != nil || len(secret) != 32 {
+			return ErrHandshakeFailed
+		}
+	}
+	c.hello = c.sess.controlFrame(reply) //written by dosend before encrypted frames
+	return c.establish(secret, peerNonce, c.nonce[:])
+}
+
+func seqNonce(seq uint64) []byte {
+	var nonce [12]byte
+	binary.BigEndian.PutUint64(nonce[4:], seq)
+	return nonce[:]
+}
+
+// headerData is authenticated, it is independent of FrameCodec.
+func headerData(h *FrameHeader) []byte {
+	return []byte{h.Flags, byte(h.Encoding), byte(h.Version)}
+}
+
+func (c *sessionCrypt) open(h *FrameHeader, body []byte) ([]byte, error) {
+	if !c.isReady() {
+		return nil, ErrHandshakeNotReady
+	}
+	d, err := c.recv.Open(nil, seqNonce(c.recvSeq), body, headerData(h))
+	if err != nil {
+		return nil, ErrDecryptFailed
+	}
+	c.recvSeq++
+	h.Flags &^= FrameFlagEncrypted
+	return d, nil
+}
+
+func (c *sessionCrypt) isControl(data []byte) bool {
+	codec := c.sess.frameCodec()
+	if len(data) < codec.HeaderLen() {
+		return false
+	}
+	h, err := codec.ParseHeader(data[:codec.HeaderLen()])
+	return err == nil && h.Flags&FrameFlagControl != 0
+}
+
+// sealFrame encrypt frame written by dosend, control frames are sent as they are.
+func (c *sessionCrypt) sealFrame(data []byte) ([]byte, error) {
+	codec := c.sess.frameCodec()
+	hl := codec.HeaderLen()
+	if len(data) < hl {
+		return nil, fmt.Errorf("data sent by encrypted session should be a whole frame")
+	}
+	h, err := codec.ParseHeader(data[:hl])
+	if err != nil || h.Length != len(data) {
+		return nil, fmt.Errorf("data sent by encrypted session should be a whole frame")
+	}
+	if h.Flags&FrameFlagControl != 0 {
+		return data, nil
+	}
+	h.Flags |= FrameFlagEncrypted
+	body := c.send.Seal(nil, seqNonce(c.sendSeq), data[hl:], headerData(&h))
+	buf, err := encodeFrame(codec, h, body)
+	if err != nil {
+		return nil, err
+	}
+	c.sendSeq++
+	return buf, nil
+}
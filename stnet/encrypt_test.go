@@ -0,0 +1,153 @@
+package stnet_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/greedchase/gotools/stnet"
+	"github.com/greedchase/gotools/stnet/stnettest"
+)
+
+// wireConn keeps data read from the connection.
+type wireConn struct {
+	net.Conn
+	mutex *sync.Mutex
+	buf   *bytes.Buffer
+}
+
+func (c wireConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.mutex.Lock()
+	c.buf.Write(b[:n])
+	c.mutex.Unlock()
+	return n, err
+}
+
+// rpcEncrypted call Concat and return frames recorded and data read by client.
+func rpcEncrypted(t *testing.T, server, client *stnet.EncryptOptions, compress *stnet.CompressOptions) ([][]byte, []byte) {
+	h := stnettest.New(t, 2)
+	defer h.Stop()
+	ss, srec := h.AddService("server", stnet.NewServiceRpc(&arith{}), 0)
+	if err := ss.SetEncryption(server); err != nil {
+		t.Fatal(err)
+	}
+	cli := stnet.NewServiceRpc(&arith{})
+	cs, crec := h.AddClientService("client", cli, 1)
+	if err := cs.SetEncryption(client); err != nil {
+		t.Fatal(err)
+	}
+	if compress != nil {
+		ss.SetCompression(compress)
+		cs.SetCompression(compress)
+	}
+	var (
+		wireMutex sync.Mutex
+		wire      bytes.Buffer
+	)
+	p := fastPolicy()
+	p.WrapConn = func(c net.Conn) net.Conn { return wireConn{c, &wireMutex, &wire} }
+	conn := cs.NewConnectWithPolicy(h.Addr("server"), nil, p)
+	var buf bytes.Buffer
+	rec := stnet.NewTrafficRecorder(&buf)
+	conn.Session().SetRecorder(rec)
+	h.Start()
+	h.WaitOpen(srec)
+	h.WaitOpen(crec)
+
+	for i := 0; i < 3; i++ {
+		words := []string{"secret", strings.Repeat("payload", i*100)}
+		s := ""
+		if err := cli.RpcCall_Sync(conn.Session(), "Concat", words, ",", func(r string) { s = r }, nil); err != nil {
+			t.Fatal(err)
+		}
+		if s != strings.Join(words, ",") {
+			t.Fatalf("Concat returns %q", s)
+		}
+	}
+
+	rec.Flush()
+	r, _ := stnet.NewTrafficReader(&buf)
+	var frames [][]byte
+	for {
+		f, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if f.Dir == stnet.TrafficIn {
+			frames = append(frames, f.Data)
+		}
+	}
+	wireMutex.Lock()
+	defer wireMutex.Unlock()
+	return frames, append([]byte(nil), wire.Bytes()...)
+}
+
+// checkEncrypted data on wire is encrypted, frames are recorded after decryption.
+func checkEncrypted(t *testing.T, frames [][]byte, wire []byte) {
+	t.Helper()
+	if len(wire) == 0 || bytes.Contains(wire, []byte("secret")) {
+		t.Fatalf("data is not encrypted: %q", wire)
+	}
+	n := 0
+	plain := false
+	for _, f := range frames {
+		if f[0]&0x8 != 0 || f[0]&0x80 != 0 {
+			t.Fatalf("frame is recorded before decryption: %q", f)
+		}
+		plain = plain || bytes.Contains(f, []byte("secret"))
+		n++
+	}
+	if n != 3 || !plain {
+		t.Fatalf("%d responses are recorded: %q", n, frames)
+	}
+}
+
+func TestEncryptECDH(t *testing.T) {
+	opt := &stnet.EncryptOptions{Mode: stnet.EncryptECDH}
+	frames, wire := rpcEncrypted(t, opt, opt, nil)
+	checkEncrypted(t, frames, wire)
+	frames, wire = rpcEncrypted(t, opt, opt, &stnet.CompressOptions{Algorithms: []string{"lz"}, Threshold: 64})
+	checkEncrypted(t, frames, wire)
+}
+
+func TestEncryptRSA(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	server := &stnet.EncryptOptions{
+		Mode:       stnet.EncryptRSA,
+		PrivateKey: pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}),
+	}
+	client := &stnet.EncryptOptions{
+		Mode:      stnet.EncryptRSA,
+		PublicKey: pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub}),
+	}
+	frames, wire := rpcEncrypted(t, server, client, nil)
+	checkEncrypted(t, frames, wire)
+}
+
+func TestEncryptRejectPlaintext(t *testing.T) {
+	h := stnettest.New(t, 1)
+	s, _ := h.AddService("spb", stnet.NewServiceSpb(&traceSpbImp{spans: make(chan *stnet.Span, 1)}), 0)
+	s.SetEncryption(&stnet.EncryptOptions{Mode: stnet.EncryptECDH, HandshakeTimeout: 100 * time.Millisecond})
+	h.Start()
+	defer h.Stop()
+
+	c := h.Dial(s)
+	c.SendSpb(1, spbInner{"plaintext", 0})
+	c.ExpectClosed()
+
+	c = h.Dial(s) //no handshake
+	c.ExpectClosed()
+}
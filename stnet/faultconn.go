@@ -0,0 +1,241 @@
+package stnet
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrFaultClosed is returned when connection is closed by FaultInjector.
+var ErrFaultClosed = errors.New("connection closed by fault injector")
+
+// ConnWrapper wraps connection accepted by Listener or dialed by Connector.
+type ConnWrapper func(net.Conn) net.Conn
+
+// FaultConfig faults injected into wrapped connections, zero value means no fault.
+type FaultConfig struct {
+	Delay        time.Duration //delay of every write
+	Jitter       time.Duration //random delay in [0, Jitter) added to Delay
+	BytesPerSec  int           //bandwidth of write, 0 means no limit
+	DropRate     float64       //0-1, datagram is dropped randomly when reading and writing(udp and unixgram only)
+	FragmentSize int           //write is split into pieces of FragmentSize bytes(stream only), 0 means no fragment
+	CloseAfter   int64         //connection is closed after CloseAfter bytes are read and written, 0 means never
+}
+
+// FaultStats counters of FaultInjector.
+type FaultStats struct {
+	Dropped    uint64 //datagrams dropped
+	Fragmented uint64 //writes fragmented
+	Closed     uint64 //connections closed by CloseAfter or CloseAll
+}
+
+// FaultInjector injects faults into connections wrapped by it, config could be changed at runtime.
+// use Listener.SetConnWrapper(fi.Wrap) or Connector.SetConnWrapper(fi.Wrap).
+type FaultInjector struct {
+	cfg   atomic.Value //*FaultConfig
+	stats FaultStats
+
+	mutex sync.Mutex
+	conns map[*faultConn]struct{}
+}
+
+func NewFaultInjector(cfg *FaultConfig) *FaultInjector {
+	fi := &FaultInjector{conns: make(map[*faultConn]struct{})}
+	fi.Set(cfg)
+	return fi
+}
+
+// Set change faults of all wrapped connections, nil disables injecting.
+func (fi *FaultInjector) Set(cfg *FaultConfig) {
+	if cfg != nil {
+		c := *cfg
+		cfg = &c
+	}
+	fi.cfg.Store(cfg)
+}
+
+func (fi *FaultInjector) Config() *FaultConfig {
+	cfg, _ := fi.cfg.Load().(*FaultConfig)
+	return cfg
+}
+
+func (fi *FaultInjector) Stats() FaultStats {
+	return FaultStats{
+		Dropped:    atomic.LoadUint64(&fi.stats.Dropped),
+		Fragmented: atomic.LoadUint64(&fi.stats.Fragmented),
+		Closed:     atomic.LoadUint64(&fi.stats.Closed),
+	}
+}
+
+// CloseAll reset all alive connections abruptly(RST is sent for tcp).
+func (fi *FaultInjector) CloseAll() {
+	fi.mutex.Lock()
+	conns := make([]*faultConn, 0, len(fi.conns))
+	for c := range fi.conns {
+		conns = append(conns, c)
+	}
+	fi.mutex.Unlock()
+	for _, c := range conns {
+		c.reset()
+	}
+}
+
+// Wrap is a ConnWrapper, net.PacketConn is still a net.PacketConn after wrapped.
+func (fi *FaultInjector) Wrap(c net.Conn) net.Conn {
+	fc := &faultConn{Conn: c, fi: fi}
+	fi.mutex.Lock()
+	fi.conns[fc] = struct{}{}
+	fi.mutex.Unlock()
+	if pc, ok := c.(net.PacketConn); ok {
+		return &faultPacketConn{fc, pc}
+	}
+	return fc
+}
+
+type faultConn struct {
+	net.Conn
+	fi     *FaultInjector
+	nbytes int64
+	closed int32
+}
+
+func (c *faultConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// count add n bytes transferred, it returns the bytes allowed and whether connection should be closed.
+func (c *faultConn) count(cfg *FaultConfig, n int) (int, bool) {
+	if cfg == nil || cfg.CloseAfter <= 0 {
+		return n, false
+	}
+	total := atomic.AddInt64(&c.nbytes, int64(n))
+	if total < cfg.CloseAfter {
+		return n, false
+	}
+	over := total - cfg.CloseAfter
+	if over > int64(n) {
+		return 0, true
+	}
+	return n - int(over), true
+}
+
+func (c *faultConn) delay(cfg *FaultConfig, n int) {
+	d := cfg.Delay
+	if cfg.Jitter > 0 {
+		d += time.Duration(rand.Int63n(int64(cfg.Jitter)))
+	}
+	if cfg.BytesPerSec > 0 {
+		d += time.Duration(int64(n) * int64(time.Second) / int64(cfg.BytesPerSec))
+	}
+	if d > 0 {
+		time.Sleep(d)
+	}
+}
+
+func (c *faultConn) drop(cfg *FaultConfig) bool {
+	if cfg == nil || cfg.DropRate <= 0 || rand.Float64() >= cfg.DropRate {
+		return false
+	}
+	atomic.AddUint64(&c.fi.stats.Dropped, 1)
+	return true
+}
+
+func (c *faultConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		if m, closed := c.count(c.fi.Config(), n); closed {
+			c.reset()
+			if m == 0 {
+				return 0, ErrFaultClosed
+			}
+			n = m
+		}
+	}
+	return n, err
+}
+
+func (c *faultConn) Write(b []byte) (int, error) {
+	cfg := c.fi.Config()
+	if cfg == nil {
+		return c.Conn.Write(b)
+	}
+	if _, ok := c.Conn.(net.PacketConn); ok {
+		if c.drop(cfg) {
+			return len(b), nil
+		}
+		c.delay(cfg, len(b))
+		return c.Conn.Write(b)
+	}
+
+	piece := len(b)
+	if cfg.FragmentSize > 0 && cfg.FragmentSize < len(b) {
+		piece = cfg.FragmentSize
+		atomic.AddUint64(&c.fi.stats.Fragmented, 1)
+	}
+	written := 0
+	for written < len(b) {
+		p := b[written:]
+		if len(p) > piece {
+			p = p[:piece]
+		}
+		m, closed := c.count(cfg, len(p))
+		c.delay(cfg, m)
+		n, err := c.Conn.Write(p[:m])
+		written += n
+		if closed {
+			c.reset()
+			return written, ErrFaultClosed
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// reset close connection abruptly.
+func (c *faultConn) reset() {
+	if !atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		return
+	}
+	atomic.AddUint64(&c.fi.stats.Closed, 1)
+	if tc, ok := rawConn(c.Conn).(*net.TCPConn); ok {
+		tc.SetLinger(0)
+	}
+	c.Close()
+}
+
+func (c *faultConn) Close() error {
+	c.fi.mutex.Lock()
+	delete(c.fi.conns, c)
+	c.fi.mutex.Unlock()
+	return c.Conn.Close()
+}
+
+type faultPacketConn struct {
+	*faultConn
+	pc net.PacketConn
+}
+
+func (c *faultPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.pc.ReadFrom(b)
+		if err != nil || !c.drop(c.fi.Config()) {
+			return n, addr, err
+		}
+	}
+}
+
+func (c *faultPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	cfg := c.fi.Config()
+	if cfg != nil {
+		if c.drop(cfg) {
+			return len(b), nil
+		}
+		c.delay(cfg, len(b))
+	}
+	return c.pc.WriteTo(b, addr)
+}
@@ -0,0 +1,112 @@
+package stnet_test
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/greedchase/gotools/stnet"
+	"github.com/greedchase/gotools/stnet/stnettest"
+)
+
+func TestFaultFragmentAndDelay(t *testing.T) {
+	h := stnettest.New(t, 1)
+	_, srec := h.AddService("server", &lineImp{}, 0)
+	cs, crec := h.AddClientService("client", &lineImp{}, 0)
+	fi := stnet.NewFaultInjector(&stnet.FaultConfig{FragmentSize: 3, Delay: 5 * time.Millisecond})
+	p := fastPolicy()
+	p.WrapConn = fi.Wrap
+	conn := cs.NewConnectWithPolicy(h.Addr("server"), nil, p)
+	h.Start()
+	defer h.Stop()
+	h.WaitOpen(srec)
+	h.WaitOpen(crec)
+
+	msg := append(bytes.Repeat([]byte("f"), 20), '\n')
+	start := time.Now()
+	if err := conn.Send(msg); err != nil {
+		t.Fatal(err)
+	}
+	e := h.WaitMessage(srec, 'f')
+	if len(e.Msg.([]byte)) != 20 {
+		t.Fatalf("message length %d", len(e.Msg.([]byte)))
+	}
+	//7 pieces, every piece is delayed
+	if d := time.Since(start); d < 35*time.Millisecond {
+		t.Fatalf("delay %s is too short", d)
+	}
+	if fi.Stats().Fragmented != 1 {
+		t.Fatalf("stats %+v", fi.Stats())
+	}
+
+	fi.Set(nil)
+	start = time.Now()
+	conn.Send(msg)
+	h.WaitMessage(srec, 'f')
+	if d := time.Since(start); d > 30*time.Millisecond {
+		t.Fatalf("delay %s after faults disabled", d)
+	}
+}
+
+func TestFaultCloseAfter(t *testing.T) {
+	h := stnettest.New(t, 1)
+	s, rec := h.AddService("server", &lineImp{}, 0)
+	fi := stnet.NewFaultInjector(&stnet.FaultConfig{CloseAfter: 10})
+	s.SetConnWrapper(fi.Wrap)
+	h.Start()
+	defer h.Stop()
+
+	c := h.Dial(s)
+	defer c.Close()
+	sess := h.WaitOpen(rec)
+	c.Send([]byte("abcd\n"))
+	h.WaitMessage(rec, 'a')
+	c.Send([]byte("efghijk\n"))
+	h.WaitClose(rec, sess)
+	if rec.Count(stnettest.EventMessage) != 1 || fi.Stats().Closed != 1 {
+		t.Fatalf("messages %d, stats %+v", rec.Count(stnettest.EventMessage), fi.Stats())
+	}
+}
+
+func TestFaultCloseAll(t *testing.T) {
+	h := stnettest.New(t, 1)
+	s, rec := h.AddService("server", &lineImp{}, 0)
+	fi := stnet.NewFaultInjector(nil)
+	s.SetConnWrapper(fi.Wrap)
+	h.Start()
+	defer h.Stop()
+
+	c := h.Dial(s)
+	defer c.Close()
+	sess := h.WaitOpen(rec)
+	fi.CloseAll()
+	c.ExpectClosed()
+	h.WaitClose(rec, sess)
+}
+
+func TestFaultDropDatagram(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer pc.Close()
+	fi := stnet.NewFaultInjector(&stnet.FaultConfig{DropRate: 1})
+	wc := fi.Wrap(pc.(net.Conn)).(net.PacketConn)
+	for i := 0; i < 10; i++ {
+		if _, err := wc.WriteTo([]byte("x"), pc.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if fi.Stats().Dropped != 10 {
+		t.Fatalf("stats %+v", fi.Stats())
+	}
+	fi.Set(nil)
+	wc.WriteTo([]byte("y"), pc.LocalAddr())
+	b := make([]byte, 8)
+	pc.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := pc.ReadFrom(b)
+	if err != nil || string(b[:n]) != "y" {
+		t.Fatalf("read %q %v", b[:n], err)
+	}
+}
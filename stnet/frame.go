@@ -0,0 +1,243 @@
+package stnet
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+// Frames of ServiceSpb ServiceJson and ServiceRpc are [header][body], the header of DefaultFrameCodec is 4 bytes:
+//
+//	byte 0:   flags and version
+//	          0x01 response of ServiceRpc      0x02 rpc call of ServiceRpc
+//	          0x04 body is compressed          0x08 body is encrypted
+//	          0x10 body is json encoded(since version 1)
+//	          0x60 version(2 bits)
+//	          0x80 control frame, it is handled by stnet and never passed to imp
+//	byte 1-3: length of the frame including header, big endian
+//
+// body of JsonProto(ServiceSpb ServiceJson) is encoded JsonProto, body of ServiceRpc is ReqProto or RspProto in spb.
+// compressed body is [compressor id(1 byte)][compressed data], encrypted body is sealed by AES-GCM.
+// json frames of version 0 have no 0x10, json services of older stnet read byte 0 as a part of length and can not accept it.
+// frames of version 1 are accepted, they will be sent when FrameVersion is 1.
+const (
+	FrameFlagResponse   = 0x01
+	FrameFlagRpc        = 0x02
+	FrameFlagCompressed = 0x04
+	FrameFlagEncrypted  = 0x08
+	FrameFlagControl    = 0x80
+
+	frameFlagJson      = 0x10
+	frameVersionMask   = 0x60
+	frameVersionShift  = 5
+	frameVersionMax    = 1 //highest version accepted
+	frameVersionJson   = 1 //first version with frameFlagJson
+	frameFlagsMask     = FrameFlagResponse | FrameFlagRpc | FrameFlagCompressed | FrameFlagEncrypted | FrameFlagControl
+	defaultHeaderLen   = 4
+	defaultMaxFrameLen = 1<<24 - 1
+)
+
+// FrameVersion is the version of frames sent, frames of version higher than 1 are rejected.
+// it will be 1 when all peers accept frames of version 1.
+const FrameVersion = 0
+
+var ErrFrameVersion = errors.New("frame version is not supported")
+
+// FrameHeader is the header of a frame, it is independent of how it is encoded by FrameCodec.
+type FrameHeader struct {
+	Length   int  //length of the frame including header
+	Flags    byte //FrameFlagResponse FrameFlagRpc FrameFlagCompressed FrameFlagEncrypted FrameFlagControl
+	Encoding int  //EncodeTyepSpb or EncodeTyepJson, encoding of the frame, not the codec of payload(Service.SetCodec)
+	Version  int
+}
+
+// FrameCodec encodes frame header, the default is DefaultFrameCodec.
+// services could use their own header by Service.SetFrameCodec, both sides must use the same codec.
+type FrameCodec interface {
+	HeaderLen() int
+	PutHeader(b []byte, h *FrameHeader) error  //b is HeaderLen bytes
+	ParseHeader(b []byte) (FrameHeader, error) //b is HeaderLen bytes
+}
+
+type stdFrameCodec struct{}
+
+// DefaultFrameCodec is the 4 bytes header described above.
+var DefaultFrameCodec FrameCodec = stdFrameCodec{}
+
+func (stdFrameCodec) HeaderLen() int {
+	return defaultHeaderLen
+}
+
+func (stdFrameCodec) PutHeader(b []byte, h *FrameHeader) error {
+	if h.Length > defaultMaxFrameLen {
+		return fmt.Errorf("msg is too long: %d,max size is %d", h.Length, defaultMaxFrameLen)
+	}
+	if h.Version < 0 || h.Version > frameVersionMask>>frameVersionShift {
+		return ErrFrameVersion
+	}
+	b[0] = h.Flags&frameFlagsMask | byte(h.Version<<frameVersionShift)
+	if h.Encoding == EncodeTyepJson && h.Version >= frameVersionJson {
+		b[0] |= frameFlagJson
+	}
+	b[1] = byte(h.Length >> 16)
+	b[2] = byte(h.Length >> 8)
+	b[3] = byte(h.Length)
+	return nil
+}
+
+func (stdFrameCodec) ParseHeader(b []byte) (FrameHeader, error) {
+	h := FrameHeader{
+		Length:  int(MsgLen(b)),
+		Flags:   b[0] & frameFlagsMask,
+		Version: int(b[0]&frameVersionMask) >> frameVersionShift,
+	}
+	if b[0]&frameFlagJson != 0 {
+		h.Encoding = EncodeTyepJson
+	}
+	if h.Version > frameVersionMax {
+		return h, ErrFrameVersion
+	}
+	return h, nil
+}
+
+// MsgLen return length of frame in header of DefaultFrameCodec.
+func MsgLen(b []byte) uint32 {
+	return uint32(b[3]) | uint32(b[2])<<8 | uint32(b[1])<<16
+}
+
+// SetFrameCodec set header codec of frames of ServiceSpb ServiceJson and ServiceRpc, nil means DefaultFrameCodec.
+// it should be called before the server starts.
+func (service *Service) SetFrameCodec(c FrameCodec) {
+	if c == nil {
+		c = DefaultFrameCodec
+	}
+	service.codec.Store(codecHolder{c})
+}
+
+type codecHolder struct {
+	c FrameCodec
+}
+
+func (service *Service) frameCodec() FrameCodec {
+	if h, ok := service.codec.Load().(codecHolder); ok {
+		return h.c
+	}
+	return DefaultFrameCodec
+}
+
+func (s *Session) frameCodec() FrameCodec {
+	if s != nil {
+		if svc := sessionService(s); svc != nil {
+			return svc.frameCodec()
+		}
+	}
+	return DefaultFrameCodec
+}
+
+func encodeFrame(codec FrameCodec, h FrameHeader, body []byte) ([]byte, error) {
+	hl := codec.HeaderLen()
+	h.Length = hl + len(body)
+	if h.Length >= MaxMsgSize {
+		return nil, fmt.Errorf("msg is too long: %d,max size is %d", h.Length, MaxMsgSize)
+	}
+	buf := make([]byte, h.Length)
+	if err := codec.PutHeader(buf[:hl], &h); err != nil {
+		return nil, err
+	}
+	copy(buf[hl:], body)
+	return buf, nil
+}
+
+// sendFrame encode msg into frame with codec of the session, body is compressed if it is negotiated.
+func sendFrame(sess *Session, peer net.Addr, flags byte, msg interface{}, encode int) error {
+	data, e := Marshal(msg, encode)
+	if e != nil {
+		return e
+	}
+	return sendFrameBody(sess, peer, FrameHeader{Flags: flags, Encoding: encode, Version: FrameVersion}, data)
+}
+
+func sendFrameBody(sess *Session, peer net.Addr, h FrameHeader, body []byte) error {
+	body = sess.compressBody(&h, body)
+	buf, e := encodeFrame(sess.frameCodec(), h, body)
+	if e != nil {
+		return e
+	}
+	return sess.Send(buf, peer)
+}
+
+func (s *Session) controlFrame(body []byte) []byte {
+	buf, _ := encodeFrame(s.frameCodec(), FrameHeader{Flags: FrameFlagControl, Version: FrameVersion}, body)
+	return buf
+}
+
+// readFrame parse frame of ServiceSpb ServiceJson and ServiceRpc, frameLen is 0 if data is not enough.
+// control frames are handled here(h.Flags has FrameFlagControl), encrypted body is decrypted and compressed body is decompressed.
+// session is closed if key exchange or decryption failed. sess could be nil when frame is only decoded.
+func readFrame(sess *Session, data []byte) (frameLen int, h FrameHeader, body []byte, err error) {
+	codec := sess.frameCodec()
+	hl := codec.HeaderLen()
+	if len(data) < hl {
+		return 0, h, nil, nil
+	}
+	if h, err = codec.ParseHeader(data[:hl]); err != nil {
+		return len(data), h, nil, err
+	}
+	n := h.Length
+	if n < hl || n >= MaxMsgSize {
+		return len(data), h, nil, fmt.Errorf("message length is invalid: %d", n)
+	}
+	if len(data) < n {
+		return 0, h, nil, nil
+	}
+
+	body = data[hl:n]
+	if h.Flags&FrameFlagControl != 0 {
+		if sess != nil && len(body) > 0 {
+			err = sess.handleControl(body)
+		}
+		return n, h, nil, err
+	}
+	if sess != nil {
+		if c := sess.cryptState(); c != nil {
+			if h.Flags&FrameFlagEncrypted == 0 {
+				sess.Close()
+				return n, h, nil, ErrNotEncrypted
+			}
+			if body, err = c.open(&h, body); err != nil {
+				sess.Close()
+				return n, h, nil, err
+			}
+			sess.recordFrame(codec, h, body)
+		}
+	}
+	if h.Flags&FrameFlagEncrypted != 0 {
+		return n, h, nil, ErrHandshakeNotReady
+	}
+	if h.Flags&FrameFlagCompressed != 0 {
+		if body, err = decompressBody(body); err != nil {
+			return n, h, nil, err
+		}
+		h.Flags &^= FrameFlagCompressed
+	}
+	return n, h, body, nil
+}
+
+func (s *Session) handleControl(body []byte) error {
+	var err error
+	switch body[0] {
+	case ctrlCompressHello:
+		s.negotiateCompress(body[1:])
+	case ctrlKeyExchange:
+		err = ErrHandshakeFailed
+		if c := s.cryptState(); c != nil {
+			err = c.keyExchange(body[1:])
+		}
+	case ctrlCodecHello:
+		err = s.checkCodec(body[1:])
+	} //unknown control frames are ignored
+	if err != nil {
+		s.Close()
+	}
+	return err
+}
@@ -0,0 +1,144 @@
+package stnet_test
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/greedchase/gotools/stnet"
+	"github.com/greedchase/gotools/stnet/stnettest"
+)
+
+func TestFrameHeader(t *testing.T) {
+	codec := stnet.DefaultFrameCodec
+	for _, h := range []stnet.FrameHeader{
+		{Length: 4},
+		{Length: 300000, Flags: stnet.FrameFlagRpc | stnet.FrameFlagResponse},
+		{Length: 1<<24 - 1, Flags: stnet.FrameFlagCompressed | stnet.FrameFlagEncrypted, Encoding: stnet.EncodeTyepJson, Version: 1},
+		{Length: 1 << 20, Flags: stnet.FrameFlagControl},
+	} {
+		b := make([]byte, codec.HeaderLen())
+		if err := codec.PutHeader(b, &h); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := codec.ParseHeader(b); err != nil || got != h {
+			t.Fatalf("header %+v != %+v, %v", got, h, err)
+		}
+		if int(stnet.MsgLen(b)) != h.Length {
+			t.Fatalf("MsgLen %d != %d", stnet.MsgLen(b), h.Length)
+		}
+	}
+
+	b := make([]byte, 4)
+	if err := codec.PutHeader(b, &stnet.FrameHeader{Length: 1 << 24}); err == nil {
+		t.Fatal("too long frame is encoded")
+	}
+	//json flag is not sent in version 0 frames
+	if err := codec.PutHeader(b, &stnet.FrameHeader{Length: 4, Encoding: stnet.EncodeTyepJson}); err != nil || b[0] != 0 {
+		t.Fatalf("byte 0 of json frame is %x, %v", b[0], err)
+	}
+	b[0] = 0x40 //version 2
+	if _, err := codec.ParseHeader(b); err != stnet.ErrFrameVersion {
+		t.Fatalf("version is not checked: %v", err)
+	}
+}
+
+func TestEncodeProtocolLarge(t *testing.T) {
+	for _, n := range []int{0, 1000, 300000, 900000} {
+		frame, err := stnet.EncodeProtocol(stnet.JsonProto{CmdId: 1, CmdData: make([]byte, n)}, stnet.EncodeTyepSpb)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int(stnet.MsgLen(frame)) != len(frame) || frame[0] != 0 {
+			t.Fatalf("frame of %d bytes has length %d", len(frame), stnet.MsgLen(frame))
+		}
+	}
+	frame, _ := stnet.EncodeProtocol(stnet.JsonProto{CmdId: 1}, stnet.EncodeTyepJson)
+	if int(stnet.MsgLen(frame)) != len(frame) || frame[0] != 0 {
+		t.Fatalf("json frame of %d bytes has length %d, byte 0 %x", len(frame), stnet.MsgLen(frame), frame[0])
+	}
+	if _, err := stnet.EncodeProtocol(stnet.JsonProto{CmdData: make([]byte, stnet.MaxMsgSize)}, stnet.EncodeTyepSpb); err == nil {
+		t.Fatal("frame larger than MaxMsgSize is encoded")
+	}
+}
+
+type echoSpbImp struct{}
+
+func (imp *echoSpbImp) Init() bool { return true }
+func (imp *echoSpbImp) Loop()      {}
+func (imp *echoSpbImp) Handle(current *stnet.CurrentContent, cmdId uint64, cmd interface{}, e error) {
+	if e == nil {
+		stnet.SendSpbCmd(current.Sess, cmdId, *cmd.(*spbInner))
+	}
+}
+func (imp *echoSpbImp) HashProcessor(current *stnet.CurrentContent, cmdId uint64) int { return 0 }
+
+func TestSpbLargeFrame(t *testing.T) {
+	h := stnettest.New(t, 1)
+	imp := stnet.NewServiceSpb(&echoSpbImp{})
+	imp.RegisterMsg(1, spbInner{})
+	s, rec := h.AddService("spb", imp, 0)
+	h.Start()
+	defer h.Stop()
+
+	c := h.Dial(s)
+	defer c.Close()
+	for _, n := range []int{10, 70000, 300000, 900000} {
+		in := spbInner{strings.Repeat("x", n), float64(n)}
+		c.SendSpb(1, in)
+		var out spbInner
+		if id := c.ReadSpb(&out); id != 1 || out != in {
+			t.Fatalf("echo of %d bytes failed", n)
+		}
+	}
+	if rec.Count(stnettest.EventError) > 0 {
+		t.Fatal("error occurs")
+	}
+}
+
+// magicCodec is [magic(4 bytes)][flags(1 byte)][encoding(1 byte)][length(4 bytes)].
+type magicCodec struct{}
+
+func (magicCodec) HeaderLen() int { return 10 }
+
+func (magicCodec) PutHeader(b []byte, h *stnet.FrameHeader) error {
+	copy(b, "STNT")
+	b[4] = h.Flags
+	b[5] = byte(h.Encoding)
+	binary.BigEndian.PutUint32(b[6:], uint32(h.Length))
+	return nil
+}
+
+func (magicCodec) ParseHeader(b []byte) (stnet.FrameHeader, error) {
+	if string(b[:4]) != "STNT" {
+		return stnet.FrameHeader{}, errors.New("bad magic")
+	}
+	return stnet.FrameHeader{Length: int(binary.BigEndian.Uint32(b[6:])), Flags: b[4], Encoding: int(b[5])}, nil
+}
+
+func TestRpcFrameCodec(t *testing.T) {
+	h := stnettest.New(t, 2)
+	defer h.Stop()
+	ss, srec := h.AddService("server", stnet.NewServiceRpc(&arith{}), 0)
+	cli := stnet.NewServiceRpc(&arith{})
+	cs, crec := h.AddClientService("client", cli, 1)
+	for _, s := range []*stnet.Service{ss, cs} {
+		s.SetFrameCodec(magicCodec{})
+		s.SetEncryption(&stnet.EncryptOptions{Mode: stnet.EncryptECDH})
+		s.SetCompression(&stnet.CompressOptions{Algorithms: []string{"deflate"}})
+	}
+	conn := cs.NewConnectWithPolicy(h.Addr("server"), nil, fastPolicy())
+	h.Start()
+	h.WaitOpen(srec)
+	h.WaitOpen(crec)
+
+	words := []string{strings.Repeat("a", 1000000), "b"}
+	s := ""
+	if err := cli.RpcCall_Sync(conn.Session(), "Concat", words, "-", func(r string) { s = r }, nil); err != nil {
+		t.Fatal(err)
+	}
+	if s != strings.Join(words, "-") {
+		t.Fatalf("Concat returns %d bytes", len(s))
+	}
+}
@@ -0,0 +1,242 @@
+package stnet
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// SessionGroup is a named set of sessions(room, channel...), session is removed automatically when it is closed.
+type SessionGroup struct {
+	name  string
+	mutex sync.RWMutex
+	sess  map[uint64]*Session
+}
+
+func newSessionGroup(name string) *SessionGroup {
+	return &SessionGroup{name: name, sess: make(map[uint64]*Session)}
+}
+
+func (g *SessionGroup) Name() string {
+	return g.name
+}
+
+// Join add session into group, ErrSocketClosed is returned if the session is closed.
+func (g *SessionGroup) Join(sess *Session) error {
+	sess.groupMutex.Lock()
+	defer sess.groupMutex.Unlock()
+	if sess.IsClose() {
+		return ErrSocketClosed
+	}
+	if sess.groups == nil {
+		sess.groups = make(map[*SessionGroup]struct{})
+	}
+	sess.groups[g] = struct{}{}
+
+	g.mutex.Lock()
+	g.sess[sess.GetID()] = sess
+	g.mutex.Unlock()
+	return nil
+}
+
+func (g *SessionGroup) Leave(sess *Session) {
+	sess.groupMutex.Lock()
+	delete(sess.groups, g)
+	sess.groupMutex.Unlock()
+	g.remove(sess)
+}
+
+func (g *SessionGroup) remove(sess *Session) {
+	g.mutex.Lock()
+	delete(g.sess, sess.GetID())
+	g.mutex.Unlock()
+}
+
+func (g *SessionGroup) Contains(sess *Session) bool {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+	_, ok := g.sess[sess.GetID()]
+	return ok
+}
+
+func (g *SessionGroup) Len() int {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+	return len(g.sess)
+}
+
+func (g *SessionGroup) IterateSession(callback func(*Session) bool) {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+	for _, s := range g.sess {
+		if !callback(s) {
+			break
+		}
+	}
+}
+
+func (g *SessionGroup) sessions() []*Session {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+	ss := make([]*Session, 0, len(g.sess))
+	for _, s := range g.sess {
+		ss = append(ss, s)
+	}
+	return ss
+}
+
+// broadcastParallelSize sessions sent by a goroutine when broadcasting in parallel
+var broadcastParallelSize = 256
+
+// Broadcast send frame to all sessions of the group, frame is shared by sessions and should not be modified after calling.
+// when parallel is true, sessions are split and sent by multiple goroutines.
+// it returns number of sessions the frame is pushed to.
+func (g *SessionGroup) Broadcast(frame []byte, parallel bool) int {
+	return broadcastFrame(g.sessions(), frame, parallel)
+}
+
+func broadcastFrame(ss []*Session, frame []byte, parallel bool) int {
+	if !parallel || len(ss) <= broadcastParallelSize {
+		return broadcastShared(ss, frame)
+	}
+
+	var (
+		sent int64
+		wg   sync.WaitGroup
+	)
+	workers := runtime.NumCPU()
+	chunk := (len(ss) + workers - 1) / workers
+	if chunk < broadcastParallelSize {
+		chunk = broadcastParallelSize
+	}
+	for i := 0; i < len(ss); i += chunk {
+		end := i + chunk
+		if end > len(ss) {
+			end = len(ss)
+		}
+		wg.Add(1)
+		go func(part []*Session) {
+			atomic.AddInt64(&sent, int64(broadcastShared(part, frame)))
+			wg.Done()
+		}(ss[i:end])
+	}
+	wg.Wait()
+	return int(sent)
+}
+
+// broadcastEncoded send frame encoded for every service of sessions, sessions of a service share frame codec and codec.
+// encode is called once for each service with a session of it, sessions of failed encoding are skipped and the error is returned.
+func (g *SessionGroup) broadcastEncoded(parallel bool, encode func(sess *Session) ([]byte, error)) (int, error) {
+	parts := make(map[*Service][]*Session)
+	for _, s := range g.sessions() {
+		svc := sessionService(s)
+		parts[svc] = append(parts[svc], s)
+	}
+	var err error
+	n := 0
+	for _, ss := range parts {
+		frame, e := encode(ss[0])
+		if e != nil {
+			err = e
+			continue
+		}
+		n += broadcastFrame(ss, frame, parallel)
+	}
+	return n, err
+}
+
+func broadcastShared(ss []*Session, frame []byte) int {
+	n := 0
+	for _, s := range ss {
+		if s.sendShared(frame) == nil {
+			n++
+		}
+	}
+	return n
+}
+
+// BroadcastSpb send message to all sessions of the group like SendSpbCmd, msg is encoded by codec of the service of sessions
+// (Service.SetCodec) and frame is encoded by its frame codec(Service.SetFrameCodec), once for every service.
+// the frame is not compressed.
+func (g *SessionGroup) BroadcastSpb(msgID uint64, msg interface{}, parallel bool) (int, error) {
+	return g.broadcastEncoded(parallel, func(sess *Session) ([]byte, error) {
+		d, e := Marshal(msg, sess.msgEncoding())
+		if e != nil {
+			return nil, e
+		}
+		return encodeFrameMsg(sess.frameCodec(), JsonProto{msgID, d, ""}, EncodeTyepSpb)
+	})
+}
+
+// BroadcastJson send message to all sessions of the group like SendJsonCmd,
+// frame is encoded by frame codec of the service of sessions(Service.SetFrameCodec), once for every service.
+// the frame is not compressed.
+func (g *SessionGroup) BroadcastJson(msgID uint64, msg []byte, parallel bool) (int, error) {
+	return g.broadcastEncoded(parallel, func(sess *Session) ([]byte, error) {
+		return encodeFrameMsg(sess.frameCodec(), JsonProto{msgID, msg, ""}, EncodeTyepJson)
+	})
+}
+
+// leaveGroups is called when session closed.
+func (s *Session) leaveGroups() {
+	s.groupMutex.Lock()
+	groups := s.groups
+	s.groups = nil
+	s.groupMutex.Unlock()
+	for g := range groups {
+		g.remove(s)
+	}
+}
+
+// Groups returns names of groups the session joined.
+func (s *Session) Groups() []string {
+	s.groupMutex.Lock()
+	defer s.groupMutex.Unlock()
+	names := make([]string, 0, len(s.groups))
+	for g := range s.groups {
+		names = append(names, g.name)
+	}
+	return names
+}
+
+// Group returns the group named name, it is created if not exist.
+func (svr *Server) Group(name string) *SessionGroup {
+	svr.groupMutex.RLock()
+	g, ok := svr.groups[name]
+	svr.groupMutex.RUnlock()
+	if ok {
+		return g
+	}
+
+	svr.groupMutex.Lock()
+	defer svr.groupMutex.Unlock()
+	if g, ok = svr.groups[name]; !ok {
+		g = newSessionGroup(name)
+		svr.groups[name] = g
+	}
+	return g
+}
+
+// RemoveGroup remove the group and all sessions in it.
+func (svr *Server) RemoveGroup(name string) {
+	svr.groupMutex.Lock()
+	g, ok := svr.groups[name]
+	delete(svr.groups, name)
+	svr.groupMutex.Unlock()
+	if ok {
+		for _, s := range g.sessions() {
+			g.Leave(s)
+		}
+	}
+}
+
+// Broadcast send frame to all sessions of group, see SessionGroup.Broadcast.
+func (svr *Server) Broadcast(group string, frame []byte, parallel bool) int {
+	svr.groupMutex.RLock()
+	g, ok := svr.groups[group]
+	svr.groupMutex.RUnlock()
+	if !ok {
+		return 0
+	}
+	return g.Broadcast(frame, parallel)
+}
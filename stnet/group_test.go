@@ -0,0 +1,51 @@
+package stnet_test
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/greedchase/gotools/stnet"
+	"github.com/greedchase/gotools/stnet/stnettest"
+)
+
+func TestGroupBroadcastCodecs(t *testing.T) {
+	h := stnettest.New(t, 1)
+	plain, prec := h.AddService("plain", stnet.NewServiceSpb(&echoSpbImp{}), 0)
+	custom, crec := h.AddService("custom", stnet.NewServiceSpb(&echoSpbImp{}), 0)
+	if err := custom.SetCodec("gob"); err != nil {
+		t.Fatal(err)
+	}
+	custom.SetFrameCodec(magicCodec{})
+	h.Start()
+	defer h.Stop()
+
+	c1 := h.Dial(plain)
+	defer c1.Close()
+	c2 := h.Dial(custom)
+	defer c2.Close()
+	g := h.Server.Group("room")
+	g.Join(h.WaitOpen(prec))
+	g.Join(h.WaitOpen(crec))
+
+	in := spbInner{"broadcast", 3}
+	if n, err := g.BroadcastSpb(1, in, false); n != 2 || err != nil {
+		t.Fatalf("broadcast to %d sessions: %v", n, err)
+	}
+	var out spbInner
+	if id := c1.ReadSpb(&out); id != 1 || out != in {
+		t.Fatalf("plain session receives %d %v", id, out)
+	}
+
+	head := c2.Read(10)
+	if string(head[:4]) != "STNT" {
+		t.Fatalf("custom session receives header %q", head)
+	}
+	var cmd stnet.JsonProto
+	if err := stnet.Unmarshal(c2.Read(int(binary.BigEndian.Uint32(head[6:]))-10), &cmd, stnet.EncodeTyepSpb); err != nil {
+		t.Fatal(err)
+	}
+	out = spbInner{}
+	if err := stnet.Unmarshal(cmd.CmdData, &out, gobCodecID); err != nil || cmd.CmdId != 1 || out != in {
+		t.Fatalf("custom session receives %v %v", out, err)
+	}
+}
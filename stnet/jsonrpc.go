@@ -0,0 +1,304 @@
+package stnet
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+)
+
+// error codes of JSON-RPC 2.0
+const (
+	JsonRpcParseError     = -32700
+	JsonRpcInvalidRequest = -32600
+	JsonRpcMethodNotFound = -32601
+	JsonRpcInvalidParams  = -32602
+	JsonRpcInternalError  = -32603
+	JsonRpcServerError    = -32000 //error returned by method
+)
+
+// JsonRpcError is the error object of JSON-RPC 2.0.
+// methods could return it as the last result(type error) to set code and data, other errors are JsonRpcServerError.
+type JsonRpcError struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+func (e *JsonRpcError) Error() string {
+	return fmt.Sprintf("json rpc error %d: %s", e.Code, e.Message)
+}
+
+type jsonRpcRequest struct {
+	Version string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+	ID      json.RawMessage `json:"id"` //nil for notification
+}
+
+type jsonRpcResponse struct {
+	Version string          `json:"jsonrpc"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *JsonRpcError   `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+var (
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+	jsonRpcNull = json.RawMessage("null")
+)
+
+// ServiceJsonRpc serves JSON-RPC 2.0 with methods of imp, the same method set as ServiceRpc.
+// positional params(array) are decoded into params of method in order, named params(object) are accepted when the method has one param.
+// result is null if method returns nothing, the value if it returns one value, otherwise an array;
+// if the last return value is error and it is not nil, the response is error object.
+//
+// over tcp(AddJsonRpcService) every request and response is [length(4 bytes big endian, including itself)][json],
+// it is a frame of DefaultFrameCodec without flags, so compression, encryption and Service.SetFrameCodec are also available.
+// over http(AddJsonRpcHttpService or ServeHTTP) the request is POST with json body.
+// the first param of method could be *CurrentContent as ServiceRpc, it is not a param of request.
+type ServiceJsonRpc struct {
+	ServiceBase
+	imp     RpcService
+	methods map[string]reflect.Method
+}
+
+func NewServiceJsonRpc(imp RpcService) *ServiceJsonRpc {
+	return &ServiceJsonRpc{ServiceBase{}, imp, rpcMethods(imp)}
+}
+
+func (service *ServiceJsonRpc) Loop() {
+	service.imp.Loop()
+}
+
+func (service *ServiceJsonRpc) HandleMessage(current *CurrentContent, msgID uint64, msg interface{}) {
+	d, _ := msg.([]byte)
+	if rsp := service.Process(current, d); len(rsp) > 0 {
+		if err := sendFrameBody(current.Sess, current.Peer, FrameHeader{Version: FrameVersion}, rsp); err != nil {
+			sysLog.Error("send json rpc response failed: %s", err.Error())
+		}
+	}
+}
+
+func (service *ServiceJsonRpc) HandleError(current *CurrentContent, err error) {
+	service.imp.HandleError(current, err)
+}
+
+func (service *ServiceJsonRpc) Unmarshal(sess *Session, data []byte) (lenParsed int, msgID int64, msg interface{}, err error) {
+	msgLen, h, body, e := readFrame(sess, data)
+	if msgLen == 0 || e != nil {
+		return msgLen, 0, nil, e
+	}
+	if h.Flags&FrameFlagControl != 0 {
+		return msgLen, -1, nil, nil
+	}
+	return msgLen, 0, body, nil
+}
+
+func (service *ServiceJsonRpc) HashProcessor(current *CurrentContent, msgID uint64, msg interface{}) (processorID int) {
+	return service.imp.HashProcessor(current)
+}
+
+// Process handle request or batch in data and return the response, nil if there is no response(notifications).
+// current is passed to methods whose first param is *CurrentContent.
+func (service *ServiceJsonRpc) Process(current *CurrentContent, data []byte) []byte {
+	data = bytes.TrimSpace(data)
+	var rsp interface{}
+	if len(data) > 0 && data[0] == '[' {
+		var batch []json.RawMessage
+		if err := json.Unmarshal(data, &batch); err != nil {
+			rsp = jsonRpcFail(jsonRpcNull, JsonRpcParseError, err.Error())
+		} else if len(batch) == 0 {
+			rsp = jsonRpcFail(jsonRpcNull, JsonRpcInvalidRequest, "empty batch")
+		} else {
+			rsps := make([]*jsonRpcResponse, 0, len(batch))
+			for _, d := range batch {
+				if r := service.processOne(current, d); r != nil {
+					rsps = append(rsps, r)
+				}
+			}
+			if len(rsps) == 0 {
+				return nil
+			}
+			rsp = rsps
+		}
+	} else if r := service.processOne(current, data); r != nil {
+		rsp = r
+	} else {
+		return nil
+	}
+
+	b, err := json.Marshal(rsp)
+	if err != nil {
+		sysLog.Error("json rpc response marshal failed: %s", err.Error())
+		b, _ = json.Marshal(jsonRpcFail(jsonRpcNull, JsonRpcInternalError, err.Error()))
+	}
+	return b
+}
+
+func jsonRpcFail(id json.RawMessage, code int, msg string) *jsonRpcResponse {
+	return &jsonRpcResponse{Version: "2.0", Error: &JsonRpcError{Code: code, Message: msg}, ID: id}
+}
+
+// processOne return nil for notification.
+func (service *ServiceJsonRpc) processOne(current *CurrentContent, data []byte) *jsonRpcResponse {
+	var req jsonRpcRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		if _, ok := err.(*json.SyntaxError); ok {
+			return jsonRpcFail(jsonRpcNull, JsonRpcParseError, err.Error())
+		}
+		return jsonRpcFail(jsonRpcNull, JsonRpcInvalidRequest, err.Error())
+	}
+	id := req.ID
+	if id == nil {
+		id = jsonRpcNull
+	}
+	if req.Version != "2.0" || req.Method == "" {
+		return jsonRpcFail(id, JsonRpcInvalidRequest, "invalid request")
+	}
+
+	result, rpcErr := service.call(current, &req)
+	if req.ID == nil {
+		return nil
+	}
+	if rpcErr != nil {
+		return &jsonRpcResponse{Version: "2.0", Error: rpcErr, ID: id}
+	}
+	if result == nil {
+		result = jsonRpcNull
+	}
+	return &jsonRpcResponse{Version: "2.0", Result: result, ID: id}
+}
+
+func (service *ServiceJsonRpc) params(current *CurrentContent, m reflect.Method, raw json.RawMessage) ([]reflect.Value, error) {
+	funcT := m.Type
+	first := 1 //first parameter passed by caller
+	if funcT.NumIn() > 1 && funcT.In(1) == currentContentType {
+		first = 2
+	}
+	n := funcT.NumIn() - first
+	var items []json.RawMessage
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 || bytes.Equal(raw, jsonRpcNull) {
+		items = nil
+	} else if raw[0] == '{' {
+		if n != 1 {
+			return nil, fmt.Errorf("named params need method with one param")
+		}
+		items = []json.RawMessage{raw}
+	} else if err := json.Unmarshal(raw, &items); err != nil {
+		return nil, err
+	}
+	if len(items) != n {
+		return nil, fmt.Errorf("%s needs %d params, got %d", m.Name, n, len(items))
+	}
+
+	vals := make([]reflect.Value, funcT.NumIn())
+	vals[0] = reflect.ValueOf(service.imp)
+	if first == 2 {
+		vals[1] = reflect.ValueOf(current)
+	}
+	for i := first; i < funcT.NumIn(); i++ {
+		t := funcT.In(i)
+		val := newValByType(t)
+		if err := json.Unmarshal(items[i-first], val.Interface()); err != nil {
+			return nil, fmt.Errorf("param %d: %s", i-first, err.Error())
+		}
+		if t.Kind() == reflect.Ptr {
+			vals[i] = val
+		} else {
+			vals[i] = val.Elem()
+		}
+	}
+	return vals, nil
+}
+
+func (service *ServiceJsonRpc) call(current *CurrentContent, req *jsonRpcRequest) (result interface{}, rpcErr *JsonRpcError) {
+	m, ok := service.methods[req.Method]
+	if !ok {
+		return nil, &JsonRpcError{Code: JsonRpcMethodNotFound, Message: "method not found: " + req.Method}
+	}
+	vals, err := service.params(current, m, req.Params)
+	if err != nil {
+		return nil, &JsonRpcError{Code: JsonRpcInvalidParams, Message: err.Error()}
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			sysLog.Error("json rpc %s panic: %v", req.Method, r)
+			result, rpcErr = nil, &JsonRpcError{Code: JsonRpcInternalError, Message: fmt.Sprint(r)}
+		}
+	}()
+	returns := m.Func.Call(vals)
+
+	if n := len(returns); n > 0 && m.Type.Out(n-1) == errorType {
+		if e, _ := returns[n-1].Interface().(error); e != nil {
+			if je, ok := e.(*JsonRpcError); ok {
+				return nil, je
+			}
+			return nil, &JsonRpcError{Code: JsonRpcServerError, Message: e.Error()}
+		}
+		returns = returns[:n-1]
+	}
+	switch len(returns) {
+	case 0:
+		return nil, nil
+	case 1:
+		return returns[0].Interface(), nil
+	}
+	rs := make([]interface{}, len(returns))
+	for i, v := range returns {
+		rs[i] = v.Interface()
+	}
+	return rs, nil
+}
+
+// ServeHTTP serve JSON-RPC over http POST, it could be registered into HttpHandler.
+// methods get empty current from it, AddJsonRpcHttpService passes current of the request.
+func (service *ServiceJsonRpc) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	service.serveHTTP(&CurrentContent{}, w, r)
+}
+
+func (service *ServiceJsonRpc) serveHTTP(current *CurrentContent, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		w.Header().Set("Content-Length", "0")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write(nil)
+		return
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, int64(MaxMsgSize)))
+	if err != nil {
+		w.Header().Set("Content-Length", "0")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(nil)
+		return
+	}
+	rsp := service.Process(current, data)
+	if rsp == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(rsp)
+}
+
+// jsonRpcHttp is HttpService of ServiceJsonRpc.
+type jsonRpcHttp struct {
+	rpc *ServiceJsonRpc
+}
+
+func (h jsonRpcHttp) Init() bool { return true }
+func (h jsonRpcHttp) Loop()      { h.rpc.Loop() }
+func (h jsonRpcHttp) HandleError(current *CurrentContent, e error) {
+	h.rpc.HandleError(current, e)
+}
+func (h jsonRpcHttp) HashProcessor(current *CurrentContent, req *http.Request) (processorID int) {
+	return h.rpc.imp.HashProcessor(current)
+}
+func (h jsonRpcHttp) Handle(current *CurrentContent, req *http.Request) {
+	h.rpc.serveHTTP(current, &httpWriter{current: current, header: make(http.Header)}, req)
+}
@@ -0,0 +1,148 @@
+package stnet_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/greedchase/gotools/stnet"
+	"github.com/greedchase/gotools/stnet/stnettest"
+)
+
+type jsonArith struct {
+	arith
+}
+
+func (a *jsonArith) Sqrt(n int) (int, error) {
+	if n < 0 {
+		return 0, errors.New("negative")
+	}
+	r := 0
+	for (r+1)*(r+1) <= n {
+		r++
+	}
+	return r, nil
+}
+
+func (a *jsonArith) Check(n int) error {
+	if n != 0 {
+		return &stnet.JsonRpcError{Code: 7, Message: "not zero", Data: n}
+	}
+	return nil
+}
+
+func (a *jsonArith) Session(current *stnet.CurrentContent, x int) (bool, int) {
+	return current.Sess != nil, x
+}
+
+func TestJsonRpcProcess(t *testing.T) {
+	imp := &jsonArith{arith{make(chan string, 1)}}
+	svc := stnet.NewServiceJsonRpc(imp)
+	cases := []struct{ req, rsp string }{
+		{`{"jsonrpc":"2.0","method":"Add","params":[1,2],"id":1}`, `{"jsonrpc":"2.0","result":3,"id":1}`},
+		{`{"jsonrpc":"2.0","method":"Div","params":[17,5],"id":"a"}`, `{"jsonrpc":"2.0","result":[3,2],"id":"a"}`},
+		{`{"jsonrpc":"2.0","method":"Sqrt","params":[10],"id":2}`, `{"jsonrpc":"2.0","result":3,"id":2}`},
+		{`{"jsonrpc":"2.0","method":"Sqrt","params":[-1],"id":3}`, `{"jsonrpc":"2.0","error":{"code":-32000,"message":"negative"},"id":3}`},
+		{`{"jsonrpc":"2.0","method":"Check","params":{"x":1},"id":4}`, `{"jsonrpc":"2.0","error":{"code":-32602,"message":"param 0: json: cannot unmarshal object into Go value of type int"},"id":4}`},
+		{`{"jsonrpc":"2.0","method":"Check","params":[1],"id":5}`, `{"jsonrpc":"2.0","error":{"code":7,"message":"not zero","data":1},"id":5}`},
+		{`{"jsonrpc":"2.0","method":"Check","params":[0],"id":6}`, `{"jsonrpc":"2.0","result":null,"id":6}`},
+		{`{"jsonrpc":"2.0","method":"Nope","id":7}`, `{"jsonrpc":"2.0","error":{"code":-32601,"message":"method not found: Nope"},"id":7}`},
+		{`{"jsonrpc":"2.0","method":"Loop","id":7}`, `{"jsonrpc":"2.0","error":{"code":-32601,"message":"method not found: Loop"},"id":7}`},
+		{`{"jsonrpc":"2.0","method":"HashProcessor","params":[null],"id":7}`, `{"jsonrpc":"2.0","error":{"code":-32601,"message":"method not found: HashProcessor"},"id":7}`},
+		{`{"jsonrpc":"2.0","method":"Add","params":[1],"id":8}`, `{"jsonrpc":"2.0","error":{"code":-32602,"message":"Add needs 2 params, got 1"},"id":8}`},
+		{`{"jsonrpc":"2.0","method":"Session","params":[5],"id":8}`, `{"jsonrpc":"2.0","result":[false,5],"id":8}`},
+		{`{"jsonrpc":"2.0","method":"Session","params":[5,6],"id":8}`, `{"jsonrpc":"2.0","error":{"code":-32602,"message":"Session needs 1 params, got 2"},"id":8}`},
+		{`{"method":"Add","id":9}`, `{"jsonrpc":"2.0","error":{"code":-32600,"message":"invalid request"},"id":9}`},
+		{`{"jsonrpc":"2.0","method"`, `{"jsonrpc":"2.0","error":{"code":-32700,"message":"unexpected end of JSON input"},"id":null}`},
+		{`[]`, `{"jsonrpc":"2.0","error":{"code":-32600,"message":"empty batch"},"id":null}`},
+		{`[{"jsonrpc":"2.0","method":"Add","params":[1,1],"id":1},{"jsonrpc":"2.0","method":"Notify","params":["hi"]},1]`,
+			`[{"jsonrpc":"2.0","result":2,"id":1},{"jsonrpc":"2.0","error":{"code":-32600,"message":"json: cannot unmarshal number into Go value of type stnet.jsonRpcRequest"},"id":null}]`},
+	}
+	for _, c := range cases {
+		if rsp := string(svc.Process(&stnet.CurrentContent{}, []byte(c.req))); rsp != c.rsp {
+			t.Errorf("%s\n got %s\nwant %s", c.req, rsp, c.rsp)
+		}
+	}
+	if msg := <-imp.called; msg != "hi" {
+		t.Fatalf("notification receives %q", msg)
+	}
+	if rsp := svc.Process(&stnet.CurrentContent{}, []byte(`{"jsonrpc":"2.0","method":"Notify","params":["again"]}`)); rsp != nil {
+		t.Fatalf("notification is responded: %s", rsp)
+	}
+	<-imp.called
+}
+
+func TestJsonRpcTcp(t *testing.T) {
+	h := stnettest.New(t, 1)
+	s, rec := h.AddService("jsonrpc", stnet.NewServiceJsonRpc(&jsonArith{}), 0)
+	h.Start()
+	defer h.Stop()
+
+	c := h.Dial(s)
+	defer c.Close()
+	req := []byte(`{"jsonrpc":"2.0","method":"Concat","params":[["a","b"],"+"],"id":1}`)
+	frame := make([]byte, 4, 4+len(req))
+	binary.BigEndian.PutUint32(frame, uint32(4+len(req)))
+	c.Send(append(frame, req...))
+	if rsp := string(c.ReadFrame()[4:]); rsp != `{"jsonrpc":"2.0","result":"a+b","id":1}` {
+		t.Fatalf("response is %s", rsp)
+	}
+	req = []byte(`{"jsonrpc":"2.0","method":"Session","params":[5],"id":2}`)
+	binary.BigEndian.PutUint32(frame, uint32(4+len(req)))
+	c.Send(append(frame[:4], req...))
+	if rsp := string(c.ReadFrame()[4:]); rsp != `{"jsonrpc":"2.0","result":[true,5],"id":2}` {
+		t.Fatalf("response is %s", rsp)
+	}
+	if rec.Count(stnettest.EventError) > 0 {
+		t.Fatal("error occurs")
+	}
+}
+
+func TestJsonRpcHttp(t *testing.T) {
+	h := stnettest.New(t, 1)
+	addr := h.Addr("http")
+	if _, err := h.Server.AddJsonRpcHttpService("http", addr, 0, stnet.NewServiceJsonRpc(&jsonArith{}), 0); err != nil {
+		t.Fatal(err)
+	}
+	h.Start()
+	defer h.Stop()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, a string) (net.Conn, error) {
+			return stnet.DialMem(strings.TrimPrefix(addr, "mem://"))
+		},
+	}}
+	rsp, err := client.Post("http://stnet/rpc", "application/json", bytes.NewBufferString(`{"jsonrpc":"2.0","method":"Add","params":[40,2],"id":1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(rsp.Body)
+	rsp.Body.Close()
+	if rsp.StatusCode != 200 || string(body) != `{"jsonrpc":"2.0","result":42,"id":1}` {
+		t.Fatalf("response is %d %s", rsp.StatusCode, body)
+	}
+	rsp, err = client.Post("http://stnet/rpc", "application/json", bytes.NewBufferString(`{"jsonrpc":"2.0","method":"Session","params":[5],"id":2}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = ioutil.ReadAll(rsp.Body)
+	rsp.Body.Close()
+	if string(body) != `{"jsonrpc":"2.0","result":[true,5],"id":2}` {
+		t.Fatalf("response is %s", body)
+	}
+
+	rsp, err = client.Get("http://stnet/rpc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("GET returns %d", rsp.StatusCode)
+	}
+}
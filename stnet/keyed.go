@@ -0,0 +1,42 @@
+package stnet
+
+import (
+	"strconv"
+)
+
+// keyProcessorOf find the KeyProcessor of imp, the inner imp of ServiceSpb ServiceJson ServiceRpc and ServiceHttp is checked too.
+func keyProcessorOf(imp ServiceImp) KeyProcessor {
+	if p, ok := imp.(KeyProcessor); ok {
+		return p
+	}
+	if p, ok := innerImp(imp).(KeyProcessor); ok {
+		return p
+	}
+	return nil
+}
+
+func newProcessorRing(threadnum int) *hashRing {
+	nodes := make([]string, threadnum)
+	for i := range nodes {
+		nodes[i] = "processor" + strconv.Itoa(i)
+	}
+	return newHashRing(0, nodes)
+}
+
+// KeyProcessor return the processor thread which the key is mapped to by consistent hashing.
+// all messages and tasks of the same key are processed in the same thread one by one,
+// so state of the key can be used without lock.
+func (svr *Server) KeyProcessor(key string) int {
+	return svr.procRing.get(key)
+}
+
+// Post run fn in the processor thread of key(actor style), see KeyProcessor.
+func (svr *Server) Post(key string, fn func()) error {
+	return svr.postTask(svr.KeyProcessor(key), fn)
+}
+
+// PostProcessor run fn in processor thread, the rule of processorID is the same as ServiceImp.HashProcessor,
+// 0 means the thread of session's service, or thread 0 if sess is nil.
+func (svr *Server) PostProcessor(processorID int, sess *Session, fn func()) error {
+	return svr.postTask(svr.timerProcessor(sess, processorID), fn)
+}
@@ -0,0 +1,133 @@
+package stnet_test
+
+import (
+	"bytes"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/greedchase/gotools/stnet"
+	"github.com/greedchase/gotools/stnet/stnettest"
+)
+
+// goid return id of the current goroutine, processor threads are goroutines running until server stopped.
+func goid() string {
+	buf := make([]byte, 64)
+	buf = buf[:runtime.Stack(buf, false)]
+	return string(bytes.Fields(buf)[1])
+}
+
+// keyImp dispatch line messages by the key after the first byte, sessions are hashed to threads without key.
+type keyImp struct {
+	lineImp
+	svr     *stnet.Server
+	running map[string]*int32
+	mutex   sync.Mutex
+	threads map[string]string //key: goroutine
+	handled chan string
+	t       *testing.T
+}
+
+func (imp *keyImp) ProcessorKey(current *stnet.CurrentContent, msgID uint64, msg interface{}) string {
+	return string(msg.([]byte)[1:])
+}
+
+func (imp *keyImp) HashProcessor(current *stnet.CurrentContent, msgID uint64, msg interface{}) int {
+	return -1
+}
+
+func (imp *keyImp) HandleMessage(current *stnet.CurrentContent, msgID uint64, msg interface{}) {
+	key := string(msg.([]byte)[1:])
+	if atomic.AddInt32(imp.running[key], 1) != 1 {
+		imp.t.Errorf("messages of key %s are processed concurrently", key)
+	}
+	time.Sleep(100 * time.Microsecond)
+	if want := imp.svr.KeyProcessor(key); current.GoroutineID != want {
+		imp.t.Errorf("key %s is processed in thread %d, want %d", key, current.GoroutineID, want)
+	}
+	imp.mutex.Lock()
+	if th, ok := imp.threads[key]; ok && th != goid() {
+		imp.t.Errorf("key %s is processed in goroutine %s and %s", key, th, goid())
+	}
+	imp.threads[key] = goid()
+	imp.mutex.Unlock()
+	atomic.AddInt32(imp.running[key], -1)
+	imp.handled <- key
+}
+
+func TestKeyProcessor(t *testing.T) {
+	h := stnettest.New(t, 4)
+	keys := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+	procs := make(map[int]bool)
+	imp := &keyImp{svr: h.Server, running: make(map[string]*int32), threads: make(map[string]string), handled: make(chan string, 100), t: t}
+	for _, k := range keys {
+		imp.running[k] = new(int32)
+		procs[h.Server.KeyProcessor(k)] = true
+		if h.Server.KeyProcessor(k) != h.Server.KeyProcessor(k) {
+			t.Fatalf("key %s is mapped to different processors", k)
+		}
+	}
+	if len(procs) < 2 {
+		t.Fatal("keys are mapped to one processor")
+	}
+	addr := h.Addr("keyed")
+	if _, err := h.Server.AddService("keyed", addr, 0, imp, 0); err != nil {
+		t.Fatal(err)
+	}
+	h.Start()
+	defer h.Stop()
+
+	//sessions are hashed to different threads, but messages of a key are processed in its thread one by one
+	const clients, rounds = 3, 5
+	for i := 0; i < clients; i++ {
+		conn, err := stnet.DialMem(strings.TrimPrefix(addr, "mem://"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := &stnettest.Client{TB: t, Conn: conn, Timeout: h.Timeout}
+		defer c.Close()
+		var b bytes.Buffer
+		for r := 0; r < rounds; r++ {
+			for _, k := range keys {
+				b.WriteString("m" + k + "\n")
+			}
+		}
+		c.Send(b.Bytes())
+	}
+	for i := 0; i < clients*rounds*len(keys); i++ {
+		select {
+		case <-imp.handled:
+		case <-time.After(h.Timeout):
+			t.Fatalf("%d messages are handled, want %d", i, clients*rounds*len(keys))
+		}
+	}
+
+	//keys of the same processor are processed in the same goroutine
+	threads := make(map[int]string)
+	for _, k := range keys {
+		p := h.Server.KeyProcessor(k)
+		if th, ok := threads[p]; ok && th != imp.threads[k] {
+			t.Fatalf("processor %d runs in goroutine %s and %s", p, th, imp.threads[k])
+		}
+		threads[p] = imp.threads[k]
+	}
+
+	//Post runs fn in the thread processing messages of the key
+	for i, k := range keys {
+		ran := make(chan string, 1)
+		if err := h.Server.Post(k, func() { ran <- goid() }); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case th := <-ran:
+			if th != imp.threads[k] {
+				t.Fatalf("post %d of key %s runs in goroutine %s, want %s", i, k, th, imp.threads[k])
+			}
+		case <-time.After(h.Timeout):
+			t.Fatalf("post of key %s is not run", k)
+		}
+	}
+}
@@ -4,39 +4,76 @@ import (
 	"fmt"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Listener struct {
 	isclose   *Closer
+	network   string
 	address   string
 	lst       net.Listener
 	heartbeat uint32
-	isUdp     bool
-	udpConn   *net.UDPConn
+	isUdp     bool //datagram listener, udp or unixgram
+	udpConn   net.PacketConn
 	udpCh     chan int
 
 	sessMap      map[uint64]*Session
 	sessMapMutex sync.RWMutex
 	waitExit     sync.WaitGroup
+
+	proxyProto   int32                 //mode of PROXY protocol
+	proxyTrusted atomic.Value          //[]*net.IPNet, sources whose PROXY protocol header is parsed
+	proxyPending map[net.Conn]struct{} //connections waiting for PROXY protocol header
+	admission    admission
+	wrapper      atomic.Value //ConnWrapper
 }
 
 func NewListener(address string, msgparse MsgParse, heartbeat uint32) (*Listener, error) {
+	return newStreamListener("tcp", address, msgparse, heartbeat)
+}
+
+// NewUnixListener listen on unix domain socket(SOCK_STREAM), stale socket file left by a dead process will be removed.
+// address beginning with '@' is in the abstract namespace(linux only).
+func NewUnixListener(address string, msgparse MsgParse, heartbeat uint32) (*Listener, error) {
+	if err := removeStaleUnixSocket("unix", address); err != nil {
+		return nil, err
+	}
+	return newStreamListener("unix", address, msgparse, heartbeat)
+}
+
+// NewMemListener listen on in-process address(mem://name), connect it by Service.NewConnect("mem://name") or DialMem.
+func NewMemListener(name string, msgparse MsgParse, heartbeat uint32) (*Listener, error) {
+	return newStreamListener("mem", name, msgparse, heartbeat)
+}
+
+func newStreamListener(network, address string, msgparse MsgParse, heartbeat uint32) (*Listener, error) {
 	if msgparse == nil {
 		return nil, fmt.Errorf("MsgParse should not be nil")
 	}
 
-	ls, err := net.Listen("tcp", address)
+	var (
+		ls  net.Listener
+		err error
+	)
+	if network == "mem" {
+		ls, err = ListenMem(address)
+	} else {
+		ls, err = net.Listen(network, address)
+	}
 	if err != nil {
 		return nil, err
 	}
 
 	lis := &Listener{
 		isclose:   NewCloser(false),
+		network:   network,
 		address:   address,
 		lst:       ls,
 		heartbeat: heartbeat,
 		sessMap:   make(map[uint64]*Session),
+
+		proxyPending: make(map[net.Conn]struct{}),
 	}
 
 	lis.waitExit.Add(1)
@@ -48,24 +85,135 @@ func NewListener(address string, msgparse MsgParse, heartbeat uint32) (*Listener
 				break
 			}
 
-			lis.sessMapMutex.Lock()
-			if !lis.isclose.IsClose() {
-				lis.waitExit.Add(1)
-				sess, _ := NewSession(conn, msgparse, nil, func(con *Session) {
-					lis.sessMapMutex.Lock()
-					delete(lis.sessMap, con.id)
-					lis.waitExit.Done()
-					lis.sessMapMutex.Unlock()
-				}, heartbeat, false)
-				lis.sessMap[sess.id] = sess
+			conn = lis.wrap(conn)
+			if mode := atomic.LoadInt32(&lis.proxyProto); mode != ProxyProtocolOff {
+				lis.acceptProxy(conn, int(mode), msgparse)
+				continue
 			}
-			lis.sessMapMutex.Unlock()
+			lis.newSession(conn, msgparse)
 		}
 		lis.waitExit.Done()
 	}()
 	return lis, nil
 }
 
+func (ls *Listener) newSession(conn net.Conn, msgparse MsgParse) {
+	ip, err := ls.admit(conn, msgparse)
+	if err != nil {
+		sysLog.Error("connection is rejected: %s, remote addr: %s", err.Error(), conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+
+	ls.sessMapMutex.Lock()
+	defer ls.sessMapMutex.Unlock()
+	if ls.isclose.IsClose() {
+		conn.Close()
+		return
+	}
+	release, err := ls.admission.acquire(ip, len(ls.sessMap))
+	if err != nil {
+		sysLog.Error("connection is rejected: %s, remote addr: %s", err.Error(), conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+	ls.waitExit.Add(1)
+	sess, _ := NewSession(conn, msgparse, nil, func(con *Session) {
+		if release != nil {
+			release()
+		}
+		ls.sessMapMutex.Lock()
+		delete(ls.sessMap, con.id)
+		ls.waitExit.Done()
+		ls.sessMapMutex.Unlock()
+	}, ls.heartbeat, false)
+	ls.sessMap[sess.id] = sess
+}
+
+// acceptProxy read PROXY protocol header in another goroutine, so accepting will not be blocked by slow connection.
+// number of connections waiting for header is limited before the goroutine starts,
+// ip limits are checked after header is read, the ip is of the real client.
+func (ls *Listener) acceptProxy(conn net.Conn, mode int, msgparse MsgParse) {
+	ls.sessMapMutex.Lock()
+	if ls.isclose.IsClose() {
+		ls.sessMapMutex.Unlock()
+		conn.Close()
+		return
+	}
+	err := ls.admission.checkSessions(len(ls.sessMap) + len(ls.proxyPending))
+	if err == nil && len(ls.proxyPending) >= ProxyProtocolMaxPending {
+		err = fmt.Errorf("connections waiting for PROXY protocol header is over limit %d", ProxyProtocolMaxPending)
+	}
+	if err != nil {
+		ls.sessMapMutex.Unlock()
+		sysLog.Error("connection is rejected: %s, remote addr: %s", err.Error(), conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+	ls.proxyPending[conn] = struct{}{}
+	ls.waitExit.Add(1)
+	ls.sessMapMutex.Unlock()
+
+	go func() {
+		defer ls.waitExit.Done()
+		pc, err := newProxyConn(conn, mode, ls.proxyTrustedBy(conn.RemoteAddr()))
+
+		ls.sessMapMutex.Lock()
+		delete(ls.proxyPending, conn)
+		ls.sessMapMutex.Unlock()
+
+		if err != nil {
+			sysLog.Error("read PROXY protocol header failed: %s, remote addr: %s", err.Error(), conn.RemoteAddr())
+			conn.Close()
+			return
+		}
+		ls.newSession(pc, msgparse)
+	}()
+}
+
+// SetConnWrapper wraps connections accepted later(a new socket of udp listener), example FaultInjector.Wrap; nil means no wrapper.
+func (ls *Listener) SetConnWrapper(w ConnWrapper) {
+	ls.wrapper.Store(w)
+}
+
+func (ls *Listener) wrap(conn net.Conn) net.Conn {
+	if w, _ := ls.wrapper.Load().(ConnWrapper); w != nil {
+		return w(conn)
+	}
+	return conn
+}
+
+// SetProxyProtocol set mode of parsing PROXY protocol header(v1 and v2) before data is handed to MsgParse,
+// then Session.RemoteAddr returns address of the real client. It only works on stream listener(tcp or unix).
+// mode: ProxyProtocolOff ProxyProtocolOptional ProxyProtocolRequired
+// any client reaching the listener could set its address by a header, so set trusted sources by SetProxyTrusted
+// unless the listener is only reachable by load balancers.
+func (ls *Listener) SetProxyProtocol(mode int) {
+	atomic.StoreInt32(&ls.proxyProto, int32(mode))
+}
+
+// SetProxyTrusted set ip or CIDR of load balancers, PROXY protocol header is only parsed from them.
+// connections from other sources are plain connections in ProxyProtocolOptional mode and closed in ProxyProtocolRequired mode,
+// so admission and rate limits of ip work on their own address. empty list means all sources(default).
+// unix sockets have no ip, they are untrusted if the list is not empty.
+func (ls *Listener) SetProxyTrusted(cidrs []string) error {
+	nets, err := parseCIDRs(cidrs)
+	if err != nil {
+		return err
+	}
+	ls.proxyTrusted.Store(nets)
+	return nil
+}
+
+func (ls *Listener) proxyTrustedBy(addr net.Addr) bool {
+	nets, _ := ls.proxyTrusted.Load().([]*net.IPNet)
+	if len(nets) == 0 {
+		return true
+	}
+	ip := addrIP(addr)
+	return ip != nil && containsIP(nets, ip)
+}
+
 func NewUdpListener(address string, msgparse MsgParse, heartbeat uint32) (*Listener, error) {
 	if msgparse == nil {
 		return nil, fmt.Errorf("MsgParse should not be nil")
@@ -75,13 +223,41 @@ func NewUdpListener(address string, msgparse MsgParse, heartbeat uint32) (*Liste
 		return nil, err
 	}
 
-	ls, err := net.ListenUDP("udp", addr)
+	return newPacketListener("udp", address, msgparse, heartbeat, func() (net.PacketConn, error) {
+		return net.ListenUDP("udp", addr)
+	})
+}
+
+// NewUnixgramListener listen on unix domain socket(SOCK_DGRAM), it works like udp listener.
+// address beginning with '@' is in the abstract namespace(linux only).
+func NewUnixgramListener(address string, msgparse MsgParse, heartbeat uint32) (*Listener, error) {
+	if msgparse == nil {
+		return nil, fmt.Errorf("MsgParse should not be nil")
+	}
+	addr, err := net.ResolveUnixAddr("unixgram", address)
+	if err != nil {
+		return nil, err
+	}
+	if err := removeStaleUnixSocket("unixgram", address); err != nil {
+		return nil, err
+	}
+
+	return newPacketListener("unixgram", address, msgparse, heartbeat, func() (net.PacketConn, error) {
+		//the socket file of last listening should be removed before listening again
+		removeUnixSocketFile(address)
+		return net.ListenUnixgram("unixgram", addr)
+	})
+}
+
+func newPacketListener(network, address string, msgparse MsgParse, heartbeat uint32, listen func() (net.PacketConn, error)) (*Listener, error) {
+	ls, err := listen()
 	if err != nil {
 		return nil, err
 	}
 
 	lis := &Listener{
 		isclose:   NewCloser(false),
+		network:   network,
 		address:   address,
 		isUdp:     true,
 		udpConn:   ls,
@@ -94,7 +270,7 @@ func NewUdpListener(address string, msgparse MsgParse, heartbeat uint32) (*Liste
 	go func() {
 		for !lis.isclose.IsClose() {
 			if err == nil {
-				NewSession(lis.udpConn, msgparse, nil, func(con *Session) {
+				NewSession(lis.wrap(lis.udpConn.(net.Conn)), msgparse, nil, func(con *Session) {
 					lis.udpCh <- 1
 				}, heartbeat, true)
 
@@ -102,9 +278,9 @@ func NewUdpListener(address string, msgparse MsgParse, heartbeat uint32) (*Liste
 			}
 
 			if !lis.isclose.IsClose() {
-				ls, err = net.ListenUDP("udp", addr)
+				ls, err = listen()
 				if err != nil {
-					sysLog.Error("udp listen failed: %s %s", address, err.Error())
+					sysLog.Error("%s listen failed: %s %s", network, address, err.Error())
 					time.Sleep(time.Second * 3)
 				} else {
 					lis.udpConn = ls
@@ -130,12 +306,19 @@ func (ls *Listener) Close() {
 		ls.udpCh <- 1
 
 		//send udp data to awake udpsocket
-		addr := ls.udpConn.LocalAddr().(*net.UDPAddr)
-		if tmpconn, err := net.DialUDP("udp", nil, addr); err == nil {
+		if tmpconn, err := net.Dial(ls.network, ls.udpConn.LocalAddr().String()); err == nil {
 			tmpconn.Write([]byte(""))
 			tmpconn.Close()
 		}
+		if ls.network == "unixgram" {
+			removeUnixSocketFile(ls.address)
+		}
 	}
+	ls.sessMapMutex.RLock()
+	for conn := range ls.proxyPending {
+		conn.Close()
+	}
+	ls.sessMapMutex.RUnlock()
 	ls.IterateSession(func(sess *Session) bool {
 		sess.Close()
 		return true
@@ -143,6 +326,11 @@ func (ls *Listener) Close() {
 	ls.waitExit.Wait()
 }
 
+// Network tcp udp unix unixgram or mem
+func (ls *Listener) Network() string {
+	return ls.network
+}
+
 func (ls *Listener) GetSession(id uint64) *Session {
 	ls.sessMapMutex.RLock()
 	defer ls.sessMapMutex.RUnlock()
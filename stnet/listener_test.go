@@ -0,0 +1,88 @@
+package stnet_test
+
+import (
+	"testing"
+
+	"github.com/greedchase/gotools/stnet"
+	"github.com/greedchase/gotools/stnet/stnettest"
+)
+
+func TestListenMemAddrInUse(t *testing.T) {
+	l, err := stnet.ListenMem("listener-test-inuse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stnet.ListenMem("listener-test-inuse"); err != stnet.ErrMemAddrInUse {
+		t.Fatalf("listen again: %v", err)
+	}
+	l.Close()
+	if _, err := stnet.DialMem("listener-test-inuse"); err != stnet.ErrMemConnRefused {
+		t.Fatalf("dial closed listener: %v", err)
+	}
+}
+
+func TestListenerSessions(t *testing.T) {
+	h := stnettest.New(t, 2)
+	s, rec := h.AddService("line", &lineImp{}, 0)
+	h.Start()
+	defer h.Stop()
+
+	if s.Network() != "mem" {
+		t.Fatalf("network %s, want mem", s.Network())
+	}
+	c1 := h.Dial(s)
+	c2 := h.Dial(s)
+	defer c2.Close()
+	s1 := h.WaitOpen(rec)
+	s2 := h.WaitOpen(rec)
+	if s.GetSession(s1.GetID()) != s1 || s.GetSession(s2.GetID()) != s2 {
+		t.Fatal("GetSession failed")
+	}
+	n := 0
+	s.IterateSession(func(*stnet.Session) bool {
+		n++
+		return true
+	})
+	if n != 2 {
+		t.Fatalf("%d sessions, want 2", n)
+	}
+
+	c1.Close()
+	e := h.WaitClose(rec, nil)
+	if s.GetSession(e.Sess.GetID()) != nil {
+		t.Fatal("closed session should be removed")
+	}
+}
+
+func TestListenerAdmission(t *testing.T) {
+	h := stnettest.New(t, 1)
+	s, rec := h.AddService("line", &lineImp{}, 0)
+	if err := s.SetAdmission(&stnet.AdmissionConfig{MaxSessions: 1}); err != nil {
+		t.Fatal(err)
+	}
+	h.Start()
+	defer h.Stop()
+
+	c1 := h.Dial(s)
+	defer c1.Close()
+	h.WaitOpen(rec)
+	c2 := h.Dial(s)
+	c2.ExpectClosed()
+	if st := s.AdmissionStats(); st.Accepted != 1 || st.RejectedMaxSessions != 1 {
+		t.Fatalf("unexpected stats %+v", st)
+	}
+}
+
+func TestListenerClose(t *testing.T) {
+	h := stnettest.New(t, 1)
+	s, rec := h.AddService("line", &lineImp{}, 0)
+	h.Start()
+	defer h.Stop()
+
+	c := h.Dial(s)
+	defer c.Close()
+	sess := h.WaitOpen(rec)
+	s.Listener.Close()
+	c.ExpectClosed()
+	h.WaitClose(rec, sess)
+}
@@ -0,0 +1,114 @@
+package stnet
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+var errLZCorrupt = errors.New("lz: corrupt input")
+
+// lz is a snappy-like LZ77 block format, fast and without entropy coding:
+// [decoded length(uvarint)] then elements of
+// literal: [n<<1(uvarint)][n bytes]; copy: [n<<1|1(uvarint)][offset(uvarint)], copy n bytes from offset back.
+const (
+	lzHashBits = 14
+	lzMinMatch = 4
+	lzMaxMatch = 1 << 16
+)
+
+func lzHash(u uint32) uint32 {
+	return (u * 0x1e35a7bd) >> (32 - lzHashBits)
+}
+
+func lzEmitLiteral(dst, lit []byte) []byte {
+	if len(lit) == 0 {
+		return dst
+	}
+	dst = appendUvarint(dst, uint64(len(lit))<<1)
+	return append(dst, lit...)
+}
+
+func appendUvarint(dst []byte, v uint64) []byte {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], v)
+	return append(dst, b[:n]...)
+}
+
+func lzEncode(src []byte) []byte {
+	dst := make([]byte, 0, len(src)/2+16)
+	dst = appendUvarint(dst, uint64(len(src)))
+	if len(src) < lzMinMatch+4 {
+		return lzEmitLiteral(dst, src)
+	}
+
+	var table [1 << lzHashBits]int32
+	lit := 0
+	i := 0
+	last := len(src) - lzMinMatch
+	for i <= last {
+		cur := binary.LittleEndian.Uint32(src[i:])
+		h := lzHash(cur)
+		cand := int(table[h]) - 1
+		table[h] = int32(i + 1)
+		if cand < 0 || binary.LittleEndian.Uint32(src[cand:]) != cur {
+			i++
+			continue
+		}
+
+		n := lzMinMatch
+		for i+n < len(src) && n < lzMaxMatch && src[cand+n] == src[i+n] {
+			n++
+		}
+		dst = lzEmitLiteral(dst, src[lit:i])
+		dst = appendUvarint(dst, uint64(n)<<1|1)
+		dst = appendUvarint(dst, uint64(i-cand))
+		i += n
+		lit = i
+	}
+	return lzEmitLiteral(dst, src[lit:])
+}
+
+func lzDecode(src []byte, maxSize int) ([]byte, error) {
+	size, n := binary.Uvarint(src)
+	if n <= 0 {
+		return nil, errLZCorrupt
+	}
+	if size > uint64(maxSize) {
+		return nil, ErrDecompressTooLarge
+	}
+	src = src[n:]
+	dst := make([]byte, 0, size)
+	for len(src) > 0 {
+		v, n := binary.Uvarint(src)
+		if n <= 0 {
+			return nil, errLZCorrupt
+		}
+		src = src[n:]
+		l := v >> 1
+		if l > size-uint64(len(dst)) {
+			return nil, errLZCorrupt
+		}
+		if v&1 == 0 {
+			if l > uint64(len(src)) {
+				return nil, errLZCorrupt
+			}
+			dst = append(dst, src[:l]...)
+			src = src[l:]
+			continue
+		}
+
+		off, n := binary.Uvarint(src)
+		if n <= 0 || off == 0 || off > uint64(len(dst)) {
+			return nil, errLZCorrupt
+		}
+		src = src[n:]
+		p := len(dst) - int(off)
+		for k := 0; k < int(l); k++ { //overlapped copy
+			dst = append(dst, dst[p+k])
+		}
+	}
+	if uint64(len(dst)) != size {
+		return nil, errLZCorrupt
+	}
+	return dst, nil
+}
@@ -0,0 +1,115 @@
+package stnet
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// in-process transport based on net.Pipe, address is mem://name.
+// it is mainly used in tests, no socket is opened.
+
+var (
+	ErrMemAddrInUse   = errors.New("mem address already in use")
+	ErrMemConnRefused = errors.New("mem connection refused")
+)
+
+var (
+	memListeners     = make(map[string]*memListener)
+	memListenerMutex sync.Mutex
+	memDialID        uint64
+)
+
+// memAddr is address of mem network.
+type memAddr string
+
+func (a memAddr) Network() string {
+	return "mem"
+}
+
+func (a memAddr) String() string {
+	return string(a)
+}
+
+type memConn struct {
+	net.Conn
+	local, remote net.Addr
+}
+
+func (c *memConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *memConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+type memListener struct {
+	name    string
+	conns   chan net.Conn
+	closed  chan struct{}
+	closing sync.Once
+}
+
+// ListenMem listen on in-process address name, it is the same as listening on mem://name.
+func ListenMem(name string) (net.Listener, error) {
+	memListenerMutex.Lock()
+	defer memListenerMutex.Unlock()
+	if _, ok := memListeners[name]; ok {
+		return nil, ErrMemAddrInUse
+	}
+	l := &memListener{name: name, conns: make(chan net.Conn), closed: make(chan struct{})}
+	memListeners[name] = l
+	return l, nil
+}
+
+// DialMem connect to the in-process listener of name.
+func DialMem(name string) (net.Conn, error) {
+	memListenerMutex.Lock()
+	l, ok := memListeners[name]
+	memListenerMutex.Unlock()
+	if !ok {
+		return nil, ErrMemConnRefused
+	}
+
+	id := atomic.AddUint64(&memDialID, 1)
+	local := memAddr(name + "#" + strconv.FormatUint(id, 10))
+	c1, c2 := net.Pipe()
+	client := &memConn{c1, local, memAddr(name)}
+	server := &memConn{c2, memAddr(name), local}
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.closed:
+		c1.Close()
+		c2.Close()
+		return nil, ErrMemConnRefused
+	}
+}
+
+func (l *memListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.closed:
+		return nil, ErrSocketClosed
+	}
+}
+
+func (l *memListener) Close() error {
+	l.closing.Do(func() {
+		close(l.closed)
+		memListenerMutex.Lock()
+		if memListeners[l.name] == l {
+			delete(memListeners, l.name)
+		}
+		memListenerMutex.Unlock()
+	})
+	return nil
+}
+
+func (l *memListener) Addr() net.Addr {
+	return memAddr(l.name)
+}
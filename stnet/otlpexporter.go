@@ -0,0 +1,152 @@
+package stnet
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// OTLPFileExporter writes spans in OTLP JSON format(ExportTraceServiceRequest), one request per line,
+// the file could be imported by OpenTelemetry collector(otlpjsonfile receiver).
+type OTLPFileExporter struct {
+	mutex   sync.Mutex
+	w       *bufio.Writer
+	closer  io.Closer
+	service string
+	err     error
+}
+
+// NewOTLPFileExporter serviceName is resource attribute service.name of spans.
+func NewOTLPFileExporter(w io.Writer, serviceName string) *OTLPFileExporter {
+	return &OTLPFileExporter{w: bufio.NewWriter(w), service: serviceName}
+}
+
+// CreateOTLPFileExporter append spans into file of path.
+func CreateOTLPFileExporter(path, serviceName string) (*OTLPFileExporter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	e := NewOTLPFileExporter(f, serviceName)
+	e.closer = f
+	return e, nil
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpKeyValue struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"` //1 ok, 2 error
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+func toOTLPSpan(s *Span) otlpSpan {
+	o := otlpSpan{
+		TraceID:           hex.EncodeToString(s.Context.TraceID[:]),
+		SpanID:            hex.EncodeToString(s.Context.SpanID[:]),
+		Name:              s.Name,
+		Kind:              s.Kind,
+		StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+		Status:            otlpStatus{Code: 1},
+	}
+	if s.Parent != [8]byte{} {
+		o.ParentSpanID = hex.EncodeToString(s.Parent[:])
+	}
+	if s.Err != nil {
+		o.Status = otlpStatus{2, s.Err.Error()}
+	}
+	keys := make([]string, 0, len(s.Attributes))
+	for k := range s.Attributes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		o.Attributes = append(o.Attributes, otlpKeyValue{k, otlpValue{s.Attributes[k]}})
+	}
+	return o
+}
+
+func (e *OTLPFileExporter) ExportSpan(s *Span) {
+	var rs otlpResourceSpans
+	rs.Resource.Attributes = []otlpKeyValue{{"service.name", otlpValue{e.service}}}
+	ss := otlpScopeSpans{Spans: []otlpSpan{toOTLPSpan(s)}}
+	ss.Scope.Name = "stnet"
+	rs.ScopeSpans = []otlpScopeSpans{ss}
+	b, err := json.Marshal(otlpRequest{[]otlpResourceSpans{rs}})
+	if err != nil {
+		sysLog.Error("export span failed: %s", err.Error())
+		return
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.err != nil {
+		return
+	}
+	if _, e.err = e.w.Write(append(b, '\n')); e.err != nil {
+		sysLog.Error("export span failed: %s", e.err.Error())
+	}
+}
+
+func (e *OTLPFileExporter) Flush() error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.err != nil {
+		return e.err
+	}
+	e.err = e.w.Flush()
+	return e.err
+}
+
+// Close flush spans and close file created by CreateOTLPFileExporter.
+func (e *OTLPFileExporter) Close() error {
+	err := e.Flush()
+	if e.closer != nil {
+		if er := e.closer.Close(); err == nil {
+			err = er
+		}
+	}
+	return err
+}
@@ -0,0 +1,33 @@
+// peercred_linux.go
+
+// +build linux
+
+package stnet
+
+import (
+	"net"
+	"syscall"
+)
+
+const supportAbstractUnixAddr = true
+
+func getPeerCred(c *net.UnixConn) (*PeerCred, error) {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var (
+		cred *syscall.Ucred
+		cerr error
+	)
+	err = raw.Control(func(fd uintptr) {
+		cred, cerr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if cerr != nil {
+		return nil, cerr
+	}
+	return &PeerCred{Pid: cred.Pid, Uid: cred.Uid, Gid: cred.Gid}, nil
+}
@@ -0,0 +1,15 @@
+// peercred_other.go
+
+// +build !linux
+
+package stnet
+
+import (
+	"net"
+)
+
+const supportAbstractUnixAddr = false
+
+func getPeerCred(c *net.UnixConn) (*PeerCred, error) {
+	return nil, ErrPeerCredNotSupported
+}
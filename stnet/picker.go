@@ -0,0 +1,173 @@
+package stnet
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Picker selects a connect from ConnectPool.
+type Picker interface {
+	// Update is called when connects of pool are changed, weights[i] is the weight of conns[i].
+	Update(conns []*Connect, weights []int)
+	// Pick key is used by hash picker, nil means no connect.
+	Pick(key string) *Connect
+}
+
+// connectAvailable connect could be picked, connect whose circuit breaker is open is ejected.
+func connectAvailable(c *Connect) bool {
+	return c.IsConnected() && c.CircuitState() != CircuitOpen
+}
+
+// RoundRobinPicker
+type RoundRobinPicker struct {
+	conns atomic.Value //[]*Connect
+	next  uint32
+}
+
+func NewRoundRobinPicker() *RoundRobinPicker {
+	return &RoundRobinPicker{}
+}
+
+func (p *RoundRobinPicker) Update(conns []*Connect, weights []int) {
+	p.conns.Store(conns)
+}
+
+func (p *RoundRobinPicker) Pick(key string) *Connect {
+	conns, _ := p.conns.Load().([]*Connect)
+	if len(conns) == 0 {
+		return nil
+	}
+	n := atomic.AddUint32(&p.next, 1)
+	for i := 0; i < len(conns); i++ {
+		c := conns[(int(n)+i)%len(conns)]
+		if connectAvailable(c) {
+			return c
+		}
+	}
+	return conns[int(n)%len(conns)]
+}
+
+// WeightedPicker smooth weighted round-robin.
+type WeightedPicker struct {
+	mutex   sync.Mutex
+	conns   []*Connect
+	weights []int
+	current []int
+}
+
+func NewWeightedPicker() *WeightedPicker {
+	return &WeightedPicker{}
+}
+
+func (p *WeightedPicker) Update(conns []*Connect, weights []int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.conns = conns
+	p.weights = make([]int, len(weights))
+	for i, w := range weights {
+		if w <= 0 {
+			w = 1
+		}
+		p.weights[i] = w
+	}
+	p.current = make([]int, len(conns))
+}
+
+func (p *WeightedPicker) Pick(key string) *Connect {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if len(p.conns) == 0 {
+		return nil
+	}
+	best := -1
+	total := 0
+	for i, c := range p.conns {
+		if !connectAvailable(c) {
+			continue
+		}
+		p.current[i] += p.weights[i]
+		total += p.weights[i]
+		if best < 0 || p.current[i] > p.current[best] {
+			best = i
+		}
+	}
+	if best < 0 {
+		return p.conns[0]
+	}
+	p.current[best] -= total
+	return p.conns[best]
+}
+
+// LeastPendingPicker selects the connect with least pending rpc requests.
+type LeastPendingPicker struct {
+	RoundRobinPicker
+}
+
+func NewLeastPendingPicker() *LeastPendingPicker {
+	return &LeastPendingPicker{}
+}
+
+func (p *LeastPendingPicker) Pick(key string) *Connect {
+	conns, _ := p.conns.Load().([]*Connect)
+	if len(conns) == 0 {
+		return nil
+	}
+	n := int(atomic.AddUint32(&p.next, 1))
+	var best *Connect
+	for i := 0; i < len(conns); i++ {
+		c := conns[(n+i)%len(conns)]
+		if !connectAvailable(c) {
+			continue
+		}
+		if best == nil || c.Pending() < best.Pending() {
+			best = c
+		}
+	}
+	if best == nil {
+		return conns[n%len(conns)]
+	}
+	return best
+}
+
+// ConsistentHashPicker connects with the same key are always the same one if it is available.
+type ConsistentHashPicker struct {
+	replicas int
+	mutex    sync.RWMutex
+	conns    []*Connect
+	ring     *hashRing
+}
+
+// NewConsistentHashPicker replicas is number of virtual nodes of every connect, default is 160.
+func NewConsistentHashPicker(replicas int) *ConsistentHashPicker {
+	return &ConsistentHashPicker{replicas: replicas}
+}
+
+func (p *ConsistentHashPicker) Update(conns []*Connect, weights []int) {
+	nodes := make([]string, len(conns))
+	for i, c := range conns {
+		nodes[i] = c.Addr()
+	}
+	ring := newHashRing(p.replicas, nodes)
+	p.mutex.Lock()
+	p.conns = conns
+	p.ring = ring
+	p.mutex.Unlock()
+}
+
+func (p *ConsistentHashPicker) Pick(key string) *Connect {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	if len(p.conns) == 0 {
+		return nil
+	}
+	for i := 0; i < len(p.conns); i++ {
+		idx := p.ring.getN(key, i)
+		if idx < 0 {
+			break
+		}
+		if connectAvailable(p.conns[idx]) {
+			return p.conns[idx]
+		}
+	}
+	return p.conns[p.ring.get(key)]
+}
@@ -0,0 +1,167 @@
+package stnet
+
+import "sync/atomic"
+
+// priority lanes of service message queue, message in higher lane is processed first.
+const (
+	PriorityLow    = 0 //session events(close, heartbeat timeout) are always in this lane, they wait for data of the session in higher lanes
+	PriorityNormal = 1
+	PriorityHigh   = 2
+	PriorityLanes  = 3
+)
+
+// PriorityStarvationLimit is the max number of messages processed continuously from higher lanes,
+// then one message of lower lanes is processed, the lower lanes take turns from high to low.
+var PriorityStarvationLimit = 32
+
+// priorityProcessorOf find the PriorityProcessor of imp, the inner imp of ServiceSpb ServiceJson ServiceRpc and ServiceHttp is checked too.
+func priorityProcessorOf(imp ServiceImp) PriorityProcessor {
+	if p, ok := imp.(PriorityProcessor); ok {
+		return p
+	}
+	if p, ok := innerImp(imp).(PriorityProcessor); ok {
+		return p
+	}
+	return nil
+}
+
+// innerImp return the user imp wrapped by ServiceSpb ServiceJson ServiceRpc ServiceJsonRpc and ServiceHttp.
+func innerImp(imp ServiceImp) interface{} {
+	switch s := imp.(type) {
+	case *ServiceSpb:
+		return s.imp
+	case *ServiceJson:
+		return s.imp
+	case *ServiceRpc:
+		return s.imp
+	case *ServiceHttp:
+		return s.imp
+	case *ServiceJsonRpc:
+		return s.imp
+	}
+	return nil
+}
+
+func (service *Service) getPriority(sess *Session, msgid int64, msg interface{}) int {
+	if service.priority == nil {
+		return PriorityLow
+	}
+	cur := &CurrentContent{}
+	if sess != nil {
+		cur = &CurrentContent{0, sess, sess.UserData, sess.peer, nil}
+	}
+	m, _ := untraceMsg(msg)
+	p := service.priority.MsgPriority(cur, uint64(msgid), m)
+	if p < PriorityLow {
+		p = PriorityLow
+	} else if p >= len(service.lanes) {
+		p = len(service.lanes) - 1
+	}
+	return p
+}
+
+// laneState state of priority lanes of a processor thread, it is only used in the thread.
+type laneState struct {
+	burst    int              //messages processed continuously from higher lanes
+	rescue   int              //lower lane whose turn it is when burst reaches PriorityStarvationLimit
+	deferred []sessionMessage //session events waiting for data of the session in higher lanes
+}
+
+// queue return message queue of thread th in lane.
+func (service *Service) queue(th, lane int) chan sessionMessage {
+	return service.lanes[lane][th]
+}
+
+// pushLane push data message of sess into lane of thread th, it returns false if the queue is full.
+// data in higher lanes is counted, so that session events in PriorityLow are not handled before it.
+func (service *Service) pushLane(th, lane int, m sessionMessage) bool {
+	if lane > PriorityLow && m.Sess != nil {
+		atomic.AddInt32(&m.Sess.laneQueued, 1)
+	}
+	select {
+	case service.queue(th, lane) <- m:
+		return true
+	default:
+		if lane > PriorityLow && m.Sess != nil {
+			service.laneDone(m.Sess)
+		}
+		return false
+	}
+}
+
+// laneDone is called when data of sess in higher lanes is handled, deferred session events is waked up.
+func (service *Service) laneDone(sess *Session) {
+	if atomic.AddInt32(&sess.laneQueued, -1) == 0 && atomic.LoadInt32(&sess.laneDeferred) > 0 {
+		select {
+		case (*service.netSignal)[service.threadId] <- 1:
+		default:
+		}
+	}
+}
+
+// popMessage take message from the highest lane which is not empty, lane is where the message comes from;
+// after PriorityStarvationLimit messages of higher lanes, lower lanes take precedence once.
+// session events are deferred until the session has no data in higher lanes.
+func (service *Service) popMessage(th int) (msg sessionMessage, lane int, ok bool) {
+	if len(service.lanes) == 1 {
+		select {
+		case msg := <-service.messageQ[th]:
+			return msg, PriorityLow, true
+		default:
+			return sessionMessage{}, PriorityLow, false
+		}
+	}
+
+	st := &service.laneStates[th]
+	for i, m := range st.deferred {
+		if atomic.LoadInt32(&m.Sess.laneQueued) == 0 {
+			st.deferred = append(st.deferred[:i], st.deferred[i+1:]...)
+			atomic.AddInt32(&m.Sess.laneDeferred, -1)
+			return m, PriorityLow, true
+		}
+	}
+	for {
+		msg, lane, ok = service.popLane(st, th)
+		if !ok || lane != PriorityLow || msg.DtType == Data || msg.Sess == nil || atomic.LoadInt32(&msg.Sess.laneQueued) == 0 {
+			return msg, lane, ok
+		}
+		st.deferred = append(st.deferred, msg)
+		atomic.AddInt32(&msg.Sess.laneDeferred, 1)
+	}
+}
+
+func (service *Service) popLane(st *laneState, th int) (sessionMessage, int, bool) {
+	top := len(service.lanes) - 1
+	if st.burst >= PriorityStarvationLimit {
+		//lower lanes take turns, one lane down every time
+		st.burst = 0
+		for i := 0; i < top; i++ {
+			l := (st.rescue - i + top) % top
+			select {
+			case msg := <-service.lanes[l][th]:
+				st.rescue = (l - 1 + top) % top
+				return msg, l, true
+			default:
+			}
+		}
+		select {
+		case msg := <-service.lanes[top][th]:
+			return msg, top, true
+		default:
+		}
+		return sessionMessage{}, 0, false
+	}
+	for l := top; l >= 0; l-- {
+		select {
+		case msg := <-service.lanes[l][th]:
+			if l > 0 {
+				st.burst++
+			} else {
+				st.burst = 0
+			}
+			return msg, l, true
+		default:
+		}
+	}
+	return sessionMessage{}, 0, false
+}
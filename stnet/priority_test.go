@@ -0,0 +1,140 @@
+package stnet_test
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/greedchase/gotools/stnet"
+	"github.com/greedchase/gotools/stnet/stnettest"
+)
+
+// priorityImp is lineImp whose lane is decided by msgID: 'b'(blocks until released) and 'h' are high, 'n' is normal.
+type priorityImp struct {
+	lineImp
+	thread  int //processor of data
+	entered chan struct{}
+	release chan struct{}
+
+	mutex sync.Mutex
+	order []string
+}
+
+func newPriorityImp(thread int) *priorityImp {
+	return &priorityImp{thread: thread, entered: make(chan struct{}, 1), release: make(chan struct{})}
+}
+
+func (imp *priorityImp) MsgPriority(current *stnet.CurrentContent, msgID uint64, msg interface{}) int {
+	switch msgID {
+	case 'b', 'h':
+		return stnet.PriorityHigh
+	case 'n':
+		return stnet.PriorityNormal
+	}
+	return stnet.PriorityLow
+}
+
+func (imp *priorityImp) HashProcessor(current *stnet.CurrentContent, msgID uint64, msg interface{}) int {
+	return imp.thread
+}
+
+func (imp *priorityImp) HandleMessage(current *stnet.CurrentContent, msgID uint64, msg interface{}) {
+	if msgID == 'b' {
+		imp.entered <- struct{}{}
+		<-imp.release
+	}
+	imp.add(string(msg.([]byte)))
+}
+
+func (imp *priorityImp) SessionClose(sess *stnet.Session) {
+	imp.add("close")
+}
+
+func (imp *priorityImp) add(s string) {
+	imp.mutex.Lock()
+	imp.order = append(imp.order, s)
+	imp.mutex.Unlock()
+}
+
+func (imp *priorityImp) wait(t *testing.T, n int) []string {
+	t.Helper()
+	deadline := time.Now().Add(stnettest.DefaultTimeout)
+	for time.Now().Before(deadline) {
+		imp.mutex.Lock()
+		order := imp.order
+		imp.mutex.Unlock()
+		if len(order) >= n {
+			return order
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("%d messages are handled, want %d", len(imp.order), n)
+	return nil
+}
+
+func TestPriorityStarvation(t *testing.T) {
+	h := stnettest.New(t, 1)
+	imp := newPriorityImp(0)
+	s, err := h.Server.AddService("priority", "", 0, imp, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Start()
+	defer h.Stop()
+
+	s.PushRequest(nil, 'b', []byte("b"))
+	<-imp.entered
+	high := 3 * stnet.PriorityStarvationLimit
+	for i := 0; i < high; i++ {
+		s.PushRequest(nil, 'h', []byte("h"))
+	}
+	s.PushRequest(nil, 'n', []byte("n"))
+	s.PushRequest(nil, 'l', []byte("l"))
+	close(imp.release)
+
+	order := imp.wait(t, high+3)
+	//normal and low lanes take turns from high to low before high lane is empty
+	rescued := ""
+	for _, m := range order[:high] {
+		if m == "n" || m == "l" {
+			rescued += m
+		}
+	}
+	if rescued != "nl" {
+		t.Fatalf("rescued %q, want nl: %v", rescued, order)
+	}
+}
+
+func TestPrioritySessionClose(t *testing.T) {
+	h := stnettest.New(t, 2)
+	imp := newPriorityImp(1) //data in thread 1, session events in thread 0
+	s, err := h.Server.AddService("priority", h.Addr("priority"), 0, imp, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Start()
+	defer h.Stop()
+
+	conn, err := stnet.DialMem(strings.TrimPrefix(h.Addr("priority"), "mem://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("b\nh1\nh2\n"))
+	<-imp.entered
+	conn.Close()
+	//close event is deferred while high lane has data of the session
+	var sess *stnet.Session
+	s.IterateSession(func(ss *stnet.Session) bool {
+		sess = ss
+		return false
+	})
+	for sess != nil && !sess.IsClose() {
+		time.Sleep(time.Millisecond)
+	}
+	close(imp.release)
+	order := imp.wait(t, 4)
+	if order[len(order)-1] != "close" {
+		t.Fatalf("session is closed before its data: %v", order)
+	}
+}
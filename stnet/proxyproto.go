@@ -0,0 +1,355 @@
+package stnet
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// mode of parsing PROXY protocol header on Listener
+const (
+	ProxyProtocolOff      = 0
+	ProxyProtocolOptional = 1 //parse header if the connection begins with PROXY protocol signature
+	ProxyProtocolRequired = 2 //connection without header will be closed
+)
+
+var (
+	// ProxyProtocolTimeout is the max time waiting for PROXY protocol header after accepting.
+	ProxyProtocolTimeout = 3 * time.Second
+	// ProxyProtocolMaxPending is the max number of connections waiting for PROXY protocol header of a listener,
+	// more connections are closed at once; they are also counted in AdmissionConfig.MaxSessions.
+	ProxyProtocolMaxPending = 1024
+
+	ErrNoProxyHeader      = errors.New("PROXY protocol header not found")
+	ErrInvalidProxyHeader = errors.New("invalid PROXY protocol header")
+	ErrUntrustedProxy     = errors.New("PROXY protocol header from untrusted source")
+
+	proxyV1Sig = []byte("PROXY ")
+	proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+const (
+	proxyV1MaxLen = 107
+	proxyV2HdrLen = 16
+)
+
+// ProxyHeader is the header of HAProxy PROXY protocol v1 or v2.
+type ProxyHeader struct {
+	Version int
+	Local   bool     //LOCAL command(v2) or UNKNOWN protocol(v1), addresses should be ignored
+	SrcAddr net.Addr //address of real client
+	DstAddr net.Addr //address the client connected to
+	TLV     []byte   //raw tlv data of v2
+}
+
+// readProxyHeader read header from r; when the data is not begin with signature and required is false, it returns nil,nil.
+// if required is false and the signature is not complete until timeout, it is not a header too.
+func readProxyHeader(r *bufio.Reader, required bool) (*ProxyHeader, error) {
+	for n := 1; n <= len(proxyV2Sig); n++ {
+		b, err := r.Peek(n)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() && !required {
+				return nil, nil
+			}
+			return nil, err
+		}
+		if n <= len(proxyV1Sig) && bytes.Equal(b, proxyV1Sig[:n]) {
+			if n == len(proxyV1Sig) {
+				return readProxyHeaderV1(r)
+			}
+			continue
+		}
+		if bytes.Equal(b, proxyV2Sig[:n]) {
+			if n == len(proxyV2Sig) {
+				return readProxyHeaderV2(r)
+			}
+			continue
+		}
+		break
+	}
+	if required {
+		return nil, ErrNoProxyHeader
+	}
+	return nil, nil
+}
+
+func readProxyHeaderV1(r *bufio.Reader) (*ProxyHeader, error) {
+	line := make([]byte, 0, proxyV1MaxLen)
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, c)
+		if c == '\n' {
+			break
+		}
+		if len(line) >= proxyV1MaxLen {
+			return nil, ErrInvalidProxyHeader
+		}
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return nil, ErrInvalidProxyHeader
+	}
+
+	//PROXY TCP4 255.255.255.255 255.255.255.255 65535 65535\r\n
+	ss := strings.Split(string(line[:len(line)-2]), " ")
+	hdr := &ProxyHeader{Version: 1}
+	if len(ss) < 2 {
+		return nil, ErrInvalidProxyHeader
+	}
+	if ss[1] == "UNKNOWN" {
+		hdr.Local = true
+		return hdr, nil
+	}
+	if len(ss) != 6 || (ss[1] != "TCP4" && ss[1] != "TCP6") {
+		return nil, ErrInvalidProxyHeader
+	}
+	src, err := parseProxyV1Addr(ss[2], ss[4])
+	if err != nil {
+		return nil, err
+	}
+	dst, err := parseProxyV1Addr(ss[3], ss[5])
+	if err != nil {
+		return nil, err
+	}
+	hdr.SrcAddr = src
+	hdr.DstAddr = dst
+	return hdr, nil
+}
+
+func parseProxyV1Addr(ip, port string) (*net.TCPAddr, error) {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return nil, ErrInvalidProxyHeader
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, ErrInvalidProxyHeader
+	}
+	return &net.TCPAddr{IP: addr, Port: int(p)}, nil
+}
+
+func readProxyHeaderV2(r *bufio.Reader) (*ProxyHeader, error) {
+	head := make([]byte, proxyV2HdrLen)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+	if head[12]>>4 != 2 {
+		return nil, ErrInvalidProxyHeader
+	}
+	cmd := head[12] & 0xf
+	fam := head[13]
+	body := make([]byte, binary.BigEndian.Uint16(head[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	hdr := &ProxyHeader{Version: 2}
+	if cmd == 0x0 { //LOCAL
+		hdr.Local = true
+		return hdr, nil
+	} else if cmd != 0x1 {
+		return nil, ErrInvalidProxyHeader
+	}
+
+	isUdp := fam&0xf == 0x2
+	addrLen := 0
+	switch fam >> 4 {
+	case 0x1: //AF_INET
+		addrLen = 12
+		if len(body) < addrLen {
+			return nil, ErrInvalidProxyHeader
+		}
+		hdr.SrcAddr = newProxyIPAddr(isUdp, body[0:4], body[8:10])
+		hdr.DstAddr = newProxyIPAddr(isUdp, body[4:8], body[10:12])
+	case 0x2: //AF_INET6
+		addrLen = 36
+		if len(body) < addrLen {
+			return nil, ErrInvalidProxyHeader
+		}
+		hdr.SrcAddr = newProxyIPAddr(isUdp, body[0:16], body[32:34])
+		hdr.DstAddr = newProxyIPAddr(isUdp, body[16:32], body[34:36])
+	case 0x3: //AF_UNIX
+		addrLen = 216
+		if len(body) < addrLen {
+			return nil, ErrInvalidProxyHeader
+		}
+		network := "unix"
+		if isUdp {
+			network = "unixgram"
+		}
+		hdr.SrcAddr = &net.UnixAddr{Name: string(bytes.TrimRight(body[0:108], "\x00")), Net: network}
+		hdr.DstAddr = &net.UnixAddr{Name: string(bytes.TrimRight(body[108:216], "\x00")), Net: network}
+	default: //AF_UNSPEC
+		hdr.Local = true
+	}
+	if len(body) > addrLen {
+		hdr.TLV = body[addrLen:]
+	}
+	return hdr, nil
+}
+
+func newProxyIPAddr(isUdp bool, ip []byte, port []byte) net.Addr {
+	addr := make(net.IP, len(ip))
+	copy(addr, ip)
+	p := int(binary.BigEndian.Uint16(port))
+	if isUdp {
+		return &net.UDPAddr{IP: addr, Port: p}
+	}
+	return &net.TCPAddr{IP: addr, Port: p}
+}
+
+// EncodeProxyHeader encode PROXY protocol header of version 1 or 2.
+// src is the address of real client, dst is the address client connected to.
+// when addresses are not tcp(udp or unix in v2), a header of UNKNOWN(v1) or LOCAL(v2) is returned.
+func EncodeProxyHeader(version int, src, dst net.Addr) ([]byte, error) {
+	if version == 1 {
+		return encodeProxyHeaderV1(src, dst), nil
+	} else if version == 2 {
+		return encodeProxyHeaderV2(src, dst), nil
+	}
+	return nil, fmt.Errorf("invalid PROXY protocol version: %d", version)
+}
+
+func encodeProxyHeaderV1(src, dst net.Addr) []byte {
+	s, ok1 := src.(*net.TCPAddr)
+	d, ok2 := dst.(*net.TCPAddr)
+	if !ok1 || !ok2 || s == nil || d == nil {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+	proto := "TCP6"
+	if s.IP.To4() != nil && d.IP.To4() != nil {
+		proto = "TCP4"
+	}
+	return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", proto, s.IP.String(), d.IP.String(), s.Port, d.Port))
+}
+
+func encodeProxyHeaderV2(src, dst net.Addr) []byte {
+	buf := make([]byte, proxyV2HdrLen, proxyV2HdrLen+216)
+	copy(buf, proxyV2Sig)
+	buf[12] = 0x21 //version 2, command PROXY
+
+	var body []byte
+	switch s := src.(type) {
+	case *net.TCPAddr:
+		if d, ok := dst.(*net.TCPAddr); ok && s != nil && d != nil {
+			buf[13], body = encodeProxyV2IP(0x1, s.IP, d.IP, s.Port, d.Port)
+		}
+	case *net.UDPAddr:
+		if d, ok := dst.(*net.UDPAddr); ok && s != nil && d != nil {
+			buf[13], body = encodeProxyV2IP(0x2, s.IP, d.IP, s.Port, d.Port)
+		}
+	case *net.UnixAddr:
+		if d, ok := dst.(*net.UnixAddr); ok && s != nil && d != nil {
+			buf[13] = 0x31
+			if s.Net == "unixgram" {
+				buf[13] = 0x32
+			}
+			body = make([]byte, 216)
+			copy(body[0:108], s.Name)
+			copy(body[108:216], d.Name)
+		}
+	}
+	if body == nil {
+		buf[12] = 0x20 //LOCAL
+		buf[13] = 0x0  //AF_UNSPEC
+	}
+	binary.BigEndian.PutUint16(buf[14:16], uint16(len(body)))
+	return append(buf, body...)
+}
+
+func encodeProxyV2IP(transport byte, src, dst net.IP, sport, dport int) (byte, []byte) {
+	var body []byte
+	fam := byte(0x20)
+	if s4, d4 := src.To4(), dst.To4(); s4 != nil && d4 != nil {
+		fam = 0x10
+		body = append(body, s4...)
+		body = append(body, d4...)
+	} else {
+		body = append(body, src.To16()...)
+		body = append(body, dst.To16()...)
+	}
+	body = append(body, byte(sport>>8), byte(sport), byte(dport>>8), byte(dport))
+	return fam | transport, body
+}
+
+// proxyConn is the connection whose PROXY protocol header has been read.
+type proxyConn struct {
+	net.Conn
+	r   *bufio.Reader
+	hdr *ProxyHeader
+}
+
+// newProxyConn read header of mode; untrusted connections are not parsed, they are closed if header is required.
+func newProxyConn(conn net.Conn, mode int, trusted bool) (net.Conn, error) {
+	if !trusted {
+		if mode == ProxyProtocolRequired {
+			return nil, ErrUntrustedProxy
+		}
+		return conn, nil
+	}
+	r := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(ProxyProtocolTimeout))
+	hdr, err := readProxyHeader(r, mode == ProxyProtocolRequired)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{conn, r, hdr}, nil
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	if c.r.Buffered() > 0 {
+		return c.r.Read(b)
+	}
+	return c.Conn.Read(b)
+}
+
+// RemoteAddr returns address of the real client.
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if c.hdr != nil && !c.hdr.Local && c.hdr.SrcAddr != nil {
+		return c.hdr.SrcAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// rawConn returns the socket under wrapped connections.
+func rawConn(c net.Conn) net.Conn {
+	for {
+		w, ok := c.(interface{ NetConn() net.Conn })
+		if !ok {
+			return c
+		}
+		c = w.NetConn()
+	}
+}
+
+// ProxyHeader returns PROXY protocol header received from load balancer, nil if there is no header.
+func (s *Session) ProxyHeader() *ProxyHeader {
+	if c, ok := s.socket.(*proxyConn); ok {
+		return c.hdr
+	}
+	return nil
+}
+
+// proxyHeaderAddrs returns addresses should be sent to backend in PROXY protocol header.
+func (s *Session) proxyHeaderAddrs() (src net.Addr, dst net.Addr) {
+	src = s.socket.RemoteAddr()
+	dst = s.socket.LocalAddr()
+	if h := s.ProxyHeader(); h != nil && !h.Local && h.DstAddr != nil {
+		dst = h.DstAddr
+	}
+	return
+}
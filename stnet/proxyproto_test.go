@@ -0,0 +1,131 @@
+package stnet_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/greedchase/gotools/stnet"
+	"github.com/greedchase/gotools/stnet/stnettest"
+)
+
+func TestProxyProtocolPartialSignature(t *testing.T) {
+	old := stnet.ProxyProtocolTimeout
+	stnet.ProxyProtocolTimeout = 50 * time.Millisecond
+	defer func() { stnet.ProxyProtocolTimeout = old }()
+
+	h := stnettest.New(t, 1)
+	s, rec := h.AddService("line", &lineImp{}, 0)
+	s.SetProxyProtocol(stnet.ProxyProtocolOptional)
+	h.Start()
+	defer h.Stop()
+
+	//"P" is a prefix of v1 signature, it is plain data after timeout
+	c := h.Dial(s)
+	defer c.Close()
+	c.Send([]byte("P"))
+	h.WaitOpen(rec)
+	c.Send([]byte("ing\n"))
+	if e := h.WaitMessage(rec, 'P'); string(e.Msg.([]byte)) != "Ping" {
+		t.Fatalf("message %q, want Ping", e.Msg)
+	}
+}
+
+func TestProxyProtocolUntrusted(t *testing.T) {
+	h := stnettest.New(t, 1)
+	s, rec := h.AddService("line", &lineImp{}, 0)
+	s.SetProxyProtocol(stnet.ProxyProtocolOptional)
+	if err := s.SetProxyTrusted([]string{"10.0.0.0/8"}); err != nil {
+		t.Fatal(err)
+	}
+	h.Start()
+	defer h.Stop()
+
+	//header from untrusted source is not parsed
+	c := h.Dial(s)
+	defer c.Close()
+	sess := h.WaitOpen(rec)
+	c.Send([]byte("PROXY TCP4 1.2.3.4 5.6.7.8 1000 2000\r\n"))
+	if e := h.WaitMessage(rec, 'P'); string(e.Msg.([]byte)) != "PROXY TCP4 1.2.3.4 5.6.7.8 1000 2000\r" {
+		t.Fatalf("message %q", e.Msg)
+	}
+	if sess.RemoteAddr() == "1.2.3.4:1000" {
+		t.Fatal("address of untrusted header is used")
+	}
+
+	s.SetProxyProtocol(stnet.ProxyProtocolRequired)
+	c2 := h.Dial(s)
+	c2.ExpectClosed()
+
+	if err := s.SetProxyTrusted([]string{"bad"}); err == nil {
+		t.Fatal("invalid CIDR should fail")
+	}
+}
+
+func TestProxyServiceHeaderOnReconnect(t *testing.T) {
+	h := stnettest.New(t, 1)
+	back, rec := h.AddService("back", &lineImp{}, 0)
+	back.SetProxyProtocol(stnet.ProxyProtocolRequired)
+	if _, err := h.Server.AddTcpProxyServiceWithHeader(h.Addr("front"), 0, 0, []string{h.Addr("back")}, []int{1}, 2); err != nil {
+		t.Fatal(err)
+	}
+	h.Start()
+	defer h.Stop()
+
+	conn, err := stnet.DialMem(strings.TrimPrefix(h.Addr("front"), "mem://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &stnettest.Client{TB: t, Conn: conn, Timeout: h.Timeout}
+	defer c.Close()
+	c.Send([]byte("a1\n"))
+	sess := h.WaitOpen(rec)
+	h.WaitMessage(rec, 'a')
+
+	//backend drops the connection, header is sent again when the proxy reconnects
+	sess.Close()
+	h.WaitClose(rec, sess)
+	h.WaitOpen(rec)
+	c.Send([]byte("b1\n"))
+	h.WaitMessage(rec, 'b')
+	if n := rec.Count(stnettest.EventClose); n != 1 {
+		t.Fatalf("%d sessions closed by backend, want 1", n)
+	}
+}
+
+func TestProxyProtocolPendingLimit(t *testing.T) {
+	oldTimeout, oldPending := stnet.ProxyProtocolTimeout, stnet.ProxyProtocolMaxPending
+	stnet.ProxyProtocolTimeout = time.Minute
+	defer func() { stnet.ProxyProtocolTimeout, stnet.ProxyProtocolMaxPending = oldTimeout, oldPending }()
+
+	h := stnettest.New(t, 1)
+	s, rec := h.AddService("line", &lineImp{}, 0)
+	s.SetProxyProtocol(stnet.ProxyProtocolRequired)
+	if err := s.SetAdmission(&stnet.AdmissionConfig{MaxSessions: 2}); err != nil {
+		t.Fatal(err)
+	}
+	h.Start()
+	defer h.Stop()
+
+	//connections waiting for header are counted in MaxSessions
+	c1 := h.Dial(s)
+	defer c1.Close()
+	c2 := h.Dial(s)
+	defer c2.Close()
+	c3 := h.Dial(s)
+	c3.ExpectClosed()
+	if st := s.AdmissionStats(); st.RejectedMaxSessions != 1 {
+		t.Fatalf("unexpected stats %+v", st)
+	}
+
+	//and limited by ProxyProtocolMaxPending
+	s.SetAdmission(nil)
+	stnet.ProxyProtocolMaxPending = 1
+	c1.Send([]byte("PROXY TCP4 1.2.3.4 5.6.7.8 1000 2000\r\n"))
+	h.WaitOpen(rec)
+	c4 := h.Dial(s)
+	c4.ExpectClosed()
+	if st := s.AdmissionStats(); st.RejectedMaxSessions != 1 || st.Accepted != 1 {
+		t.Fatalf("unexpected stats %+v", st)
+	}
+}
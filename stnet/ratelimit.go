@@ -0,0 +1,338 @@
+package stnet
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// tokenBucket is not thread safe.
+type tokenBucket struct {
+	rate   float64 //tokens per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket when burst <= 0, burst is rate(at least 1).
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	b := float64(burst)
+	if b <= 0 {
+		b = rate
+	}
+	if b < 1 {
+		b = 1
+	}
+	return &tokenBucket{rate: rate, burst: b, tokens: b, last: now}
+}
+
+func (tb *tokenBucket) refill(now time.Time) {
+	if now.After(tb.last) {
+		tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+		if tb.tokens > tb.burst {
+			tb.tokens = tb.burst
+		}
+		tb.last = now
+	}
+}
+
+// take n tokens if there are enough tokens.
+func (tb *tokenBucket) take(n float64, now time.Time) bool {
+	tb.refill(now)
+	if tb.tokens >= n {
+		tb.tokens -= n
+		return true
+	}
+	return false
+}
+
+// reserve take n tokens and return the time should be waited for them.
+func (tb *tokenBucket) reserve(n float64, now time.Time) time.Duration {
+	tb.refill(now)
+	tb.tokens -= n
+	if tb.tokens >= 0 || tb.rate <= 0 {
+		return 0
+	}
+	return time.Duration(-tb.tokens / tb.rate * float64(time.Second))
+}
+
+// isFull bucket is full means it has been idle for a while.
+func (tb *tokenBucket) isFull(now time.Time) bool {
+	tb.refill(now)
+	return tb.tokens >= tb.burst
+}
+
+// action when message rate of a session is over limit
+const (
+	RateLimitDrop       = 0 //drop the message
+	RateLimitDelay      = 1 //delay the message and stop reading the session until tokens are enough
+	RateLimitDisconnect = 2 //close the session
+)
+
+// RateLimit token bucket limits of a session, 0 means no limit.
+type RateLimit struct {
+	MsgPerSec   float64
+	MsgBurst    int //default is MsgPerSec
+	BytesPerSec float64
+	BytesBurst  int //default is BytesPerSec
+	Action      int //RateLimitDrop RateLimitDelay RateLimitDisconnect
+}
+
+type rateLimitConfig struct {
+	dropLog  rateLog //first fields for 64-bit atomic alignment
+	closeLog rateLog
+	session  *RateLimit
+	msgs     map[int64]*RateLimit //limit of msgid
+}
+
+// rateLog counts events and logs them at most once per second, so that a flood does not flood the log.
+type rateLog struct {
+	last  int64 //unix nano of last log
+	count uint64
+}
+
+// hit returns events since last log if it should be logged now.
+func (l *rateLog) hit(now time.Time) (uint64, bool) {
+	atomic.AddUint64(&l.count, 1)
+	last := atomic.LoadInt64(&l.last)
+	if now.UnixNano()-last < int64(time.Second) || !atomic.CompareAndSwapInt64(&l.last, last, now.UnixNano()) {
+		return 0, false
+	}
+	return atomic.SwapUint64(&l.count, 0), true
+}
+
+type rateBuckets struct {
+	limit *RateLimit
+	msg   *tokenBucket
+	bytes *tokenBucket
+}
+
+func newRateBuckets(limit *RateLimit, now time.Time) *rateBuckets {
+	rb := &rateBuckets{limit: limit}
+	if limit.MsgPerSec > 0 {
+		rb.msg = newTokenBucket(limit.MsgPerSec, limit.MsgBurst, now)
+	}
+	if limit.BytesPerSec > 0 {
+		rb.bytes = newTokenBucket(limit.BytesPerSec, limit.BytesBurst, now)
+	}
+	return rb
+}
+
+func (rb *rateBuckets) isFull(now time.Time) bool {
+	return (rb.msg == nil || rb.msg.isFull(now)) && (rb.bytes == nil || rb.bytes.isFull(now))
+}
+
+// check returns the time should be waited, ok is false when the message should not be handled at once.
+// tokens are reserved for the message if delay, otherwise they are taken only if they are enough.
+func (rb *rateBuckets) check(msgLen int, now time.Time, delay bool) (wait time.Duration, ok bool) {
+	if delay {
+		if rb.msg != nil {
+			wait = rb.msg.reserve(1, now)
+		}
+		if rb.bytes != nil {
+			if w := rb.bytes.reserve(float64(msgLen), now); w > wait {
+				wait = w
+			}
+		}
+		return wait, wait == 0
+	}
+
+	if rb.msg != nil {
+		rb.msg.refill(now)
+		if rb.msg.tokens < 1 {
+			return 0, false
+		}
+	}
+	if rb.bytes != nil {
+		rb.bytes.refill(now)
+		if rb.bytes.tokens < float64(msgLen) {
+			return 0, false
+		}
+	}
+	if rb.msg != nil {
+		rb.msg.tokens--
+	}
+	if rb.bytes != nil {
+		rb.bytes.tokens -= float64(msgLen)
+	}
+	return 0, true
+}
+
+// sessionLimiter is only used in the receiving thread of session.
+type sessionLimiter struct {
+	cfg     *rateLimitConfig
+	session *rateBuckets
+	msgs    map[int64]*rateBuckets
+}
+
+func newSessionLimiter(cfg *rateLimitConfig, now time.Time) *sessionLimiter {
+	lm := &sessionLimiter{cfg: cfg, msgs: make(map[int64]*rateBuckets)}
+	if cfg.session != nil {
+		lm.session = newRateBuckets(cfg.session, now)
+	}
+	return lm
+}
+
+// idle all buckets are full, the limiter could be recreated without changing limits.
+func (lm *sessionLimiter) idle(now time.Time) bool {
+	if lm.session != nil && !lm.session.isFull(now) {
+		return false
+	}
+	for _, rb := range lm.msgs {
+		if !rb.isFull(now) {
+			return false
+		}
+	}
+	return true
+}
+
+// minPeerSweep peers of a datagram listener session are swept when their number reaches it(and doubled after sweeping).
+const minPeerSweep = 1024
+
+// peerLimiters limiters of every peer of a datagram listener session, it is only used in the receiving thread.
+type peerLimiters struct {
+	cfg     *rateLimitConfig
+	peers   map[string]*sessionLimiter
+	sweepAt int
+}
+
+func (pl *peerLimiters) get(peer net.Addr, now time.Time) *sessionLimiter {
+	key := ""
+	if peer != nil {
+		key = peer.String()
+	}
+	lm, ok := pl.peers[key]
+	if !ok {
+		if len(pl.peers) >= pl.sweepAt {
+			for k, v := range pl.peers {
+				if v.idle(now) {
+					delete(pl.peers, k)
+				}
+			}
+			pl.sweepAt = 2 * len(pl.peers)
+			if pl.sweepAt < minPeerSweep {
+				pl.sweepAt = minPeerSweep
+			}
+		}
+		lm = newSessionLimiter(pl.cfg, now)
+		pl.peers[key] = lm
+	}
+	return lm
+}
+
+// SetRateLimit set message limits of every session of this service(including connections), nil means no limit.
+// limits are checked in receiving thread of session before the message is pushed into message queue.
+// a udp(unixgram) listener has one session shared by all peers, so its limits are kept for every peer address,
+// and RateLimitDelay RateLimitDisconnect work as RateLimitDrop, the shared session is never delayed or closed.
+func (service *Service) SetRateLimit(limit *RateLimit) {
+	service.rateMutex.Lock()
+	defer service.rateMutex.Unlock()
+	cfg := service.rateLimitConfig()
+	ncfg := &rateLimitConfig{msgs: cfg.msgs}
+	if limit != nil {
+		l := *limit
+		ncfg.session = &l
+	}
+	service.rateLimit.Store(ncfg)
+}
+
+// SetMsgRateLimit set limits of msgID of every session, nil means no limit.
+func (service *Service) SetMsgRateLimit(msgID int64, limit *RateLimit) {
+	service.rateMutex.Lock()
+	defer service.rateMutex.Unlock()
+	cfg := service.rateLimitConfig()
+	ncfg := &rateLimitConfig{session: cfg.session, msgs: make(map[int64]*RateLimit)}
+	for k, v := range cfg.msgs {
+		ncfg.msgs[k] = v
+	}
+	if limit != nil {
+		l := *limit
+		ncfg.msgs[msgID] = &l
+	} else {
+		delete(ncfg.msgs, msgID)
+	}
+	service.rateLimit.Store(ncfg)
+}
+
+func (service *Service) rateLimitConfig() *rateLimitConfig {
+	if cfg, ok := service.rateLimit.Load().(*rateLimitConfig); ok {
+		return cfg
+	}
+	return &rateLimitConfig{}
+}
+
+// checkRateLimit ok is false when the message should be dropped, closed is true when the session is closed by limit.
+func (service *Service) checkRateLimit(sess *Session, msgID int64, msgLen int) (ok bool, closed bool) {
+	cfg, ok := service.rateLimit.Load().(*rateLimitConfig)
+	if !ok || (cfg.session == nil && len(cfg.msgs) == 0) {
+		return true, false
+	}
+
+	now := time.Now()
+	shared := sess.isUdp && sess.conn == nil //session of datagram listener
+	var lm *sessionLimiter
+	if shared {
+		if sess.peerLimiters == nil || sess.peerLimiters.cfg != cfg { //limits changed
+			sess.peerLimiters = &peerLimiters{cfg: cfg, peers: make(map[string]*sessionLimiter), sweepAt: minPeerSweep}
+		}
+		lm = sess.peerLimiters.get(sess.peer, now)
+	} else {
+		lm = sess.limiter
+		if lm == nil || lm.cfg != cfg { //limits changed
+			lm = newSessionLimiter(cfg, now)
+			sess.limiter = lm
+		}
+	}
+
+	rbs := make([]*rateBuckets, 0, 2)
+	if l, ok := cfg.msgs[msgID]; ok {
+		rb, ok := lm.msgs[msgID]
+		if !ok {
+			rb = newRateBuckets(l, now)
+			lm.msgs[msgID] = rb
+		}
+		rbs = append(rbs, rb)
+	}
+	if lm.session != nil {
+		rbs = append(rbs, lm.session)
+	}
+
+	for _, rb := range rbs {
+		action := rb.limit.Action
+		if shared {
+			action = RateLimitDrop
+		}
+		wait, ok := rb.check(msgLen, now, action == RateLimitDelay)
+		if ok {
+			continue
+		}
+		service.throttled(sess, msgID, action)
+		switch action {
+		case RateLimitDelay:
+			to := time.NewTimer(wait)
+			select {
+			case <-sess.closer:
+			case <-to.C:
+			}
+			to.Stop()
+		case RateLimitDisconnect:
+			if n, ok := cfg.closeLog.hit(now); ok {
+				sysLog.Error("session is closed by rate limit;service=%s;sessionid=%d;msgid=%d;closed=%d", service.Name, sess.GetID(), msgID, n)
+			}
+			sess.Close()
+			return false, true
+		default:
+			if n, ok := cfg.dropLog.hit(now); ok {
+				sysLog.Error("message is dropped by rate limit;service=%s;sessionid=%d;msgid=%d;peer=%v;dropped=%d", service.Name, sess.GetID(), msgID, sess.peer, n)
+			}
+			return false, false
+		}
+	}
+	return true, false
+}
+
+func (service *Service) throttled(sess *Session, msgID int64, action int) {
+	if t, ok := service.imp.(SessionThrottler); ok {
+		t.SessionThrottled(sess, msgID, action)
+	}
+}
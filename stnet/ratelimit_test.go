@@ -0,0 +1,90 @@
+package stnet_test
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/greedchase/gotools/stnet"
+	"github.com/greedchase/gotools/stnet/stnettest"
+)
+
+// badLineImp is lineImp whose lines beginning with 'x' are malformed.
+type badLineImp struct {
+	lineImp
+}
+
+func (imp *badLineImp) Unmarshal(sess *stnet.Session, data []byte) (int, int64, interface{}, error) {
+	n, id, msg, err := imp.lineImp.Unmarshal(sess, data)
+	if id == 'x' {
+		err = errors.New("malformed")
+	}
+	return n, id, msg, err
+}
+
+func TestRateLimitMalformed(t *testing.T) {
+	h := stnettest.New(t, 1)
+	s, rec := h.AddService("line", &badLineImp{}, 0)
+	s.SetMsgRateLimit('x', &stnet.RateLimit{MsgPerSec: 0.001, MsgBurst: 1})
+	h.Start()
+	defer h.Stop()
+
+	c := h.Dial(s)
+	defer c.Close()
+	h.WaitOpen(rec)
+	c.Send([]byte("x1\nx2\nx3\ny\n"))
+	h.WaitMessage(rec, 'y')
+	if n := rec.Count(stnettest.EventError); n != 1 {
+		t.Fatalf("%d malformed messages are handled, want 1", n)
+	}
+}
+
+func TestRateLimitDatagramPeers(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	addr := pc.LocalAddr().String()
+	pc.Close()
+
+	h := stnettest.New(t, 1)
+	rec := stnettest.NewRecorder(&lineImp{})
+	s, err := h.Server.AddService("udp", "udp:"+addr, 0, rec, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//disconnect works as drop, the shared session is not closed
+	limit := &stnet.RateLimit{MsgPerSec: 0.001, MsgBurst: 1, Action: stnet.RateLimitDisconnect}
+	s.SetMsgRateLimit('a', limit)
+	s.SetMsgRateLimit('b', limit)
+	h.Start()
+	defer h.Stop()
+
+	send := func(c net.Conn, msg string) {
+		if _, err := c.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	send(a, "a1\n")
+	h.WaitMessage(rec, 'a')
+	send(a, "a2\n")
+	send(b, "b1\n") //limits of peers are separate
+	h.WaitMessage(rec, 'b')
+	send(b, "b2\n")
+	send(b, "z\n")
+	h.WaitMessage(rec, 'z')
+	if rec.Count(stnettest.EventMessage) != 3 || rec.Count(stnettest.EventClose) != 0 {
+		t.Fatal("messages over limit are handled or session is closed")
+	}
+}
@@ -0,0 +1,107 @@
+package stnet
+
+import (
+	"math/rand"
+	"net"
+	"time"
+)
+
+// backoff of ReconnectPolicy
+const (
+	BackoffQuadratic   = 0 //reconnect at 0 1 4 9 16...(max 900) times Base
+	BackoffExponential = 1 //reconnect at 0 1 2 4 8...times Base
+	BackoffFixed       = 2 //reconnect every Base
+)
+
+// ReconnectPolicy policy of Connector reconnecting, callbacks are called in connecting thread of the connector.
+type ReconnectPolicy struct {
+	Backoff     int
+	Base        time.Duration //default 100ms
+	Max         time.Duration //max interval between attempts, 0 means no limit(BackoffQuadratic is limited by 900 times Base)
+	Jitter      float64       //0-1, interval is randomized in [interval*(1-Jitter), interval*(1+Jitter)]
+	MaxAttempts int           //give up after continuous failed attempts and the connector will be closed, 0 means never give up
+	DialTimeout time.Duration //0 means no timeout
+	LocalAddr   string        //source address bound when dialing, ip or ip:port(tcp/udp)
+	WrapConn    ConnWrapper   //wraps every dialed connection, example FaultInjector.Wrap
+
+	OnConnected    func(c *Connector)
+	OnDisconnected func(c *Connector)
+	OnGiveUp       func(c *Connector)
+}
+
+// DefaultReconnectPolicy quadratic backoff of 100ms without jitter.
+func DefaultReconnectPolicy() *ReconnectPolicy {
+	return &ReconnectPolicy{Backoff: BackoffQuadratic, Base: 100 * time.Millisecond}
+}
+
+// interval returns waiting time before the attempt, attempt begins at 1.
+func (p *ReconnectPolicy) interval(attempt int) time.Duration {
+	base := p.Base
+	if base <= 0 {
+		base = 100 * time.Millisecond
+	}
+	var d time.Duration
+	switch p.Backoff {
+	case BackoffExponential:
+		d = base
+		for i := 1; i < attempt && (p.Max <= 0 || d < p.Max); i++ {
+			if d > time.Hour {
+				break
+			}
+			d *= 2
+		}
+	case BackoffFixed:
+		d = base
+	default:
+		n := attempt
+		if n > 30 { //max 900 times
+			n = 10 + (n-31)%21
+		}
+		d = time.Duration(n*n) * base
+	}
+	if p.Max > 0 && d > p.Max {
+		d = p.Max
+	}
+	if p.Jitter > 0 {
+		j := p.Jitter
+		if j > 1 {
+			j = 1
+		}
+		d = time.Duration(float64(d) * (1 - j + 2*j*rand.Float64()))
+	}
+	return d
+}
+
+func (p *ReconnectPolicy) dialer(network string) (*net.Dialer, error) {
+	d := &net.Dialer{Timeout: p.DialTimeout}
+	if p.LocalAddr == "" {
+		return d, nil
+	}
+	laddr := p.LocalAddr
+	switch network {
+	case "tcp", "udp":
+		if _, _, err := net.SplitHostPort(laddr); err != nil {
+			laddr = net.JoinHostPort(laddr, "0")
+		}
+		if network == "tcp" {
+			a, err := net.ResolveTCPAddr(network, laddr)
+			if err != nil {
+				return nil, err
+			}
+			d.LocalAddr = a
+		} else {
+			a, err := net.ResolveUDPAddr(network, laddr)
+			if err != nil {
+				return nil, err
+			}
+			d.LocalAddr = a
+		}
+	case "unix":
+		a, err := net.ResolveUnixAddr(network, laddr)
+		if err != nil {
+			return nil, err
+		}
+		d.LocalAddr = a
+	}
+	return d, nil
+}
@@ -0,0 +1,291 @@
+package stnet
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// direction of recorded frame
+const (
+	TrafficIn  = 0 //received by session, split by MsgParse(Unmarshal of ServiceImp)
+	TrafficOut = 1 //sent by Session.Send
+)
+
+// file format: magic, then frames of [direction(1 byte)][nanoseconds since start(uvarint)][length(uvarint)][data]
+const trafficMagic = "STNETREC1"
+
+var ErrBadTrafficFile = errors.New("bad traffic file")
+
+// TrafficFrame is a recorded frame.
+type TrafficFrame struct {
+	Dir  int
+	Time time.Duration //since recording started
+	Data []byte
+}
+
+// TrafficRecorder writes frames of sessions with timestamps, it could be shared by sessions.
+type TrafficRecorder struct {
+	mutex  sync.Mutex
+	w      *bufio.Writer
+	closer io.Closer
+	start  time.Time
+	err    error
+	head   [1 + 2*binary.MaxVarintLen64]byte
+}
+
+func NewTrafficRecorder(w io.Writer) *TrafficRecorder {
+	r := &TrafficRecorder{w: bufio.NewWriter(w), start: time.Now()}
+	_, r.err = r.w.WriteString(trafficMagic)
+	return r
+}
+
+// CreateTrafficRecorder record into file of path, the file is truncated.
+func CreateTrafficRecorder(path string) (*TrafficRecorder, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	r := NewTrafficRecorder(f)
+	r.closer = f
+	return r, nil
+}
+
+// Record write a frame, error is returned if writing failed before.
+func (r *TrafficRecorder) Record(dir int, data []byte) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.err != nil {
+		return r.err
+	}
+	r.head[0] = byte(dir)
+	n := 1
+	n += binary.PutUvarint(r.head[n:], uint64(time.Since(r.start)))
+	n += binary.PutUvarint(r.head[n:], uint64(len(data)))
+	if _, r.err = r.w.Write(r.head[:n]); r.err != nil {
+		return r.err
+	}
+	_, r.err = r.w.Write(data)
+	return r.err
+}
+
+func (r *TrafficRecorder) Flush() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.err != nil {
+		return r.err
+	}
+	r.err = r.w.Flush()
+	return r.err
+}
+
+// Close flush frames and close file created by CreateTrafficRecorder.
+func (r *TrafficRecorder) Close() error {
+	err := r.Flush()
+	if r.closer != nil {
+		if e := r.closer.Close(); err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// TrafficReader reads frames written by TrafficRecorder.
+type TrafficReader struct {
+	r *bufio.Reader
+}
+
+func NewTrafficReader(r io.Reader) (*TrafficReader, error) {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(trafficMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != trafficMagic {
+		return nil, ErrBadTrafficFile
+	}
+	return &TrafficReader{br}, nil
+}
+
+// Next return the next frame, io.EOF at the end.
+func (tr *TrafficReader) Next() (TrafficFrame, error) {
+	var f TrafficFrame
+	dir, err := tr.r.ReadByte()
+	if err != nil {
+		return f, err
+	}
+	if dir != TrafficIn && dir != TrafficOut {
+		return f, ErrBadTrafficFile
+	}
+	t, err := binary.ReadUvarint(tr.r)
+	if err != nil {
+		return f, ErrBadTrafficFile
+	}
+	n, err := binary.ReadUvarint(tr.r)
+	if err != nil || n > uint64(MaxMsgSize) {
+		return f, ErrBadTrafficFile
+	}
+	f.Dir = int(dir)
+	f.Time = time.Duration(t)
+	f.Data = make([]byte, n)
+	if _, err := io.ReadFull(tr.r, f.Data); err != nil {
+		return f, ErrBadTrafficFile
+	}
+	return f, nil
+}
+
+// SetRecorder start recording frames of the session, nil stops recording.
+// it is usually called in SessionOpen.
+// frames of encrypted session(Service.SetEncryption) are recorded in plaintext: inbound frames after decryption and
+// outbound frames before encryption, key exchange is not recorded; they could be replayed to a server without encryption.
+func (s *Session) SetRecorder(r *TrafficRecorder) {
+	s.recorder.Store(r)
+}
+
+func (s *Session) Recorder() *TrafficRecorder {
+	r, _ := s.recorder.Load().(*TrafficRecorder)
+	return r
+}
+
+func (s *Session) record(dir int, data []byte) {
+	if r := s.Recorder(); r != nil && len(data) > 0 {
+		if err := r.Record(dir, data); err != nil {
+			sysLog.Error("record traffic failed: %s;sessionid=%d", err.Error(), s.id)
+			s.recorder.Store((*TrafficRecorder)(nil))
+		}
+	}
+}
+
+// recordFrame record inbound frame decrypted by readFrame.
+func (s *Session) recordFrame(codec FrameCodec, h FrameHeader, body []byte) {
+	if s.Recorder() == nil {
+		return
+	}
+	if buf, err := encodeFrame(codec, h, body); err == nil {
+		s.record(TrafficIn, buf)
+	}
+}
+
+// ReplayOptions options of replaying.
+type ReplayOptions struct {
+	Speed      float64           //1 is original speed, 2 is twice as fast, 0 means no waiting between frames
+	Wait       time.Duration     //time waiting for responses after the last frame is sent
+	OnResponse func(data []byte) //called in reading goroutine with data received from server
+}
+
+// ReplayTo send inbound frames of r to address at speed of recording, address is the same as Server.AddService.
+func ReplayTo(address string, r *TrafficReader, opt *ReplayOptions) error {
+	if opt == nil {
+		opt = &ReplayOptions{Speed: 1}
+	}
+	network, addr := parseAddress(address)
+	var (
+		conn net.Conn
+		err  error
+	)
+	switch network {
+	case "mem":
+		conn, err = DialMem(addr)
+	case "unixgram":
+		conn, err = dialUnixgram(addr)
+	default:
+		conn, err = net.Dial(network, addr)
+	}
+	if err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := make([]byte, MsgBuffSize)
+		for {
+			n, err := conn.Read(buf)
+			if n > 0 && opt.OnResponse != nil {
+				opt.OnResponse(buf[:n])
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	err = replayFrames(conn, r, opt.Speed)
+	if err == nil && opt.Wait > 0 {
+		time.Sleep(opt.Wait)
+	}
+	conn.Close()
+	<-done
+	return err
+}
+
+func replayFrames(conn net.Conn, r *TrafficReader, speed float64) error {
+	start := time.Now()
+	var first time.Duration = -1
+	for {
+		f, err := r.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if f.Dir != TrafficIn {
+			continue
+		}
+		if first < 0 {
+			first = f.Time
+		}
+		if speed > 0 {
+			at := time.Duration(float64(f.Time-first) / speed)
+			if d := at - time.Since(start); d > 0 {
+				time.Sleep(d)
+			}
+		}
+		if _, err := conn.Write(f.Data); err != nil {
+			return err
+		}
+	}
+}
+
+var replayID uint64
+
+// replayImp notify when the replaying session is closed.
+type replayImp struct {
+	ServiceImp
+	closed chan struct{}
+}
+
+func (imp *replayImp) SessionClose(sess *Session) {
+	imp.ServiceImp.SessionClose(sess)
+	close(imp.closed)
+}
+
+// ReplayToImp feed inbound frames of r into imp in process, it returns after SessionClose of imp is called.
+// imp runs in a server of one processor thread, Init and Destroy of imp are called too.
+func ReplayToImp(imp ServiceImp, r *TrafficReader, opt *ReplayOptions) error {
+	svr := NewServer(1, 1)
+	name := "stnet-replay-" + strconv.FormatUint(atomic.AddUint64(&replayID, 1), 10)
+	ri := &replayImp{imp, make(chan struct{})}
+	if _, err := svr.AddService(name, "mem://"+name, 0, ri, 0); err != nil {
+		return err
+	}
+	if err := svr.Start(); err != nil {
+		return err
+	}
+	defer svr.Stop()
+
+	err := ReplayTo("mem://"+name, r, opt)
+	select {
+	case <-ri.closed:
+	case <-time.After(10 * time.Second):
+		if err == nil {
+			err = fmt.Errorf("replay session is not closed")
+		}
+	}
+	return err
+}
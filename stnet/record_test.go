@@ -0,0 +1,92 @@
+package stnet_test
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/greedchase/gotools/stnet"
+	"github.com/greedchase/gotools/stnet/stnettest"
+)
+
+type recordImp struct {
+	lineImp
+	rec *stnet.TrafficRecorder
+
+	mutex sync.Mutex
+	msgs  []string
+}
+
+func (imp *recordImp) SessionOpen(sess *stnet.Session) {
+	if imp.rec != nil {
+		sess.SetRecorder(imp.rec)
+	}
+}
+
+func (imp *recordImp) HandleMessage(current *stnet.CurrentContent, msgID uint64, msg interface{}) {
+	imp.mutex.Lock()
+	imp.msgs = append(imp.msgs, string(msg.([]byte)))
+	imp.mutex.Unlock()
+	current.Sess.Send([]byte("ok\n"), nil)
+}
+
+func TestTrafficRecordAndReplay(t *testing.T) {
+	var buf bytes.Buffer
+	tr := stnet.NewTrafficRecorder(&buf)
+	h := stnettest.New(t, 1)
+	s, rec := h.AddService("server", &recordImp{rec: tr}, 0)
+	h.Start()
+
+	c := h.Dial(s)
+	h.WaitOpen(rec)
+	c.Send([]byte("one\ntw"))
+	h.WaitMessage(rec, 'o')
+	c.Read(3)
+	c.Send([]byte("o\nthree\n"))
+	h.WaitMessage(rec, 't')
+	h.WaitMessage(rec, 't')
+	c.Read(6)
+	c.Close()
+	h.Stop()
+	if err := tr.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := stnet.NewTrafficReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var in, out []string
+	for {
+		f, err := r.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if f.Dir == stnet.TrafficIn {
+			in = append(in, string(f.Data))
+		} else {
+			out = append(out, string(f.Data))
+		}
+	}
+	if len(in) != 3 || in[0] != "one\n" || in[1] != "two\n" || in[2] != "three\n" || len(out) != 3 {
+		t.Fatalf("in %q out %q", in, out)
+	}
+
+	r, _ = stnet.NewTrafficReader(bytes.NewReader(buf.Bytes()))
+	imp := &recordImp{}
+	if err := stnet.ReplayToImp(imp, r, &stnet.ReplayOptions{Speed: 0}); err != nil {
+		t.Fatal(err)
+	}
+	if len(imp.msgs) != 3 || imp.msgs[2] != "three" {
+		t.Fatalf("replayed %q", imp.msgs)
+	}
+}
+
+func TestTrafficReaderBadFile(t *testing.T) {
+	if _, err := stnet.NewTrafficReader(bytes.NewReader([]byte("nothing"))); err != stnet.ErrBadTrafficFile {
+		t.Fatalf("err %v", err)
+	}
+}
@@ -0,0 +1,257 @@
+package stnet
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Endpoint is an instance of service.
+type Endpoint struct {
+	Addr   string //address used by NewConnect, such as 127.0.0.1:6060 udp:127.0.0.1:6060 unix:///tmp/s.sock
+	Weight int    //used by weighted picker, <= 0 means 1
+}
+
+// Resolver returns all instances of a service, it is called by ConnectPool every PoolRefreshInterval.
+type Resolver interface {
+	Resolve() ([]Endpoint, error)
+}
+
+// ResolverNotifier is an optional interface of Resolver, ConnectPool refreshes at once when Changed is signaled.
+type ResolverNotifier interface {
+	Changed() <-chan struct{}
+}
+
+// ResolverCloser is an optional interface of Resolver, ConnectPool calls Close when it is closed.
+type ResolverCloser interface {
+	Close()
+}
+
+// StaticResolver fixed address list.
+type StaticResolver struct {
+	endpoints []Endpoint
+}
+
+func NewStaticResolver(addrs ...string) *StaticResolver {
+	r := &StaticResolver{}
+	for _, v := range addrs {
+		r.endpoints = append(r.endpoints, Endpoint{v, 1})
+	}
+	return r
+}
+
+func NewWeightedStaticResolver(endpoints []Endpoint) *StaticResolver {
+	r := &StaticResolver{make([]Endpoint, len(endpoints))}
+	copy(r.endpoints, endpoints)
+	return r
+}
+
+func (r *StaticResolver) Resolve() ([]Endpoint, error) {
+	return r.endpoints, nil
+}
+
+// SRVResolver resolves DNS SRV record _service._proto.name, only targets with the lowest priority are used.
+type SRVResolver struct {
+	Service string
+	Proto   string
+	Name    string
+	Prefix  string //prefix of address, such as udp: unix://
+}
+
+func NewSRVResolver(service, proto, name string) *SRVResolver {
+	return &SRVResolver{Service: service, Proto: proto, Name: name}
+}
+
+func (r *SRVResolver) Resolve() ([]Endpoint, error) {
+	_, srvs, err := net.LookupSRV(r.Service, r.Proto, r.Name)
+	if err != nil {
+		return nil, err
+	}
+	if len(srvs) == 0 {
+		return nil, fmt.Errorf("no SRV record: %s %s %s", r.Service, r.Proto, r.Name)
+	}
+	eps := make([]Endpoint, 0, len(srvs))
+	priority := srvs[0].Priority //sorted by priority
+	for _, v := range srvs {
+		if v.Priority != priority {
+			break
+		}
+		host := strings.TrimSuffix(v.Target, ".")
+		eps = append(eps, Endpoint{r.Prefix + net.JoinHostPort(host, strconv.Itoa(int(v.Port))), int(v.Weight)})
+	}
+	return eps, nil
+}
+
+// FileResolver reads address list from file, the file is read again when it is modified.
+// every line is "address [weight]", line beginning with # is comment.
+type FileResolver struct {
+	path      string
+	mutex     sync.Mutex
+	modTime   time.Time
+	size      int64
+	endpoints []Endpoint
+}
+
+func NewFileResolver(path string) *FileResolver {
+	return &FileResolver{path: path}
+}
+
+func (r *FileResolver) Resolve() ([]Endpoint, error) {
+	fi, err := os.Stat(r.path)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.endpoints != nil && fi.ModTime().Equal(r.modTime) && fi.Size() == r.size {
+		return r.endpoints, nil
+	}
+
+	f, err := os.Open(r.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	eps := make([]Endpoint, 0)
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		ss := strings.Fields(line)
+		ep := Endpoint{ss[0], 1}
+		if len(ss) > 1 {
+			w, e := strconv.Atoi(ss[1])
+			if e != nil {
+				return nil, fmt.Errorf("invalid weight in %s: %s", r.path, line)
+			}
+			ep.Weight = w
+		}
+		eps = append(eps, ep)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	r.endpoints = eps
+	r.modTime = fi.ModTime()
+	r.size = fi.Size()
+	return eps, nil
+}
+
+// Registry is a local registry of service instances in process.
+type Registry struct {
+	mutex    sync.RWMutex
+	services map[string]map[string]Endpoint
+	watchers map[string][]chan struct{}
+}
+
+// DefaultRegistry is the default local registry.
+var DefaultRegistry = NewRegistry()
+
+func NewRegistry() *Registry {
+	return &Registry{
+		services: make(map[string]map[string]Endpoint),
+		watchers: make(map[string][]chan struct{}),
+	}
+}
+
+// Register add or update an instance of service name.
+func (r *Registry) Register(name string, ep Endpoint) {
+	r.mutex.Lock()
+	eps, ok := r.services[name]
+	if !ok {
+		eps = make(map[string]Endpoint)
+		r.services[name] = eps
+	}
+	eps[ep.Addr] = ep
+	r.mutex.Unlock()
+	r.notify(name)
+}
+
+// Deregister remove an instance of service name.
+func (r *Registry) Deregister(name, addr string) {
+	r.mutex.Lock()
+	if eps, ok := r.services[name]; ok {
+		delete(eps, addr)
+		if len(eps) == 0 {
+			delete(r.services, name)
+		}
+	}
+	r.mutex.Unlock()
+	r.notify(name)
+}
+
+func (r *Registry) notify(name string) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	for _, ch := range r.watchers[name] {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (r *Registry) unwatch(name string, ch chan struct{}) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	ws := r.watchers[name]
+	for i, v := range ws {
+		if v == ch {
+			ws = append(ws[:i], ws[i+1:]...)
+			break
+		}
+	}
+	if len(ws) == 0 {
+		delete(r.watchers, name)
+	} else {
+		r.watchers[name] = ws
+	}
+}
+
+func (r *Registry) endpoints(name string) []Endpoint {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	eps := make([]Endpoint, 0, len(r.services[name]))
+	for _, v := range r.services[name] {
+		eps = append(eps, v)
+	}
+	return eps
+}
+
+// Resolver returns resolver of service name, it is notified when instances are changed until it is closed.
+// resolver used by ConnectPool is closed by ConnectPool.Close.
+func (r *Registry) Resolver(name string) Resolver {
+	ch := make(chan struct{}, 1)
+	r.mutex.Lock()
+	r.watchers[name] = append(r.watchers[name], ch)
+	r.mutex.Unlock()
+	return &registryResolver{r, name, ch}
+}
+
+type registryResolver struct {
+	registry *Registry
+	name     string
+	changed  chan struct{}
+}
+
+func (r *registryResolver) Resolve() ([]Endpoint, error) {
+	return r.registry.endpoints(r.name), nil
+}
+
+func (r *registryResolver) Changed() <-chan struct{} {
+	return r.changed
+}
+
+// Close stop notifying the resolver.
+func (r *registryResolver) Close() {
+	r.registry.unwatch(r.name, r.changed)
+}
@@ -6,6 +6,7 @@ import (
 	"net"
 	"reflect"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -17,6 +18,7 @@ const (
 	RpcErrNoRemoteFunc = -1
 	RpcErrCallTimeout  = -2
 	RpcErrFuncParamErr = -3
+	RpcErrCircuitOpen  = -4 //circuit breaker of the connect is open, request is not sent
 )
 
 type ReqProto struct {
@@ -25,6 +27,7 @@ type ReqProto struct {
 	ReqData   []byte
 	IsOneWay  bool
 	FuncName  string
+	Trace     string //W3C traceparent, see TraceContext
 }
 
 type RspProto struct {
@@ -36,6 +39,9 @@ type RspProto struct {
 	FuncName  string
 }
 
+// RpcService exported methods of it could be called remotely,
+// a method whose first parameter is *CurrentContent gets current of the request(current.Span to trace calls of it),
+// the other parameters are passed by caller.
 type RpcService interface {
 	Loop()
 	HandleError(current *CurrentContent, err error)
@@ -55,10 +61,37 @@ type rpcRequest struct {
 	exception RpcFuncException
 	timeout   int64
 	sess      *Session
+	conn      *Connector //pending requests of connector is counted
+	breaker   *CircuitBreaker
+	span      *Span //client span, finished when request is removed
+	encoding  int   //codec of params, returns are decoded by it
 
 	signal chan *RspProto
 }
 
+// done is called when request is removed from rpcRequests, ok is false when it is timeout.
+func (r *rpcRequest) done(ok bool) {
+	if r.conn != nil {
+		atomic.AddInt64(&r.conn.pending, -1)
+		r.conn = nil
+	}
+	if r.breaker != nil {
+		if ok {
+			r.breaker.Success()
+		} else {
+			r.breaker.Failure()
+		}
+		r.breaker = nil
+	}
+	if r.span != nil {
+		if !ok && r.span.Err == nil {
+			r.span.Err = errors.New("rpc call timeout")
+		}
+		r.span.Finish()
+		r.span = nil
+	}
+}
+
 type ServiceRpc struct {
 	ServiceBase
 	imp     RpcService
@@ -73,19 +106,37 @@ func NewServiceRpc(imp RpcService) *ServiceRpc {
 	svr := &ServiceRpc{}
 	svr.imp = imp
 	svr.rpcRequests = make(map[uint32]*rpcRequest)
-	svr.methods = make(map[string]reflect.Method)
+	svr.methods = rpcMethods(imp)
+	return svr
+}
 
+var rpcServiceType = reflect.TypeOf((*RpcService)(nil)).Elem()
+
+// rpcMethods exported methods of imp which could be called remotely, methods of RpcService(Loop HandleError HashProcessor) are excluded.
+func rpcMethods(imp interface{}) map[string]reflect.Method {
+	methods := make(map[string]reflect.Method)
 	t := reflect.TypeOf(imp)
 	for i := 0; i < t.NumMethod(); i++ {
 		m := t.Method(i)
-		svr.methods[m.Name] = m
+		if _, ok := rpcServiceType.MethodByName(m.Name); ok {
+			continue
+		}
+		methods[m.Name] = m
 	}
-	return svr
+	return methods
+}
+
+// rpcSessionClosed request could never be sent by sess, requests of a disconnected connector are sent after it reconnects.
+func rpcSessionClosed(sess *Session) bool {
+	if sess.conn != nil {
+		return sess.conn.IsClose()
+	}
+	return sess.IsClose()
 }
 
-// rpc_call syncORasync remotesession udppeer remotefunction functionparams callback exception
+// rpc_call syncORasync remotesession udppeer parentspan remotefunction functionparams callback exception
 // rpc_call exception function: func(int32){}
-func (service *ServiceRpc) rpc_call(issync bool, sess *Session, peer net.Addr, funcName string, params ...interface{}) error {
+func (service *ServiceRpc) rpc_call(issync bool, sess *Session, peer net.Addr, parent *Span, funcName string, params ...interface{}) error {
 	var rpcReq rpcRequest
 	rpcReq.timeout = time.Now().Unix() + TimeOut
 	rpcReq.req.FuncName = funcName
@@ -109,23 +160,68 @@ func (service *ServiceRpc) rpc_call(issync bool, sess *Session, peer net.Addr, f
 	rpcReq.callback = params[len(params)-2]
 
 	params = params[0 : len(params)-2]
-	var err error
-	spb := Spb{}
+	rpcReq.encoding = sess.msgEncoding()
+	packer, err := newRpcParams(rpcReq.encoding, nil)
+	if err != nil {
+		return err
+	}
 	for i, v := range params {
-		err = rpcMarshal(&spb, uint32(i+1), v)
+		err = packer.marshal(uint32(i+1), v)
 		if err != nil {
 			return fmt.Errorf("wrong params in RpcCall:%s(%d) %s", funcName, i, err.Error())
 		}
 	}
-	rpcReq.req.ReqData = spb.buf
+	rpcReq.req.ReqData = packer.bytes()
 	if rpcReq.callback == nil && rpcReq.exception == nil {
 		rpcReq.req.IsOneWay = true
 	}
 
+	if sess != nil && rpcSessionClosed(sess) {
+		return ErrSocketClosed
+	}
+	if sess != nil && sess.conn != nil {
+		if cb := sess.conn.getBreaker(); cb != nil {
+			if (rpcReq.req.IsOneWay && cb.State() == CircuitOpen) || (!rpcReq.req.IsOneWay && !cb.Allow()) {
+				if rpcReq.exception != nil {
+					rpcReq.exception(RpcErrCircuitOpen)
+				}
+				return ErrCircuitOpen
+			}
+			if !rpcReq.req.IsOneWay {
+				rpcReq.breaker = cb
+			}
+		}
+	}
+
+	if parent == nil {
+		parent = activeHandlerSpan()
+	}
+	if parent != nil || getSpanExporter() != nil {
+		var span *Span
+		if parent != nil {
+			span = StartSpan("rpc "+funcName, SpanKindClient, &parent.Context)
+		} else {
+			span = StartSpan("rpc "+funcName, SpanKindClient, nil)
+		}
+		if sess != nil {
+			span.SetAttribute("net.peer", sess.RemoteAddr())
+		}
+		rpcReq.req.Trace = span.Context.TraceParent()
+		if rpcReq.req.IsOneWay {
+			defer span.Finish()
+		} else {
+			rpcReq.span = span
+		}
+	}
+
 	service.rpcMutex.Lock()
 	service.rpcReqSequence++
 	rpcReq.req.ReqCmdSeq = service.rpcReqSequence
 	rpcReq.sess = sess
+	if !rpcReq.req.IsOneWay && sess != nil && sess.conn != nil {
+		rpcReq.conn = sess.conn
+		atomic.AddInt64(&rpcReq.conn.pending, 1)
+	}
 	if issync {
 		rpcReq.signal = make(chan *RspProto, 1)
 	}
@@ -134,6 +230,17 @@ func (service *ServiceRpc) rpc_call(issync bool, sess *Session, peer net.Addr, f
 
 	err = service.sendRpcReq(sess, peer, rpcReq.req)
 	if err != nil {
+		//the request is never sent, it is done at once instead of timeout; error is returned without exception
+		service.rpcMutex.Lock()
+		_, found := service.rpcRequests[rpcReq.req.ReqCmdSeq]
+		delete(service.rpcRequests, rpcReq.req.ReqCmdSeq)
+		service.rpcMutex.Unlock()
+		if found {
+			if rpcReq.span != nil {
+				rpcReq.span.Err = err
+			}
+			rpcReq.done(false)
+		}
 		return err
 	}
 
@@ -147,8 +254,12 @@ func (service *ServiceRpc) rpc_call(issync bool, sess *Session, peer net.Addr, f
 		service.handleRpcRsp(rsp)
 	case <-to.C:
 		service.rpcMutex.Lock()
+		_, found := service.rpcRequests[rpcReq.req.ReqCmdSeq]
 		delete(service.rpcRequests, rpcReq.req.ReqCmdSeq)
 		service.rpcMutex.Unlock()
+		if found {
+			rpcReq.done(false)
+		}
 
 		if rpcReq.exception != nil {
 			rpcReq.exception(RpcErrCallTimeout)
@@ -160,17 +271,42 @@ func (service *ServiceRpc) rpc_call(issync bool, sess *Session, peer net.Addr, f
 }
 
 // RpcCall remotesession remotefunction(string) functionparams callback(could nil) exception(could nil, func(rspCode int32))
+// the call is in the span of the handler if it is called in a handler with span, see RpcCallTrace.
 func (service *ServiceRpc) RpcCall(sess *Session, funcName string, params ...interface{}) error {
-	return service.rpc_call(false, sess, nil, funcName, params...)
+	return service.rpc_call(false, sess, nil, nil, funcName, params...)
 }
 func (service *ServiceRpc) RpcCall_Sync(sess *Session, funcName string, params ...interface{}) error {
-	return service.rpc_call(true, sess, nil, funcName, params...)
+	return service.rpc_call(true, sess, nil, nil, funcName, params...)
+}
+
+// RpcCallTrace is RpcCall in span parent(usually current.Span of the handler), the remote handler is in the child span.
+func (service *ServiceRpc) RpcCallTrace(parent *Span, sess *Session, funcName string, params ...interface{}) error {
+	return service.rpc_call(false, sess, nil, parent, funcName, params...)
+}
+func (service *ServiceRpc) RpcCallTrace_Sync(parent *Span, sess *Session, funcName string, params ...interface{}) error {
+	return service.rpc_call(true, sess, nil, parent, funcName, params...)
 }
 func (service *ServiceRpc) UdpRpcCall(sess *Session, peer net.Addr, funcName string, params ...interface{}) error {
-	return service.rpc_call(false, sess, peer, funcName, params...)
+	return service.rpc_call(false, sess, peer, nil, funcName, params...)
 }
 func (service *ServiceRpc) UdpRpcCall_Sync(sess *Session, peer net.Addr, funcName string, params ...interface{}) error {
-	return service.rpc_call(true, sess, peer, funcName, params...)
+	return service.rpc_call(true, sess, peer, nil, funcName, params...)
+}
+
+// RpcCallPool call remote function of the connect picked from pool, key is used by ConsistentHashPicker.
+func (service *ServiceRpc) RpcCallPool(pool *ConnectPool, key string, funcName string, params ...interface{}) error {
+	sess := pool.Session(key)
+	if sess == nil {
+		return ErrNoConnect
+	}
+	return service.rpc_call(false, sess, nil, nil, funcName, params...)
+}
+func (service *ServiceRpc) RpcCallPool_Sync(pool *ConnectPool, key string, funcName string, params ...interface{}) error {
+	sess := pool.Session(key)
+	if sess == nil {
+		return ErrNoConnect
+	}
+	return service.rpc_call(true, sess, nil, nil, funcName, params...)
 }
 
 func (service *ServiceRpc) Init() bool {
@@ -180,6 +316,7 @@ func (service *ServiceRpc) Init() bool {
 func (service *ServiceRpc) Loop() {
 	now := time.Now().Unix()
 	timeouts := make([]*rpcRequest, 0)
+	expired := make([]*rpcRequest, 0)
 	service.rpcMutex.Lock()
 	for k, v := range service.rpcRequests {
 		if v.timeout < now {
@@ -187,10 +324,15 @@ func (service *ServiceRpc) Loop() {
 				timeouts = append(timeouts, v)
 			}
 			delete(service.rpcRequests, k)
+			expired = append(expired, v)
 		}
 	}
 	service.rpcMutex.Unlock()
 
+	for _, v := range expired {
+		v.done(false)
+	}
+
 	for _, v := range timeouts {
 		v.exception(RpcErrCallTimeout)
 	}
@@ -203,6 +345,10 @@ func (service *ServiceRpc) handleRpcReq(current *CurrentContent, req *ReqProto)
 	rsp.RspCmdSeq = req.ReqCmdSeq
 	rsp.FuncName = req.FuncName
 
+	if finish := startHandlerSpan(current, "rpc "+req.FuncName, req.Trace); finish != nil {
+		defer finish()
+	}
+
 	m, ok := service.methods[req.FuncName]
 	if !ok {
 		rsp.RspCode = RpcErrNoRemoteFunc
@@ -211,16 +357,25 @@ func (service *ServiceRpc) handleRpcReq(current *CurrentContent, req *ReqProto)
 		return
 	}
 
-	spb := Spb{[]byte(req.ReqData), 0}
-
-	var e error
+	unpacker, e := newRpcParams(current.Sess.msgEncoding(), req.ReqData)
+	if e != nil {
+		rsp.RspCode = RpcErrFuncParamErr
+		service.sendRpcRsp(current, rsp)
+		sysLog.Error("function %s param unpack failed: %s", req.FuncName, e.Error())
+		return
+	}
 	funcT := m.Type
 	funcVals := make([]reflect.Value, funcT.NumIn())
 	funcVals[0] = reflect.ValueOf(service.imp)
-	for i := 1; i < funcT.NumIn(); i++ {
+	first := 1 //first parameter passed by caller
+	if funcT.NumIn() > 1 && funcT.In(1) == currentContentType {
+		funcVals[1] = reflect.ValueOf(current)
+		first = 2
+	}
+	for i := first; i < funcT.NumIn(); i++ {
 		t := funcT.In(i)
 		val := newValByType(t)
-		e = rpcUnmarshal(&spb, uint32(i), val.Interface())
+		e = unpacker.unmarshal(uint32(i-first+1), val.Interface())
 		if e != nil {
 			rsp.RspCode = RpcErrFuncParamErr
 			service.sendRpcRsp(current, rsp)
@@ -240,9 +395,9 @@ func (service *ServiceRpc) handleRpcReq(current *CurrentContent, req *ReqProto)
 		return
 	}
 
-	spbSend := Spb{}
+	packer, _ := newRpcParams(unpacker.enc, nil)
 	for i, v := range returns {
-		e = rpcMarshal(&spbSend, uint32(i+1), v.Interface())
+		e = packer.marshal(uint32(i+1), v.Interface())
 		if e != nil {
 			rsp.RspCode = RpcErrFuncParamErr
 			service.sendRpcRsp(current, rsp)
@@ -250,7 +405,7 @@ func (service *ServiceRpc) handleRpcReq(current *CurrentContent, req *ReqProto)
 			return
 		}
 	}
-	rsp.RspData = spbSend.buf
+	rsp.RspData = packer.bytes()
 	service.sendRpcRsp(current, rsp)
 }
 
@@ -264,22 +419,31 @@ func (service *ServiceRpc) handleRpcRsp(rsp *RspProto) {
 	}
 	delete(service.rpcRequests, rsp.RspCmdSeq)
 	service.rpcMutex.Unlock()
+	if v.span != nil && rsp.RspCode != 0 {
+		v.span.Err = fmt.Errorf("rpc error code %d", rsp.RspCode)
+	}
+	v.done(true)
 
 	if rsp.RspCode != 0 {
 		if v.exception != nil {
 			v.exception(rsp.RspCode)
 		}
 	} else {
-		spb := Spb{rsp.RspData, 0}
-
 		if v.callback != nil {
-			var e error
+			unpacker, e := newRpcParams(v.encoding, rsp.RspData)
+			if e != nil {
+				if v.exception != nil {
+					v.exception(RpcErrFuncParamErr)
+				}
+				sysLog.Error("recv rpc rsp but unpack failed, func:%s,%s", rsp.FuncName, e.Error())
+				return
+			}
 			funcT := reflect.TypeOf(v.callback)
 			funcVals := make([]reflect.Value, funcT.NumIn())
 			for i := 0; i < funcT.NumIn(); i++ {
 				t := funcT.In(i)
 				val := newValByType(t)
-				e = rpcUnmarshal(&spb, uint32(i+1), val.Interface())
+				e = unpacker.unmarshal(uint32(i+1), val.Interface())
 				if e != nil {
 					if v.exception != nil {
 						v.exception(RpcErrFuncParamErr)
@@ -319,51 +483,46 @@ func (service *ServiceRpc) HandleError(current *CurrentContent, err error) {
 }
 
 func (service *ServiceRpc) Unmarshal(sess *Session, data []byte) (lenParsed int, msgID int64, msg interface{}, err error) {
-	if len(data) < 4 {
-		return 0, 0, nil, nil
-	}
-	msgLen := msgLen(data)
-	if msgLen < 4 || msgLen >= uint32(MaxMsgSize) {
-		return len(data), 0, nil, fmt.Errorf("message length is invalid: %d", msgLen)
+	msgLen, h, body, e := readFrame(sess, data)
+	if msgLen == 0 || e != nil {
+		return msgLen, 0, nil, e
 	}
-
-	if len(data) < int(msgLen) {
-		return 0, 0, nil, nil
+	if h.Flags&FrameFlagControl != 0 {
+		return msgLen, -1, nil, nil
 	}
 
-	flag := data[0]
-	if flag&0x1 == 0 { //req
+	if h.Flags&FrameFlagResponse == 0 { //req
 		req := &ReqProto{}
-		e := Unmarshal(data[4:msgLen], req, 0)
+		e := Unmarshal(body, req, 0)
 		if e != nil {
-			return int(msgLen), 0, nil, e
+			return msgLen, 0, nil, e
 		}
 
-		if flag&0x2 == 0 {
-			return int(msgLen), 0, req, nil
+		if h.Flags&FrameFlagRpc == 0 {
+			return msgLen, 0, req, nil
 		} else { //rpc
-			return int(msgLen), 2, req, nil
+			return msgLen, 2, req, nil
 		}
 	} else { //rsp
 		rsp := &RspProto{}
-		e := Unmarshal(data[4:msgLen], rsp, 0)
+		e := Unmarshal(body, rsp, 0)
 		if e != nil {
-			return int(msgLen), 0, nil, e
+			return msgLen, 0, nil, e
 		}
 
-		if flag&0x2 == 0 {
-			return int(msgLen), 1, rsp, nil
+		if h.Flags&FrameFlagRpc == 0 {
+			return msgLen, 1, rsp, nil
 		} else { //rpc
 			service.rpcMutex.Lock()
 			v, ok := service.rpcRequests[rsp.RspCmdSeq]
 			if ok && v.signal != nil { //sync call
 				v.signal <- rsp
 				service.rpcMutex.Unlock()
-				return int(msgLen), -1, nil, nil
+				return msgLen, -1, nil, nil
 			}
 			service.rpcMutex.Unlock()
 			//async call
-			return int(msgLen), 3, rsp, nil
+			return msgLen, 3, rsp, nil
 		}
 	}
 }
@@ -375,20 +534,11 @@ func (service *ServiceRpc) HashProcessor(current *CurrentContent, msgID uint64,
 //extra: req rsp
 /*
 func (service *ServiceRpc) SendUdpReq(sess *Session, peer net.Addr, req ReqProto) error {
-	buf, e := encodeProtocol(&req, 0)
-	if e != nil {
-		return e
-	}
-	return sess.Send(buf, peer)
+	return sendFrame(sess, peer, 0, &req, EncodeTyepSpb)
 }
 
 func (service *ServiceRpc) SendUdpRsp(sess *Session, peer net.Addr, rsp RspProto) error {
-	buf, e := encodeProtocol(&rsp, 0)
-	if e != nil {
-		return e
-	}
-	buf[0] |= 0x1
-	return sess.Send(buf, peer)
+	return sendFrame(sess, peer, FrameFlagResponse, &rsp, EncodeTyepSpb)
 }
 
 func (service *ServiceRpc) SendReq(sess *Session, req ReqProto) error {
@@ -400,42 +550,9 @@ func (service *ServiceRpc) SendRsp(sess *Session, rsp RspProto) error {
 }*/
 
 func (service *ServiceRpc) sendRpcReq(sess *Session, peer net.Addr, req ReqProto) error {
-	buf, e := encodeProtocol(&req, 0)
-	if e != nil {
-		return e
-	}
-	buf[0] |= 0x2
-	return sess.Send(buf, peer)
+	return sendFrame(sess, peer, FrameFlagRpc, &req, EncodeTyepSpb)
 }
 
 func (service *ServiceRpc) sendRpcRsp(current *CurrentContent, rsp RspProto) error {
-	buf, e := encodeProtocol(&rsp, 0)
-	if e != nil {
-		return e
-	}
-	buf[0] |= 0x3
-	return current.Sess.Send(buf, current.Peer)
-}
-
-func msgLen(b []byte) uint32 {
-	return uint32(b[3]) | uint32(b[2])<<8 | uint32(b[1])<<16 //| uint32(b[0])<<24
-}
-
-func encodeProtocol(msg interface{}, encode int) ([]byte, error) {
-	data, e := Marshal(msg, encode)
-	if e != nil {
-		return nil, e
-	}
-	msglen := len(data) + 4
-	spbMsg := Spb{}
-	spbMsg.packByte(byte(msglen >> 24))
-	spbMsg.packByte(byte(msglen >> 16))
-	spbMsg.packByte(byte(msglen >> 8))
-	spbMsg.packByte(byte(msglen))
-	spbMsg.packData(data)
-	flag := spbMsg.buf[0]
-	if flag > 0 {
-		return nil, fmt.Errorf("msg is too long: %d,max size is 16k", msglen)
-	}
-	return spbMsg.buf, nil
+	return sendFrame(current.Sess, current.Peer, FrameFlagRpc|FrameFlagResponse, &rsp, EncodeTyepSpb)
 }
@@ -0,0 +1,163 @@
+package stnet_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/greedchase/gotools/stnet"
+	"github.com/greedchase/gotools/stnet/stnettest"
+)
+
+type arith struct {
+	called chan string
+}
+
+func (a *arith) Loop()                                                {}
+func (a *arith) HandleError(current *stnet.CurrentContent, err error) {}
+func (a *arith) HashProcessor(current *stnet.CurrentContent) int      { return -1 }
+
+func (a *arith) Add(x, y int) int {
+	return x + y
+}
+
+func (a *arith) Div(x, y int) (int, int) {
+	return x / y, x % y
+}
+
+func (a *arith) Concat(s []string, sep string) string {
+	r := ""
+	for i, v := range s {
+		if i > 0 {
+			r += sep
+		}
+		r += v
+	}
+	return r
+}
+
+func (a *arith) Traced(current *stnet.CurrentContent, x int) int {
+	if current.Span == nil {
+		return 0
+	}
+	return x
+}
+
+func (a *arith) Notify(msg string) {
+	a.called <- msg
+}
+
+func startRpc(t *testing.T) (*stnettest.Harness, *stnet.ServiceRpc, *stnet.Connect, *arith) {
+	h := stnettest.New(t, 2)
+	a := &arith{called: make(chan string, 1)}
+	_, srec := h.AddService("server", stnet.NewServiceRpc(a), 0)
+	client := stnet.NewServiceRpc(&arith{})
+	cs, crec := h.AddClientService("client", client, 1)
+	conn := cs.NewConnectWithPolicy(h.Addr("server"), nil, fastPolicy())
+	h.Start()
+	h.WaitOpen(srec)
+	h.WaitOpen(crec)
+	return h, client, conn, a
+}
+
+func TestRpcCallSync(t *testing.T) {
+	h, client, conn, _ := startRpc(t)
+	defer h.Stop()
+
+	sum := 0
+	err := client.RpcCall_Sync(conn.Session(), "Add", 1, 2, func(r int) { sum = r }, func(code int32) {
+		t.Errorf("exception %d", code)
+	})
+	if err != nil || sum != 3 {
+		t.Fatalf("Add = %d, %v", sum, err)
+	}
+
+	q, m := 0, 0
+	client.RpcCall_Sync(conn.Session(), "Div", 7, 2, func(a, b int) { q, m = a, b }, nil)
+	if q != 3 || m != 1 {
+		t.Fatalf("Div = %d %d", q, m)
+	}
+
+	s := ""
+	client.RpcCall_Sync(conn.Session(), "Concat", []string{"a", "b", "c"}, "-", func(r string) { s = r }, nil)
+	if s != "a-b-c" {
+		t.Fatalf("Concat = %s", s)
+	}
+}
+
+func TestRpcCallAsync(t *testing.T) {
+	h, client, conn, _ := startRpc(t)
+	defer h.Stop()
+
+	done := make(chan int, 1)
+	if err := client.RpcCall(conn.Session(), "Add", 20, 22, func(r int) { done <- r }, nil); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case r := <-done:
+		if r != 42 {
+			t.Fatalf("Add = %d", r)
+		}
+	case <-time.After(stnettest.DefaultTimeout):
+		t.Fatal("no response")
+	}
+}
+
+func TestRpcOneWay(t *testing.T) {
+	h, client, conn, a := startRpc(t)
+	defer h.Stop()
+
+	if err := client.RpcCall(conn.Session(), "Notify", "hi", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-a.called:
+		if msg != "hi" {
+			t.Fatalf("Notify(%s)", msg)
+		}
+	case <-time.After(stnettest.DefaultTimeout):
+		t.Fatal("oneway call is not received")
+	}
+}
+
+func TestRpcNoRemoteFunc(t *testing.T) {
+	h, client, conn, _ := startRpc(t)
+	defer h.Stop()
+
+	code := int32(0)
+	client.RpcCall_Sync(conn.Session(), "Nothing", 1, func(int) {}, func(c int32) { code = c })
+	if code != stnet.RpcErrNoRemoteFunc {
+		t.Fatalf("exception %d, want %d", code, stnet.RpcErrNoRemoteFunc)
+	}
+}
+
+func TestRpcCallNoCallback(t *testing.T) {
+	h, client, conn, _ := startRpc(t)
+	defer h.Stop()
+
+	if err := client.RpcCall(conn.Session(), "Add"); err == nil {
+		t.Fatal("call without callback should fail")
+	}
+}
+
+func TestRpcCallSendFailed(t *testing.T) {
+	h := stnettest.New(t, 2)
+	_, srec := h.AddService("server", stnet.NewServiceRpc(&arith{}), 0)
+	client := stnet.NewServiceRpc(&arith{})
+	cs, crec := h.AddClientService("client", client, 1)
+	conn := cs.NewConnectWithPolicy(h.Addr("server"), nil, fastPolicy())
+	h.Start()
+	defer h.Stop()
+	h.WaitOpen(srec)
+	sess := h.WaitOpen(crec)
+
+	conn.Close()
+	h.WaitClose(crec, sess)
+	called := false
+	err := client.RpcCall(sess, "Add", 1, 2, func(int) {}, func(int32) { called = true })
+	if err == nil {
+		t.Fatal("call on closed session should fail")
+	}
+	if conn.Pending() != 0 || called {
+		t.Fatalf("pending %d, exception called %v", conn.Pending(), called)
+	}
+}
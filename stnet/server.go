@@ -3,6 +3,7 @@ package stnet
 import (
 	"fmt"
 	"net"
+	"runtime"
 	"sync"
 	"time"
 )
@@ -14,9 +15,15 @@ type Server struct {
 	wg        sync.WaitGroup
 	isClose   *Closer
 	netSignal []chan int
+	tasks     []chan func() //task queue of processor threads
+	timer     *timerWheel
+	procRing  *hashRing //consistent hash of processor threads
 
 	nameServices map[string]*Service
 
+	groups     map[string]*SessionGroup
+	groupMutex sync.RWMutex
+
 	ProcessorThreadsNum int //number of threads in server.
 }
 
@@ -35,11 +42,18 @@ func NewServer(loopmsec uint32, threadnum int) *Server {
 	svr.services = make(map[int][]*Service)
 	svr.isClose = NewCloser(false)
 	svr.nameServices = make(map[string]*Service)
+	svr.groups = make(map[string]*SessionGroup)
 
 	svr.netSignal = make([]chan int, svr.ProcessorThreadsNum)
 	for i := 0; i < svr.ProcessorThreadsNum; i++ {
 		svr.netSignal[i] = make(chan int, 1)
 	}
+	svr.tasks = make([]chan func(), svr.ProcessorThreadsNum)
+	for i := 0; i < svr.ProcessorThreadsNum; i++ {
+		svr.tasks[i] = make(chan func(), 10240)
+	}
+	svr.procRing = newProcessorRing(svr.ProcessorThreadsNum)
+	svr.timer = newTimerWheel(time.Duration(loopmsec) * time.Millisecond)
 	return svr
 }
 
@@ -59,6 +73,22 @@ func (svr *Server) newService(name, address string, heartbeat uint32, imp Servic
 		threadId:  threadId,
 		svr:       svr,
 	}
+	sve.keyProc = keyProcessorOf(imp)
+	sve.lanes = [][]chan sessionMessage{msgTh}
+	if p := priorityProcessorOf(imp); p != nil {
+		sve.priority = p
+		sve.laneStates = make([]laneState, svr.ProcessorThreadsNum)
+		for i := range sve.laneStates {
+			sve.laneStates[i].rescue = PriorityLanes - 2
+		}
+		for l := PriorityLow + 1; l < PriorityLanes; l++ {
+			q := make([]chan sessionMessage, svr.ProcessorThreadsNum)
+			for i := 0; i < svr.ProcessorThreadsNum; i++ {
+				q[i] = make(chan sessionMessage, 10240)
+			}
+			sve.lanes = append(sve.lanes, q)
+		}
+	}
 
 	if address != "" {
 		var (
@@ -66,9 +96,16 @@ func (svr *Server) newService(name, address string, heartbeat uint32, imp Servic
 			err error
 		)
 		network, ipport := parseAddress(address)
-		if network == "udp" {
+		switch network {
+		case "udp":
 			lis, err = NewUdpListener(ipport, sve, heartbeat)
-		} else {
+		case "unix":
+			lis, err = NewUnixListener(ipport, sve, heartbeat)
+		case "unixgram":
+			lis, err = NewUnixgramListener(ipport, sve, heartbeat)
+		case "mem":
+			lis, err = NewMemListener(ipport, sve, heartbeat)
+		default:
 			lis, err = NewListener(ipport, sve, heartbeat)
 		}
 		if err != nil {
@@ -82,12 +119,14 @@ func (svr *Server) newService(name, address string, heartbeat uint32, imp Servic
 
 // AddService must be called before server started.
 // address could be null,then you get a service without listen; address could be udp,example udp:127.0.0.1:6060,default use tcp(127.0.0.1:6060)
+// address could be unix domain socket,example unix:///tmp/s.sock or unixgram:///tmp/s.sock; unix://@name is in the abstract namespace(linux only).
+// address could be mem://name, it is an in-process transport for tests.
 // when heartbeat(second)=0,heartbeat will be close.
 // threadId should be between 1-ProcessorThreadsNum.
 // call Service.NewConnect start a connector
 func (svr *Server) AddService(name, address string, heartbeat uint32, imp ServiceImp, threadId int) (*Service, error) {
 	if threadId < 0 || threadId > svr.ProcessorThreadsNum {
-		return nil, fmt.Errorf("threadId should be 1-%s", svr.ProcessorThreadsNum)
+		return nil, fmt.Errorf("threadId should be 1-%d", svr.ProcessorThreadsNum)
 	}
 	threadId = threadId % svr.ProcessorThreadsNum
 	s, e := svr.newService(name, address, heartbeat, imp, &svr.netSignal, threadId)
@@ -119,9 +158,9 @@ func (svr *Server) AddSpbService(name, address string, heartbeat uint32, imp *Se
 	return svr.AddService(name, address, heartbeat, imp, threadId)
 }
 
-// AddJsonService use SendJsonCmd to send message
+// AddJsonService use SendJsonCmd to send message, use AddService with NewServiceJson to register typed handlers.
 func (svr *Server) AddJsonService(name, address string, heartbeat uint32, imp JsonService, threadId int) (*Service, error) {
-	return svr.AddService(name, address, heartbeat, &ServiceJson{ServiceBase{}, imp}, threadId)
+	return svr.AddService(name, address, heartbeat, NewServiceJson(imp), threadId)
 }
 
 // AddRpcService imp:	NewServiceRpc
@@ -129,16 +168,37 @@ func (svr *Server) AddRpcService(name, address string, heartbeat uint32, imp *Se
 	return svr.AddService(name, address, heartbeat, imp, threadId)
 }
 
+// AddJsonRpcService imp: NewServiceJsonRpc, JSON-RPC 2.0 over tcp frames.
+func (svr *Server) AddJsonRpcService(name, address string, heartbeat uint32, imp *ServiceJsonRpc, threadId int) (*Service, error) {
+	return svr.AddService(name, address, heartbeat, imp, threadId)
+}
+
+// AddJsonRpcHttpService imp: NewServiceJsonRpc, JSON-RPC 2.0 over http POST of any path.
+func (svr *Server) AddJsonRpcHttpService(name, address string, heartbeat uint32, imp *ServiceJsonRpc, threadId int) (*Service, error) {
+	return svr.AddService(name, address, heartbeat, &ServiceHttp{ServiceBase{}, jsonRpcHttp{imp}, nil}, threadId)
+}
+
 func (svr *Server) AddTcpProxyService(address string, heartbeat uint32, threadId int, proxyaddr []string, proxyweight []int) error {
+	_, e := svr.AddTcpProxyServiceWithHeader(address, heartbeat, threadId, proxyaddr, proxyweight, 0)
+	return e
+}
+
+// AddTcpProxyServiceWithHeader proxyHeader is the version(1 or 2) of PROXY protocol header sent to backends before any data, 0 means no header.
+// use SetProxyProtocol of the returned service to accept PROXY protocol header from load balancer.
+func (svr *Server) AddTcpProxyServiceWithHeader(address string, heartbeat uint32, threadId int, proxyaddr []string, proxyweight []int, proxyHeader int) (*Service, error) {
 	if len(proxyaddr) > 1 && len(proxyaddr) != len(proxyweight) {
-		return fmt.Errorf("error proxy param")
+		return nil, fmt.Errorf("error proxy param")
+	}
+	if proxyHeader < 0 || proxyHeader > 2 {
+		return nil, fmt.Errorf("error PROXY protocol version: %d", proxyHeader)
 	}
 	c, e := svr.AddService("", "", 0, &ServiceProxyC{}, threadId)
 	if e != nil {
-		return e
+		return nil, e
 	}
 	s := &ServiceProxyS{}
 	s.remote = c
+	s.proxyHeader = proxyHeader
 	addr := make([]string, len(proxyaddr))
 	copy(addr, proxyaddr)
 	s.remoteip = addr
@@ -150,8 +210,7 @@ func (svr *Server) AddTcpProxyService(address string, heartbeat uint32, threadId
 		}
 		s.weight = weight
 	}
-	_, e = svr.AddService("", address, heartbeat, s, threadId)
-	return e
+	return svr.AddService("", address, heartbeat, s, threadId)
 }
 
 // PushRequest push message into handle thread;id of thread is the result of ServiceImp.HashProcessor
@@ -176,6 +235,49 @@ type CurrentContent struct {
 	Sess        *Session
 	UserDefined interface{}
 	Peer        net.Addr //use in udp
+	Span        *Span    //span of the message handled, nil if it carries no trace context and tracing is disabled
+}
+
+// postTask push fn into task queue of processor thread th.
+func (svr *Server) postTask(th int, fn func()) error {
+	select {
+	case svr.tasks[th] <- fn:
+	default:
+		return fmt.Errorf("task queue is full and the task is droped;thread=%d", th)
+	}
+
+	//wakeup logic thread
+	select {
+	case svr.netSignal[th] <- 1:
+	default:
+	}
+	return nil
+}
+
+func (svr *Server) runTask(fn func()) {
+	defer func() {
+		if err := recover(); err != nil {
+			sysLog.Critical("panic error: %v", err)
+			buf := make([]byte, 16384)
+			buf = buf[:runtime.Stack(buf, true)]
+			sysLog.Critical("panic stack: %s", string(buf))
+		}
+	}()
+	fn()
+}
+
+func (svr *Server) runTasks(th int) int {
+	n := 0
+	for i := 0; i < 1024; i++ {
+		select {
+		case fn := <-svr.tasks[th]:
+			svr.runTask(fn)
+			n++
+		default:
+			return n
+		}
+	}
+	return n
 }
 
 func (svr *Server) Start() error {
@@ -211,6 +313,7 @@ func (svr *Server) Start() error {
 				for _, s := range all {
 					s.messageThread(current)
 				}
+				svr.runTasks(threadIdx)
 
 				subD := now.Sub(lastLoopTime)
 				if subD < needD {
@@ -239,6 +342,7 @@ func (svr *Server) Start() error {
 				for _, s := range ss {
 					nmsg += s.messageThread(current)
 				}
+				nmsg += svr.runTasks(idx)
 				if nmsg == 0 {
 					//wait for new message
 					<-svr.netSignal[idx]
@@ -248,6 +352,12 @@ func (svr *Server) Start() error {
 			svr.wg.Done()
 		}(i, allServices)
 	}
+	svr.timer.mutex.Lock()
+	svr.timer.start = time.Now()
+	svr.timer.mutex.Unlock()
+	svr.wg.Add(1)
+	go svr.timer.run(svr)
+
 	sysLog.Debug("server start~~~~~~")
 	return nil
 }
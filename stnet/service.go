@@ -6,6 +6,7 @@ import (
 	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -13,15 +14,39 @@ type Service struct {
 	*Listener
 	Name     string
 	imp      ServiceImp
-	messageQ []chan sessionMessage
-	connects sync.Map //map[uint64]*Connect
+	messageQ []chan sessionMessage //lowest lane
+	//lanes[priority][threadid], lanes[PriorityLow] is messageQ
+	lanes      [][]chan sessionMessage
+	laneStates []laneState
+	priority   PriorityProcessor
+	keyProc    KeyProcessor
+	connects   sync.Map //map[uint64]*Connect
 	//connectMutex sync.Mutex
 	netSignal *[]chan int
 	threadId  int
 	svr       *Server
+
+	rateLimit atomic.Value //*rateLimitConfig
+	rateMutex sync.Mutex
+
+	compress atomic.Value //*compressConfig
+	encrypt  atomic.Value //*EncryptOptions
+	codec    atomic.Value //codecHolder
+	msgCodec int32        //id of Codec+1, 0 means not set
 }
 
+// parseAddress split address into network and address of the network.
+// unix://path and unixgram://path are unix domain sockets; a path beginning with '@' is in the abstract namespace(linux only).
+// mem://name is in-process transport.
 func parseAddress(address string) (network string, ipport string) {
+	if strings.HasPrefix(address, "unix://") {
+		return "unix", strings.TrimPrefix(address, "unix://")
+	} else if strings.HasPrefix(address, "unixgram://") {
+		return "unixgram", strings.TrimPrefix(address, "unixgram://")
+	} else if strings.HasPrefix(address, "mem://") {
+		return "mem", strings.TrimPrefix(address, "mem://")
+	}
+
 	network = "tcp"
 	ipport = address
 	ipport = strings.Replace(ipport, " ", "", -1)
@@ -32,6 +57,11 @@ func parseAddress(address string) (network string, ipport string) {
 	return network, ipport
 }
 
+// isPacketNetwork datagram network reads and writes a whole message once, such as udp and unixgram.
+func isPacketNetwork(network string) bool {
+	return network == "udp" || network == "unixgram"
+}
+
 func (service *Service) handlePanic() {
 	if err := recover(); err != nil {
 		sysLog.Critical("panic error: %v", err)
@@ -65,13 +95,15 @@ func (service *Service) messageThread(current *CurrentContent) int {
 
 	n := 0
 	for i := 0; i < 1024; i++ {
-		select {
-		case msg := <-service.messageQ[current.GoroutineID]:
-			service.handleMsg(current, msg)
-			n++
-		default:
+		msg, lane, ok := service.popMessage(current.GoroutineID)
+		if !ok {
 			return n
 		}
+		service.handleMsg(current, msg)
+		if lane > PriorityLow && msg.Sess != nil {
+			service.laneDone(msg.Sess)
+		}
+		n++
 	}
 	return n
 }
@@ -85,6 +117,13 @@ type sessionMessage struct {
 	peer   net.Addr
 }
 
+func (service *Service) admit(remote net.Addr) error {
+	if a, ok := service.imp.(SessionAdmitter); ok {
+		return a.Admit(remote)
+	}
+	return nil
+}
+
 func (service *Service) Imp() ServiceImp {
 	return service.imp
 }
@@ -116,9 +155,7 @@ func (service *Service) PushRequest(sess *Session, msgid int64, msg interface{})
 	if sess != nil {
 		m.peer = sess.peer
 	}
-	select {
-	case service.messageQ[th] <- m:
-	default:
+	if !service.pushLane(th, service.getPriority(sess, msgid, msg), m) {
 		return fmt.Errorf("service recv queue is full and the message is droped;service=%s;msgid=%d;", service.Name, msgid)
 	}
 
@@ -133,7 +170,13 @@ func (service *Service) PushRequest(sess *Session, msgid int64, msg interface{})
 func (service *Service) getProcessor(sess *Session, msgid int64, msg interface{}) int {
 	cur := &CurrentContent{}
 	if sess != nil {
-		cur = &CurrentContent{0, sess, sess.UserData, sess.peer}
+		cur = &CurrentContent{0, sess, sess.UserData, sess.peer, nil}
+	}
+	if service.keyProc != nil {
+		m, _ := untraceMsg(msg) //user hooks get the message without trace context
+		if key := service.keyProc.ProcessorKey(cur, uint64(msgid), m); key != "" {
+			return service.svr.KeyProcessor(key)
+		}
 	}
 	th := service.imp.HashProcessor(cur, uint64(msgid), msg)
 	if th > 0 {
@@ -152,13 +195,24 @@ func (service *Service) getProcessor(sess *Session, msgid int64, msg interface{}
 
 func (service *Service) ParseMsg(sess *Session, data []byte) int {
 	lenParsed, msgid, msg, e := service.imp.Unmarshal(sess, data)
+	if lenParsed > 0 && sess.cryptState() == nil { //frames of encrypted session are recorded after decryption
+		if lenParsed < len(data) {
+			sess.record(TrafficIn, data[:lenParsed])
+		} else {
+			sess.record(TrafficIn, data)
+		}
+	}
 	if lenParsed <= 0 || msgid < 0 {
 		return lenParsed
 	}
+	//malformed messages are limited too, so that they can't flood the processor
+	if ok, closed := service.checkRateLimit(sess, msgid, lenParsed); closed {
+		return len(data) //session is closed, drop the rest data
+	} else if !ok {
+		return lenParsed
+	}
 	th := service.getProcessor(sess, msgid, msg)
-	select {
-	case service.messageQ[th] <- sessionMessage{sess, Data, msgid, msg, e, sess.peer}:
-	default:
+	if !service.pushLane(th, service.getPriority(sess, msgid, msg), sessionMessage{sess, Data, msgid, msg, e, sess.peer}) {
 		sysLog.Error("service recv queue is full and the message is droped;service=%s;msgid=%d;err=%v;", service.Name, msgid, e)
 	}
 
@@ -175,7 +229,9 @@ func (service *Service) sessionEvent(sess *Session, cmd CMDType) {
 	if cmd == Data {
 		th = service.getProcessor(sess, 0, nil)
 	} else if cmd == Open {
-		service.handleMsg(&CurrentContent{th, sess, nil, nil}, sessionMessage{sess, cmd, 0, nil, nil, sess.peer})
+		service.startCompress(sess)
+		service.startCodec(sess)
+		service.handleMsg(&CurrentContent{th, sess, nil, nil, nil}, sessionMessage{sess, cmd, 0, nil, nil, sess.peer})
 		return
 	}
 
@@ -209,8 +265,24 @@ func (service *Service) GetConnect(id uint64) *Connect {
 
 // NewConnect reconnect at 0 1 4 9 16...times reconnectMSec(100ms);when call send or changeAddr, it will NotifyReconn and reconnect at once;when call Close, reconnect will stop
 func (service *Service) NewConnect(address string, userdata interface{}) *Connect {
-	conn := &Connect{NewConnector(address, service, userdata), service}
+	return service.NewConnectWithPolicy(address, userdata, nil)
+}
+
+// NewConnectWithPolicy reconnect by policy, nil means DefaultReconnectPolicy.
+// the connect is removed from the service when it is closed or gives up(policy.MaxAttempts).
+func (service *Service) NewConnectWithPolicy(address string, userdata interface{}, policy *ReconnectPolicy) *Connect {
+	return service.newConnect(address, userdata, policy, nil)
+}
+
+// newConnect every connection of the connect begins with preface, it could be nil.
+func (service *Service) newConnect(address string, userdata interface{}, policy *ReconnectPolicy, preface []byte) *Connect {
+	conn := &Connect{newConnector(address, service, userdata, policy), service}
+	conn.preface = preface
+	conn.onGiveUp = func() {
+		service.connects.Delete(conn.GetID())
+	}
 	service.connects.Store(conn.GetID(), conn)
+	conn.start()
 	return conn
 }
 
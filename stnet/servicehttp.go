@@ -143,8 +143,8 @@ func (service *ServiceHttp) Unmarshal(sess *Session, data []byte) (lenParsed int
 	cl = textproto.TrimString(cl)
 	if len(cl) > 0 { //fixed length
 		n, err := strconv.ParseUint(cl, 10, 63)
-		if err != nil {
-			return len(data), 0, nil, fmt.Errorf("bad Content-Length %d", cl)
+		if err != nil || n >= uint64(MaxMsgSize) {
+			return len(data), 0, nil, fmt.Errorf("bad Content-Length %s", cl)
 		}
 		dataLen += int(n)
 		if len(data) < dataLen {
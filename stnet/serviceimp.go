@@ -1,5 +1,9 @@
 package stnet
 
+import (
+	"net"
+)
+
 type ServiceImp interface {
 	Init() bool
 	Loop()
@@ -27,6 +31,42 @@ type ServiceImp interface {
 	HashProcessor(current *CurrentContent, msgID uint64, msg interface{}) (processorID int)
 }
 
+// PriorityProcessor is an optional interface of ServiceImp(or the imp of ServiceSpb ServiceJson ServiceRpc ServiceHttp).
+// MsgPriority is called in receiving thread with the message returned by Unmarshal,
+// it returns the lane of the message: PriorityLow PriorityNormal or PriorityHigh.
+// message queues of higher lanes are created only when the imp implements it.
+type PriorityProcessor interface {
+	MsgPriority(current *CurrentContent, msgID uint64, msg interface{}) (priority int)
+}
+
+// KeyProcessor is an optional interface of ServiceImp(or the imp of ServiceSpb ServiceJson ServiceRpc ServiceHttp).
+// ProcessorKey is called instead of HashProcessor, messages are dispatched by consistent hashing of the key,
+// messages with the same key(example: player id) are always processed in the same thread one by one; see Server.KeyProcessor.
+// if key is empty, HashProcessor is used.
+type KeyProcessor interface {
+	ProcessorKey(current *CurrentContent, msgID uint64, msg interface{}) (key string)
+}
+
+// SessionAdmitter is an optional interface of ServiceImp.
+// Admit is called in accepting thread before session is created(SessionOpen);
+// the connection will be closed when it returns error.
+type SessionAdmitter interface {
+	Admit(remote net.Addr) error
+}
+
+// SessionThrottler is an optional interface of ServiceImp.
+// SessionThrottled is called in receiving thread of the session when its message is over limit of Service.SetRateLimit,
+// action is RateLimitDrop RateLimitDelay or RateLimitDisconnect.
+type SessionThrottler interface {
+	SessionThrottled(sess *Session, msgID int64, action int)
+}
+
+// CircuitObserver is an optional interface of ServiceImp.
+// CircuitStateChanged is called in random thread when state of circuit breaker of the connect changed.
+type CircuitObserver interface {
+	CircuitStateChanged(conn *Connect, from, to CircuitState)
+}
+
 type LoopService interface {
 	Init() bool
 	Loop()
@@ -35,6 +75,7 @@ type LoopService interface {
 type JsonProto struct {
 	CmdId   uint64 `json:"id"`
 	CmdData []byte `json:"cmd"`
+	Trace   string `json:"trace,omitempty"` //W3C traceparent, see TraceContext
 }
 type JsonService interface {
 	Init() bool
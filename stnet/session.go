@@ -59,8 +59,9 @@ var (
 var GlobalSessionID uint64
 
 type rsData struct {
-	data []byte
-	peer net.Addr
+	data   []byte
+	peer   net.Addr
+	shared bool //data is shared by sessions, it should not be freed
 }
 
 type Session struct {
@@ -76,27 +77,47 @@ type Session struct {
 	isclose   *Closer
 	heartbeat uint32
 	conn      *Connector
-	isUdp     bool
+	isUdp     bool //datagram socket, udp or unixgram
 	peer      net.Addr
+	limiter   *sessionLimiter
+	//limiters of peers, only used by session of datagram listener
+	peerLimiters *peerLimiters
+	laneQueued   int32 //data in priority lanes higher than PriorityLow not handled
+	laneDeferred int32 //session events deferred by laneQueued
+
+	groups     map[*SessionGroup]struct{}
+	groupMutex sync.Mutex
+
+	timers     map[TimerID]*Server
+	timerMutex sync.Mutex
+
+	recorder atomic.Value //*TrafficRecorder
+	compress atomic.Value //*sessionCompress
+	crypt    atomic.Value //*sessionCrypt
 
 	UserData interface{}
 }
 
+// queueLen return length of sending and receiving queues of session, datagram session has longer queues.
+func queueLen(isudp bool) (writerLen int, recvLen int) {
+	if isudp {
+		return 10240, 10240
+	}
+	return WriterListLen, RecvListLen
+}
+
 func NewSession(con net.Conn, msgparse MsgParse, onopen FuncOnOpen, onclose FuncOnClose, heartbeat uint32, isudp bool) (*Session, error) {
 	if msgparse == nil {
 		return nil, ErrMsgParseNil
 	}
 
-	if isudp {
-		WriterListLen = 10240
-		RecvListLen = 10240
-	}
+	writerLen, recvLen := queueLen(isudp)
 
 	sess := &Session{
 		id:        atomic.AddUint64(&GlobalSessionID, 1),
 		socket:    con,
-		writer:    make(chan rsData, WriterListLen), //It's OK to leave a Go channel open forever and never close it. When the channel is no longer used, it will be garbage collected.
-		hander:    make(chan rsData, RecvListLen),
+		writer:    make(chan rsData, writerLen), //It's OK to leave a Go channel open forever and never close it. When the channel is no longer used, it will be garbage collected.
+		hander:    make(chan rsData, recvLen),
 		closer:    make(chan int),
 		wg:        &sync.WaitGroup{},
 		parser:    msgparse,
@@ -106,6 +127,10 @@ func NewSession(con net.Conn, msgparse MsgParse, onopen FuncOnOpen, onclose Func
 		heartbeat: heartbeat,
 		isUdp:     isudp,
 	}
+	if err := sess.initCrypt(); err != nil {
+		con.Close()
+		return nil, err
+	}
 	if isudp {
 		sysLog.System("udp session start, local addr: %s", sess.socket.LocalAddr())
 	} else {
@@ -123,15 +148,12 @@ func newConnSession(msgparse MsgParse, onopen FuncOnOpen, onclose FuncOnClose, c
 		return nil, ErrMsgParseNil
 	}
 
-	if isudp {
-		WriterListLen = 10240
-		RecvListLen = 10240
-	}
+	writerLen, recvLen := queueLen(isudp)
 
 	sess := &Session{
 		id:        atomic.AddUint64(&GlobalSessionID, 1),
-		writer:    make(chan rsData, WriterListLen), //It's OK to leave a Go channel open forever and never close it. When the channel is no longer used, it will be garbage collected.
-		hander:    make(chan rsData, RecvListLen),
+		writer:    make(chan rsData, writerLen), //It's OK to leave a Go channel open forever and never close it. When the channel is no longer used, it will be garbage collected.
+		hander:    make(chan rsData, recvLen),
 		wg:        &sync.WaitGroup{},
 		parser:    msgparse,
 		onopen:    onopen,
@@ -145,6 +167,9 @@ func newConnSession(msgparse MsgParse, onopen FuncOnOpen, onclose FuncOnClose, c
 }
 
 func (s *Session) RemoteAddr() string {
+	if s.peer == nil {
+		return ""
+	}
 	return s.peer.Network() + ":" + s.peer.String()
 }
 
@@ -167,13 +192,17 @@ func (s *Session) restart(con net.Conn) error {
 	if !s.isclose.IsClose() {
 		return ErrSocketIsOpen
 	}
-	s.isclose = NewCloser(false)
+	s.isclose.Open()
 	s.closer = make(chan int)
 	s.socket = con
 	//writer buffer not should be cleanup
 	//s.writer = make(chan rsData, WriterListLen)
 	//receive buffer maybe half part,so should be cleanup
-	s.hander = make(chan rsData, RecvListLen)
+	s.hander = make(chan rsData, cap(s.hander))
+	if err := s.initCrypt(); err != nil {
+		sysLog.Error("session init encryption failed: %s;sessionid=%d", err.Error(), s.id)
+		con.Close()
+	}
 
 	if s.isUdp {
 		sysLog.System("udp session restart, local addr: %s", s.socket.LocalAddr())
@@ -195,15 +224,21 @@ func (s *Session) Peer() net.Addr {
 	return s.peer
 }
 
-// Send peer is used in udp
+// Send peer is used in udp.
+// data of connector session is queued when it is not connected, and it is sent after connecting.
 func (s *Session) Send(data []byte, peerUdp net.Addr) error {
+	closer, err := s.sendCloser()
+	if err != nil {
+		return err
+	}
+	s.record(TrafficOut, data)
 	msg := bp.Alloc(len(data))
 	copy(msg, data)
 
 	select {
-	case <-s.closer:
+	case <-closer:
 		return ErrSocketClosed
-	case s.writer <- rsData{msg, peerUdp}:
+	case s.writer <- rsData{msg, peerUdp, false}:
 		return nil
 	default:
 		sysLog.Error("session sending queue is full and the message is droped;sessionid=%d", s.id)
@@ -211,6 +246,36 @@ func (s *Session) Send(data []byte, peerUdp net.Addr) error {
 	}
 }
 
+// sendShared send data without copy, data should not be modified.
+func (s *Session) sendShared(data []byte) error {
+	closer, err := s.sendCloser()
+	if err != nil {
+		return err
+	}
+	s.record(TrafficOut, data)
+	select {
+	case <-closer:
+		return ErrSocketClosed
+	case s.writer <- rsData{data, nil, true}:
+		return nil
+	default:
+		sysLog.Error("session sending queue is full and the message is droped;sessionid=%d", s.id)
+		return ErrSendBuffIsFull
+	}
+}
+
+// sendCloser returns channel closed when data could not be sent.
+// it is nil for connector session which restarts with new closer, data is queued until the connector is closed.
+func (s *Session) sendCloser() (chan int, error) {
+	if s.conn == nil {
+		return s.closer, nil
+	}
+	if s.conn.IsClose() {
+		return nil, ErrSocketClosed
+	}
+	return nil, nil
+}
+
 func (s *Session) Close() {
 	if s.IsClose() {
 		return
@@ -224,39 +289,99 @@ func (s *Session) IsClose() bool {
 }
 
 func (s *Session) dosend() {
-	var udpConn *net.UDPConn
+	var udpConn net.PacketConn
 	if s.isUdp {
-		udpConn = s.socket.(*net.UDPConn)
+		udpConn = s.socket.(net.PacketConn)
+	}
+
+	//encrypted session: client sends key exchange first, server replies when keys are established
+	c := s.cryptState()
+	var ready <-chan struct{}
+	if c != nil {
+		if c.client {
+			if !s.write(c.hello) {
+				return
+			}
+		} else {
+			ready = c.ready
+		}
 	}
 
 	for {
 		select {
 		case <-s.closer:
 			return
+		case <-ready:
+			ready = nil
+			if !s.write(c.hello) {
+				return
+			}
 		case buf := <-s.writer:
 			if s.isUdp {
 				if buf.peer == nil || s.conn != nil {
-					udpConn.Write(buf.data)
+					s.socket.Write(buf.data)
 				} else {
 					udpConn.WriteTo(buf.data, buf.peer)
 				}
-			} else {
-				//s.socket.SetWriteDeadline(time.Now().Add(time.Millisecond * 300))
-				n := 0
-				for n < len(buf.data) {
-					n1, err := s.socket.Write(buf.data[n:])
-					if err != nil {
-						sysLog.Error("session sending error: %s;sessionid=%d", err.Error(), s.id)
-						s.socket.Close()
-						bp.Free(buf.data)
-						return
-					}
-					n += n1
+			} else if c != nil {
+				ok := s.sendEncrypted(c, buf.data, &ready)
+				if !buf.shared {
+					bp.Free(buf.data)
+				}
+				if !ok {
+					return
 				}
+				continue
+			} else if !s.write(buf.data) {
+				if !buf.shared {
+					bp.Free(buf.data)
+				}
+				return
+			}
+			if !buf.shared {
+				bp.Free(buf.data)
+			}
+		}
+	}
+}
+
+// sendEncrypted wait for key exchange and write the sealed frame, it returns false if session is closed.
+func (s *Session) sendEncrypted(c *sessionCrypt, data []byte, ready *<-chan struct{}) bool {
+	if !c.isControl(data) {
+		select {
+		case <-c.ready:
+		case <-s.closer:
+			return false
+		}
+		if *ready != nil { //reply of server is sent before encrypted frames
+			*ready = nil
+			if !s.write(c.hello) {
+				return false
 			}
-			bp.Free(buf.data)
 		}
 	}
+	d, err := c.sealFrame(data)
+	if err != nil {
+		sysLog.Error("%s;sessionid=%d", err.Error(), s.id)
+		return true
+	}
+	return s.write(d)
+}
+
+// write data into stream socket, socket is closed when error occurs.
+func (s *Session) write(data []byte) bool {
+	//s.socket.SetWriteDeadline(time.Now().Add(time.Millisecond * 300))
+	n := 0
+	for n < len(data) {
+		n1, err := s.socket.Write(data[n:])
+		if err != nil {
+			sysLog.Error("session sending error: %s;sessionid=%d", err.Error(), s.id)
+			s.socket.Close()
+			return false
+		}
+		n += n1
+	}
+	return true
 }
 
 func (s *Session) dorecv() {
@@ -270,6 +395,9 @@ func (s *Session) dorecv() {
 		}
 		s.wg.Wait()
 		s.isclose.Close()
+		s.leaveGroups()
+		s.cancelTimers()
+		s.stopHandshakeTimer()
 		if s.isUdp {
 			sysLog.System("udp session close, local addr: %s", s.socket.LocalAddr())
 		} else {
@@ -287,14 +415,14 @@ func (s *Session) dorecv() {
 	s.parser.sessionEvent(s, Open)
 
 	var (
-		udpConn *net.UDPConn
+		udpConn net.PacketConn
 		peer    net.Addr
 		n       int
 		err     error
 	)
 
 	if s.isUdp {
-		udpConn = s.socket.(*net.UDPConn)
+		udpConn = s.socket.(net.PacketConn)
 	} else {
 		peer = s.socket.RemoteAddr()
 	}
@@ -311,7 +439,7 @@ func (s *Session) dorecv() {
 			//defer close
 			return
 		}
-		s.hander <- rsData{msgbuf[0:n], peer}
+		s.hander <- rsData{msgbuf[0:n], peer, false}
 		if s.isUdp {
 			msgbuf = bp.Alloc(MsgBuffSize)
 			continue
@@ -351,19 +479,19 @@ func (s *Session) dohand() {
 		}
 		select {
 		case <-s.closer:
-			//handle the last msg
-			var lastBuf rsData
-			select {
-			case lastBuf = <-s.hander:
-			default:
-			}
-			if tempBuf != nil {
-				lastBuf.data = append(tempBuf, lastBuf.data...)
-			}
-			if lastBuf.data != nil {
-				s.parser.ParseMsg(s, lastBuf.data)
+			//handle the rest msgs
+			for {
+				select {
+				case buf := <-s.hander:
+					s.peer = buf.peer
+					if tempBuf != nil {
+						buf.data = append(tempBuf, buf.data...)
+					}
+					tempBuf = s.parseRest(buf.data)
+				default:
+					return
+				}
 			}
-			return
 		case <-ht.C:
 			if s.heartbeat > 0 {
 				s.parser.sessionEvent(s, HeartBeat)
@@ -399,6 +527,24 @@ func (s *Session) dohand() {
 	}
 }
 
+// parseRest parse all messages of data after session closed, it returns the incomplete message.
+func (s *Session) parseRest(data []byte) []byte {
+	for len(data) > 0 {
+		n := s.parser.ParseMsg(s, data)
+		if n <= 0 {
+			if s.isUdp {
+				return nil
+			}
+			return data
+		}
+		if n >= len(data) {
+			return nil
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
 func asyncDo(fn func(), wg *sync.WaitGroup) {
 	wg.Add(1)
 	go func() {
@@ -0,0 +1,104 @@
+package stnet_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/greedchase/gotools/stnet"
+	"github.com/greedchase/gotools/stnet/stnettest"
+)
+
+// lineImp parse messages end with '\n', msgID is the first byte.
+type lineImp struct {
+	stnet.ServiceBase
+}
+
+func (imp *lineImp) Unmarshal(sess *stnet.Session, data []byte) (int, int64, interface{}, error) {
+	i := bytes.IndexByte(data, '\n')
+	if i < 0 {
+		return 0, 0, nil, nil
+	}
+	msg := make([]byte, i)
+	copy(msg, data[:i])
+	if len(msg) == 0 {
+		return i + 1, 0, msg, nil
+	}
+	return i + 1, int64(msg[0]), msg, nil
+}
+
+func TestSessionEcho(t *testing.T) {
+	h := stnettest.New(t, 2)
+	s, rec := h.AddService("echo", &stnet.ServiceEcho{}, 0)
+	h.Start()
+	defer h.Stop()
+
+	c := h.Dial(s)
+	defer c.Close()
+	h.WaitOpen(rec)
+
+	c.Send([]byte("hello"))
+	if got := c.Read(5); string(got) != "hello" {
+		t.Fatalf("echo %q, want hello", got)
+	}
+}
+
+func TestSessionMessageAndClose(t *testing.T) {
+	h := stnettest.New(t, 2)
+	s, rec := h.AddService("line", &lineImp{}, 0)
+	h.Start()
+	defer h.Stop()
+
+	c := h.Dial(s)
+	sess := h.WaitOpen(rec)
+	c.Send([]byte("abc\nxyz\n"))
+	e := h.WaitMessage(rec, 'a')
+	if string(e.Msg.([]byte)) != "abc" || e.Sess != sess {
+		t.Fatalf("unexpected message %q", e.Msg)
+	}
+	e = h.WaitMessage(rec, 'x')
+	if string(e.Msg.([]byte)) != "xyz" {
+		t.Fatalf("unexpected message %q", e.Msg)
+	}
+
+	c.Close()
+	h.WaitClose(rec, sess)
+	if !sess.IsClose() {
+		t.Fatal("session should be closed")
+	}
+}
+
+func TestSessionCloseByServer(t *testing.T) {
+	h := stnettest.New(t, 1)
+	s, rec := h.AddService("line", &lineImp{}, 0)
+	h.Start()
+	defer h.Stop()
+
+	c := h.Dial(s)
+	defer c.Close()
+	sess := h.WaitOpen(rec)
+	if err := sess.Send([]byte("bye"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.Read(3); string(got) != "bye" {
+		t.Fatalf("read %q, want bye", got)
+	}
+	sess.Close()
+	c.ExpectClosed()
+	h.WaitClose(rec, sess)
+}
+
+func TestSessionLargeMessage(t *testing.T) {
+	h := stnettest.New(t, 1)
+	s, rec := h.AddService("line", &lineImp{}, 0)
+	h.Start()
+	defer h.Stop()
+
+	c := h.Dial(s)
+	defer c.Close()
+	big := bytes.Repeat([]byte("b"), 100*1024)
+	c.Send(append(big, '\n'))
+	e := h.WaitMessage(rec, 'b')
+	if !bytes.Equal(e.Msg.([]byte), big) {
+		t.Fatalf("message length %d, want %d", len(e.Msg.([]byte)), len(big))
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"math/rand"
 	"reflect"
+	"strconv"
 )
 
 // ServiceImpBase
@@ -75,9 +76,10 @@ func (service *ServiceLoop) Loop() {
 
 type ServiceProxyS struct {
 	ServiceBase
-	remote   *Service
-	remoteip []string
-	weight   []int
+	remote      *Service
+	remoteip    []string
+	weight      []int
+	proxyHeader int //version of PROXY protocol header sent to remote
 }
 
 func (service *ServiceProxyS) SessionOpen(sess *Session) {
@@ -92,7 +94,15 @@ func (service *ServiceProxyS) SessionOpen(sess *Session) {
 			}
 		}
 	}
-	sess.UserData = service.remote.NewConnect(rip, sess)
+	//header is sent on every connection, the connect may reconnect
+	var hdr []byte
+	if service.proxyHeader > 0 {
+		src, dst := sess.proxyHeaderAddrs()
+		if h, e := EncodeProxyHeader(service.proxyHeader, src, dst); e == nil {
+			hdr = h
+		}
+	}
+	sess.UserData = service.remote.newConnect(rip, sess, nil, hdr)
 }
 func (service *ServiceProxyS) SessionClose(sess *Session) {
 	if sess.UserData != nil {
@@ -128,35 +138,52 @@ func (service *ServiceProxyC) HashProcessor(current *CurrentContent, msgID uint6
 // ServiceSpb
 type ServiceSpb struct {
 	ServiceBase
-	imp    SpbService
-	msgReg map[uint64]reflect.Type
+	imp  SpbService
+	disp msgDispatcher
 }
 
+// NewServiceSpb imp could be nil if all messages are handled by RegisterHandler, errors are logged and the session is closed then.
 func NewServiceSpb(imp SpbService) *ServiceSpb {
-	return &ServiceSpb{ServiceBase{}, imp, make(map[uint64]reflect.Type)}
+	return &ServiceSpb{ServiceBase: ServiceBase{}, imp: imp}
 }
 
 func (service *ServiceSpb) RegisterMsg(msgId uint64, msg interface{}) error {
-	t := reflect.TypeOf(msg)
-	if msg == nil || t.Kind() == reflect.Ptr {
-		return fmt.Errorf("type of msg cannot be ptr or nil")
-	}
-	service.msgReg[msgId] = t
-	return nil
+	return service.disp.register(msgId, reflect.TypeOf(msg))
 }
 
 func (service *ServiceSpb) Init() bool {
+	if service.imp == nil {
+		return true
+	}
 	return service.imp.Init()
 }
 
 func (service *ServiceSpb) Loop() {
-	service.imp.Loop()
+	if service.imp != nil {
+		service.imp.Loop()
+	}
+}
+
+func (service *ServiceSpb) handle(current *CurrentContent, msgID uint64, msg interface{}, e error) {
+	if service.imp != nil {
+		service.imp.Handle(current, msgID, msg, e)
+	} else if e != nil {
+		service.ServiceBase.HandleError(current, e)
+	} else {
+		sysLog.Error("no handler of msg %d", msgID)
+	}
 }
 
 func (service *ServiceSpb) HandleMessage(current *CurrentContent, msgID uint64, msg interface{}) {
-	t, ok := service.msgReg[msgID]
+	msg, trace := untraceMsg(msg)
+	if finish := startHandlerSpan(current, "spb "+strconv.FormatUint(msgID, 10), trace); finish != nil {
+		defer finish()
+	}
+	t, ok := service.disp.types[msgID]
 	if !ok {
-		service.imp.Handle(current, msgID, msg, nil)
+		if d, isBytes := msg.([]byte); !isBytes || !service.disp.handleUnknown(current, msgID, d) {
+			service.handle(current, msgID, msg, nil)
+		}
 		return
 	}
 
@@ -164,118 +191,171 @@ func (service *ServiceSpb) HandleMessage(current *CurrentContent, msgID uint64,
 	if msg != nil {
 		d, ok = msg.([]byte)
 		if !ok {
-			service.imp.Handle(current, msgID, msg, fmt.Errorf("msg unmarshal failed id=%d,err=msg not marshaled bytes", msgID))
+			service.handle(current, msgID, msg, fmt.Errorf("msg unmarshal failed id=%d,err=msg not marshaled bytes", msgID))
 			return
 		}
 	}
 	m := reflect.New(t).Interface()
-	e := Unmarshal(d, m, EncodeTyepSpb)
+	e := Unmarshal(d, m, current.Sess.msgEncoding())
 	if e != nil {
-		service.imp.Handle(current, msgID, nil, fmt.Errorf("msg unmarshal failed id=%d,err=%s", msgID, e.Error()))
-	} else {
-		service.imp.Handle(current, msgID, m, nil)
+		service.handle(current, msgID, nil, fmt.Errorf("msg unmarshal failed id=%d,err=%s", msgID, e.Error()))
+	} else if !service.disp.dispatch(current, msgID, m) {
+		service.handle(current, msgID, m, nil)
 	}
 }
 func (service *ServiceSpb) HandleError(current *CurrentContent, err error) {
-	service.imp.Handle(current, 0, nil, err)
+	service.handle(current, 0, nil, err)
 }
 func (service *ServiceSpb) Unmarshal(sess *Session, data []byte) (lenParsed int, msgID int64, msg interface{}, err error) {
-	if len(data) < 4 {
-		return 0, 0, nil, nil
+	msgLen, h, body, e := readFrame(sess, data)
+	if msgLen == 0 || e != nil {
+		return msgLen, 0, nil, e
 	}
-	msgLen := MsgLen(data)
-	if msgLen < 4 || msgLen >= uint32(MaxMsgSize) {
-		return len(data), 0, nil, fmt.Errorf("message length is invalid: %d", msgLen)
+	if h.Flags&FrameFlagControl != 0 {
+		return msgLen, -1, nil, nil
 	}
-
-	if len(data) < int(msgLen) {
-		return 0, 0, nil, nil
+	if h.Encoding != EncodeTyepSpb {
+		return msgLen, 0, nil, fmt.Errorf("encoding of message is not spb")
 	}
 	cmd := JsonProto{}
-	e := Unmarshal(data[4:msgLen], &cmd, EncodeTyepSpb)
+	e = Unmarshal(body, &cmd, EncodeTyepSpb)
 	if e != nil {
-		return int(msgLen), 0, nil, e
+		return msgLen, 0, nil, e
+	}
+	if cmd.Trace != "" {
+		return msgLen, int64(cmd.CmdId), &tracedMsg{cmd.CmdData, cmd.Trace}, nil
 	}
-	return int(msgLen), int64(cmd.CmdId), cmd.CmdData, nil
+	return msgLen, int64(cmd.CmdId), cmd.CmdData, nil
 }
 func (service *ServiceSpb) HashProcessor(current *CurrentContent, msgID uint64, msg interface{}) (processorID int) {
+	if service.imp == nil {
+		return -1
+	}
 	return service.imp.HashProcessor(current, msgID)
 }
 
+// SendSpbCmd msg is encoded by codec of the service of sess(Service.SetCodec).
 func SendSpbCmd(sess *Session, msgID uint64, msg interface{}) error {
-	d, e := Marshal(msg, EncodeTyepSpb)
-	if e != nil {
-		return e
-	}
-	cmd := JsonProto{msgID, d}
-	buf, e := EncodeProtocol(cmd, EncodeTyepSpb)
+	return SendSpbCmdTrace(nil, sess, msgID, msg)
+}
+
+// SendSpbCmdTrace is SendSpbCmd carrying trace context of parent(usually current.Span of the handler), parent could be nil.
+func SendSpbCmdTrace(parent *Span, sess *Session, msgID uint64, msg interface{}) error {
+	d, e := Marshal(msg, sess.msgEncoding())
 	if e != nil {
 		return e
 	}
-	return sess.Send(buf, nil)
+	cmd := JsonProto{msgID, d, outgoingTrace(parent)}
+	return sendFrame(sess, nil, 0, cmd, EncodeTyepSpb)
 }
 
 // ServiceJson
 type ServiceJson struct {
 	ServiceBase
-	imp JsonService
+	imp  JsonService
+	disp msgDispatcher
+}
+
+// NewServiceJson is used by AddService when typed handlers are needed(AddJsonService creates it internally).
+// imp could be nil if all messages are handled by RegisterHandler, errors are logged and the session is closed then.
+func NewServiceJson(imp JsonService) *ServiceJson {
+	return &ServiceJson{ServiceBase: ServiceBase{}, imp: imp}
 }
 
 func (service *ServiceJson) Init() bool {
+	if service.imp == nil {
+		return true
+	}
 	return service.imp.Init()
 }
 
 func (service *ServiceJson) Loop() {
-	service.imp.Loop()
+	if service.imp != nil {
+		service.imp.Loop()
+	}
+}
+
+func (service *ServiceJson) handle(current *CurrentContent, cmd JsonProto, e error) {
+	if service.imp != nil {
+		service.imp.Handle(current, cmd, e)
+	} else if e != nil {
+		service.ServiceBase.HandleError(current, e)
+	} else {
+		sysLog.Error("no handler of msg %d", cmd.CmdId)
+	}
 }
 
 func (service *ServiceJson) HandleMessage(current *CurrentContent, msgID uint64, msg interface{}) {
+	msg, trace := untraceMsg(msg)
+	if finish := startHandlerSpan(current, "json "+strconv.FormatUint(msgID, 10), trace); finish != nil {
+		defer finish()
+	}
 	var d []byte
 	var ok bool
 	if msg != nil {
 		d, ok = msg.([]byte)
 		if !ok {
-			service.imp.Handle(current, JsonProto{msgID, nil}, fmt.Errorf("format of msg should be []byte, id=%d", msgID))
+			service.handle(current, JsonProto{msgID, nil, trace}, fmt.Errorf("format of msg should be []byte, id=%d", msgID))
 			return
 		}
 	}
-	service.imp.Handle(current, JsonProto{msgID, d}, nil)
+	t, ok := service.disp.types[msgID]
+	if !ok {
+		if !service.disp.handleUnknown(current, msgID, d) {
+			service.handle(current, JsonProto{msgID, d, trace}, nil)
+		}
+		return
+	}
+	if _, ok = service.disp.handlers[msgID]; !ok {
+		service.handle(current, JsonProto{msgID, d, trace}, nil)
+		return
+	}
+	m := reflect.New(t).Interface()
+	if e := Unmarshal(d, m, EncodeTyepJson); e != nil {
+		service.handle(current, JsonProto{msgID, d, trace}, fmt.Errorf("msg unmarshal failed id=%d,err=%s", msgID, e.Error()))
+		return
+	}
+	service.disp.dispatch(current, msgID, m)
 }
 func (service *ServiceJson) HandleError(current *CurrentContent, err error) {
-	service.imp.Handle(current, JsonProto{}, err)
+	service.handle(current, JsonProto{}, err)
 }
 func (service *ServiceJson) Unmarshal(sess *Session, data []byte) (lenParsed int, msgID int64, msg interface{}, err error) {
-	if len(data) < 4 {
-		return 0, 0, nil, nil
+	msgLen, h, body, e := readFrame(sess, data)
+	if msgLen == 0 || e != nil {
+		return msgLen, 0, nil, e
 	}
-	msgLen := MsgLen(data)
-	if msgLen < 4 || msgLen >= uint32(MaxMsgSize) {
-		return len(data), 0, nil, fmt.Errorf("message length is invalid: %d", msgLen)
-	}
-
-	if len(data) < int(msgLen) {
-		return 0, 0, nil, nil
+	if h.Flags&FrameFlagControl != 0 {
+		return msgLen, -1, nil, nil
 	}
 	cmd := JsonProto{}
-	e := Unmarshal(data[4:msgLen], &cmd, EncodeTyepJson)
+	e = Unmarshal(body, &cmd, EncodeTyepJson)
 	if e != nil {
-		return int(msgLen), 0, nil, e
+		return msgLen, 0, nil, e
+	}
+	if cmd.Trace != "" {
+		return msgLen, int64(cmd.CmdId), &tracedMsg{cmd.CmdData, cmd.Trace}, nil
 	}
-	return int(msgLen), int64(cmd.CmdId), cmd.CmdData, nil
+	return msgLen, int64(cmd.CmdId), cmd.CmdData, nil
 }
 func (service *ServiceJson) HashProcessor(current *CurrentContent, msgID uint64, msg interface{}) (processorID int) {
+	msg, trace := untraceMsg(msg)
 	var d []byte
 	if msg != nil {
-		d = msg.([]byte)
+		d, _ = msg.([]byte)
 	}
-	return service.imp.HashProcessor(current, JsonProto{msgID, d})
+	if service.imp == nil {
+		return -1
+	}
+	return service.imp.HashProcessor(current, JsonProto{msgID, d, trace})
 }
 
 func SendJsonCmd(sess *Session, msgID uint64, msg []byte) error {
-	cmd := JsonProto{msgID, msg}
-	buf, e := EncodeProtocol(cmd, EncodeTyepJson)
-	if e != nil {
-		return e
-	}
-	return sess.Send(buf, nil)
+	return SendJsonCmdTrace(nil, sess, msgID, msg)
+}
+
+// SendJsonCmdTrace is SendJsonCmd carrying trace context of parent(usually current.Span of the handler), parent could be nil.
+func SendJsonCmdTrace(parent *Span, sess *Session, msgID uint64, msg []byte) error {
+	cmd := JsonProto{msgID, msg, outgoingTrace(parent)}
+	return sendFrame(sess, nil, 0, cmd, EncodeTyepJson)
 }
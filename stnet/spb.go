@@ -4,7 +4,6 @@ import (
 	"errors"
 	"io"
 	"reflect"
-	"strconv"
 	"unsafe"
 )
 
@@ -21,6 +20,10 @@ var (
 type Spb struct {
 	buf   []byte // encode/decode byte stream
 	index int    // write/read point
+
+	limits SpbLimits // decode limits
+	depth  int       // nesting depth of decoding value
+	alloc  uint64    // bytes allocated by decoding
 }
 
 const (
@@ -63,18 +66,26 @@ func (spb *Spb) packHeader(tag uint32, typ uint8) {
 	}
 }
 
-func (spb *Spb) packSlice(tag uint32, x interface{}, packHead bool, require bool) error {
-	if reflect.TypeOf(x).Kind() != reflect.Slice {
-		return errInvalidType
+func (spb *Spb) packString(tag uint32, b []byte, packHead bool, require bool) {
+	if len(b) == 0 && !require {
+		return
 	}
-	refVal := reflect.ValueOf(x)
-	if refVal.Len() == 0 && !require {
+	if packHead {
+		spb.packHeader(tag, SpbPackDataType_String)
+	}
+	spb.packNumber(uint64(len(b)))
+	spb.packData(b)
+}
+
+// packSlice encode slices and arrays, zero arrays are omitted if not require.
+func (spb *Spb) packSlice(tag uint32, refVal reflect.Value, require bool) error {
+	if !require && (refVal.Len() == 0 || refVal.Kind() == reflect.Array && refVal.IsZero()) {
 		return nil
 	}
 	spb.packHeader(tag, SpbPackDataType_Vector)
 	spb.packNumber(uint64(refVal.Len()))
 	for i := 0; i < refVal.Len(); i++ {
-		err := spb.pack(0, refVal.Index(i).Interface(), true, true)
+		err := spb.packValue(0, refVal.Index(i), true, true)
 		if err != nil {
 			return err
 		}
@@ -82,11 +93,7 @@ func (spb *Spb) packSlice(tag uint32, x interface{}, packHead bool, require bool
 	return nil
 }
 
-func (spb *Spb) packMap(tag uint32, x interface{}, packHead bool, require bool) error {
-	if reflect.TypeOf(x).Kind() != reflect.Map {
-		return errInvalidType
-	}
-	refVal := reflect.ValueOf(x)
+func (spb *Spb) packMap(tag uint32, refVal reflect.Value, require bool) error {
 	if refVal.Len() == 0 && !require {
 		return nil
 	}
@@ -94,11 +101,11 @@ func (spb *Spb) packMap(tag uint32, x interface{}, packHead bool, require bool)
 	spb.packNumber(uint64(refVal.Len()))
 	keys := refVal.MapKeys()
 	for i := 0; i < len(keys); i++ {
-		err := spb.pack(0, keys[i].Interface(), true, true)
+		err := spb.packValue(0, keys[i], true, true)
 		if err != nil {
 			return err
 		}
-		err = spb.pack(0, refVal.MapIndex(keys[i]).Interface(), true, true)
+		err = spb.packValue(0, refVal.MapIndex(keys[i]), true, true)
 		if err != nil {
 			return err
 		}
@@ -106,167 +113,114 @@ func (spb *Spb) packMap(tag uint32, x interface{}, packHead bool, require bool)
 	return nil
 }
 
-func (spb *Spb) packStruct(tag uint32, x interface{}, packHead bool) error {
-	refVal := reflect.ValueOf(x)
-	if reflect.TypeOf(x).Kind() == reflect.Ptr {
-		refVal = refVal.Elem()
-	}
-	if refVal.Kind() != reflect.Struct {
-		return errInvalidType
+func (spb *Spb) packStruct(tag uint32, refVal reflect.Value) error {
+	info := getSpbStructInfo(refVal.Type())
+	if info.err != nil {
+		return info.err
 	}
 	spb.packHeader(tag, SpbPackDataType_StructBegin)
-	for i := 0; i < refVal.NumField(); i++ {
-		iTg := i
-		tg := refVal.Type().Field(i).Tag.Get("tag")
-		if tg != "" {
-			itg, er := strconv.Atoi(tg)
-			if er == nil {
-				iTg = itg
-			}
-		}
-		req := refVal.Type().Field(i).Tag.Get("require")
-		require := false
-		if req == "true" {
-			require = true
-		}
-		fld := refVal.Field(i)
-		err := spb.pack(uint32(iTg), fld.Interface(), true, require)
-		if err != nil {
+	if info.marshaler && refVal.CanInterface() {
+		if err := refVal.Interface().(SpbMarshaler).MarshalSpb(spb); err != nil {
 			return err
 		}
+	} else {
+		for _, f := range info.fields {
+			err := spb.packValue(f.tag, refVal.Field(f.index), true, f.require)
+			if err != nil {
+				return err
+			}
+		}
+		if info.unknown >= 0 {
+			spb.packData(refVal.Field(info.unknown).Bytes())
+		}
 	}
 	spb.packHeader(0, SpbPackDataType_StructEnd)
 	return nil
 }
 
 func (spb *Spb) pack(tag uint32, i interface{}, packHead bool, require bool) error {
-	t := reflect.TypeOf(i)
-	v := reflect.ValueOf(i)
-	var x interface{}
-	if t.Kind() == reflect.Ptr {
-		x = v.Elem().Interface()
-	} else {
-		x = v.Interface()
-	}
-	if x == nil {
+	if i == nil {
 		return errors.New("Marshal called with nil")
 	}
+	return spb.packValue(tag, reflect.ValueOf(i), packHead, require)
+}
+
+// packValue encode x, nil pointers are omitted, or encoded as zero value if require(elements of slices and maps).
+func (spb *Spb) packValue(tag uint32, x reflect.Value, packHead bool, require bool) error {
+	for x.Kind() == reflect.Ptr {
+		if !x.IsNil() {
+			x = x.Elem()
+		} else if require {
+			x = reflect.Zero(x.Type().Elem())
+		} else {
+			return nil
+		}
+	}
 
 	typ := SpbPackDataType_Integer_Positive
 	var val uint64
 
-	switch reflect.TypeOf(x).Kind() {
+	switch x.Kind() {
 	case reflect.Bool:
 		{
-			v := x.(bool)
-			if v {
+			if x.Bool() {
 				val = 1
 			}
 		}
-	case reflect.Int:
-		{
-			v := x.(int)
-			if v < 0 {
-				typ = SpbPackDataType_Integer_Negative
-				v = -v
-			}
-			val = uint64(v)
-		}
-	case reflect.Int8:
-		{
-			v := x.(int8)
-			if v < 0 {
-				typ = SpbPackDataType_Integer_Negative
-				v = -v
-			}
-			val = uint64(v)
-		}
-	case reflect.Int16:
-		{
-			v := x.(int16)
-			if v < 0 {
-				typ = SpbPackDataType_Integer_Negative
-				v = -v
-			}
-			val = uint64(v)
-		}
-	case reflect.Int32:
-		{
-			v := x.(int32)
-			if v < 0 {
-				typ = SpbPackDataType_Integer_Negative
-				v = -v
-			}
-			val = uint64(v)
-		}
-	case reflect.Int64:
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
 		{
-			v := x.(int64)
+			v := x.Int()
 			if v < 0 {
 				typ = SpbPackDataType_Integer_Negative
 				v = -v
 			}
 			val = uint64(v)
 		}
-	case reflect.Uint:
-		{
-			v := x.(uint)
-			val = uint64(v)
-		}
-	case reflect.Uint8:
-		{
-			v := x.(uint8)
-			val = uint64(v)
-		}
-	case reflect.Uint16:
-		{
-			v := x.(uint16)
-			val = uint64(v)
-		}
-	case reflect.Uint32:
-		{
-			v := x.(uint32)
-			val = uint64(v)
-		}
-	case reflect.Uint64:
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
 		{
-			v := x.(uint64)
-			val = uint64(v)
+			val = x.Uint()
 		}
 	case reflect.Float32:
 		{
-			v := x.(float32)
+			v := float32(x.Float())
 			val = uint64(*(*uint32)(unsafe.Pointer(&v)))
 		}
 	case reflect.Float64:
 		{
-			v := x.(float64)
+			v := x.Float()
 			val = uint64(*(*uint64)(unsafe.Pointer(&v)))
 		}
 	case reflect.String:
 		{
-			v := x.(string)
-			if len(v) == 0 && !require {
-				return nil
-			}
-			if packHead {
-				spb.packHeader(tag, SpbPackDataType_String)
-			}
-			spb.packNumber(uint64(len(v)))
-			spb.packData(*(*[]byte)(unsafe.Pointer(&v)))
+			v := x.String()
+			spb.packString(tag, *(*[]byte)(unsafe.Pointer(&v)), packHead, require)
 			return nil
 		}
-	case reflect.Slice:
+	case reflect.Slice, reflect.Array:
 		{
-			return spb.packSlice(tag, x, packHead, require)
+			if x.Type().Elem().Kind() == reflect.Uint8 { //[]byte is encoded as string
+				if x.Kind() == reflect.Array && !require && x.IsZero() {
+					return nil
+				}
+				spb.packString(tag, spbBytes(x), packHead, require)
+				return nil
+			}
+			return spb.packSlice(tag, x, require)
 		}
 	case reflect.Map:
 		{
-			return spb.packMap(tag, x, packHead, require)
+			return spb.packMap(tag, x, require)
 		}
 	case reflect.Struct:
 		{
-			return spb.packStruct(tag, x, packHead)
+			if x.Type() == spbTimeType {
+				return spb.packTime(tag, x, require)
+			}
+			return spb.packStruct(tag, x)
+		}
+	case reflect.Interface:
+		{
+			return spb.packOneof(tag, x, require)
 		}
 	default:
 		{
@@ -285,19 +239,6 @@ func (spb *Spb) pack(tag uint32, i interface{}, packHead bool, require bool) err
 	return nil
 }
 
-func (spb *Spb) unpackByte(n int) (x []byte, err error) {
-	if n <= 0 {
-		return nil, nil
-	}
-	if spb.index+n > len(spb.buf) {
-		return nil, errNoEnoughData
-	}
-	x = make([]byte, n)
-	copy(x, spb.buf[spb.index:spb.index+n])
-	spb.index = spb.index + n
-	return
-}
-
 func (spb *Spb) unpackNumber() (x uint64, err error) {
 	// x, err already 0
 
@@ -385,72 +326,87 @@ func CanSetUint(x reflect.Value) bool {
 	}
 }
 
-func (spb *Spb) skipHeadField() {
+func (spb *Spb) skipHeadField() error {
 	_, typ, err := spb.unpackHeader()
 	if err != nil {
-		return
+		return err
 	}
-	spb.skipField(typ)
+	return spb.skipField(typ)
 }
 
-func (spb *Spb) skipField(typ uint8) {
+func (spb *Spb) skipField(typ uint8) error {
 	switch typ {
 	case SpbPackDataType_Integer_Positive, SpbPackDataType_Integer_Negative, SpbPackDataType_Float, SpbPackDataType_Double:
 		{
-			spb.unpackNumber()
+			_, err := spb.unpackNumber()
+			return err
 		}
 	case SpbPackDataType_String:
 		{
 			ln, err := spb.unpackNumber()
 			if err != nil {
-				return
+				return err
 			}
-			spb.unpackByte(int(ln))
+			n, err := spb.checkString(ln, false)
+			if err != nil {
+				return err
+			}
+			spb.index += n
 		}
-	case SpbPackDataType_Vector:
+	case SpbPackDataType_Vector, SpbPackDataType_Map:
 		{
 			ln, err := spb.unpackNumber()
 			if err != nil {
-				return
+				return err
 			}
-			for i := 0; i < int(ln); i++ {
-				spb.skipHeadField()
+			fields := 1
+			if typ == SpbPackDataType_Map {
+				fields = 2
 			}
-		}
-	case SpbPackDataType_Map:
-		{
-			ln, err := spb.unpackNumber()
+			n, err := spb.checkLen(ln, fields, 0)
 			if err != nil {
-				return
+				return err
+			}
+			if err = spb.enter(); err != nil {
+				return err
 			}
-			for i := 0; i < int(ln); i++ {
-				spb.skipHeadField()
-				spb.skipHeadField()
+			defer spb.leave()
+			for i := 0; i < n*fields; i++ {
+				if err = spb.skipHeadField(); err != nil {
+					return err
+				}
 			}
 		}
 	case SpbPackDataType_StructBegin:
 		{
-			spb.skipToStructEnd()
+			if err := spb.enter(); err != nil {
+				return err
+			}
+			defer spb.leave()
+			return spb.skipToStructEnd()
 		}
 	case SpbPackDataType_StructEnd:
 		{
 			break
 		}
 	default:
-		return
+		return errInvalidType
 	}
+	return nil
 }
 
-func (spb *Spb) skipToStructEnd() {
+func (spb *Spb) skipToStructEnd() error {
 	for {
 		_, typ, err := spb.unpackHeader()
 		if err != nil {
-			return
+			return err
 		}
 		if typ == SpbPackDataType_StructEnd {
-			break
+			return nil
+		}
+		if err = spb.skipField(typ); err != nil {
+			return err
 		}
-		spb.skipField(typ)
 	}
 }
 
@@ -464,34 +420,34 @@ func (spb *Spb) unpack(x reflect.Value, first bool) error {
 		return err
 	}
 
-	if x.Kind() == reflect.Ptr {
+	if x.Kind() == reflect.Ptr && !x.IsNil() {
 		x = x.Elem()
 	}
 
+	if first {
+		return spb.unpackValue(x, typ)
+	}
+	if typ == SpbPackDataType_StructEnd {
+		return errStructEnd
+	}
 	var valField reflect.Value
-	if x.Type().Kind() == reflect.Struct {
-		isTag := false
-		for i := 0; i < x.NumField(); i++ {
-			tg := x.Type().Field(i).Tag.Get("tag")
-			if tg != "" {
-				iTg, er := strconv.Atoi(tg)
-				if er == nil && iTg == int(tag) {
-					valField = x.Field(i)
-					isTag = true
-					break
-				}
-			}
-		}
+	if x.Kind() == reflect.Struct {
+		valField = getSpbStructInfo(x.Type()).field(x, tag)
+	}
+	return spb.unpackValue(valField, typ)
+}
 
-		if !isTag {
-			t := int(tag)
-			if t < x.NumField() {
-				tg := x.Type().Field(t).Tag.Get("tag")
-				if tg == "" {
-					valField = x.Field(t)
-				}
+// unpackValue decode value of typ whose header is read into x, the value is skipped if x is invalid or its type does not match.
+func (spb *Spb) unpackValue(x reflect.Value, typ uint8) error {
+	for x.Kind() == reflect.Ptr && typ != SpbPackDataType_StructEnd {
+		if x.IsNil() {
+			if !x.CanSet() {
+				x = reflect.Value{}
+				break
 			}
+			x.Set(reflect.New(x.Type().Elem()))
 		}
+		x = x.Elem()
 	}
 
 	switch typ {
@@ -502,22 +458,14 @@ func (spb *Spb) unpack(x reflect.Value, first bool) error {
 				return err
 			}
 
-			if first {
-				if CanSetUint(x) {
-					x.SetUint(v)
-				} else if CanSetInt(x) {
-					x.SetInt(int64(v))
-				} else if CanSetBool(x) {
-					x.SetBool(v > 0)
-				}
-			} else {
-				if CanSetUint(valField) {
-					valField.SetUint(v)
-				} else if CanSetInt(valField) {
-					valField.SetInt(int64(v))
-				} else if CanSetBool(valField) {
-					valField.SetBool(v > 0)
-				}
+			if CanSetUint(x) {
+				x.SetUint(v)
+			} else if CanSetInt(x) {
+				x.SetInt(int64(v))
+			} else if CanSetBool(x) {
+				x.SetBool(v > 0)
+			} else if CanSetFloat(x) { //float is packed as bits
+				x.SetFloat(numberToFloat(x.Kind() == reflect.Float32, v))
 			}
 		}
 	case SpbPackDataType_Integer_Negative:
@@ -526,14 +474,8 @@ func (spb *Spb) unpack(x reflect.Value, first bool) error {
 			if err != nil {
 				return err
 			}
-			vv := int64(-v)
-
-			if first {
-				if CanSetInt(x) {
-					x.SetInt(vv)
-				}
-			} else if CanSetInt(valField) {
-				valField.SetInt(vv)
+			if CanSetInt(x) {
+				x.SetInt(int64(-v))
 			}
 		}
 	case SpbPackDataType_Float, SpbPackDataType_Double:
@@ -542,13 +484,8 @@ func (spb *Spb) unpack(x reflect.Value, first bool) error {
 			if err != nil {
 				return err
 			}
-			f := *(*float64)(unsafe.Pointer(&v))
-			if first {
-				if CanSetFloat(x) {
-					x.SetFloat(f)
-				}
-			} else if CanSetFloat(valField) {
-				valField.SetFloat(f)
+			if CanSetFloat(x) {
+				x.SetFloat(numberToFloat(typ == SpbPackDataType_Float, v))
 			}
 		}
 	case SpbPackDataType_String:
@@ -557,17 +494,16 @@ func (spb *Spb) unpack(x reflect.Value, first bool) error {
 			if err != nil {
 				return err
 			}
-			bt, er := spb.unpackByte(int(ln))
-			if er != nil {
-				return er
+			n, err := spb.checkString(ln, true)
+			if err != nil {
+				return err
 			}
-			str := string(bt)
-			if first {
-				if x.Kind() == reflect.String {
-					x.SetString(str)
-				}
-			} else if valField.Kind() == reflect.String {
-				valField.SetString(str)
+			bt := spb.buf[spb.index : spb.index+n]
+			spb.index += n
+			if x.Kind() == reflect.String {
+				x.SetString(string(bt))
+			} else if spbIsBytes(x) {
+				spb.setBytes(x, append([]byte(nil), bt...))
 			}
 		}
 	case SpbPackDataType_Vector:
@@ -577,25 +513,36 @@ func (spb *Spb) unpack(x reflect.Value, first bool) error {
 				return err
 			}
 			var vecType reflect.Type
-			if first {
-				if x.Kind() == reflect.Slice && x.CanSet() {
-					x.SetLen(0)
-					vecType = x.Type().Elem()
-				}
-			} else if valField.Kind() == reflect.Slice && valField.CanSet() {
-				valField.SetLen(0)
-				vecType = valField.Type().Elem()
+			var elemSize uintptr
+			if x.Kind() == reflect.Slice && x.CanSet() {
+				x.SetLen(0)
+				vecType = x.Type().Elem()
+				elemSize = vecType.Size() + unsafe.Sizeof(reflect.Value{})
+			}
+			n, err := spb.checkLen(ln, 1, elemSize)
+			if err != nil {
+				return err
+			}
+			if err = spb.enter(); err != nil {
+				return err
+			}
+			defer spb.leave()
+
+			if x.Kind() == reflect.Array && x.CanSet() {
+				return spb.unpackArray(x, n)
 			}
 
 			if vecType == nil {
-				for i := 0; i < int(ln); i++ {
-					spb.skipHeadField()
+				for i := 0; i < n; i++ {
+					if err = spb.skipHeadField(); err != nil {
+						return err
+					}
 				}
 				break
 			}
 
-			vals := make([]reflect.Value, 0, ln)
-			for i := 0; i < int(ln); i++ {
+			vals := make([]reflect.Value, 0, n)
+			for i := 0; i < n; i++ {
 				vecVal := newValByType(vecType)
 				err := spb.unpack(vecVal, true)
 				if err != nil {
@@ -607,19 +554,11 @@ func (spb *Spb) unpack(x reflect.Value, first bool) error {
 				vals = append(vals, vecVal)
 			}
 			vecln := len(vals)
-			if first {
-				vec := reflect.MakeSlice(x.Type(), vecln, vecln)
-				for i, k := range vals {
-					vec.Index(i).Set(k)
-				}
-				x.Set(vec)
-			} else {
-				vec := reflect.MakeSlice(valField.Type(), vecln, vecln)
-				for i, k := range vals {
-					vec.Index(i).Set(k)
-				}
-				valField.Set(vec)
+			vec := reflect.MakeSlice(x.Type(), vecln, vecln)
+			for i, k := range vals {
+				vec.Index(i).Set(k)
 			}
+			x.Set(vec)
 		}
 	case SpbPackDataType_Map:
 		{
@@ -629,27 +568,33 @@ func (spb *Spb) unpack(x reflect.Value, first bool) error {
 			}
 			var keyType reflect.Type
 			var valType reflect.Type
-			if first {
-				if x.Kind() == reflect.Map && x.CanSet() {
-					keyType = x.Type().Key()
-					valType = x.Type().Elem()
-				}
-			} else if valField.Kind() == reflect.Map && valField.CanSet() {
-				keyType = valField.Type().Key()
-				valType = valField.Type().Elem()
+			var elemSize uintptr
+			if x.Kind() == reflect.Map && x.CanSet() {
+				keyType = x.Type().Key()
+				valType = x.Type().Elem()
+				elemSize = keyType.Size() + valType.Size() + 2*unsafe.Sizeof(reflect.Value{})
+			}
+			n, err := spb.checkLen(ln, 2, elemSize)
+			if err != nil {
+				return err
+			}
+			if err = spb.enter(); err != nil {
+				return err
 			}
+			defer spb.leave()
 
 			if keyType == nil {
-				for i := 0; i < int(ln); i++ {
-					spb.skipHeadField()
-					spb.skipHeadField()
+				for i := 0; i < 2*n; i++ {
+					if err = spb.skipHeadField(); err != nil {
+						return err
+					}
 				}
 				break
 			}
 
-			valsKey := make([]reflect.Value, 0, ln)
-			valsVal := make([]reflect.Value, 0, ln)
-			for i := 0; i < int(ln); i++ {
+			valsKey := make([]reflect.Value, 0, n)
+			valsVal := make([]reflect.Value, 0, n)
+			for i := 0; i < n; i++ {
 				mapKey := reflect.New(keyType).Elem()
 				mapVal := newValByType(valType)
 				err := spb.unpack(mapKey, true)
@@ -667,39 +612,28 @@ func (spb *Spb) unpack(x reflect.Value, first bool) error {
 				valsVal = append(valsVal, mapVal)
 			}
 
-			if first {
-				mp := reflect.MakeMap(x.Type())
-				for i, k := range valsKey {
-					mp.SetMapIndex(k, valsVal[i])
-				}
-				x.Set(mp)
-			} else {
-				mp := reflect.MakeMap(valField.Type())
-				for i, k := range valsKey {
-					mp.SetMapIndex(k, valsVal[i])
-				}
-				valField.Set(mp)
+			mp := reflect.MakeMap(x.Type())
+			for i, k := range valsKey {
+				mp.SetMapIndex(k, valsVal[i])
 			}
+			x.Set(mp)
 		}
 	case SpbPackDataType_StructBegin:
 		{
-			stVal := x
-			if !first {
-				stVal = valField
+			if err := spb.enter(); err != nil {
+				return err
 			}
-			if stVal.Kind() != reflect.Struct {
-				spb.skipToStructEnd()
-				return nil
+			defer spb.leave()
+			if x.Kind() == reflect.Interface && x.CanSet() {
+				return spb.unpackOneof(x)
 			}
-			for {
-				err := spb.unpack(stVal, false)
-				if err == errStructEnd {
-					break
-				}
-				if err != nil {
-					return err
-				}
+			if x.Kind() != reflect.Struct {
+				return spb.skipToStructEnd()
 			}
+			if x.Type() == spbTimeType {
+				return spb.unpackTime(x)
+			}
+			return spb.unpackStruct(x)
 		}
 	case SpbPackDataType_StructEnd:
 		{
@@ -712,6 +646,71 @@ func (spb *Spb) unpack(x reflect.Value, first bool) error {
 	return nil
 }
 
+func (spb *Spb) unpackStruct(stVal reflect.Value) error {
+	info := getSpbStructInfo(stVal.Type())
+	if info.err != nil {
+		return info.err
+	}
+	var unknown reflect.Value
+	if info.unknown >= 0 && stVal.CanSet() {
+		unknown = stVal.Field(info.unknown)
+		unknown.SetBytes(nil)
+	}
+	if info.unmarshaler && stVal.CanAddr() && stVal.CanInterface() {
+		return spb.unpackGenerated(stVal.Addr().Interface().(SpbUnmarshaler), unknown)
+	}
+	for {
+		if unknown.IsValid() {
+			kept, err := spb.keepUnknown(info, unknown)
+			if err != nil {
+				return err
+			}
+			if kept {
+				continue
+			}
+		}
+		err := spb.unpack(stVal, false)
+		if err == errStructEnd {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// numberToFloat convert bits of float32 or float64 to float64.
+func numberToFloat(bits32 bool, v uint64) float64 {
+	if bits32 {
+		v32 := uint32(v)
+		return float64(*(*float32)(unsafe.Pointer(&v32)))
+	}
+	return *(*float64)(unsafe.Pointer(&v))
+}
+
+// keepUnknown append the next field into unknown if its tag is unknown.
+func (spb *Spb) keepUnknown(info *spbStructInfo, unknown reflect.Value) (bool, error) {
+	start := spb.index
+	tag, typ, err := spb.unpackHeader()
+	if err != nil || typ == SpbPackDataType_StructEnd {
+		spb.index = start
+		return false, nil
+	}
+	if _, ok := info.byTag[tag]; ok {
+		spb.index = start
+		return false, nil
+	}
+	if err = spb.skipField(typ); err != nil {
+		return false, err
+	}
+	if err = spb.allocate(uint64(spb.index - start)); err != nil {
+		return false, err
+	}
+	unknown.SetBytes(append(unknown.Bytes(), spb.buf[start:spb.index]...))
+	return true, nil
+}
+
 func newValByType(ty reflect.Type) reflect.Value {
 	if ty.Kind() == reflect.Map {
 		return reflect.New(reflect.MakeMap(ty).Type())
@@ -729,10 +728,16 @@ func SpbEncode(data interface{}) ([]byte, error) {
 	return spb.buf, e
 }
 
+// SpbDecode decode data into x(pointer) with limits set by SetSpbLimits.
 func SpbDecode(data []byte, x interface{}) error {
-	if reflect.TypeOf(x).Kind() != reflect.Ptr {
+	spb := newSpbReader(data, GetSpbLimits())
+	return spb.decode(x)
+}
+
+func (spb *Spb) decode(x interface{}) error {
+	rv := reflect.ValueOf(x)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
 		return errNeedPtr
 	}
-	spb := Spb{data, 0}
-	return spb.unpack(reflect.ValueOf(x).Elem(), true)
+	return spb.unpack(rv.Elem(), true)
 }
@@ -0,0 +1,75 @@
+//go:build go1.18
+// +build go1.18
+
+package stnet_test
+
+import (
+	"testing"
+
+	"github.com/greedchase/gotools/stnet"
+)
+
+// go test -fuzz FuzzSpbDecode
+func FuzzSpbDecode(f *testing.F) {
+	for _, v := range []interface{}{
+		spbAll{I: -1, S: "s", Ss: []string{"a"}, M: map[string]int{"k": 1}, Ins: []spbInner{{"n", 1}}},
+		newGenOrder(),
+		spbExt{Shape: spbCircle{1}, Shapes: []spbShape{&spbRect{1, 2}}, Hash: [4]byte{1}},
+		spbNested{{{}}, {}},
+	} {
+		d, err := stnet.SpbEncode(v)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(d)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, v := range []interface{}{
+			&spbAll{}, &genOrder{}, &refOrder{}, &spbExt{}, &spbNested{},
+			&map[string][]int{}, &[]spbShape{}, new(string), &stnet.ReqProto{},
+		} {
+			stnet.SpbDecode(data, v)
+		}
+		stnet.SpbDecodeLimits(data, &spbAll{}, stnet.SpbLimits{MaxDepth: 3, MaxCollection: 4, MaxString: 4, MaxAlloc: 256})
+	})
+}
+
+// go test -fuzz FuzzServiceUnmarshal
+func FuzzServiceUnmarshal(f *testing.F) {
+	for _, v := range []interface{}{
+		stnet.JsonProto{CmdId: 1, CmdData: []byte("data"), Trace: "trace"},
+		stnet.ReqProto{ReqCmdId: 1, ReqCmdSeq: 2, ReqData: []byte("data"), FuncName: "Sqrt"},
+		stnet.RspProto{RspCmdId: 1, RspCmdSeq: 2, RspCode: -1, RspData: []byte("data")},
+	} {
+		for _, enc := range []int{stnet.EncodeTyepSpb, stnet.EncodeTyepJson} {
+			d, err := stnet.EncodeProtocol(v, enc)
+			if err != nil {
+				f.Fatal(err)
+			}
+			f.Add(d)
+		}
+	}
+	f.Add([]byte("POST / HTTP/1.1\r\nContent-Length: 2\r\n\r\n{}"))
+
+	services := []stnet.ServiceImp{
+		stnet.NewServiceSpb(nil),
+		stnet.NewServiceJson(nil),
+		stnet.NewServiceRpc(&jsonArith{}),
+		stnet.NewServiceJsonRpc(&jsonArith{}),
+		&stnet.ServiceHttp{},
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, s := range services {
+			for d := data; len(d) > 0; {
+				n, _, _, err := s.Unmarshal(nil, d)
+				if err != nil || n <= 0 {
+					break
+				}
+				if n > len(d) {
+					t.Fatalf("%T parsed %d bytes of %d", s, n, len(d))
+				}
+				d = d[n:]
+			}
+		}
+	})
+}
@@ -0,0 +1,168 @@
+package stnet_test
+
+import (
+	"bytes"
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/greedchase/gotools/stnet"
+	"github.com/greedchase/gotools/stnet/stnettest"
+)
+
+type spbInner struct {
+	Name  string
+	Score float64
+}
+
+type spbAll struct {
+	B   bool
+	I   int
+	I8  int8
+	I16 int16
+	I32 int32
+	I64 int64
+	U   uint
+	U8  uint8
+	U16 uint16
+	U32 uint32
+	U64 uint64
+	F32 float32
+	F64 float64
+	S   string
+	Ss  []string
+	Is  []int32
+	M   map[string]int
+	In  spbInner
+	Ins []spbInner
+}
+
+func TestSpbRoundTrip(t *testing.T) {
+	in := spbAll{
+		B: true, I: -1, I8: -8, I16: -16, I32: -32, I64: -1 << 40,
+		U: 1, U8: 8, U16: 16, U32: 32, U64: 1 << 60,
+		F32: 1.5, F64: -2.25, S: "spb",
+		Ss:  []string{"a", "", "c"},
+		Is:  []int32{1, -2, 3},
+		M:   map[string]int{"x": 1, "y": -2},
+		In:  spbInner{"in", 1},
+		Ins: []spbInner{{"a", 2}, {"b", 3}},
+	}
+	data, err := stnet.SpbEncode(&in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out spbAll
+	if err := stnet.SpbDecode(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Fatalf("decode %+v, want %+v", out, in)
+	}
+}
+
+func TestSpbFloatBits(t *testing.T) {
+	//floats are packed as bits in Integer_Positive, the same bytes as unsigned integers
+	type floats struct {
+		F32 float32
+		F64 float64
+	}
+	type bits struct {
+		F32 uint32
+		F64 uint64
+	}
+	in := floats{1.5, -2.25}
+	data, err := stnet.SpbEncode(&in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := stnet.SpbEncode(&bits{math.Float32bits(in.F32), math.Float64bits(in.F64)})
+	if !bytes.Equal(data, want) {
+		t.Fatalf("floats are encoded %x, want %x", data, want)
+	}
+	var out floats
+	if err := stnet.SpbDecode(want, &out); err != nil || out != in {
+		t.Fatalf("decode %+v %v, want %+v", out, err, in)
+	}
+}
+
+func TestSpbDecodeNeedPtr(t *testing.T) {
+	data, _ := stnet.SpbEncode(spbInner{"a", 1})
+	if err := stnet.SpbDecode(data, spbInner{}); err == nil {
+		t.Fatal("decode into value should fail")
+	}
+}
+
+type spbHandled struct {
+	current *stnet.CurrentContent
+	id      uint64
+	msg     interface{}
+	err     error
+}
+
+type spbImp struct {
+	handled chan spbHandled
+}
+
+func (imp *spbImp) Init() bool { return true }
+func (imp *spbImp) Loop()      {}
+func (imp *spbImp) Handle(current *stnet.CurrentContent, cmdId uint64, cmd interface{}, e error) {
+	if in, ok := cmd.(*spbInner); ok && e == nil {
+		stnet.SendSpbCmd(current.Sess, cmdId+1, spbInner{in.Name + "!", in.Score * 2})
+	}
+	imp.handled <- spbHandled{current, cmdId, cmd, e}
+}
+func (imp *spbImp) HashProcessor(current *stnet.CurrentContent, cmdId uint64) int { return -1 }
+
+func TestServiceSpb(t *testing.T) {
+	h := stnettest.New(t, 2)
+	imp := &spbImp{handled: make(chan spbHandled, 10)}
+	spb := stnet.NewServiceSpb(imp)
+	if err := spb.RegisterMsg(1, spbInner{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := spb.RegisterMsg(2, &spbInner{}); err == nil {
+		t.Fatal("register ptr should fail")
+	}
+	s, rec := h.AddService("spb", spb, 0)
+	h.Start()
+	defer h.Stop()
+
+	c := h.Dial(s)
+	defer c.Close()
+	c.SendSpb(1, spbInner{"req", 1.5})
+	h.WaitMessage(rec, 1)
+	got := <-imp.handled
+	if got.err != nil || !reflect.DeepEqual(got.msg, &spbInner{"req", 1.5}) {
+		t.Fatalf("handled %+v", got)
+	}
+
+	var rsp spbInner
+	if id := c.ReadSpb(&rsp); id != 2 || rsp != (spbInner{"req!", 3}) {
+		t.Fatalf("response %d %+v", id, rsp)
+	}
+
+	//unregistered message is handled as raw bytes
+	c.SendSpb(9, spbInner{"raw", 0})
+	h.WaitMessage(rec, 9)
+	got = <-imp.handled
+	if _, ok := got.msg.([]byte); !ok || got.err != nil {
+		t.Fatalf("handled %+v", got)
+	}
+}
+
+func TestServiceSpbBadFrame(t *testing.T) {
+	h := stnettest.New(t, 1)
+	imp := &spbImp{handled: make(chan spbHandled, 10)}
+	s, rec := h.AddService("spb", stnet.NewServiceSpb(imp), 0)
+	h.Start()
+	defer h.Stop()
+
+	c := h.Dial(s)
+	defer c.Close()
+	c.Send([]byte{0, 0, 0, 2})
+	e := h.Wait(rec, stnettest.EventError, nil)
+	if e.Err == nil {
+		t.Fatal("error should be reported")
+	}
+}
@@ -0,0 +1,178 @@
+// Code generated by stspbgen. DO NOT EDIT.
+
+package stnet_test
+
+import "github.com/greedchase/gotools/stnet"
+
+func (x genItem) MarshalSpb(spb *stnet.Spb) error {
+	spb.WriteInt(100, int64(x.ID), false)
+	spb.WriteString(101, x.Name, false)
+	if spb.WriteVectorHeader(2, len(x.Scores), false) {
+		for _, v := range x.Scores {
+			spb.WriteInt(0, int64(v), true)
+		}
+	}
+	spb.WriteFloat64(3, x.Ratio, false)
+	spb.WriteFloat32(4, x.F32, false)
+	spb.WriteInt(5, int64(x.Neg), false)
+	spb.WriteUint(6, uint64(x.U16), true)
+	spb.WriteBool(7, x.On, false)
+	if spb.WriteVectorHeader(8, len(x.Flags), false) {
+		for _, v := range x.Flags {
+			spb.WriteBool(0, v, true)
+		}
+	}
+	if spb.WriteVectorHeader(9, len(x.Names), false) {
+		for _, v := range x.Names {
+			spb.WriteString(0, v, true)
+		}
+	}
+	if err := spb.WriteValue(10, x.Sub, false); err != nil {
+		return err
+	}
+	if err := spb.WriteValue(11, x.Attr, false); err != nil {
+		return err
+	}
+	if err := spb.WriteValue(12, x.Data, false); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (x *genItem) UnmarshalSpb(spb *stnet.Spb, tag uint32, typ uint8) (bool, error) {
+	switch tag {
+	case 100:
+		v, ok, err := spb.ReadInt(typ)
+		if ok {
+			x.ID = int32(v)
+		}
+		return true, err
+	case 101:
+		v, ok, err := spb.ReadString(typ)
+		if ok {
+			x.Name = v
+		}
+		return true, err
+	case 2:
+		n, ok, err := spb.ReadVectorLen(typ)
+		if !ok {
+			return true, err
+		}
+		x.Scores = make([]int32, 0, n)
+		for i := 0; i < n; i++ {
+			_, et, err := spb.ReadHeader()
+			if err != nil {
+				return true, err
+			}
+			v, _, err := spb.ReadInt(et)
+			if err != nil {
+				return true, err
+			}
+			x.Scores = append(x.Scores, int32(v))
+		}
+		return true, nil
+	case 3:
+		v, ok, err := spb.ReadFloat64(typ)
+		if ok {
+			x.Ratio = v
+		}
+		return true, err
+	case 4:
+		v, ok, err := spb.ReadFloat32(typ)
+		if ok {
+			x.F32 = v
+		}
+		return true, err
+	case 5:
+		v, ok, err := spb.ReadInt(typ)
+		if ok {
+			x.Neg = v
+		}
+		return true, err
+	case 6:
+		v, ok, err := spb.ReadUint(typ)
+		if ok {
+			x.U16 = uint16(v)
+		}
+		return true, err
+	case 7:
+		v, ok, err := spb.ReadBool(typ)
+		if ok {
+			x.On = v
+		}
+		return true, err
+	case 8:
+		n, ok, err := spb.ReadVectorLen(typ)
+		if !ok {
+			return true, err
+		}
+		x.Flags = make([]bool, 0, n)
+		for i := 0; i < n; i++ {
+			_, et, err := spb.ReadHeader()
+			if err != nil {
+				return true, err
+			}
+			v, _, err := spb.ReadBool(et)
+			if err != nil {
+				return true, err
+			}
+			x.Flags = append(x.Flags, v)
+		}
+		return true, nil
+	case 9:
+		n, ok, err := spb.ReadVectorLen(typ)
+		if !ok {
+			return true, err
+		}
+		x.Names = make([]string, 0, n)
+		for i := 0; i < n; i++ {
+			_, et, err := spb.ReadHeader()
+			if err != nil {
+				return true, err
+			}
+			v, _, err := spb.ReadString(et)
+			if err != nil {
+				return true, err
+			}
+			x.Names = append(x.Names, v)
+		}
+		return true, nil
+	case 10:
+		return true, spb.ReadValue(typ, &x.Sub)
+	case 11:
+		return true, spb.ReadValue(typ, &x.Attr)
+	case 12:
+		return true, spb.ReadValue(typ, &x.Data)
+	}
+	return false, nil
+}
+
+func (x genOrder) MarshalSpb(spb *stnet.Spb) error {
+	spb.WriteUint(100, uint64(x.ID), false)
+	if err := spb.WriteValue(1, x.Items, false); err != nil {
+		return err
+	}
+	spb.WriteString(101, x.Note, false)
+	spb.WriteRaw(x.Unknown)
+	return nil
+}
+
+func (x *genOrder) UnmarshalSpb(spb *stnet.Spb, tag uint32, typ uint8) (bool, error) {
+	switch tag {
+	case 100:
+		v, ok, err := spb.ReadUint(typ)
+		if ok {
+			x.ID = v
+		}
+		return true, err
+	case 1:
+		return true, spb.ReadValue(typ, &x.Items)
+	case 101:
+		v, ok, err := spb.ReadString(typ)
+		if ok {
+			x.Note = v
+		}
+		return true, err
+	}
+	return false, nil
+}
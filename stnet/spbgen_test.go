@@ -0,0 +1,152 @@
+package stnet_test
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/greedchase/gotools/stnet"
+)
+
+//go:generate go run ../stspbgen -file spbgen_test.go
+
+//spb:gen
+type genItem struct {
+	ID     int32  `tag:"100"`
+	Name   string `tag:"101"`
+	Scores []int32
+	Ratio  float64
+	F32    float32
+	Neg    int64
+	U16    uint16 `require:"true"`
+	On     bool
+	Flags  []bool
+	Names  []string
+	Sub    spbInner
+	Attr   map[string]int
+	Data   []byte
+}
+
+//spb:gen
+type genOrder struct {
+	ID      uint64 `tag:"100"`
+	Items   []genItem
+	Note    string `tag:"101"`
+	Unknown stnet.SpbUnknownFields
+}
+
+// same layout without generated methods
+type refItem struct {
+	ID     int32  `tag:"100"`
+	Name   string `tag:"101"`
+	Scores []int32
+	Ratio  float64
+	F32    float32
+	Neg    int64
+	U16    uint16 `require:"true"`
+	On     bool
+	Flags  []bool
+	Names  []string
+	Sub    spbInner
+	Attr   map[string]int
+	Data   []byte
+}
+
+type refOrder struct {
+	ID    uint64 `tag:"100"`
+	Items []refItem
+	Note  string `tag:"101"`
+}
+
+func newGenOrder() genOrder {
+	o := genOrder{ID: 1 << 40, Note: "order"}
+	for i := 0; i < 10; i++ {
+		o.Items = append(o.Items, genItem{
+			ID: int32(i), Name: "item", Scores: []int32{1, -2, 3}, Ratio: 0.5, F32: 1.5, Neg: -100,
+			On: true, Flags: []bool{true, false}, Names: []string{"a", "b"}, Sub: spbInner{"in", 2},
+			Attr: map[string]int{"x": 1}, Data: []byte{1, 2, 3},
+		})
+	}
+	return o
+}
+
+func toRefOrder(o genOrder) refOrder {
+	r := refOrder{ID: o.ID, Note: o.Note}
+	for _, it := range o.Items {
+		r.Items = append(r.Items, refItem(it))
+	}
+	return r
+}
+
+func TestSpbGenerated(t *testing.T) {
+	in := newGenOrder()
+	gen, err := stnet.SpbEncode(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, _ := stnet.SpbEncode(toRefOrder(in))
+	if !bytes.Equal(gen, ref) {
+		t.Fatalf("generated encoding differs from reflect\n%v\n%v", gen, ref)
+	}
+
+	var out genOrder
+	if err = stnet.SpbDecode(ref, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Fatalf("decode %+v, want %+v", out, in)
+	}
+
+	//unknown fields are kept by generated code too
+	type orderV2 struct {
+		ID    uint64 `tag:"100"`
+		Items []refItem
+		Note  string `tag:"101"`
+		Extra []string
+	}
+	v2 := orderV2{ID: 2, Note: "n", Extra: []string{"e"}}
+	d, _ := stnet.SpbEncode(v2)
+	out = genOrder{}
+	if err = stnet.SpbDecode(d, &out); err != nil || out.ID != 2 || len(out.Unknown) == 0 {
+		t.Fatalf("decode newer version %+v %v", out, err)
+	}
+	d, _ = stnet.SpbEncode(out)
+	var back orderV2
+	if err = stnet.SpbDecode(d, &back); err != nil || !reflect.DeepEqual(back, v2) {
+		t.Fatalf("round trip %+v %v", back, err)
+	}
+}
+
+func BenchmarkSpbEncodeReflect(b *testing.B) {
+	o := toRefOrder(newGenOrder())
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		stnet.SpbEncode(o)
+	}
+}
+
+func BenchmarkSpbEncodeGenerated(b *testing.B) {
+	o := newGenOrder()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		stnet.SpbEncode(o)
+	}
+}
+
+func BenchmarkSpbDecodeReflect(b *testing.B) {
+	d, _ := stnet.SpbEncode(newGenOrder())
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var o refOrder
+		stnet.SpbDecode(d, &o)
+	}
+}
+
+func BenchmarkSpbDecodeGenerated(b *testing.B) {
+	d, _ := stnet.SpbEncode(newGenOrder())
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var o genOrder
+		stnet.SpbDecode(d, &o)
+	}
+}
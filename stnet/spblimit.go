@@ -0,0 +1,106 @@
+package stnet
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"unsafe"
+)
+
+// ErrSpbLimit is wrapped by errors of decoding which exceeds SpbLimits, check it by errors.Is.
+var ErrSpbLimit = errors.New("spb: decode limit exceeded")
+
+// SpbLimits bound resources used to decode a message, so that a small hostile frame could not make the decoder
+// allocate huge memory or recurse deeply. zero means unlimited.
+// declared lengths of strings, vectors and maps are always checked against the remaining data.
+type SpbLimits struct {
+	MaxDepth      int //nesting depth of structs, vectors and maps
+	MaxCollection int //elements of a vector or entries of a map
+	MaxString     int //bytes of a string or []byte
+	MaxAlloc      int //total bytes allocated for strings, vectors and maps of a message
+}
+
+// DefaultSpbLimits is used by SpbDecode(and services decoding spb) until SetSpbLimits is called.
+var DefaultSpbLimits = SpbLimits{
+	MaxDepth:      100,
+	MaxCollection: 1 << 20,
+	MaxString:     MaxMsgSize,
+	MaxAlloc:      64 << 20,
+}
+
+var spbLimits atomic.Value //SpbLimits
+
+// SetSpbLimits set limits of SpbDecode, Unmarshal and services decoding spb.
+func SetSpbLimits(l SpbLimits) {
+	spbLimits.Store(l)
+}
+
+func GetSpbLimits() SpbLimits {
+	if l, ok := spbLimits.Load().(SpbLimits); ok {
+		return l
+	}
+	return DefaultSpbLimits
+}
+
+// SpbDecodeLimits decode data into x with limits instead of the global ones.
+func SpbDecodeLimits(data []byte, x interface{}, limits SpbLimits) error {
+	spb := newSpbReader(data, limits)
+	return spb.decode(x)
+}
+
+func newSpbReader(data []byte, limits SpbLimits) Spb {
+	return Spb{buf: data, limits: limits}
+}
+
+func (spb *Spb) enter() error {
+	spb.depth++
+	if max := spb.limits.MaxDepth; max > 0 && spb.depth > max {
+		return fmt.Errorf("%w: nesting depth exceeds %d", ErrSpbLimit, max)
+	}
+	return nil
+}
+
+func (spb *Spb) leave() {
+	spb.depth--
+}
+
+func (spb *Spb) allocate(n uint64) error {
+	max := spb.limits.MaxAlloc
+	if max <= 0 {
+		return nil
+	}
+	spb.alloc += n
+	if spb.alloc > uint64(max) {
+		return fmt.Errorf("%w: allocation exceeds %d bytes", ErrSpbLimit, max)
+	}
+	return nil
+}
+
+// checkLen check declared length of a vector or map whose elements are encoded in at least minSize bytes,
+// elemSize bytes are allocated for every element.
+func (spb *Spb) checkLen(ln uint64, minSize int, elemSize uintptr) (int, error) {
+	if ln > uint64(len(spb.buf)-spb.index)/uint64(minSize) {
+		return 0, errNoEnoughData
+	}
+	if max := spb.limits.MaxCollection; max > 0 && ln > uint64(max) {
+		return 0, fmt.Errorf("%w: %d elements exceed %d", ErrSpbLimit, ln, max)
+	}
+	return int(ln), spb.allocate(ln * uint64(elemSize))
+}
+
+// checkString check declared length of a string, it is allocated if alloc.
+func (spb *Spb) checkString(ln uint64, alloc bool) (int, error) {
+	if ln > uint64(len(spb.buf)-spb.index) {
+		return 0, errNoEnoughData
+	}
+	if max := spb.limits.MaxString; max > 0 && ln > uint64(max) {
+		return 0, fmt.Errorf("%w: string of %d bytes exceeds %d", ErrSpbLimit, ln, max)
+	}
+	if alloc {
+		return int(ln), spb.allocate(ln)
+	}
+	return int(ln), nil
+}
+
+// sizes allocated for elements of a vector decoded by generated code
+const spbBasicSize = unsafe.Sizeof("")
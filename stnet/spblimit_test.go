@@ -0,0 +1,84 @@
+package stnet_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/greedchase/gotools/stnet"
+)
+
+type spbNested []spbNested
+
+func spbVarint(x uint64) []byte {
+	var b []byte
+	for x >= 0x80 {
+		b = append(b, byte(x)|0x80)
+		x >>= 7
+	}
+	return append(b, byte(x))
+}
+
+func spbHead(typ uint8) byte {
+	return typ << 4
+}
+
+func TestSpbLimits(t *testing.T) {
+	//declared lengths larger than data
+	hostile := [][]byte{
+		append([]byte{spbHead(stnet.SpbPackDataType_String)}, spbVarint(1<<62)...),
+		append([]byte{spbHead(stnet.SpbPackDataType_Vector)}, spbVarint(1<<40)...),
+		append([]byte{spbHead(stnet.SpbPackDataType_Map)}, spbVarint(1<<40)...),
+	}
+	for _, d := range hostile {
+		var s []string
+		var m map[string]int
+		var in spbInner
+		if stnet.SpbDecode(d, &s) == nil || stnet.SpbDecode(d, &m) == nil || stnet.SpbDecode(d, &in) == nil {
+			t.Fatalf("decode %v", d)
+		}
+	}
+
+	d, _ := stnet.SpbEncode(make([]int, 10))
+	err := stnet.SpbDecodeLimits(d, &[]int{}, stnet.SpbLimits{MaxCollection: 5})
+	if !errors.Is(err, stnet.ErrSpbLimit) {
+		t.Fatalf("collection limit: %v", err)
+	}
+	d, _ = stnet.SpbEncode("0123456789")
+	if err = stnet.SpbDecodeLimits(d, new(string), stnet.SpbLimits{MaxString: 5}); !errors.Is(err, stnet.ErrSpbLimit) {
+		t.Fatalf("string limit: %v", err)
+	}
+
+	//every element of 1 byte allocates 1KB
+	d, _ = stnet.SpbEncode(make([]int, 1000))
+	err = stnet.SpbDecodeLimits(d, &[][128]int64{}, stnet.SpbLimits{MaxAlloc: 64 << 10})
+	if !errors.Is(err, stnet.ErrSpbLimit) {
+		t.Fatalf("allocation limit: %v", err)
+	}
+
+	//nested vectors are decoded and skipped with depth limit
+	var deep []byte
+	for i := 0; i < 1000; i++ {
+		deep = append(deep, spbHead(stnet.SpbPackDataType_Vector), 1)
+	}
+	deep = append(deep, spbHead(stnet.SpbPackDataType_Vector), 0)
+	var nested spbNested
+	if err = stnet.SpbDecode(deep, &nested); !errors.Is(err, stnet.ErrSpbLimit) {
+		t.Fatalf("depth limit: %v", err)
+	}
+	wrapped := append([]byte{spbHead(stnet.SpbPackDataType_StructBegin)}, deep...)
+	wrapped = append(wrapped, spbHead(stnet.SpbPackDataType_StructEnd))
+	if err = stnet.SpbDecode(wrapped, &spbInner{}); !errors.Is(err, stnet.ErrSpbLimit) {
+		t.Fatalf("depth limit of skipped field: %v", err)
+	}
+	if err = stnet.SpbDecodeLimits(deep, &nested, stnet.SpbLimits{}); err != nil {
+		t.Fatalf("decode without limits: %v", err)
+	}
+
+	old := stnet.GetSpbLimits()
+	defer stnet.SetSpbLimits(old)
+	stnet.SetSpbLimits(stnet.SpbLimits{MaxCollection: 5})
+	d, _ = stnet.SpbEncode(make([]int, 10))
+	if err = stnet.Unmarshal(d, &[]int{}, stnet.EncodeTyepSpb); !errors.Is(err, stnet.ErrSpbLimit) {
+		t.Fatalf("global limits: %v", err)
+	}
+}
@@ -0,0 +1,226 @@
+package stnet
+
+import (
+	"reflect"
+	"unsafe"
+)
+
+// SpbMarshaler is implemented by structs generated by stspbgen, MarshalSpb writes fields of the struct without reflect.
+// it is used by SpbEncode(and struct fields, elements of slices and maps) instead of reflect when it is present,
+// the receiver must be value so that both T and *T implement it.
+// structs embedding a struct which implements it are encoded by reflect, since the methods are promoted.
+type SpbMarshaler interface {
+	MarshalSpb(spb *Spb) error
+}
+
+// SpbUnmarshaler is implemented by pointer of structs generated by stspbgen,
+// UnmarshalSpb decodes the field of tag whose header is read, known is false if tag is unknown and the field is not read.
+type SpbUnmarshaler interface {
+	UnmarshalSpb(spb *Spb, tag uint32, typ uint8) (known bool, err error)
+}
+
+var (
+	spbMarshalerType   = reflect.TypeOf((*SpbMarshaler)(nil)).Elem()
+	spbUnmarshalerType = reflect.TypeOf((*SpbUnmarshaler)(nil)).Elem()
+)
+
+// NewSpbReader is used to decode data by generated code.
+func NewSpbReader(data []byte) *Spb {
+	spb := newSpbReader(data, GetSpbLimits())
+	return &spb
+}
+
+// Bytes return encoded data.
+func (spb *Spb) Bytes() []byte {
+	return spb.buf
+}
+
+func (spb *Spb) WriteUint(tag uint32, v uint64, require bool) {
+	if v == 0 && !require {
+		return
+	}
+	spb.packHeader(tag, SpbPackDataType_Integer_Positive)
+	spb.packNumber(v)
+}
+
+func (spb *Spb) WriteInt(tag uint32, v int64, require bool) {
+	if v >= 0 {
+		spb.WriteUint(tag, uint64(v), require)
+		return
+	}
+	spb.packHeader(tag, SpbPackDataType_Integer_Negative)
+	spb.packNumber(uint64(-v))
+}
+
+func (spb *Spb) WriteBool(tag uint32, v bool, require bool) {
+	if v {
+		spb.WriteUint(tag, 1, require)
+	} else {
+		spb.WriteUint(tag, 0, require)
+	}
+}
+
+func (spb *Spb) WriteFloat32(tag uint32, v float32, require bool) {
+	n := uint64(*(*uint32)(unsafe.Pointer(&v)))
+	if n == 0 && !require {
+		return
+	}
+	spb.packHeader(tag, SpbPackDataType_Integer_Positive)
+	spb.packNumber(n)
+}
+
+func (spb *Spb) WriteFloat64(tag uint32, v float64, require bool) {
+	n := *(*uint64)(unsafe.Pointer(&v))
+	if n == 0 && !require {
+		return
+	}
+	spb.packHeader(tag, SpbPackDataType_Integer_Positive)
+	spb.packNumber(n)
+}
+
+func (spb *Spb) WriteString(tag uint32, v string, require bool) {
+	if len(v) == 0 && !require {
+		return
+	}
+	spb.packHeader(tag, SpbPackDataType_String)
+	spb.packNumber(uint64(len(v)))
+	spb.buf = append(spb.buf, v...)
+}
+
+// WriteVectorHeader write header of slice of n elements, false if it is not written(empty and not required).
+// elements are written with tag 0 and require true.
+func (spb *Spb) WriteVectorHeader(tag uint32, n int, require bool) bool {
+	if n == 0 && !require {
+		return false
+	}
+	spb.packHeader(tag, SpbPackDataType_Vector)
+	spb.packNumber(uint64(n))
+	return true
+}
+
+// WriteValue write v by reflect, it is used by generated code for types which are not generated.
+func (spb *Spb) WriteValue(tag uint32, v interface{}, require bool) error {
+	return spb.pack(tag, v, true, require)
+}
+
+// WriteRaw write encoded fields such as SpbUnknownFields.
+func (spb *Spb) WriteRaw(b []byte) {
+	spb.packData(b)
+}
+
+// readNumber read number of typ, ok is false and the value is skipped if typ is not one of want.
+func (spb *Spb) readNumber(typ uint8, want ...uint8) (v uint64, ok bool, err error) {
+	for _, w := range want {
+		if typ == w {
+			v, err = spb.unpackNumber()
+			return v, err == nil, err
+		}
+	}
+	return 0, false, spb.skipValue(typ)
+}
+
+func (spb *Spb) skipValue(typ uint8) error {
+	if typ == SpbPackDataType_StructEnd {
+		return errStructEnd
+	}
+	return spb.skipField(typ)
+}
+
+// ReadUint read value of typ as SpbDecode sets unsigned integers, ok is false if typ does not match and the value is skipped.
+func (spb *Spb) ReadUint(typ uint8) (v uint64, ok bool, err error) {
+	return spb.readNumber(typ, SpbPackDataType_Integer_Positive)
+}
+
+func (spb *Spb) ReadInt(typ uint8) (v int64, ok bool, err error) {
+	n, ok, err := spb.readNumber(typ, SpbPackDataType_Integer_Positive, SpbPackDataType_Integer_Negative)
+	if typ == SpbPackDataType_Integer_Negative {
+		return int64(-n), ok, err
+	}
+	return int64(n), ok, err
+}
+
+func (spb *Spb) ReadBool(typ uint8) (v bool, ok bool, err error) {
+	n, ok, err := spb.readNumber(typ, SpbPackDataType_Integer_Positive)
+	return n > 0, ok, err
+}
+
+// ReadFloat32 read value of typ as SpbDecode sets float32, Integer_Positive is the bits of float32.
+func (spb *Spb) ReadFloat32(typ uint8) (v float32, ok bool, err error) {
+	n, ok, err := spb.readNumber(typ, SpbPackDataType_Integer_Positive, SpbPackDataType_Float, SpbPackDataType_Double)
+	return float32(numberToFloat(typ != SpbPackDataType_Double, n)), ok, err
+}
+
+// ReadFloat64 read value of typ as SpbDecode sets float64, Integer_Positive is the bits of float64.
+func (spb *Spb) ReadFloat64(typ uint8) (v float64, ok bool, err error) {
+	n, ok, err := spb.readNumber(typ, SpbPackDataType_Integer_Positive, SpbPackDataType_Float, SpbPackDataType_Double)
+	return numberToFloat(typ == SpbPackDataType_Float, n), ok, err
+}
+
+func (spb *Spb) ReadString(typ uint8) (v string, ok bool, err error) {
+	if typ != SpbPackDataType_String {
+		return "", false, spb.skipValue(typ)
+	}
+	ln, err := spb.unpackNumber()
+	if err != nil {
+		return "", false, err
+	}
+	n, err := spb.checkString(ln, true)
+	if err != nil {
+		return "", false, err
+	}
+	v = string(spb.buf[spb.index : spb.index+n])
+	spb.index += n
+	return v, true, nil
+}
+
+// ReadVectorLen read length of slice, elements are read with ReadHeader and Read functions.
+func (spb *Spb) ReadVectorLen(typ uint8) (n int, ok bool, err error) {
+	ln, ok, err := spb.readNumber(typ, SpbPackDataType_Vector)
+	if !ok {
+		return 0, false, err
+	}
+	n, err = spb.checkLen(ln, 1, spbBasicSize)
+	return n, err == nil, err
+}
+
+func (spb *Spb) ReadHeader() (tag uint32, typ uint8, err error) {
+	return spb.unpackHeader()
+}
+
+// ReadValue decode value of typ into v(pointer) by reflect, it is used by generated code for types which are not generated.
+func (spb *Spb) ReadValue(typ uint8, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return errNeedPtr
+	}
+	return spb.unpackValue(rv.Elem(), typ)
+}
+
+// unpackGenerated decode fields of struct by UnmarshalSpb.
+func (spb *Spb) unpackGenerated(u SpbUnmarshaler, unknown reflect.Value) error {
+	for {
+		start := spb.index
+		tag, typ, err := spb.unpackHeader()
+		if err != nil {
+			return err
+		}
+		if typ == SpbPackDataType_StructEnd {
+			return nil
+		}
+		known, err := u.UnmarshalSpb(spb, tag, typ)
+		if err != nil {
+			return err
+		}
+		if !known {
+			if err = spb.skipValue(typ); err != nil {
+				return err
+			}
+			if err = spb.allocate(uint64(spb.index - start)); err != nil {
+				return err
+			}
+			if unknown.IsValid() {
+				unknown.SetBytes(append(unknown.Bytes(), spb.buf[start:spb.index]...))
+			}
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package stnet
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"sync"
+)
+
+// SpbStrictMessage is implemented by structs encoded in strict mode:
+// every field must have an explicit `tag` and tags must be unique, otherwise SpbEncode and SpbDecode fail.
+// tags of other structs default to the index of field, so reordering fields breaks compatibility.
+//
+//	func (LoginReq) SpbStrict() {}
+type SpbStrictMessage interface {
+	SpbStrict()
+}
+
+// SpbUnknownFields keeps fields whose tags are unknown when decoding, they are encoded again as they are.
+// add a field of this type(without tag) into struct to keep messages of newer version when they are passed through.
+type SpbUnknownFields []byte
+
+type spbField struct {
+	index   int
+	tag     uint32
+	require bool
+}
+
+// spbStructInfo fields of struct in encoding order, it is cached by type.
+type spbStructInfo struct {
+	fields  []spbField
+	byTag   map[uint32]int //tag to index of field
+	unknown int            //index of SpbUnknownFields field, -1 if there is none
+	err     error          //strict mode violation
+
+	marshaler   bool //MarshalSpb is declared(not promoted from embedded struct)
+	unmarshaler bool
+}
+
+var (
+	spbInfoCache     sync.Map //map[reflect.Type]*spbStructInfo
+	spbStrictType    = reflect.TypeOf((*SpbStrictMessage)(nil)).Elem()
+	spbUnknownType   = reflect.TypeOf(SpbUnknownFields(nil))
+	spbStructInfoNil = &spbStructInfo{unknown: -1}
+)
+
+func getSpbStructInfo(t reflect.Type) *spbStructInfo {
+	if t.Kind() != reflect.Struct {
+		return spbStructInfoNil
+	}
+	if v, ok := spbInfoCache.Load(t); ok {
+		return v.(*spbStructInfo)
+	}
+	info := newSpbStructInfo(t)
+	spbInfoCache.Store(t, info)
+	return info
+}
+
+func newSpbStructInfo(t reflect.Type) *spbStructInfo {
+	strict := t.Implements(spbStrictType) || reflect.PtrTo(t).Implements(spbStrictType)
+	info := &spbStructInfo{byTag: make(map[uint32]int), unknown: -1}
+	info.marshaler = t.Implements(spbMarshalerType)
+	info.unmarshaler = reflect.PtrTo(t).Implements(spbUnmarshalerType)
+	var implicit []spbField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Anonymous {
+			//methods of embedded struct may be promoted, they do not encode fields of t
+			et := derefType(f.Type)
+			if et.Implements(spbMarshalerType) || reflect.PtrTo(et).Implements(spbUnmarshalerType) {
+				info.marshaler, info.unmarshaler = false, false
+			}
+			if f.PkgPath != "" && et.Kind() != reflect.Struct {
+				continue
+			}
+		} else if f.PkgPath != "" { //unexported
+			continue
+		}
+		if f.Type == spbUnknownType {
+			info.unknown = i
+			continue
+		}
+		fld := spbField{index: i, tag: uint32(i), require: f.Tag.Get("require") == "true"}
+		tg, explicit := f.Tag.Lookup("tag")
+		if explicit {
+			if n, err := strconv.ParseUint(tg, 10, 32); err == nil {
+				fld.tag = uint32(n)
+			} else {
+				explicit = false
+				if strict && info.err == nil {
+					info.err = fmt.Errorf("spb: invalid tag %q of %s.%s", tg, t.Name(), f.Name)
+				}
+			}
+		}
+		if strict && !explicit && info.err == nil {
+			info.err = fmt.Errorf("spb: field %s.%s has no tag in strict mode", t.Name(), f.Name)
+		}
+		if explicit {
+			if j, ok := info.byTag[fld.tag]; ok {
+				if strict && info.err == nil {
+					info.err = fmt.Errorf("spb: duplicate tag %d of %s.%s and %s", fld.tag, t.Name(), t.Field(j).Name, f.Name)
+				}
+			} else {
+				info.byTag[fld.tag] = i
+			}
+		} else {
+			implicit = append(implicit, fld)
+		}
+		info.fields = append(info.fields, fld)
+	}
+	for _, fld := range implicit { //explicit tags win when decoding
+		if _, ok := info.byTag[fld.tag]; !ok {
+			info.byTag[fld.tag] = fld.index
+		}
+	}
+	return info
+}
+
+// field return the field of tag, it is invalid if tag is unknown.
+func (info *spbStructInfo) field(x reflect.Value, tag uint32) reflect.Value {
+	if i, ok := info.byTag[tag]; ok {
+		return x.Field(i)
+	}
+	return reflect.Value{}
+}
+
+// SpbBreakingChange is an incompatible difference between two versions of a type found by CheckSpbCompatibility.
+type SpbBreakingChange struct {
+	Path   string //path of the field, such as "LoginReq.Items[].Name"
+	Reason string
+}
+
+func (c SpbBreakingChange) String() string {
+	return c.Path + ": " + c.Reason
+}
+
+// CheckSpbCompatibility compare two versions of a message type(values or pointers) and report changes which break
+// decoding between them: fields moved to another tag, tags reused with incompatible types and duplicate tags.
+// fields are matched by tag as spb does, added and removed fields are compatible.
+// messages must be decoded in both directions, so changes between signed and unsigned integers are breaking too.
+func CheckSpbCompatibility(old, new interface{}) []SpbBreakingChange {
+	c := spbCompat{seen: make(map[[2]reflect.Type]bool)}
+	ot, nt := reflect.TypeOf(old), reflect.TypeOf(new)
+	if ot == nil || nt == nil {
+		return []SpbBreakingChange{{"", "nil type"}}
+	}
+	c.compare(derefType(nt).Name(), ot, nt)
+	return c.changes
+}
+
+type spbCompat struct {
+	seen    map[[2]reflect.Type]bool
+	changes []SpbBreakingChange
+}
+
+func (c *spbCompat) report(path, format string, args ...interface{}) {
+	c.changes = append(c.changes, SpbBreakingChange{path, fmt.Sprintf(format, args...)})
+}
+
+func derefType(t reflect.Type) reflect.Type {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t
+}
+
+// spbWireKind group types which are decoded into each other in both directions, changes of width are not reported.
+func spbWireKind(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Bool:
+		return "bool"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return "int"
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "uint"
+	case reflect.Float32, reflect.Float64:
+		return "float"
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return "string"
+		}
+		return "vector"
+	case reflect.Struct:
+		if t == spbTimeType {
+			return "time"
+		}
+	}
+	return t.Kind().String()
+}
+
+func (c *spbCompat) compare(path string, ot, nt reflect.Type) {
+	ot, nt = derefType(ot), derefType(nt)
+	if c.seen[[2]reflect.Type{ot, nt}] {
+		return
+	}
+	c.seen[[2]reflect.Type{ot, nt}] = true
+
+	ok, nk := spbWireKind(ot), spbWireKind(nt)
+	if ok != nk {
+		c.report(path, "type changed from %s to %s", ot, nt)
+		return
+	}
+	switch nk {
+	case "vector":
+		c.compare(path+"[]", ot.Elem(), nt.Elem())
+	case "map":
+		c.compare(path+"[key]", ot.Key(), nt.Key())
+		c.compare(path+"[]", ot.Elem(), nt.Elem())
+	case "struct":
+		c.compareStruct(path, ot, nt)
+	}
+}
+
+func (c *spbCompat) compareStruct(path string, ot, nt reflect.Type) {
+	oi, ni := getSpbStructInfo(ot), getSpbStructInfo(nt)
+	tags := make(map[uint32]bool)
+	dup := false
+	for _, f := range ni.fields {
+		if tags[f.tag] {
+			c.report(path+"."+nt.Field(f.index).Name, "duplicate tag %d", f.tag)
+			dup = true
+		}
+		tags[f.tag] = true
+	}
+	if ni.err != nil && !dup {
+		c.report(path, "%s", ni.err.Error())
+	}
+
+	oldTag := make(map[string]uint32)
+	for _, f := range oi.fields {
+		oldTag[ot.Field(f.index).Name] = f.tag
+	}
+	for _, f := range ni.fields {
+		nf := nt.Field(f.index)
+		fpath := path + "." + nf.Name
+		if tag, ok := oldTag[nf.Name]; ok && tag != f.tag {
+			c.report(fpath, "tag changed from %d to %d", tag, f.tag)
+		}
+		if i, ok := oi.byTag[f.tag]; ok {
+			c.compare(fpath, ot.Field(i).Type, nf.Type)
+		}
+	}
+}
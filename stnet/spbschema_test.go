@@ -0,0 +1,152 @@
+package stnet_test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/greedchase/gotools/stnet"
+)
+
+type strictOK struct {
+	Name string `tag:"1"`
+	Age  int    `tag:"2"`
+}
+
+func (strictOK) SpbStrict() {}
+
+type strictNoTag struct {
+	Name string `tag:"1"`
+	Age  int
+}
+
+func (strictNoTag) SpbStrict() {}
+
+type strictDup struct {
+	Name string `tag:"1"`
+	Age  int    `tag:"1"`
+}
+
+func (*strictDup) SpbStrict() {}
+
+func TestSpbStrict(t *testing.T) {
+	d, err := stnet.SpbEncode(strictOK{"a", 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out strictOK
+	if err = stnet.SpbDecode(d, &out); err != nil || out != (strictOK{"a", 3}) {
+		t.Fatalf("decode %v %v", out, err)
+	}
+	if _, err = stnet.SpbEncode(strictNoTag{}); err == nil || !strings.Contains(err.Error(), "no tag") {
+		t.Fatalf("encode without tag: %v", err)
+	}
+	if _, err = stnet.SpbEncode(&strictDup{}); err == nil || !strings.Contains(err.Error(), "duplicate") {
+		t.Fatalf("encode duplicate tag: %v", err)
+	}
+	if err = stnet.SpbDecode(d, &strictDup{}); err == nil {
+		t.Fatal("decode into struct with duplicate tag")
+	}
+}
+
+type itemV2 struct {
+	ID    int      `tag:"1"`
+	Label string   `tag:"2"`
+	Tags  []string `tag:"3"`
+	Sub   spbInner `tag:"4"`
+}
+
+type itemV1 struct {
+	ID      int `tag:"1"`
+	Unknown stnet.SpbUnknownFields
+}
+
+type proxyMsg struct {
+	Items []itemV1
+	Extra map[string]int
+}
+
+type proxyMsgV2 struct {
+	Items []itemV2
+	Extra map[string]int
+}
+
+func TestSpbUnknownFields(t *testing.T) {
+	in := proxyMsgV2{
+		Items: []itemV2{{1, "one", []string{"a", "b"}, spbInner{"x", 1}}, {ID: 2}},
+		Extra: map[string]int{"k": 1},
+	}
+	d, _ := stnet.SpbEncode(in)
+	var old proxyMsg
+	if err := stnet.SpbDecode(d, &old); err != nil {
+		t.Fatal(err)
+	}
+	if old.Items[0].ID != 1 || len(old.Items[0].Unknown) == 0 || old.Items[1].ID != 2 {
+		t.Fatalf("decode old version %+v", old)
+	}
+	d, _ = stnet.SpbEncode(old)
+	var out proxyMsgV2
+	if err := stnet.SpbDecode(d, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Fatalf("round trip %+v, want %+v", out, in)
+	}
+}
+
+type userV1 struct {
+	Name string
+	Age  int
+	Tags []string
+}
+
+type userV2 struct { //fields reordered
+	Age   int
+	Name  string
+	Tags  []string
+	Email string
+}
+
+type userV3 struct { //field added
+	Name  string
+	Age   int
+	Tags  []string
+	Email string
+}
+
+type userV4 struct {
+	Name string
+	Age  uint
+	Tags []int
+}
+
+type userDup struct {
+	Name string
+	Age  int `tag:"0"`
+}
+
+func TestSpbCompatibility(t *testing.T) {
+	if c := stnet.CheckSpbCompatibility(userV1{}, &userV3{}); len(c) != 0 {
+		t.Fatalf("compatible change is reported: %v", c)
+	}
+	changes := stnet.CheckSpbCompatibility(userV1{}, userV2{})
+	s := make([]string, len(changes))
+	for i, c := range changes {
+		s[i] = c.String()
+	}
+	want := []string{
+		"userV2.Age: tag changed from 1 to 0",
+		"userV2.Age: type changed from string to int",
+		"userV2.Name: tag changed from 0 to 1",
+		"userV2.Name: type changed from int to string",
+	}
+	if !reflect.DeepEqual(s, want) {
+		t.Fatalf("changes %q", s)
+	}
+	if c := stnet.CheckSpbCompatibility(userV1{}, userV4{}); len(c) != 2 || c[0].Path != "userV4.Age" || c[1].Path != "userV4.Tags[]" {
+		t.Fatalf("type changes %v", c)
+	}
+	if c := stnet.CheckSpbCompatibility(userV1{}, userDup{}); len(c) == 0 || !strings.Contains(c[0].Reason, "duplicate") {
+		t.Fatalf("duplicate tags %v", c)
+	}
+}
@@ -0,0 +1,208 @@
+package stnet
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// time.Time is encoded as struct {Sec int64; Nsec int32}(unix time), the location is not kept and it is decoded as UTC.
+// time.Duration is encoded as int64.
+type spbTime struct {
+	Sec  int64
+	Nsec int32
+}
+
+var spbTimeType = reflect.TypeOf(time.Time{})
+
+func (spb *Spb) packTime(tag uint32, x reflect.Value, require bool) error {
+	t := x.Interface().(time.Time)
+	if t.IsZero() && !require {
+		return nil
+	}
+	return spb.packStruct(tag, reflect.ValueOf(spbTime{t.Unix(), int32(t.Nanosecond())}))
+}
+
+func (spb *Spb) unpackTime(x reflect.Value) error {
+	var st spbTime
+	if err := spb.unpackStruct(reflect.ValueOf(&st).Elem()); err != nil {
+		return err
+	}
+	if x.CanSet() {
+		x.Set(reflect.ValueOf(time.Unix(st.Sec, int64(st.Nsec)).UTC()))
+	}
+	return nil
+}
+
+// []byte and [n]byte are encoded as string, they are decoded from string or vector(encoded by old versions).
+func spbIsBytes(x reflect.Value) bool {
+	return (x.Kind() == reflect.Slice || x.Kind() == reflect.Array) && x.Type().Elem().Kind() == reflect.Uint8 && x.CanSet()
+}
+
+func spbBytes(x reflect.Value) []byte {
+	if x.Kind() == reflect.Slice {
+		return x.Bytes()
+	}
+	b := make([]byte, x.Len())
+	reflect.Copy(reflect.ValueOf(b), x)
+	return b
+}
+
+func (spb *Spb) setBytes(x reflect.Value, b []byte) {
+	if x.Kind() == reflect.Slice {
+		if b == nil {
+			b = []byte{}
+		}
+		x.SetBytes(b)
+		return
+	}
+	n := reflect.Copy(x, reflect.ValueOf(b))
+	for ; n < x.Len(); n++ {
+		x.Index(n).SetUint(0)
+	}
+}
+
+// unpackArray decode vector of ln elements into array x, extra elements are skipped and missing elements are zero.
+func (spb *Spb) unpackArray(x reflect.Value, ln int) error {
+	for i := 0; i < ln; i++ {
+		if i >= x.Len() {
+			if err := spb.skipHeadField(); err != nil {
+				return err
+			}
+			continue
+		}
+		elem := reflect.New(x.Type().Elem()).Elem()
+		if err := spb.unpack(elem, true); err != nil {
+			return err
+		}
+		x.Index(i).Set(elem)
+	}
+	for i := ln; i < x.Len(); i++ {
+		x.Index(i).Set(reflect.Zero(x.Type().Elem()))
+	}
+	return nil
+}
+
+// spbOneof variants of an interface type, the value is encoded as struct {Type uint32; Value T}.
+type spbOneof struct {
+	ids   map[reflect.Type]uint32
+	types map[uint32]reflect.Type
+}
+
+var (
+	spbOneofMutex sync.RWMutex
+	spbOneofs     = make(map[reflect.Type]*spbOneof)
+)
+
+// RegisterSpbOneof register type of v as a variant of interface iface with id, so that fields(and elements) of the
+// interface type could be encoded and decoded by spb, iface is a pointer to the interface:
+//
+//	stnet.RegisterSpbOneof((*Shape)(nil), 1, Circle{})
+//	stnet.RegisterSpbOneof((*Shape)(nil), 2, &Rect{})
+//
+// ids must be unique in the interface and must not be changed, values of unknown ids are decoded as nil.
+// it should be called before encoding, usually in init.
+func RegisterSpbOneof(iface interface{}, id uint32, v interface{}) error {
+	it := reflect.TypeOf(iface)
+	if it == nil || it.Kind() != reflect.Ptr || it.Elem().Kind() != reflect.Interface {
+		return fmt.Errorf("spb: %v is not a pointer to interface", it)
+	}
+	it = it.Elem()
+	vt := reflect.TypeOf(v)
+	if vt == nil || !vt.Implements(it) {
+		return fmt.Errorf("spb: %v does not implement %v", vt, it)
+	}
+
+	spbOneofMutex.Lock()
+	defer spbOneofMutex.Unlock()
+	o := spbOneofs[it]
+	if o == nil {
+		o = &spbOneof{make(map[reflect.Type]uint32), make(map[uint32]reflect.Type)}
+		spbOneofs[it] = o
+	}
+	if t, ok := o.types[id]; ok {
+		return fmt.Errorf("spb: id %d of %v is registered by %v", id, it, t)
+	}
+	if _, ok := o.ids[vt]; ok {
+		return fmt.Errorf("spb: %v is registered for %v", vt, it)
+	}
+	o.ids[vt] = id
+	o.types[id] = vt
+	return nil
+}
+
+func spbOneofID(it, vt reflect.Type) (uint32, bool) {
+	spbOneofMutex.RLock()
+	defer spbOneofMutex.RUnlock()
+	if o := spbOneofs[it]; o != nil {
+		id, ok := o.ids[vt]
+		return id, ok
+	}
+	return 0, false
+}
+
+func spbOneofType(it reflect.Type, id uint32) reflect.Type {
+	spbOneofMutex.RLock()
+	defer spbOneofMutex.RUnlock()
+	if o := spbOneofs[it]; o != nil {
+		return o.types[id]
+	}
+	return nil
+}
+
+func (spb *Spb) packOneof(tag uint32, x reflect.Value, require bool) error {
+	if x.IsNil() {
+		if require {
+			spb.packHeader(tag, SpbPackDataType_StructBegin)
+			spb.packHeader(0, SpbPackDataType_StructEnd)
+		}
+		return nil
+	}
+	v := x.Elem()
+	id, ok := spbOneofID(x.Type(), v.Type())
+	if !ok {
+		return fmt.Errorf("spb: %v is not registered for %v", v.Type(), x.Type())
+	}
+	spb.packHeader(tag, SpbPackDataType_StructBegin)
+	spb.WriteUint(0, uint64(id), true)
+	if err := spb.packValue(1, v, true, true); err != nil {
+		return err
+	}
+	spb.packHeader(0, SpbPackDataType_StructEnd)
+	return nil
+}
+
+func (spb *Spb) unpackOneof(x reflect.Value) error {
+	x.Set(reflect.Zero(x.Type()))
+	var vt reflect.Type
+	for {
+		tag, typ, err := spb.unpackHeader()
+		if err != nil {
+			return err
+		}
+		if typ == SpbPackDataType_StructEnd {
+			return nil
+		}
+		switch {
+		case tag == 0:
+			id, ok, err := spb.ReadUint(typ)
+			if err != nil {
+				return err
+			}
+			if ok {
+				vt = spbOneofType(x.Type(), uint32(id))
+			}
+		case tag == 1 && vt != nil:
+			v := reflect.New(vt).Elem()
+			if err = spb.unpackValue(v, typ); err != nil {
+				return err
+			}
+			x.Set(v)
+		default:
+			if err = spb.skipValue(typ); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package stnet_test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/greedchase/gotools/stnet"
+)
+
+type spbBase struct {
+	ID int
+}
+
+type SpbMeta struct {
+	Owner string
+}
+
+type spbShape interface {
+	Area() float64
+}
+
+type spbCircle struct{ R float64 }
+
+func (c spbCircle) Area() float64 { return 3 * c.R * c.R }
+
+type spbRect struct{ W, H float64 }
+
+func (r *spbRect) Area() float64 { return r.W * r.H }
+
+type spbSquare struct{ A float64 }
+
+func (s spbSquare) Area() float64 { return s.A * s.A }
+
+func init() {
+	stnet.RegisterSpbOneof((*spbShape)(nil), 1, spbCircle{})
+	stnet.RegisterSpbOneof((*spbShape)(nil), 2, &spbRect{})
+}
+
+type spbExt struct {
+	spbBase
+	*SpbMeta
+	Arr     [3]int32
+	Ins     [2]spbInner
+	Hash    [4]byte
+	Data    []byte
+	Ptr     *spbInner
+	NilPtr  *spbInner
+	Ptrs    []*spbInner
+	IntPtr  *int
+	At      time.Time
+	Zero    time.Time
+	Timeout time.Duration
+	Shape   spbShape
+	Shapes  []spbShape
+	NoShape spbShape
+	private int
+}
+
+func TestSpbExtendedTypes(t *testing.T) {
+	n := 7
+	in := spbExt{
+		spbBase: spbBase{ID: 3},
+		SpbMeta: &SpbMeta{"me"},
+		Arr:     [3]int32{1, -2, 3},
+		Ins:     [2]spbInner{{"a", 1}, {"b", 2}},
+		Hash:    [4]byte{1, 2, 3, 4},
+		Data:    []byte("data"),
+		Ptr:     &spbInner{"p", 1},
+		Ptrs:    []*spbInner{{"q", 2}, nil},
+		IntPtr:  &n,
+		At:      time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC),
+		Timeout: 3 * time.Second,
+		Shape:   spbCircle{2},
+		Shapes:  []spbShape{&spbRect{2, 3}, spbCircle{1}},
+		private: 1,
+	}
+	d, err := stnet.SpbEncode(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out spbExt
+	if err = stnet.SpbDecode(d, &out); err != nil {
+		t.Fatal(err)
+	}
+	in.Ptrs[1] = &spbInner{} //nil elements are encoded as zero value
+	in.private = 0           //unexported fields are not encoded
+	if !reflect.DeepEqual(in, out) {
+		t.Fatalf("decode %+v\nwant %+v", out, in)
+	}
+}
+
+func TestSpbBytes(t *testing.T) {
+	d, _ := stnet.SpbEncode([]byte("abc"))
+	if d[0]>>4 != stnet.SpbPackDataType_String {
+		t.Fatalf("[]byte is encoded as type %d", d[0]>>4)
+	}
+	var s string
+	if err := stnet.SpbDecode(d, &s); err != nil || s != "abc" {
+		t.Fatalf("decode into string %q %v", s, err)
+	}
+	//vector encoded by old versions
+	d, _ = stnet.SpbEncode([]int{1, 2, 3})
+	var b []byte
+	if err := stnet.SpbDecode(d, &b); err != nil || string(b) != "\x01\x02\x03" {
+		t.Fatalf("decode vector into []byte %v %v", b, err)
+	}
+}
+
+func TestSpbOneof(t *testing.T) {
+	if err := stnet.RegisterSpbOneof((*spbShape)(nil), 1, spbSquare{}); err == nil {
+		t.Fatal("register duplicate id")
+	}
+	if err := stnet.RegisterSpbOneof((*spbShape)(nil), 3, spbInner{}); err == nil {
+		t.Fatal("register type which does not implement interface")
+	}
+	type holder struct{ Shape spbShape }
+	if _, err := stnet.SpbEncode(holder{spbSquare{1}}); err == nil || !strings.Contains(err.Error(), "not registered") {
+		t.Fatalf("encode unregistered type: %v", err)
+	}
+
+	//unknown id is decoded as nil
+	type unknownShape struct {
+		Shape struct {
+			Type  uint32
+			Value spbInner
+		}
+	}
+	var u unknownShape
+	u.Shape.Type = 100
+	u.Shape.Value.Name = "x"
+	d, _ := stnet.SpbEncode(u)
+	h := holder{spbCircle{1}}
+	if err := stnet.SpbDecode(d, &h); err != nil || h.Shape != nil {
+		t.Fatalf("decode unknown id %+v %v", h, err)
+	}
+}
+
+func TestSpbCompatibilityExtended(t *testing.T) {
+	type v1 struct {
+		Data []byte
+		Arr  []int
+	}
+	type v2 struct {
+		Data string
+		Arr  [4]int64
+	}
+	if c := stnet.CheckSpbCompatibility(v1{}, v2{}); len(c) != 0 {
+		t.Fatalf("compatible change is reported: %v", c)
+	}
+}
@@ -0,0 +1,238 @@
+// Package stnettest runs stnet services in process over the mem:// transport,
+// clients connect to them without sockets and tests wait for ServiceImp events instead of sleeping.
+package stnettest
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/greedchase/gotools/stnet"
+)
+
+// DefaultTimeout is the timeout of waiting in Harness and Client.
+var DefaultTimeout = 5 * time.Second
+
+var harnessID uint64
+
+// Harness owns a stnet.Server whose services listen on mem:// addresses.
+type Harness struct {
+	TB      testing.TB
+	Server  *stnet.Server
+	Timeout time.Duration
+
+	id      uint64
+	addrs   map[*stnet.Service]string
+	started bool
+}
+
+// New create a harness with threadnum processor threads, loop of server is 1ms.
+// call Start after services added and defer Stop.
+func New(tb testing.TB, threadnum int) *Harness {
+	return &Harness{
+		TB:      tb,
+		Server:  stnet.NewServer(1, threadnum),
+		Timeout: DefaultTimeout,
+		id:      atomic.AddUint64(&harnessID, 1),
+		addrs:   make(map[*stnet.Service]string),
+	}
+}
+
+// Addr return the mem:// address of name used by the harness.
+func (h *Harness) Addr(name string) string {
+	return "mem://stnettest-" + strconv.FormatUint(h.id, 10) + "-" + name
+}
+
+// AddService add imp wrapped by Recorder listening on Addr(name).
+func (h *Harness) AddService(name string, imp stnet.ServiceImp, threadId int) (*stnet.Service, *Recorder) {
+	h.TB.Helper()
+	rec := NewRecorder(imp)
+	addr := h.Addr(name)
+	s, err := h.Server.AddService(name, addr, 0, rec, threadId)
+	if err != nil {
+		h.TB.Fatalf("add service %s failed: %v", name, err)
+	}
+	h.addrs[s] = addr
+	return s, rec
+}
+
+// AddClientService add imp wrapped by Recorder without listening, use Service.NewConnect(h.Addr(name)) to connect.
+func (h *Harness) AddClientService(name string, imp stnet.ServiceImp, threadId int) (*stnet.Service, *Recorder) {
+	h.TB.Helper()
+	rec := NewRecorder(imp)
+	s, err := h.Server.AddService(name, "", 0, rec, threadId)
+	if err != nil {
+		h.TB.Fatalf("add service %s failed: %v", name, err)
+	}
+	return s, rec
+}
+
+func (h *Harness) Start() {
+	h.TB.Helper()
+	if err := h.Server.Start(); err != nil {
+		h.TB.Fatalf("start server failed: %v", err)
+	}
+	h.started = true
+}
+
+func (h *Harness) Stop() {
+	if h.started {
+		h.started = false
+		h.Server.Stop()
+	}
+}
+
+// Dial connect to service added by AddService.
+func (h *Harness) Dial(s *stnet.Service) *Client {
+	h.TB.Helper()
+	addr, ok := h.addrs[s]
+	if !ok {
+		h.TB.Fatalf("service %s is not added by AddService", s.Name)
+	}
+	conn, err := stnet.DialMem(memName(addr))
+	if err != nil {
+		h.TB.Fatalf("dial %s failed: %v", addr, err)
+	}
+	return &Client{TB: h.TB, Conn: conn, Timeout: h.Timeout}
+}
+
+// Wait is Recorder.Wait, test fails on timeout.
+func (h *Harness) Wait(r *Recorder, typ EventType, match func(Event) bool) Event {
+	h.TB.Helper()
+	e, err := r.Wait(typ, match, h.Timeout)
+	if err != nil {
+		h.TB.Fatal(err)
+	}
+	return e
+}
+
+// WaitMessage wait for HandleMessage of msgID.
+func (h *Harness) WaitMessage(r *Recorder, msgID uint64) Event {
+	h.TB.Helper()
+	return h.Wait(r, EventMessage, func(e Event) bool { return e.MsgID == msgID })
+}
+
+// WaitOpen wait for SessionOpen of any session.
+func (h *Harness) WaitOpen(r *Recorder) *stnet.Session {
+	h.TB.Helper()
+	return h.Wait(r, EventOpen, nil).Sess
+}
+
+// WaitClose wait for SessionClose of sess, sess could be nil for any session.
+func (h *Harness) WaitClose(r *Recorder, sess *stnet.Session) Event {
+	h.TB.Helper()
+	return h.Wait(r, EventClose, func(e Event) bool { return sess == nil || e.Sess == sess })
+}
+
+func memName(addr string) string {
+	return strings.TrimPrefix(addr, "mem://")
+}
+
+// Client is the raw peer of a service.
+type Client struct {
+	TB      testing.TB
+	Conn    net.Conn
+	Timeout time.Duration
+}
+
+// Send write data, test fails on error.
+func (c *Client) Send(data []byte) {
+	c.TB.Helper()
+	c.Conn.SetWriteDeadline(time.Now().Add(c.Timeout))
+	if _, err := c.Conn.Write(data); err != nil {
+		c.TB.Fatalf("client send failed: %v", err)
+	}
+}
+
+// SendSpb send message in frame of ServiceSpb.
+func (c *Client) SendSpb(msgID uint64, msg interface{}) {
+	c.TB.Helper()
+	c.Send(SpbFrame(c.TB, msgID, msg))
+}
+
+// SendJson send message in frame of ServiceJson.
+func (c *Client) SendJson(msgID uint64, msg []byte) {
+	c.TB.Helper()
+	buf, err := stnet.EncodeProtocol(stnet.JsonProto{CmdId: msgID, CmdData: msg}, stnet.EncodeTyepJson)
+	if err != nil {
+		c.TB.Fatalf("encode json frame failed: %v", err)
+	}
+	c.Send(buf)
+}
+
+// Read read n bytes.
+func (c *Client) Read(n int) []byte {
+	c.TB.Helper()
+	b := make([]byte, n)
+	c.Conn.SetReadDeadline(time.Now().Add(c.Timeout))
+	if _, err := io.ReadFull(c.Conn, b); err != nil {
+		c.TB.Fatalf("client read failed: %v", err)
+	}
+	return b
+}
+
+// ReadFrame read a frame which begins with header of stnet.DefaultFrameCodec, the header is included in frame.
+func (c *Client) ReadFrame() []byte {
+	c.TB.Helper()
+	head := c.Read(4)
+	n := stnet.MsgLen(head)
+	if n < 4 || n > uint32(stnet.MaxMsgSize) {
+		c.TB.Fatalf("client read invalid frame length: %d", n)
+	}
+	return append(head, c.Read(int(n)-4)...)
+}
+
+// ReadSpb read a frame of ServiceSpb and decode its data into msg.
+func (c *Client) ReadSpb(msg interface{}) uint64 {
+	c.TB.Helper()
+	frame := c.ReadFrame()
+	cmd := stnet.JsonProto{}
+	if err := stnet.Unmarshal(frame[4:], &cmd, stnet.EncodeTyepSpb); err != nil {
+		c.TB.Fatalf("decode spb frame failed: %v", err)
+	}
+	if msg != nil {
+		if err := stnet.Unmarshal(cmd.CmdData, msg, stnet.EncodeTyepSpb); err != nil {
+			c.TB.Fatalf("decode spb message %d failed: %v", cmd.CmdId, err)
+		}
+	}
+	return cmd.CmdId
+}
+
+// ExpectClosed wait until the connection is closed by service.
+func (c *Client) ExpectClosed() {
+	c.TB.Helper()
+	c.Conn.SetReadDeadline(time.Now().Add(c.Timeout))
+	b := make([]byte, 1024)
+	for {
+		_, err := c.Conn.Read(b)
+		if err == nil {
+			continue
+		}
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			c.TB.Fatal("connection is not closed")
+		}
+		return
+	}
+}
+
+func (c *Client) Close() {
+	c.Conn.Close()
+}
+
+// SpbFrame encode message in frame of ServiceSpb.
+func SpbFrame(tb testing.TB, msgID uint64, msg interface{}) []byte {
+	tb.Helper()
+	d, err := stnet.Marshal(msg, stnet.EncodeTyepSpb)
+	if err != nil {
+		tb.Fatalf("encode spb message failed: %v", err)
+	}
+	buf, err := stnet.EncodeProtocol(stnet.JsonProto{CmdId: msgID, CmdData: d}, stnet.EncodeTyepSpb)
+	if err != nil {
+		tb.Fatalf("encode spb frame failed: %v", err)
+	}
+	return buf
+}
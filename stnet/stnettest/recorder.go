@@ -0,0 +1,143 @@
+package stnettest
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/greedchase/gotools/stnet"
+)
+
+type EventType int
+
+const (
+	EventOpen EventType = iota
+	EventClose
+	EventMessage
+	EventError
+	EventHeartBeat
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventOpen:
+		return "open"
+	case EventClose:
+		return "close"
+	case EventMessage:
+		return "message"
+	case EventError:
+		return "error"
+	case EventHeartBeat:
+		return "heartbeat"
+	}
+	return fmt.Sprintf("EventType(%d)", int(t))
+}
+
+// Event is called ServiceImp method recorded by Recorder.
+type Event struct {
+	Type   EventType
+	Sess   *stnet.Session
+	Thread int //processor thread, -1 for SessionOpen
+	MsgID  uint64
+	Msg    interface{}
+	Err    error
+}
+
+// Recorder wraps a ServiceImp, every event is handed to the wrapped imp first and then recorded,
+// so tests can wait for it deterministically instead of sleeping.
+// optional interfaces(PriorityProcessor KeyProcessor...) of the wrapped imp are hidden by Recorder.
+type Recorder struct {
+	stnet.ServiceImp
+
+	mutex    sync.Mutex
+	events   []Event
+	consumed []bool
+	changed  chan struct{}
+}
+
+func NewRecorder(imp stnet.ServiceImp) *Recorder {
+	return &Recorder{ServiceImp: imp, changed: make(chan struct{})}
+}
+
+func (r *Recorder) record(e Event) {
+	r.mutex.Lock()
+	r.events = append(r.events, e)
+	r.consumed = append(r.consumed, false)
+	close(r.changed)
+	r.changed = make(chan struct{})
+	r.mutex.Unlock()
+}
+
+func (r *Recorder) HandleMessage(current *stnet.CurrentContent, msgID uint64, msg interface{}) {
+	r.ServiceImp.HandleMessage(current, msgID, msg)
+	r.record(Event{Type: EventMessage, Sess: current.Sess, Thread: current.GoroutineID, MsgID: msgID, Msg: msg})
+}
+
+func (r *Recorder) HandleError(current *stnet.CurrentContent, err error) {
+	r.ServiceImp.HandleError(current, err)
+	r.record(Event{Type: EventError, Sess: current.Sess, Thread: current.GoroutineID, Err: err})
+}
+
+func (r *Recorder) SessionOpen(sess *stnet.Session) {
+	r.ServiceImp.SessionOpen(sess)
+	r.record(Event{Type: EventOpen, Sess: sess, Thread: -1})
+}
+
+func (r *Recorder) SessionClose(sess *stnet.Session) {
+	r.ServiceImp.SessionClose(sess)
+	r.record(Event{Type: EventClose, Sess: sess})
+}
+
+func (r *Recorder) HeartBeatTimeOut(sess *stnet.Session) {
+	r.ServiceImp.HeartBeatTimeOut(sess)
+	r.record(Event{Type: EventHeartBeat, Sess: sess})
+}
+
+// Events return all recorded events.
+func (r *Recorder) Events() []Event {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	es := make([]Event, len(r.events))
+	copy(es, r.events)
+	return es
+}
+
+// Count return number of recorded events of type.
+func (r *Recorder) Count(typ EventType) int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	n := 0
+	for _, e := range r.events {
+		if e.Type == typ {
+			n++
+		}
+	}
+	return n
+}
+
+// Wait return the first unconsumed event matched, match could be nil.
+// the event is consumed, so calling Wait again returns the next one.
+func (r *Recorder) Wait(typ EventType, match func(Event) bool, timeout time.Duration) (Event, error) {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		r.mutex.Lock()
+		for i, e := range r.events {
+			if r.consumed[i] || e.Type != typ || (match != nil && !match(e)) {
+				continue
+			}
+			r.consumed[i] = true
+			r.mutex.Unlock()
+			return e, nil
+		}
+		changed := r.changed
+		r.mutex.Unlock()
+
+		select {
+		case <-changed:
+		case <-deadline.C:
+			return Event{}, fmt.Errorf("wait %s event timeout after %s", typ, timeout)
+		}
+	}
+}
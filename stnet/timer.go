@@ -0,0 +1,322 @@
+package stnet
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TimerID identify a timer of server, 0 is invalid.
+type TimerID uint64
+
+const (
+	wheelRootBits  = 8
+	wheelLevelBits = 6
+	wheelLevels    = 5 //root + 4 levels
+	wheelRootSize  = 1 << wheelRootBits
+	wheelLevelSize = 1 << wheelLevelBits
+	wheelRootMask  = wheelRootSize - 1
+	wheelLevelMask = wheelLevelSize - 1
+	wheelMaxTicks  = 1<<(wheelRootBits+wheelLevelBits*(wheelLevels-1)) - 1
+)
+
+type timerEntry struct {
+	id        TimerID
+	expire    uint64 //tick
+	interval  uint64 //ticks of repeating timer,0 is one-shot
+	cron      *cronSchedule
+	fn        func()
+	processor int
+	sess      *Session
+	cancelled int32
+}
+
+func (e *timerEntry) isCancelled() bool {
+	return atomic.LoadInt32(&e.cancelled) > 0
+}
+
+// timerWheel is a hierarchical timing wheel, 256 slots in root and 64 slots in other 4 levels.
+// one tick is the loopmsec of server.
+type timerWheel struct {
+	mutex   sync.Mutex
+	tick    time.Duration
+	start   time.Time
+	current uint64
+	slots   [wheelLevels][][]*timerEntry
+	timers  map[TimerID]*timerEntry
+	idgen   uint64
+}
+
+func newTimerWheel(tick time.Duration) *timerWheel {
+	w := &timerWheel{tick: tick, start: time.Now(), timers: make(map[TimerID]*timerEntry)}
+	w.slots[0] = make([][]*timerEntry, wheelRootSize)
+	for i := 1; i < wheelLevels; i++ {
+		w.slots[i] = make([][]*timerEntry, wheelLevelSize)
+	}
+	return w
+}
+
+func (w *timerWheel) ticks(d time.Duration) uint64 {
+	if d <= 0 {
+		return 1
+	}
+	n := uint64((d + w.tick - 1) / w.tick)
+	if n == 0 {
+		n = 1
+	}
+	return n
+}
+
+// place put entry into slot, must be locked.
+// entry expired at current tick is put into the root slot of current tick, cascade is called before the slot is visited.
+func (w *timerWheel) place(e *timerEntry) {
+	if e.expire < w.current {
+		e.expire = w.current
+	}
+	delta := e.expire - w.current
+	if delta > wheelMaxTicks { //put it into the last level, it will be cascaded again
+		delta = wheelMaxTicks
+	}
+	expire := w.current + delta
+	if delta < wheelRootSize {
+		idx := expire & wheelRootMask
+		w.slots[0][idx] = append(w.slots[0][idx], e)
+		return
+	}
+	for lv := 1; lv < wheelLevels; lv++ {
+		shift := uint(wheelRootBits + wheelLevelBits*(lv-1))
+		if delta < 1<<(shift+wheelLevelBits) || lv == wheelLevels-1 {
+			idx := (expire >> shift) & wheelLevelMask
+			w.slots[lv][idx] = append(w.slots[lv][idx], e)
+			return
+		}
+	}
+}
+
+func (w *timerWheel) add(e *timerEntry) TimerID {
+	w.mutex.Lock()
+	w.idgen++
+	e.id = TimerID(w.idgen)
+	e.expire += w.current
+	w.timers[e.id] = e
+	w.place(e)
+	w.mutex.Unlock()
+	return e.id
+}
+
+func (w *timerWheel) cancel(id TimerID) *timerEntry {
+	w.mutex.Lock()
+	e, ok := w.timers[id]
+	if ok {
+		delete(w.timers, id)
+	}
+	w.mutex.Unlock()
+	if ok {
+		atomic.StoreInt32(&e.cancelled, 1)
+	}
+	return e
+}
+
+// cascade move the entries of the level's slot to lower levels, must be locked.
+func (w *timerWheel) cascade(lv int) {
+	shift := uint(wheelRootBits + wheelLevelBits*(lv-1))
+	idx := (w.current >> shift) & wheelLevelMask
+	list := w.slots[lv][idx]
+	w.slots[lv][idx] = nil
+	for _, e := range list {
+		if !e.isCancelled() {
+			w.place(e)
+		}
+	}
+	if idx == 0 && lv+1 < wheelLevels {
+		w.cascade(lv + 1)
+	}
+}
+
+// advance move one tick and return expired entries, must be locked.
+func (w *timerWheel) advance(expired []*timerEntry) []*timerEntry {
+	w.current++
+	idx := w.current & wheelRootMask
+	if idx == 0 {
+		w.cascade(1)
+	}
+	list := w.slots[0][idx]
+	w.slots[0][idx] = nil
+	for _, e := range list {
+		if e.isCancelled() {
+			continue
+		}
+		if e.expire > w.current { //clamped entry of long timer
+			w.place(e)
+			continue
+		}
+		expired = append(expired, e)
+	}
+	return expired
+}
+
+func (w *timerWheel) run(svr *Server) {
+	defer svr.wg.Done()
+	t := time.NewTicker(w.tick)
+	defer t.Stop()
+
+	var expired []*timerEntry
+	for !svr.isClose.IsClose() {
+		now := <-t.C
+		target := uint64(now.Sub(w.start) / w.tick)
+
+		w.mutex.Lock()
+		for w.current < target {
+			expired = w.advance(expired)
+		}
+		for _, e := range expired {
+			switch {
+			case e.interval > 0:
+				e.expire = w.current + e.interval
+				w.place(e)
+			case e.cron != nil:
+				next := e.cron.next(now)
+				if next.IsZero() {
+					delete(w.timers, e.id)
+				} else {
+					e.expire = w.current + w.ticks(next.Sub(now))
+					w.place(e)
+				}
+			default:
+				delete(w.timers, e.id)
+			}
+		}
+		w.mutex.Unlock()
+
+		for i, e := range expired {
+			if e.interval == 0 && e.cron == nil && e.sess != nil {
+				e.sess.removeTimer(e.id)
+			}
+			svr.dispatchTimer(e)
+			expired[i] = nil
+		}
+		expired = expired[:0]
+	}
+	sysLog.System("timer thread quit.")
+}
+
+func (svr *Server) dispatchTimer(e *timerEntry) {
+	err := svr.postTask(e.processor, func() {
+		if !e.isCancelled() {
+			e.fn()
+		}
+	})
+	if err != nil {
+		sysLog.Error("timer is droped;timerid=%d;err=%v", e.id, err)
+	}
+}
+
+// timerProcessor use the same rule as ServiceImp.HashProcessor:
+// processorID > 0: processorID % ProcessorThreadsNum; processorID < 0: hash of session id;
+// otherwise the thread of session's service, thread 0 if session is nil.
+func (svr *Server) timerProcessor(sess *Session, processorID int) int {
+	if processorID > 0 {
+		return processorID % svr.ProcessorThreadsNum
+	} else if processorID < 0 && sess != nil {
+		return int(sess.GetID() % uint64(svr.ProcessorThreadsNum))
+	}
+	if sess != nil {
+		if service, ok := sess.parser.(*Service); ok {
+			return service.threadId
+		}
+	}
+	return 0
+}
+
+func (svr *Server) addTimer(sess *Session, e *timerEntry, processorID int) TimerID {
+	if e.fn == nil {
+		return 0
+	}
+	e.sess = sess
+	e.processor = svr.timerProcessor(sess, processorID)
+	if sess == nil {
+		return svr.timer.add(e)
+	}
+
+	sess.timerMutex.Lock()
+	defer sess.timerMutex.Unlock()
+	if sess.IsClose() {
+		return 0
+	}
+	id := svr.timer.add(e)
+	if sess.timers == nil {
+		sess.timers = make(map[TimerID]*Server)
+	}
+	sess.timers[id] = svr
+	return id
+}
+
+// AfterFunc call fn once in processor thread after d.
+// processorID > 0: thread is processorID % ProcessorThreadsNum; processorID <= 0: thread 0.
+// timer precision is the loopmsec of server.
+func (svr *Server) AfterFunc(d time.Duration, processorID int, fn func()) TimerID {
+	return svr.addTimer(nil, &timerEntry{expire: svr.timer.ticks(d), fn: fn}, processorID)
+}
+
+// Every call fn in processor thread every d, the first call is after d.
+func (svr *Server) Every(d time.Duration, processorID int, fn func()) TimerID {
+	n := svr.timer.ticks(d)
+	return svr.addTimer(nil, &timerEntry{expire: n, interval: n, fn: fn}, processorID)
+}
+
+// Cron call fn in processor thread at the time matched spec.
+// spec is "minute hour day-of-month month day-of-week", example "*/5 * * * *", "0 3 * * 1-5", "@daily".
+func (svr *Server) Cron(spec string, processorID int, fn func()) (TimerID, error) {
+	cs, err := parseCron(spec)
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	next := cs.next(now)
+	if next.IsZero() {
+		return 0, fmt.Errorf("cron spec never matches: %s", spec)
+	}
+	return svr.addTimer(nil, &timerEntry{expire: svr.timer.ticks(next.Sub(now)), cron: cs, fn: fn}, processorID), nil
+}
+
+// SessionAfterFunc is the same as AfterFunc,but timer is canceled automatically when session closed.
+// processorID < 0 means the thread is hash of session id, processorID = 0 means the thread of session's service. return 0 if session is closed.
+func (svr *Server) SessionAfterFunc(sess *Session, d time.Duration, processorID int, fn func()) TimerID {
+	return svr.addTimer(sess, &timerEntry{expire: svr.timer.ticks(d), fn: fn}, processorID)
+}
+
+// SessionEvery is the same as Every,but timer is canceled automatically when session closed.
+func (svr *Server) SessionEvery(sess *Session, d time.Duration, processorID int, fn func()) TimerID {
+	n := svr.timer.ticks(d)
+	return svr.addTimer(sess, &timerEntry{expire: n, interval: n, fn: fn}, processorID)
+}
+
+// CancelTimer stop the timer, fn will not be called after CancelTimer returned if it is called in the same processor thread.
+func (svr *Server) CancelTimer(id TimerID) bool {
+	e := svr.timer.cancel(id)
+	if e == nil {
+		return false
+	}
+	if e.sess != nil {
+		e.sess.removeTimer(id)
+	}
+	return true
+}
+
+func (s *Session) removeTimer(id TimerID) {
+	s.timerMutex.Lock()
+	delete(s.timers, id)
+	s.timerMutex.Unlock()
+}
+
+// cancelTimers is called when session closed.
+func (s *Session) cancelTimers() {
+	s.timerMutex.Lock()
+	timers := s.timers
+	s.timers = nil
+	s.timerMutex.Unlock()
+	for id, svr := range timers {
+		svr.timer.cancel(id)
+	}
+}
@@ -0,0 +1,87 @@
+package stnet_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/greedchase/gotools/stnet/stnettest"
+)
+
+// waitTimer wait fn of a timer is called by chan.
+func waitTimer(t *testing.T, h *stnettest.Harness, c chan int, what string) {
+	t.Helper()
+	select {
+	case <-c:
+	case <-time.After(h.Timeout):
+		t.Fatalf("%s is not called", what)
+	}
+}
+
+func TestTimerEveryAndCancel(t *testing.T) {
+	h := stnettest.New(t, 2)
+	h.Start()
+	defer h.Stop()
+
+	//fns run in the same processor thread, so calls are not concurrent
+	calls := 0
+	called := make(chan int, 1)
+	id := h.Server.Every(2*time.Millisecond, 1, func() {
+		calls++
+		if calls == 3 {
+			called <- calls
+		}
+	})
+	waitTimer(t, h, called, "repeating timer")
+	if !h.Server.CancelTimer(id) {
+		t.Fatal("cancel repeating timer failed")
+	}
+	if h.Server.CancelTimer(id) {
+		t.Fatal("timer is cancelled twice")
+	}
+
+	//the later timer of the same thread runs after the cancelled one would have run
+	cancelled := h.Server.AfterFunc(time.Millisecond, 1, func() { t.Error("cancelled timer is called") })
+	if !h.Server.CancelTimer(cancelled) {
+		t.Fatal("cancel timer failed")
+	}
+	done := make(chan int, 1)
+	h.Server.AfterFunc(20*time.Millisecond, 1, func() {
+		if calls != 3 {
+			t.Errorf("repeating timer is called %d times after cancelled", calls-3)
+		}
+		done <- 1
+	})
+	waitTimer(t, h, done, "timer")
+}
+
+func TestSessionTimerClose(t *testing.T) {
+	h := stnettest.New(t, 2)
+	s, rec := h.AddService("line", &lineImp{}, 1)
+	h.Start()
+	defer h.Stop()
+
+	c := h.Dial(s)
+	sess := h.WaitOpen(rec)
+	called := make(chan int, 1)
+	every := h.Server.SessionEvery(sess, time.Millisecond, 0, func() {
+		select {
+		case called <- 1:
+		default:
+		}
+	})
+	after := h.Server.SessionAfterFunc(sess, time.Hour, -1, func() { t.Error("timer of closed session is called") })
+	if every == 0 || after == 0 {
+		t.Fatal("add session timer failed")
+	}
+	waitTimer(t, h, called, "session timer")
+
+	//timers are cancelled before Close event
+	c.Close()
+	h.WaitClose(rec, sess)
+	if h.Server.CancelTimer(every) || h.Server.CancelTimer(after) {
+		t.Fatal("timers of closed session are not cancelled")
+	}
+	if h.Server.SessionAfterFunc(sess, time.Millisecond, 0, func() {}) != 0 {
+		t.Fatal("timer is added to closed session")
+	}
+}
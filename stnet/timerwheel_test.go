@@ -0,0 +1,123 @@
+package stnet
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimerWheelCascade(t *testing.T) {
+	//entries just before, at and after boundaries of root, level 1 and level 2
+	delays := []uint64{1, 2, 255, 256, 257, 511, 16383, 16384, 16385, 16384*64 - 1, 16384 * 64, 16384*64 + 3}
+	for _, start := range []uint64{0, 250, 16380} {
+		w := newTimerWheel(time.Millisecond)
+		w.current = start
+		want := make(map[TimerID]uint64)
+		for _, d := range delays {
+			want[w.add(&timerEntry{expire: d, fn: func() {}})] = start + d
+		}
+		end := start + 16384*64 + 10
+		for len(want) > 0 && w.current < end {
+			for _, e := range w.advance(nil) {
+				if want[e.id] != w.current {
+					t.Fatalf("start %d: timer %d expires at %d, want %d", start, e.id, w.current, want[e.id])
+				}
+				delete(want, e.id)
+			}
+		}
+		if len(want) > 0 {
+			t.Fatalf("start %d: %d timers are not expired", start, len(want))
+		}
+	}
+}
+
+// nextVisit return the tick when the slot of the only entry in w is visited.
+func nextVisit(w *timerWheel) (uint64, bool) {
+	for lv := range w.slots {
+		for idx, list := range w.slots[lv] {
+			if len(list) == 0 {
+				continue
+			}
+			if lv == 0 {
+				return w.current + 1 + ((uint64(idx) - w.current - 1) & wheelRootMask), true
+			}
+			shift := uint(wheelRootBits + wheelLevelBits*(lv-1))
+			unit := uint64(1) << shift
+			next := (w.current/unit + 1) * unit
+			for (next>>shift)&wheelLevelMask != uint64(idx) {
+				next += unit
+			}
+			return next, true
+		}
+	}
+	return 0, false
+}
+
+func TestTimerWheelLongDelay(t *testing.T) {
+	w := newTimerWheel(time.Millisecond)
+	w.current = 12345
+	id := w.add(&timerEntry{expire: wheelMaxTicks + 1000, fn: func() {}})
+	e := w.timers[id]
+
+	//jump to the ticks visiting the entry, it is cascaded again and again without expiring early
+	for cascades := 0; ; cascades++ {
+		next, ok := nextVisit(w)
+		if !ok {
+			t.Fatal("timer is lost")
+		}
+		if next > e.expire {
+			t.Fatalf("timer is visited at %d after its expire %d", next, e.expire)
+		}
+		w.current = next - 1
+		if expired := w.advance(nil); len(expired) > 0 {
+			if expired[0] != e || w.current != e.expire {
+				t.Fatalf("timer %d expires at %d, want %d", expired[0].id, w.current, e.expire)
+			}
+			break
+		}
+		if cascades > 2*wheelLevels {
+			t.Fatal("timer is cascaded too many times")
+		}
+	}
+}
+
+func TestTimerWheelCancel(t *testing.T) {
+	w := newTimerWheel(time.Millisecond)
+	keep := w.add(&timerEntry{expire: 300, fn: func() {}})
+	drop := w.add(&timerEntry{expire: 300, fn: func() {}})
+	if e := w.cancel(drop); e == nil || !e.isCancelled() {
+		t.Fatal("cancel returns no timer")
+	}
+	if w.cancel(drop) != nil {
+		t.Fatal("cancelled timer is cancelled again")
+	}
+	var expired []*timerEntry
+	for w.current < 300 {
+		expired = w.advance(expired)
+	}
+	if len(expired) != 1 || expired[0].id != keep {
+		t.Fatalf("%d timers expired, want only timer %d", len(expired), keep)
+	}
+}
+
+func TestTimerProcessor(t *testing.T) {
+	svr := NewServer(1, 4)
+	service := &Service{threadId: 2}
+	sess := &Session{id: 5, parser: service}
+	cases := []struct {
+		sess        *Session
+		processorID int
+		want        int
+	}{
+		{nil, 0, 0},
+		{nil, -1, 0},
+		{nil, 7, 3},
+		{sess, 0, 2}, //thread of the service, the same as HashProcessor returns 0
+		{sess, -1, 1},
+		{sess, 4, 0},
+	}
+	for _, c := range cases {
+		if got := svr.timerProcessor(c.sess, c.processorID); got != c.want {
+			t.Errorf("timerProcessor(%v, %d) = %d, want %d", c.sess != nil, c.processorID, got, c.want)
+		}
+	}
+}
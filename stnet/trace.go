@@ -0,0 +1,240 @@
+package stnet
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ErrInvalidTraceParent = errors.New("invalid traceparent")
+
+// kind of span
+const (
+	SpanKindInternal = 1
+	SpanKindServer   = 2
+	SpanKindClient   = 3
+	SpanKindProducer = 4
+	SpanKindConsumer = 5
+)
+
+// TraceContext is carried in ReqProto.Trace and JsonProto.Trace as W3C traceparent "00-traceid-spanid-flags".
+type TraceContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Sampled bool
+}
+
+func (tc TraceContext) IsValid() bool {
+	return tc.TraceID != [16]byte{} && tc.SpanID != [8]byte{}
+}
+
+// TraceParent encode context in W3C traceparent format, empty string if context is invalid.
+func (tc TraceContext) TraceParent() string {
+	if !tc.IsValid() {
+		return ""
+	}
+	b := make([]byte, 55)
+	copy(b, "00-")
+	hex.Encode(b[3:35], tc.TraceID[:])
+	b[35] = '-'
+	hex.Encode(b[36:52], tc.SpanID[:])
+	copy(b[52:], "-00")
+	if tc.Sampled {
+		b[54] = '1'
+	}
+	return string(b)
+}
+
+// ParseTraceParent decode W3C traceparent.
+func ParseTraceParent(s string) (TraceContext, error) {
+	var tc TraceContext
+	if len(s) < 55 || s[2] != '-' || s[35] != '-' || s[52] != '-' || s[:2] == "ff" {
+		return tc, ErrInvalidTraceParent
+	}
+	if _, err := hex.Decode(tc.TraceID[:], []byte(s[3:35])); err != nil {
+		return tc, ErrInvalidTraceParent
+	}
+	if _, err := hex.Decode(tc.SpanID[:], []byte(s[36:52])); err != nil {
+		return tc, ErrInvalidTraceParent
+	}
+	flags, err := hex.DecodeString(s[53:55])
+	if err != nil || !tc.IsValid() {
+		return tc, ErrInvalidTraceParent
+	}
+	tc.Sampled = flags[0]&0x1 != 0
+	return tc, nil
+}
+
+// Span is an operation of trace.
+type Span struct {
+	Name       string
+	Kind       int
+	Context    TraceContext
+	Parent     [8]byte //span id of parent, zero for root span
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]string
+	Err        error
+
+	ended int32
+}
+
+// SpanExporter exports ended spans, it is called in the thread which ends the span.
+type SpanExporter interface {
+	ExportSpan(span *Span)
+}
+
+type exporterHolder struct {
+	e SpanExporter
+}
+
+var spanExporter atomic.Value //exporterHolder
+
+// SetSpanExporter enable tracing, spans are created for every rpc call and message with trace context; nil disables it.
+// when tracing is disabled, trace context received is still propagated.
+func SetSpanExporter(e SpanExporter) {
+	spanExporter.Store(exporterHolder{e})
+}
+
+func getSpanExporter() SpanExporter {
+	h, _ := spanExporter.Load().(exporterHolder)
+	return h.e
+}
+
+func randomID(b []byte) {
+	if _, err := rand.Read(b); err != nil {
+		//never happens, use time as fallback
+		n := uint64(time.Now().UnixNano())
+		for i := range b {
+			b[i] = byte(n >> (uint(i%8) * 8))
+		}
+	}
+}
+
+// StartSpan create span, parent could be nil for a new trace.
+func StartSpan(name string, kind int, parent *TraceContext) *Span {
+	s := &Span{Name: name, Kind: kind, Start: time.Now()}
+	if parent != nil && parent.IsValid() {
+		s.Context.TraceID = parent.TraceID
+		s.Context.Sampled = parent.Sampled
+		s.Parent = parent.SpanID
+	} else {
+		randomID(s.Context.TraceID[:])
+		s.Context.Sampled = true
+	}
+	randomID(s.Context.SpanID[:])
+	return s
+}
+
+func (s *Span) SetAttribute(key, value string) {
+	if s.Attributes == nil {
+		s.Attributes = make(map[string]string)
+	}
+	s.Attributes[key] = value
+}
+
+// Finish end the span and export it, it could be called only once.
+func (s *Span) Finish() {
+	if !atomic.CompareAndSwapInt32(&s.ended, 0, 1) {
+		return
+	}
+	s.End = time.Now()
+	if e := getSpanExporter(); e != nil && s.Context.Sampled {
+		e.ExportSpan(s)
+	}
+}
+
+// handlerSpans is the span of handler running in goroutine, it is used by RpcCall without parent span.
+var (
+	handlerSpans     sync.Map //goroutine id: *Span
+	handlerSpanCount int32
+)
+
+func goroutineID() uint64 {
+	var buf [64]byte
+	b := buf[:runtime.Stack(buf[:], false)]
+	//goroutine 123 [running]:
+	const prefix = "goroutine "
+	if len(b) <= len(prefix) {
+		return 0
+	}
+	b = b[len(prefix):]
+	i := 0
+	for i < len(b) && b[i] >= '0' && b[i] <= '9' {
+		i++
+	}
+	id, _ := strconv.ParseUint(string(b[:i]), 10, 64)
+	return id
+}
+
+// activeHandlerSpan return span of the handler running in current goroutine, nil if there is none.
+func activeHandlerSpan() *Span {
+	if atomic.LoadInt32(&handlerSpanCount) == 0 {
+		return nil
+	}
+	if s, ok := handlerSpans.Load(goroutineID()); ok {
+		return s.(*Span)
+	}
+	return nil
+}
+
+// startHandlerSpan start server span of a message if it carries trace context or tracing is enabled,
+// the span is set to current.Span; the returned function finishes it.
+// rpc calls of the handler are its children; messages are its children when current.Span is passed to
+// SendSpbCmdTrace SendJsonCmdTrace or RpcCallTrace.
+func startHandlerSpan(current *CurrentContent, name, traceparent string) func() {
+	if traceparent == "" && getSpanExporter() == nil {
+		return nil
+	}
+	var span *Span
+	if tc, err := ParseTraceParent(traceparent); err == nil {
+		span = StartSpan(name, SpanKindServer, &tc)
+	} else {
+		span = StartSpan(name, SpanKindServer, nil)
+	}
+	if current.Sess != nil {
+		span.SetAttribute("net.peer", current.Sess.RemoteAddr())
+	}
+	current.Span = span
+
+	gid := goroutineID()
+	prev, nested := handlerSpans.Load(gid)
+	handlerSpans.Store(gid, span)
+	atomic.AddInt32(&handlerSpanCount, 1)
+	return func() {
+		if nested {
+			handlerSpans.Store(gid, prev)
+		} else {
+			handlerSpans.Delete(gid)
+		}
+		atomic.AddInt32(&handlerSpanCount, -1)
+		current.Span = nil
+		span.Finish()
+	}
+}
+
+// outgoingTrace return traceparent carried by messages sent in span parent, parent could be nil.
+func outgoingTrace(parent *Span) string {
+	if parent != nil {
+		return parent.Context.TraceParent()
+	}
+	return ""
+}
+
+// tracedMsg is the message of ServiceSpb and ServiceJson with trace context.
+type tracedMsg struct {
+	data  []byte
+	trace string
+}
+
+func untraceMsg(msg interface{}) (interface{}, string) {
+	if m, ok := msg.(*tracedMsg); ok {
+		return m.data, m.trace
+	}
+	return msg, ""
+}
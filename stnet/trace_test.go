@@ -0,0 +1,249 @@
+package stnet_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/greedchase/gotools/stnet"
+	"github.com/greedchase/gotools/stnet/stnettest"
+)
+
+type spanCollector struct {
+	mutex sync.Mutex
+	spans []*stnet.Span
+}
+
+func (c *spanCollector) ExportSpan(s *stnet.Span) {
+	c.mutex.Lock()
+	c.spans = append(c.spans, s)
+	c.mutex.Unlock()
+}
+
+func (c *spanCollector) find(name string, kind int) *stnet.Span {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, s := range c.spans {
+		if s.Name == name && s.Kind == kind {
+			return s
+		}
+	}
+	return nil
+}
+
+func TestTraceParent(t *testing.T) {
+	s := stnet.StartSpan("a", stnet.SpanKindInternal, nil)
+	tp := s.Context.TraceParent()
+	tc, err := stnet.ParseTraceParent(tp)
+	if err != nil || tc != s.Context {
+		t.Fatalf("parse %s: %+v %v", tp, tc, err)
+	}
+	for _, bad := range []string{"", "00-xyz", "00-00000000000000000000000000000000-0000000000000000-01"} {
+		if _, err := stnet.ParseTraceParent(bad); err == nil {
+			t.Fatalf("%q should be invalid", bad)
+		}
+	}
+}
+
+func TestTraceRpcPropagation(t *testing.T) {
+	c := &spanCollector{}
+	stnet.SetSpanExporter(c)
+	defer stnet.SetSpanExporter(nil)
+
+	h, client, conn, _ := startRpc(t)
+	defer h.Stop()
+
+	root := stnet.StartSpan("root", stnet.SpanKindInternal, nil)
+	client.RpcCallTrace_Sync(root, conn.Session(), "Add", 1, 2, func(int) {}, nil)
+	got := 0
+	client.RpcCallTrace_Sync(root, conn.Session(), "Traced", 5, func(r int) { got = r }, nil)
+	if got != 5 {
+		t.Fatal("method with current should get span of request")
+	}
+
+	cs := c.find("rpc Add", stnet.SpanKindClient)
+	ss := c.find("rpc Add", stnet.SpanKindServer)
+	if cs == nil || ss == nil {
+		t.Fatal("spans are not exported")
+	}
+	if cs.Context.TraceID != root.Context.TraceID || cs.Parent != root.Context.SpanID {
+		t.Fatal("client span should be child of root")
+	}
+	if ss.Context.TraceID != root.Context.TraceID || ss.Parent != cs.Context.SpanID {
+		t.Fatal("server span should be child of client span")
+	}
+}
+
+// relay call Add of back in Relay without passing span.
+type relay struct {
+	arith
+	back *stnet.ServiceRpc
+	conn *stnet.Connect
+	sum  chan int
+}
+
+func (r *relay) Relay(x int) int {
+	r.back.RpcCall(r.conn.Session(), "Add", x, 1, func(v int) { r.sum <- v }, nil)
+	return x
+}
+
+func TestTraceRpcInHandler(t *testing.T) {
+	c := &spanCollector{}
+	stnet.SetSpanExporter(c)
+	defer stnet.SetSpanExporter(nil)
+
+	h := stnettest.New(t, 2)
+	_, brec := h.AddService("back", stnet.NewServiceRpc(&arith{}), 0)
+	r := &relay{back: stnet.NewServiceRpc(&arith{}), sum: make(chan int, 1)}
+	rcs, rcrec := h.AddClientService("relayclient", r.back, 1)
+	_, frec := h.AddService("front", stnet.NewServiceRpc(r), 0)
+	client := stnet.NewServiceRpc(&arith{})
+	cs, crec := h.AddClientService("client", client, 1)
+	r.conn = rcs.NewConnectWithPolicy(h.Addr("back"), nil, fastPolicy())
+	conn := cs.NewConnectWithPolicy(h.Addr("front"), nil, fastPolicy())
+	h.Start()
+	defer h.Stop()
+	for _, rec := range []*stnettest.Recorder{brec, rcrec, frec, crec} {
+		h.WaitOpen(rec)
+	}
+
+	root := stnet.StartSpan("root", stnet.SpanKindInternal, nil)
+	client.RpcCallTrace_Sync(root, conn.Session(), "Relay", 5, func(int) {}, nil)
+	select {
+	case v := <-r.sum:
+		if v != 6 {
+			t.Fatalf("Add returns %d", v)
+		}
+	case <-time.After(h.Timeout):
+		t.Fatal("Add is not returned")
+	}
+
+	var relaySpan, addClient, addServer *stnet.Span
+	deadline := time.Now().Add(h.Timeout)
+	for relaySpan == nil || addClient == nil || addServer == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("spans are not exported")
+		}
+		time.Sleep(time.Millisecond)
+		relaySpan, addClient, addServer = c.find("rpc Relay", stnet.SpanKindServer), c.find("rpc Add", stnet.SpanKindClient), c.find("rpc Add", stnet.SpanKindServer)
+	}
+	if addClient.Context.TraceID != root.Context.TraceID || addClient.Parent != relaySpan.Context.SpanID {
+		t.Fatal("rpc call in handler should be child of handler span")
+	}
+	if addServer.Context.TraceID != root.Context.TraceID || addServer.Parent != addClient.Context.SpanID {
+		t.Fatal("server span should be child of client span")
+	}
+}
+
+type traceSpbImp struct {
+	spans  chan *stnet.Span
+	traced int32 //hooks get message with trace context
+}
+
+func (imp *traceSpbImp) Init() bool { return true }
+func (imp *traceSpbImp) Loop()      {}
+func (imp *traceSpbImp) Handle(current *stnet.CurrentContent, cmdId uint64, cmd interface{}, e error) {
+	imp.spans <- current.Span
+}
+func (imp *traceSpbImp) HashProcessor(current *stnet.CurrentContent, cmdId uint64) int { return 0 }
+func (imp *traceSpbImp) MsgPriority(current *stnet.CurrentContent, msgID uint64, msg interface{}) int {
+	imp.check(msg)
+	return stnet.PriorityLow
+}
+func (imp *traceSpbImp) ProcessorKey(current *stnet.CurrentContent, msgID uint64, msg interface{}) string {
+	imp.check(msg)
+	return ""
+}
+func (imp *traceSpbImp) check(msg interface{}) {
+	if _, ok := msg.([]byte); !ok {
+		atomic.StoreInt32(&imp.traced, 1)
+	}
+}
+
+func TestTraceSpbMessage(t *testing.T) {
+	h := stnettest.New(t, 1)
+	imp := &traceSpbImp{spans: make(chan *stnet.Span, 2)}
+	s, rec := h.AddService("spb", stnet.NewServiceSpb(imp), 0)
+	h.Start()
+	defer h.Stop()
+
+	c := h.Dial(s)
+	defer c.Close()
+	c.SendSpb(1, spbInner{"no trace", 0})
+	h.WaitMessage(rec, 1)
+	if span := <-imp.spans; span != nil {
+		t.Fatal("message without trace should have no span")
+	}
+
+	parent := stnet.StartSpan("client", stnet.SpanKindClient, nil)
+	d, _ := stnet.SpbEncode(spbInner{"trace", 1})
+	frame, _ := stnet.EncodeProtocol(stnet.JsonProto{CmdId: 2, CmdData: d, Trace: parent.Context.TraceParent()}, stnet.EncodeTyepSpb)
+	c.Send(frame)
+	h.WaitMessage(rec, 2)
+	span := <-imp.spans
+	if span == nil || span.Context.TraceID != parent.Context.TraceID || span.Parent != parent.Context.SpanID {
+		t.Fatalf("span %+v", span)
+	}
+}
+
+func TestTraceHooksUntraced(t *testing.T) {
+	h := stnettest.New(t, 1)
+	imp := &traceSpbImp{spans: make(chan *stnet.Span, 1)}
+	//without Recorder, so MsgPriority and ProcessorKey of imp are used
+	if _, err := h.Server.AddService("spb", h.Addr("spb"), 0, stnet.NewServiceSpb(imp), 0); err != nil {
+		t.Fatal(err)
+	}
+	h.Start()
+	defer h.Stop()
+
+	conn, err := stnet.DialMem(strings.TrimPrefix(h.Addr("spb"), "mem://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &stnettest.Client{TB: t, Conn: conn, Timeout: stnettest.DefaultTimeout}
+	defer c.Close()
+	parent := stnet.StartSpan("client", stnet.SpanKindClient, nil)
+	d, _ := stnet.SpbEncode(spbInner{"trace", 1})
+	frame, _ := stnet.EncodeProtocol(stnet.JsonProto{CmdId: 1, CmdData: d, Trace: parent.Context.TraceParent()}, stnet.EncodeTyepSpb)
+	c.Send(frame)
+	if span := <-imp.spans; span == nil {
+		t.Fatal("message should have span")
+	}
+	if atomic.LoadInt32(&imp.traced) != 0 {
+		t.Fatal("hooks should get message without trace context")
+	}
+}
+
+func TestOTLPFileExporter(t *testing.T) {
+	var buf bytes.Buffer
+	e := stnet.NewOTLPFileExporter(&buf, "test")
+	s := stnet.StartSpan("op", stnet.SpanKindServer, nil)
+	s.SetAttribute("k", "v")
+	s.Finish()
+	e.ExportSpan(s)
+	if err := e.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	var req struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []struct {
+					TraceID string `json:"traceId"`
+					Name    string `json:"name"`
+					Kind    int    `json:"kind"`
+				} `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &req); err != nil {
+		t.Fatal(err)
+	}
+	sp := req.ResourceSpans[0].ScopeSpans[0].Spans[0]
+	if sp.Name != "op" || sp.Kind != stnet.SpanKindServer || len(sp.TraceID) != 32 {
+		t.Fatalf("span %+v", sp)
+	}
+}
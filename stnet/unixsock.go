@@ -0,0 +1,107 @@
+package stnet
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"syscall"
+)
+
+var (
+	ErrPeerCredNotSupported = errors.New("peer credential is only supported by unix socket on linux")
+)
+
+// PeerCred credential of the process on the other side of unix socket(SO_PEERCRED).
+type PeerCred struct {
+	Pid int32
+	Uid uint32
+	Gid uint32
+}
+
+func isAbstractUnixAddr(address string) bool {
+	return strings.HasPrefix(address, "@")
+}
+
+// removeStaleUnixSocket remove socket file which nobody is listening on.
+func removeStaleUnixSocket(network, address string) error {
+	if address == "" || isAbstractUnixAddr(address) {
+		return nil
+	}
+	fi, err := os.Lstat(address)
+	if err != nil {
+		return nil //not exist
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket file", address)
+	}
+	c, err := net.Dial(network, address)
+	if err == nil {
+		c.Close()
+		return fmt.Errorf("%s is in use by another process", address)
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return err
+	}
+	sysLog.System("remove stale unix socket file: %s", address)
+	return os.Remove(address)
+}
+
+func removeUnixSocketFile(address string) {
+	if address == "" || isAbstractUnixAddr(address) {
+		return
+	}
+	if fi, err := os.Lstat(address); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(address)
+	}
+}
+
+var unixgramClientID uint64
+
+// dialUnixgram client of unixgram must bind a local address,otherwise the listener cannot reply to it.
+func dialUnixgram(address string) (net.Conn, error) {
+	raddr, err := net.ResolveUnixAddr("unixgram", address)
+	if err != nil {
+		return nil, err
+	}
+	id := atomic.AddUint64(&unixgramClientID, 1)
+	var laddr *net.UnixAddr
+	if supportAbstractUnixAddr {
+		laddr = &net.UnixAddr{Name: fmt.Sprintf("@stnet.%d.%d", os.Getpid(), id), Net: "unixgram"}
+	} else {
+		name := fmt.Sprintf("%s/stnet.%d.%d.sock", os.TempDir(), os.Getpid(), id)
+		os.Remove(name)
+		laddr = &net.UnixAddr{Name: name, Net: "unixgram"}
+	}
+	c, err := net.DialUnix("unixgram", laddr, raddr)
+	if err != nil {
+		return nil, err
+	}
+	if !supportAbstractUnixAddr {
+		return &unixgramClientConn{c, laddr.Name}, nil
+	}
+	return c, nil
+}
+
+// unixgramClientConn remove the bound socket file when closed.
+type unixgramClientConn struct {
+	*net.UnixConn
+	path string
+}
+
+func (c *unixgramClientConn) Close() error {
+	e := c.UnixConn.Close()
+	os.Remove(c.path)
+	return e
+}
+
+// PeerCred returns credential of peer process, it is only supported by unix socket on linux.
+func (s *Session) PeerCred() (*PeerCred, error) {
+	c, ok := rawConn(s.socket).(*net.UnixConn)
+	if !ok {
+		return nil, ErrPeerCredNotSupported
+	}
+	return getPeerCred(c)
+}
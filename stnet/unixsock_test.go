@@ -0,0 +1,157 @@
+package stnet_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/greedchase/gotools/stnet"
+	"github.com/greedchase/gotools/stnet/stnettest"
+)
+
+func TestUnixStream(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "s.sock")
+	h := stnettest.New(t, 1)
+	rec := stnettest.NewRecorder(&stnet.ServiceEcho{})
+	s, err := h.Server.AddService("unix", "unix://"+path, 0, rec, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Start()
+	if s.Network() != "unix" {
+		t.Fatalf("network %s, want unix", s.Network())
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &stnettest.Client{TB: t, Conn: conn, Timeout: h.Timeout}
+	defer c.Close()
+	sess := h.WaitOpen(rec)
+	c.Send([]byte("hello"))
+	if got := c.Read(5); string(got) != "hello" {
+		t.Fatalf("echo %q, want hello", got)
+	}
+
+	cred, err := sess.PeerCred()
+	if runtime.GOOS != "linux" {
+		if err != stnet.ErrPeerCredNotSupported {
+			t.Fatalf("peer cred on %s: %v", runtime.GOOS, err)
+		}
+	} else if err != nil {
+		t.Fatal(err)
+	} else if cred.Pid != int32(os.Getpid()) || cred.Uid != uint32(os.Getuid()) || cred.Gid != uint32(os.Getgid()) {
+		t.Fatalf("peer cred %+v, want pid %d uid %d gid %d", cred, os.Getpid(), os.Getuid(), os.Getgid())
+	}
+
+	h.Stop()
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Fatalf("socket file is not removed when listener closed: %v", err)
+	}
+}
+
+func TestUnixAbstract(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("abstract unix socket is linux only")
+	}
+	name := fmt.Sprintf("@stnet-test-%d", os.Getpid())
+	h := stnettest.New(t, 1)
+	rec := stnettest.NewRecorder(&stnet.ServiceEcho{})
+	if _, err := h.Server.AddService("abstract", "unix://"+name, 0, rec, 0); err != nil {
+		t.Fatal(err)
+	}
+	h.Start()
+	defer h.Stop()
+
+	conn, err := net.Dial("unix", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &stnettest.Client{TB: t, Conn: conn, Timeout: h.Timeout}
+	defer c.Close()
+	h.WaitOpen(rec)
+	c.Send([]byte("abstract"))
+	if got := c.Read(8); string(got) != "abstract" {
+		t.Fatalf("echo %q, want abstract", got)
+	}
+}
+
+func TestUnixStaleSocket(t *testing.T) {
+	dir := t.TempDir()
+	h := stnettest.New(t, 1)
+	defer h.Stop()
+	add := func(name, path string) error {
+		_, err := h.Server.AddService(name, "unix://"+path, 0, &stnet.ServiceEcho{}, 0)
+		return err
+	}
+
+	//socket in use is kept
+	used := filepath.Join(dir, "used.sock")
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: used, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if err := add("used", used); err == nil {
+		t.Fatal("listen on socket in use should fail")
+	}
+
+	//socket file left by a dead process is removed
+	stale := filepath.Join(dir, "stale.sock")
+	sl, err := net.ListenUnix("unix", &net.UnixAddr{Name: stale, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sl.SetUnlinkOnClose(false)
+	sl.Close()
+	if _, err := os.Lstat(stale); err != nil {
+		t.Fatalf("stale socket file not left: %v", err)
+	}
+	if err := add("stale", stale); err != nil {
+		t.Fatalf("listen on stale socket: %v", err)
+	}
+
+	//regular file is kept
+	regular := filepath.Join(dir, "regular")
+	if err := ioutil.WriteFile(regular, []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := add("regular", regular); err == nil {
+		t.Fatal("listen on regular file should fail")
+	}
+	if b, err := ioutil.ReadFile(regular); err != nil || string(b) != "data" {
+		t.Fatalf("regular file is modified: %q %v", b, err)
+	}
+}
+
+func TestUnixgram(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "g.sock")
+	h := stnettest.New(t, 1)
+	echo := stnettest.NewRecorder(&stnet.ServiceEcho{})
+	s, err := h.Server.AddService("unixgram", "unixgram://"+path, 0, echo, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs, rec := h.AddClientService("client", &lineImp{}, 0)
+	h.Start()
+	defer h.Stop()
+	if s.Network() != "unixgram" {
+		t.Fatalf("network %s, want unixgram", s.Network())
+	}
+
+	//client binds a local address, so replies of the listener reach it
+	c := cs.NewConnect("unixgram://"+path, nil)
+	h.WaitOpen(rec)
+	if err := c.Send([]byte("x1\n")); err != nil {
+		t.Fatal(err)
+	}
+	e := h.WaitMessage(rec, 'x')
+	if string(e.Msg.([]byte)) != "x1" {
+		t.Fatalf("reply %q, want x1", e.Msg)
+	}
+}
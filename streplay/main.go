@@ -0,0 +1,112 @@
+// streplay replays traffic recorded by stnet.TrafficRecorder against a live server, or dumps frames of the record.
+//
+//	streplay -file sess.rec -addr 127.0.0.1:6060 -speed 2
+//	streplay -file sess.rec -dump -proto spb
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/greedchase/gotools/stnet"
+)
+
+var (
+	file  = flag.String("file", "", "traffic file recorded by stnet.TrafficRecorder")
+	addr  = flag.String("addr", "", "address of server, the same as stnet.Server.AddService(udp:ip:port, unix://path...)")
+	speed = flag.Float64("speed", 1, "replay speed, 1 is original speed, 0 means no waiting between frames")
+	wait  = flag.Duration("wait", time.Second, "time waiting for responses after the last frame is sent")
+	dump  = flag.Bool("dump", false, "print frames instead of replaying")
+	proto = flag.String("proto", "raw", "protocol of frames when dumping: raw spb json rpc")
+	quiet = flag.Bool("quiet", false, "do not print responses when replaying")
+)
+
+func main() {
+	flag.Parse()
+	if *file == "" || (*addr == "" && !*dump) {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	f, err := os.Open(*file)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer f.Close()
+	r, err := stnet.NewTrafficReader(f)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if *dump {
+		err = dumpFrames(r)
+	} else {
+		opt := &stnet.ReplayOptions{Speed: *speed, Wait: *wait}
+		if !*quiet {
+			opt.OnResponse = func(data []byte) {
+				fmt.Printf("<< %d bytes\n%s", len(data), hex.Dump(data))
+			}
+		}
+		err = stnet.ReplayTo(*addr, r, opt)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func parser() stnet.ServiceImp {
+	switch *proto {
+	case "spb":
+		return stnet.NewServiceSpb(nil)
+	case "json":
+		return &stnet.ServiceJson{}
+	case "rpc":
+		return &stnet.ServiceRpc{}
+	}
+	return nil
+}
+
+func dumpFrames(r *stnet.TrafficReader) error {
+	imp := parser()
+	for {
+		f, err := r.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		dir := ">>"
+		if f.Dir == stnet.TrafficOut {
+			dir = "<<"
+		}
+		if imp == nil {
+			fmt.Printf("%s %s %d bytes\n%s", f.Time, dir, len(f.Data), hex.Dump(f.Data))
+			continue
+		}
+		//one sending may contain several frames
+		data := f.Data
+		for len(data) > 0 {
+			n, id, msg, err := imp.Unmarshal(nil, data)
+			if n <= 0 {
+				fmt.Printf("%s %s incomplete frame %d bytes\n%s", f.Time, dir, len(data), hex.Dump(data))
+				break
+			}
+			if n > len(data) {
+				n = len(data)
+			}
+			if err != nil {
+				fmt.Printf("%s %s bad frame %d bytes: %v\n", f.Time, dir, n, err)
+			} else {
+				fmt.Printf("%s %s id=%d %d bytes: %+v\n", f.Time, dir, id, n, msg)
+			}
+			data = data[n:]
+		}
+	}
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+const annotation = "spb:gen"
+
+// kinds of basic types which are encoded without reflect
+const (
+	kindInt = iota + 1
+	kindUint
+	kindBool
+	kindFloat32
+	kindFloat64
+	kindString
+)
+
+var basicKinds = map[string]int{
+	"int": kindInt, "int8": kindInt, "int16": kindInt, "int32": kindInt, "int64": kindInt, "rune": kindInt,
+	"uint": kindUint, "uint8": kindUint, "uint16": kindUint, "uint32": kindUint, "uint64": kindUint, "byte": kindUint,
+	"bool": kindBool, "float32": kindFloat32, "float64": kindFloat64, "string": kindString,
+}
+
+type field struct {
+	name    string
+	goType  string //type of basic value or element of slice
+	kind    int    //0 means encoded by reflect
+	slice   bool
+	tag     uint32
+	require bool
+	decode  bool //false if another field has the same tag, it is not decoded as stnet does
+}
+
+type message struct {
+	name    string
+	fields  []field
+	unknown string //name of stnet.SpbUnknownFields field
+}
+
+// OutputName x.go is x_spb.go, x_test.go is x_spb_test.go.
+func OutputName(file string) string {
+	if strings.HasSuffix(file, "_test.go") {
+		return strings.TrimSuffix(file, "_test.go") + "_spb_test.go"
+	}
+	return strings.TrimSuffix(file, ".go") + "_spb.go"
+}
+
+// GenFile generate methods of structs in file, names are the structs or nil for annotated structs.
+func GenFile(file string, names []string, output string) error {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, file, nil, parser.ParseComments)
+	if err != nil {
+		return err
+	}
+	msgs, err := parseMessages(f, names)
+	if err != nil {
+		return err
+	}
+	if len(msgs) == 0 {
+		return fmt.Errorf("no struct to generate in %s", file)
+	}
+	src, err := generate(f.Name.Name, msgs)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(output, src, 0644)
+}
+
+func annotated(groups ...*ast.CommentGroup) bool {
+	for _, g := range groups {
+		if g == nil {
+			continue
+		}
+		for _, c := range g.List {
+			if strings.TrimSpace(strings.TrimLeft(c.Text, "/*")) == annotation {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// strictTypes names of types which have method SpbStrict.
+func strictTypes(f *ast.File) map[string]bool {
+	strict := make(map[string]bool)
+	for _, d := range f.Decls {
+		fd, ok := d.(*ast.FuncDecl)
+		if !ok || fd.Recv == nil || fd.Name.Name != "SpbStrict" || len(fd.Recv.List) != 1 {
+			continue
+		}
+		t := fd.Recv.List[0].Type
+		if s, ok := t.(*ast.StarExpr); ok {
+			t = s.X
+		}
+		if id, ok := t.(*ast.Ident); ok {
+			strict[id.Name] = true
+		}
+	}
+	return strict
+}
+
+func parseMessages(f *ast.File, names []string) ([]*message, error) {
+	wanted := make(map[string]bool)
+	for _, n := range names {
+		wanted[strings.TrimSpace(n)] = true
+	}
+	strict := strictTypes(f)
+	var msgs []*message
+	for _, d := range f.Decls {
+		gd, ok := d.(*ast.GenDecl)
+		if !ok || gd.Tok != token.TYPE {
+			continue
+		}
+		for _, spec := range gd.Specs {
+			ts := spec.(*ast.TypeSpec)
+			st, ok := ts.Type.(*ast.StructType)
+			if !ok {
+				continue
+			}
+			if len(wanted) > 0 {
+				if !wanted[ts.Name.Name] {
+					continue
+				}
+				delete(wanted, ts.Name.Name)
+			} else if !annotated(gd.Doc, ts.Doc) {
+				continue
+			}
+			m, err := parseStruct(ts.Name.Name, st, strict[ts.Name.Name])
+			if err != nil {
+				return nil, err
+			}
+			msgs = append(msgs, m)
+		}
+	}
+	for n := range wanted {
+		return nil, fmt.Errorf("struct %s is not found", n)
+	}
+	return msgs, nil
+}
+
+func exprString(e ast.Expr) string {
+	var b bytes.Buffer
+	format.Node(&b, token.NewFileSet(), e)
+	return b.String()
+}
+
+func isUnknownFields(e ast.Expr) bool {
+	switch t := e.(type) {
+	case *ast.SelectorExpr:
+		return t.Sel.Name == "SpbUnknownFields"
+	case *ast.Ident:
+		return t.Name == "SpbUnknownFields"
+	}
+	return false
+}
+
+// parseStruct assign tags as stnet does: explicit `tag` or index of field.
+func parseStruct(name string, st *ast.StructType, strict bool) (*message, error) {
+	m := &message{name: name}
+	index := 0
+	explicitTags := make(map[uint32]bool)
+	var implicit []int
+	for _, af := range st.Fields.List {
+		names := make([]string, 0, len(af.Names))
+		for _, n := range af.Names {
+			names = append(names, n.Name)
+		}
+		embedded := len(names) == 0
+		if embedded {
+			t := af.Type
+			if s, ok := t.(*ast.StarExpr); ok {
+				t = s.X
+			}
+			if s, ok := t.(*ast.SelectorExpr); ok {
+				t = s.Sel
+			}
+			names = append(names, exprString(t))
+		}
+		var tag reflect.StructTag
+		if af.Tag != nil {
+			s, err := strconv.Unquote(af.Tag.Value)
+			if err != nil {
+				return nil, err
+			}
+			tag = reflect.StructTag(s)
+		}
+
+		for _, n := range names {
+			i := index
+			index++
+			if !embedded && !ast.IsExported(n) { //skipped as stnet does
+				continue
+			}
+			if isUnknownFields(af.Type) {
+				m.unknown = n
+				continue
+			}
+			fld := field{name: n, tag: uint32(i), require: tag.Get("require") == "true"}
+			tg, explicit := tag.Lookup("tag")
+			if explicit {
+				v, err := strconv.ParseUint(tg, 10, 32)
+				if err != nil {
+					if strict {
+						return nil, fmt.Errorf("%s.%s: invalid tag %q", name, n, tg)
+					}
+					explicit = false
+				} else {
+					fld.tag = uint32(v)
+				}
+			}
+			if strict && !explicit {
+				return nil, fmt.Errorf("%s.%s: field has no tag in strict mode", name, n)
+			}
+			if explicit {
+				if explicitTags[fld.tag] {
+					if strict {
+						return nil, fmt.Errorf("%s.%s: duplicate tag %d", name, n, fld.tag)
+					}
+				} else {
+					explicitTags[fld.tag] = true
+					fld.decode = true
+				}
+			} else {
+				implicit = append(implicit, len(m.fields))
+			}
+			fld.goType, fld.kind, fld.slice = fieldKind(af.Type)
+			m.fields = append(m.fields, fld)
+		}
+	}
+	for _, i := range implicit {
+		if !explicitTags[m.fields[i].tag] {
+			m.fields[i].decode = true
+		}
+	}
+	return m, nil
+}
+
+func fieldKind(e ast.Expr) (goType string, kind int, slice bool) {
+	if id, ok := e.(*ast.Ident); ok {
+		return id.Name, basicKinds[id.Name], false
+	}
+	if at, ok := e.(*ast.ArrayType); ok && at.Len == nil {
+		if id, ok := at.Elt.(*ast.Ident); ok && id.Name != "byte" && id.Name != "uint8" && basicKinds[id.Name] != 0 {
+			return id.Name, basicKinds[id.Name], true
+		}
+	}
+	return "", 0, false
+}
+
+var writeFuncs = map[int]string{
+	kindInt:     "spb.WriteInt(%d, int64(%s), %t)",
+	kindUint:    "spb.WriteUint(%d, uint64(%s), %t)",
+	kindBool:    "spb.WriteBool(%d, %s, %t)",
+	kindFloat32: "spb.WriteFloat32(%d, %s, %t)",
+	kindFloat64: "spb.WriteFloat64(%d, %s, %t)",
+	kindString:  "spb.WriteString(%d, %s, %t)",
+}
+
+var readFuncs = map[int]string{
+	kindInt:     "ReadInt",
+	kindUint:    "ReadUint",
+	kindBool:    "ReadBool",
+	kindFloat32: "ReadFloat32",
+	kindFloat64: "ReadFloat64",
+	kindString:  "ReadString",
+}
+
+// convert value read by readFuncs into goType
+func convert(f field, v string) string {
+	if f.kind == kindBool || f.kind == kindString || f.goType == "int64" || f.goType == "uint64" || f.goType == "float32" || f.goType == "float64" {
+		return v
+	}
+	return f.goType + "(" + v + ")"
+}
+
+func generate(pkg string, msgs []*message) ([]byte, error) {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "// Code generated by stspbgen. DO NOT EDIT.\n\npackage %s\n\n", pkg)
+	fmt.Fprintf(&b, "import \"github.com/greedchase/gotools/stnet\"\n\n")
+	for _, m := range msgs {
+		genMarshal(&b, m)
+		genUnmarshal(&b, m)
+	}
+	return format.Source(b.Bytes())
+}
+
+func genMarshal(b *bytes.Buffer, m *message) {
+	fmt.Fprintf(b, "func (x %s) MarshalSpb(spb *stnet.Spb) error {\n", m.name)
+	for _, f := range m.fields {
+		v := "x." + f.name
+		switch {
+		case f.slice:
+			fmt.Fprintf(b, "if spb.WriteVectorHeader(%d, len(%s), %t) {\nfor _, v := range %s {\n", f.tag, v, f.require, v)
+			fmt.Fprintf(b, writeFuncs[f.kind]+"\n}\n}\n", 0, "v", true)
+		case f.kind != 0:
+			fmt.Fprintf(b, writeFuncs[f.kind]+"\n", f.tag, v, f.require)
+		default:
+			fmt.Fprintf(b, "if err := spb.WriteValue(%d, %s, %t); err != nil {\nreturn err\n}\n", f.tag, v, f.require)
+		}
+	}
+	if m.unknown != "" {
+		fmt.Fprintf(b, "spb.WriteRaw(x.%s)\n", m.unknown)
+	}
+	b.WriteString("return nil\n}\n\n")
+}
+
+func genUnmarshal(b *bytes.Buffer, m *message) {
+	fmt.Fprintf(b, "func (x *%s) UnmarshalSpb(spb *stnet.Spb, tag uint32, typ uint8) (bool, error) {\nswitch tag {\n", m.name)
+	for _, f := range m.fields {
+		if !f.decode {
+			continue
+		}
+		fmt.Fprintf(b, "case %d:\n", f.tag)
+		switch {
+		case f.slice:
+			fmt.Fprintf(b, "n, ok, err := spb.ReadVectorLen(typ)\nif !ok {\nreturn true, err\n}\n")
+			fmt.Fprintf(b, "x.%s = make([]%s, 0, n)\nfor i := 0; i < n; i++ {\n", f.name, f.goType)
+			fmt.Fprintf(b, "_, et, err := spb.ReadHeader()\nif err != nil {\nreturn true, err\n}\n")
+			fmt.Fprintf(b, "v, _, err := spb.%s(et)\nif err != nil {\nreturn true, err\n}\n", readFuncs[f.kind])
+			fmt.Fprintf(b, "x.%s = append(x.%s, %s)\n}\nreturn true, nil\n", f.name, f.name, convert(f, "v"))
+		case f.kind != 0:
+			fmt.Fprintf(b, "v, ok, err := spb.%s(typ)\nif ok {\nx.%s = %s\n}\nreturn true, err\n", readFuncs[f.kind], f.name, convert(f, "v"))
+		default:
+			fmt.Fprintf(b, "return true, spb.ReadValue(typ, &x.%s)\n", f.name)
+		}
+	}
+	b.WriteString("}\nreturn false, nil\n}\n\n")
+}
@@ -0,0 +1,46 @@
+// stspbgen generates MarshalSpb and UnmarshalSpb methods for structs, stnet.SpbEncode and stnet.SpbDecode use them instead of reflect.
+// structs are annotated by a line "spb:gen" in their doc comment, or listed by -type:
+//
+//	//spb:gen
+//	type LoginReq struct {
+//		User string `tag:"1"`
+//	}
+//
+//	//go:generate go run github.com/greedchase/gotools/stspbgen
+//	stspbgen -file msg.go -type LoginReq,LoginRsp
+//
+// the output is msg_spb.go(msg_spb_test.go for test files) in the same directory.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+var (
+	file  = flag.String("file", os.Getenv("GOFILE"), "go source file, default is $GOFILE set by go generate")
+	types = flag.String("type", "", "comma separated names of structs, default is structs annotated by spb:gen")
+	out   = flag.String("out", "", "output file, default is <file>_spb.go")
+)
+
+func main() {
+	flag.Parse()
+	if *file == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	var names []string
+	if *types != "" {
+		names = strings.Split(*types, ",")
+	}
+	output := *out
+	if output == "" {
+		output = OutputName(*file)
+	}
+	if err := GenFile(*file, names, output); err != nil {
+		fmt.Fprintln(os.Stderr, "stspbgen:", err)
+		os.Exit(1)
+	}
+}